@@ -0,0 +1,348 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The auth package implements the authentication of the 9P2000 users.
+//
+// The authentication is a conversation between the client and the file
+// server, carried out by reading and writing the authentication fid.
+// Similar to Plan 9's p9any, the server starts by offering the names
+// of the mechanisms it supports, the client chooses one of them, and
+// the rest of the conversation is specific to the chosen Mechanism.
+// Each message is sent as a frame:
+//
+//	size[4] data[size]
+//
+// The Server type implements srv.AuthOps, and the Client type
+// implements clnt.Authenticator.
+package auth
+
+import (
+	"encoding/binary"
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/srv"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Maximum size of a single message of the conversation.
+const maxMsg = 8192
+
+var Eauth error = &ixp.Error{"authentication failed", ixp.EPERM}
+var Eauthrequired error = &ixp.Error{"authentication required", ixp.EPERM}
+var Eprotocol error = &ixp.Error{"authentication protocol botch", ixp.EINVAL}
+var Enomech error = &ixp.Error{"no common authentication mechanism", ixp.EINVAL}
+
+// The Conversation interface is implemented by one side of an
+// authentication mechanism. Step is called with each message received
+// from the peer (nil for the first call on the server), and returns
+// the message to send to the peer, if any, and true once the side
+// is finished with the conversation. The server sends the first
+// message.
+type Conversation interface {
+	Step(in []byte) (out []byte, done bool, err error)
+}
+
+// The Mechanism interface should be implemented by the authentication
+// mechanisms that can be used by Server and Client.
+type Mechanism interface {
+	// Name of the mechanism, can't contain spaces.
+	Name() string
+
+	// Starts the server side of the conversation for the user.
+	Server(user ixp.User, aname string) (Conversation, error)
+
+	// Starts the client side of the conversation for the user.
+	Client(user ixp.User, aname string) (Conversation, error)
+}
+
+// The Server type implements srv.AuthOps for the specified mechanisms.
+// It can be embedded in the file server implementation, in which case
+// all users need to authenticate before attaching.
+type Server struct {
+	Mechs []Mechanism // offered to the clients, in the order of preference
+
+	lock   sync.Mutex
+	states map[*srv.Fid]*state // per-afid state, Aux is left to the file server
+}
+
+// The Client type implements clnt.Authenticator. It chooses the first
+// mechanism offered by the server that is also in Mechs.
+type Client struct {
+	Mechs []Mechanism
+}
+
+// Per-afid authentication state.
+type state struct {
+	sync.Mutex
+	user  ixp.User
+	aname string
+	conv  Conversation
+	in    []byte // partial frame written by the client
+	out   []byte // frames not yet read by the client
+	done  bool   // conversation finished successfully
+	err   error  // conversation failed
+}
+
+var qlock sync.Mutex
+var qnext uint64
+
+// Creates a server that offers the specified mechanisms.
+func NewServer(mechs ...Mechanism) *Server {
+	return &Server{Mechs: mechs}
+}
+
+// Creates a client that can use the specified mechanisms.
+func NewClient(mechs ...Mechanism) *Client {
+	return &Client{mechs}
+}
+
+// Appends a frame with the data to buf.
+func frame(buf, data []byte) []byte {
+	var sz [4]byte
+	binary.LittleEndian.PutUint32(sz[:], uint32(len(data)))
+	return append(append(buf, sz[:]...), data...)
+}
+
+// Reads a frame from r.
+func readFrame(r io.Reader) ([]byte, error) {
+	var sz [4]byte
+	_, err := io.ReadFull(r, sz[:])
+	if err != nil {
+		return nil, err
+	}
+
+	n := binary.LittleEndian.Uint32(sz[:])
+	if n > maxMsg {
+		return nil, Eprotocol
+	}
+
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+// Returns the state of the afid, or nil.
+func (s *Server) state(afid *srv.Fid) *state {
+	if afid == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.states[afid]
+}
+
+func (s *Server) mech(name string) Mechanism {
+	for _, m := range s.Mechs {
+		if m.Name() == name {
+			return m
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) AuthInit(afid *srv.Fid, aname string) (*ixp.Qid, error) {
+	names := make([]string, len(s.Mechs))
+	for i, m := range s.Mechs {
+		names[i] = m.Name()
+	}
+
+	st := new(state)
+	st.user = afid.User
+	st.aname = aname
+	st.out = frame(nil, []byte(strings.Join(names, " ")))
+	s.lock.Lock()
+	if s.states == nil {
+		s.states = make(map[*srv.Fid]*state)
+	}
+	s.states[afid] = st
+	s.lock.Unlock()
+
+	qlock.Lock()
+	qid := &ixp.Qid{Type: ixp.QTAUTH, Path: qnext}
+	qnext++
+	qlock.Unlock()
+
+	return qid, nil
+}
+
+func (s *Server) AuthDestroy(afid *srv.Fid) {
+	s.lock.Lock()
+	delete(s.states, afid)
+	s.lock.Unlock()
+}
+
+// Returns true if a and b are the same user. Both the name and the
+// numeric id are compared, the name is empty for the ids unknown to
+// some Users implementations.
+func sameUser(a, b ixp.User) bool {
+	return a.Id() == b.Id() && a.Name() == b.Name()
+}
+
+func (s *Server) AuthCheck(fid *srv.Fid, afid *srv.Fid, aname string) error {
+	if afid == nil {
+		return Eauthrequired
+	}
+
+	st := s.state(afid)
+	if st == nil {
+		return Eauth
+	}
+
+	st.Lock()
+	defer st.Unlock()
+	if !st.done || !sameUser(st.user, fid.User) || st.aname != aname {
+		return Eauth
+	}
+
+	return nil
+}
+
+func (s *Server) AuthRead(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	st := s.state(afid)
+	if st == nil {
+		return 0, Eauth
+	}
+
+	st.Lock()
+	defer st.Unlock()
+	if st.err != nil {
+		return 0, st.err
+	}
+
+	n := copy(data, st.out)
+	st.out = st.out[n:]
+	return n, nil
+}
+
+func (s *Server) AuthWrite(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	st := s.state(afid)
+	if st == nil {
+		return 0, Eauth
+	}
+
+	st.Lock()
+	defer st.Unlock()
+	if st.err != nil {
+		return 0, st.err
+	}
+
+	st.in = append(st.in, data...)
+	for len(st.in) >= 4 {
+		n := binary.LittleEndian.Uint32(st.in)
+		if n > maxMsg {
+			st.err = Eprotocol
+			return 0, st.err
+		}
+
+		if uint32(len(st.in)-4) < n {
+			break
+		}
+
+		msg := st.in[4 : 4+n]
+		st.in = st.in[4+n:]
+		err := st.step(s, msg)
+		if err != nil {
+			st.err = err
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
+
+// Processes a message received from the client.
+func (st *state) step(s *Server, msg []byte) error {
+	if st.done {
+		return Eprotocol
+	}
+
+	var in []byte
+	if st.conv == nil {
+		/* the first message is the name of the mechanism */
+		m := s.mech(string(msg))
+		if m == nil {
+			return Enomech
+		}
+
+		conv, err := m.Server(st.user, st.aname)
+		if err != nil {
+			return err
+		}
+
+		st.conv = conv
+	} else {
+		in = msg
+	}
+
+	out, done, err := st.conv.Step(in)
+	if err != nil {
+		return err
+	}
+
+	if out != nil {
+		st.out = frame(st.out, out)
+	}
+
+	st.done = done
+	return nil
+}
+
+// Carries out the client side of the conversation over afid.
+func (c *Client) Authenticate(afid io.ReadWriter, user ixp.User, aname string) error {
+	offer, err := readFrame(afid)
+	if err != nil {
+		return err
+	}
+
+	var m Mechanism
+	names := strings.Fields(string(offer))
+	for i := 0; m == nil && i < len(c.Mechs); i++ {
+		for _, name := range names {
+			if c.Mechs[i].Name() == name {
+				m = c.Mechs[i]
+				break
+			}
+		}
+	}
+
+	if m == nil {
+		return Enomech
+	}
+
+	conv, err := m.Client(user, aname)
+	if err != nil {
+		return err
+	}
+
+	_, err = afid.Write(frame(nil, []byte(m.Name())))
+	if err != nil {
+		return err
+	}
+
+	for {
+		in, err := readFrame(afid)
+		if err != nil {
+			return err
+		}
+
+		out, done, err := conv.Step(in)
+		if err != nil {
+			return err
+		}
+
+		if out != nil {
+			_, err = afid.Write(frame(nil, out))
+			if err != nil {
+				return err
+			}
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auth_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/auth"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+var key = []byte("secret of the user")
+
+// A file server that requires the users to authenticate.
+type authSrv struct {
+	*srv.Fsrv
+	*auth.Server
+}
+
+func newSrv(t *testing.T) *authSrv {
+	secret := func(user ixp.User) ([]byte, error) { return key, nil }
+	s := &authSrv{srv.NewFileSrv(srvtest.Root(t, 0777)), auth.NewServer(auth.NewHMACServer(secret))}
+	s.Dialect = ixp.Dialect9P2000u
+	if !s.Start(s) {
+		t.Fatal("Start failed")
+	}
+
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Connects to the server without attaching.
+func connect(t *testing.T, s *authSrv) *clnt.Clnt {
+	sc, cc := srvtest.Pipe(nil)
+	s.NewConn(sc)
+	c, err := clnt.ConnectDialect(cc, 8192+ixp.IOHDRSZ, ixp.Dialect9P2000u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(c.Unmount)
+	return c
+}
+
+// Reads and writes an authentication fid as a stream.
+type afile struct {
+	c      *clnt.Clnt
+	fid    *clnt.Fid
+	offset uint64
+}
+
+func (f *afile) Read(buf []byte) (int, error) {
+	data, err := f.c.Read(f.fid, f.offset, uint32(len(buf)))
+	n := copy(buf, data)
+	f.offset += uint64(n)
+	if err == nil && n == 0 {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (f *afile) Write(buf []byte) (int, error) {
+	n, err := f.c.Write(f.fid, buf, f.offset)
+	f.offset += uint64(n)
+	return n, err
+}
+
+// Starts the authentication of the user. Returns the authentication
+// fid and the offer of the server.
+func start(t *testing.T, c *clnt.Clnt, user ixp.User, aname string) (*afile, []byte) {
+	fid, err := c.Auth(user, aname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	af := &afile{c: c, fid: fid}
+	offer := make([]byte, 64)
+	n, err := af.Read(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return af, offer[0:n]
+}
+
+func frame(data []byte) []byte {
+	buf := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint32(buf, uint32(len(data)))
+	return append(buf, data...)
+}
+
+// Returns true if err is the error want sent by the server.
+func isErr(err, want error) bool {
+	e, ok := err.(*ixp.Error)
+	w := want.(*ixp.Error)
+	return ok && e.Errornum == w.Errornum && strings.HasPrefix(e.Err, w.Err)
+}
+
+func TestMount(t *testing.T) {
+	s := newSrv(t)
+	cfg := &srvtest.Config{Auth: auth.NewClient(auth.NewHMACClient(key))}
+	c, unmount, err := srvtest.Loopback(s, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmount()
+
+	if _, err := c.FStat("/"); err != nil {
+		t.Error(err)
+	}
+
+	cfg.Auth = auth.NewClient(auth.NewHMACClient([]byte("wrong key")))
+	if _, _, err := srvtest.Loopback(s, cfg); !isErr(err, auth.Eauth) {
+		t.Errorf("mount with a bad key: %v, want %v", err, auth.Eauth)
+	}
+
+	if _, _, err := srvtest.Loopback(s, nil); !isErr(err, auth.Eauthrequired) {
+		t.Errorf("mount without authentication: %v, want %v", err, auth.Eauthrequired)
+	}
+
+	cfg.Auth = auth.NewClient(unknownMech{})
+	if _, _, err := srvtest.Loopback(s, cfg); err != auth.Enomech {
+		t.Errorf("mount with an unknown mechanism: %v, want %v", err, auth.Enomech)
+	}
+}
+
+// A mechanism the server doesn't offer.
+type unknownMech struct{}
+
+func (unknownMech) Name() string { return "unknown" }
+
+func (unknownMech) Server(ixp.User, string) (auth.Conversation, error) { return nil, auth.Eauth }
+
+func (unknownMech) Client(ixp.User, string) (auth.Conversation, error) { return nil, auth.Eauth }
+
+func TestReuse(t *testing.T) {
+	s := newSrv(t)
+	c := connect(t, s)
+
+	/* users without a passwd entry have no names, only the ids tell them apart */
+	uid := 1<<30 + os.Geteuid()
+	user := ixp.OsUsers.Uid2User(uid)
+	other := ixp.OsUsers.Uid2User(uid + 1)
+	fid, err := c.Auth(user, "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	af := &afile{c: c, fid: fid}
+	if err := auth.NewClient(auth.NewHMACClient(key)).Authenticate(af, user, "tree"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Attach(fid, other, "tree"); !isErr(err, auth.Eauth) {
+		t.Errorf("attach as another user: %v, want %v", err, auth.Eauth)
+	}
+
+	if _, err := c.Attach(fid, user, "other"); !isErr(err, auth.Eauth) {
+		t.Errorf("attach to another tree: %v, want %v", err, auth.Eauth)
+	}
+
+	if _, err := c.Attach(fid, user, "tree"); err != nil {
+		t.Errorf("attach: %v", err)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	s := newSrv(t)
+	c := connect(t, s)
+	user := srvtest.User()
+
+	/* a truncated frame isn't processed, the conversation doesn't finish */
+	af, offer := start(t, c, user, "")
+	if !bytes.Equal(offer, frame([]byte("hmac-sha256"))) {
+		t.Fatalf("offer %q", offer)
+	}
+
+	msg := frame([]byte("hmac-sha256"))
+	if _, err := af.Write(msg[0 : len(msg)-1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Attach(af.fid, user, ""); !isErr(err, auth.Eauth) {
+		t.Errorf("attach after a truncated frame: %v, want %v", err, auth.Eauth)
+	}
+
+	/* the size of a frame is limited, the failure sticks to the afid */
+	af, _ = start(t, c, user, "")
+	big := make([]byte, 4)
+	binary.LittleEndian.PutUint32(big, 8193)
+	if _, err := af.Write(big); !isErr(err, auth.Eprotocol) {
+		t.Errorf("write of an oversized frame: %v, want %v", err, auth.Eprotocol)
+	}
+
+	if _, err := af.Read(make([]byte, 64)); !isErr(err, auth.Eprotocol) {
+		t.Errorf("read after the failed step: %v, want %v", err, auth.Eprotocol)
+	}
+
+	/* the server doesn't know the mechanism */
+	af, _ = start(t, c, user, "")
+	if _, err := af.Write(frame([]byte("unknown"))); !isErr(err, auth.Enomech) {
+		t.Errorf("write of an unknown mechanism: %v, want %v", err, auth.Enomech)
+	}
+
+	if _, err := af.Read(make([]byte, 64)); !isErr(err, auth.Enomech) {
+		t.Errorf("read after the failed step: %v, want %v", err, auth.Enomech)
+	}
+}
+
+// Carries out the client side of the conversation with a server that
+// sends the data.
+func TestClientFrames(t *testing.T) {
+	client := auth.NewClient(auth.NewHMACClient(key))
+	user := srvtest.User()
+	offer := frame([]byte("hmac-sha256"))
+	big := make([]byte, 4)
+	binary.LittleEndian.PutUint32(big, 8193)
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"truncated", offer[0 : len(offer)-1], io.ErrUnexpectedEOF},
+		{"oversized", big, auth.Eprotocol},
+		{"unknown", frame([]byte("unknown")), auth.Enomech},
+		{"nonce", append(offer, frame([]byte("short nonce"))...), auth.Eprotocol},
+	}
+
+	for _, tt := range tests {
+		rw := &struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(tt.data), io.Discard}
+		if err := client.Authenticate(rw, user, ""); err != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/jsouthworth/ixp"
+)
+
+// Size of the nonces used by the HMAC mechanism.
+const nonceSize = 32
+
+// The HMAC type implements a challenge-response mechanism based on a
+// secret shared by the user and the file server. Both sides prove the
+// knowledge of the secret:
+//
+//	S->C: snonce[32]
+//	C->S: cnonce[32] HMAC-SHA256(secret, "client" snonce cnonce user 0 uid[4] aname)
+//	S->C: HMAC-SHA256(secret, "server" snonce cnonce user 0 uid[4] aname)
+//
+// where user and uid are the name and the numeric id of the user.
+type HMAC struct {
+	// Returns the secret of the user. Used by the server.
+	Secret func(user ixp.User) ([]byte, error)
+
+	// Secret of the user. Used by the client.
+	Key []byte
+}
+
+type hmacConv struct {
+	server bool
+	key    []byte
+	user   string
+	uid    uint32
+	aname  string
+	snonce []byte
+	cnonce []byte
+}
+
+// Creates a HMAC mechanism for a client that knows key.
+func NewHMACClient(key []byte) *HMAC {
+	return &HMAC{Key: key}
+}
+
+// Creates a HMAC mechanism for a server that looks up the
+// user's secrets using the secret function.
+func NewHMACServer(secret func(user ixp.User) ([]byte, error)) *HMAC {
+	return &HMAC{Secret: secret}
+}
+
+func (*HMAC) Name() string {
+	return "hmac-sha256"
+}
+
+func (h *HMAC) Server(user ixp.User, aname string) (Conversation, error) {
+	if h.Secret == nil {
+		return nil, Eauth
+	}
+
+	key, err := h.Secret(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hmacConv{server: true, key: key, user: user.Name(), uid: uint32(user.Id()), aname: aname}, nil
+}
+
+func (h *HMAC) Client(user ixp.User, aname string) (Conversation, error) {
+	if h.Key == nil {
+		return nil, Eauth
+	}
+
+	return &hmacConv{key: h.Key, user: user.Name(), uid: uint32(user.Id()), aname: aname}, nil
+}
+
+func nonce() ([]byte, error) {
+	b := make([]byte, nonceSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, &ixp.Error{err.Error(), ixp.EIO}
+	}
+
+	return b, nil
+}
+
+// Returns the HMAC of the conversation, as sent by the side.
+func (c *hmacConv) sum(side string) []byte {
+	m := hmac.New(sha256.New, c.key)
+	m.Write([]byte(side))
+	m.Write(c.snonce)
+	m.Write(c.cnonce)
+	m.Write([]byte(c.user))
+	m.Write([]byte{0})
+	binary.Write(m, binary.LittleEndian, c.uid)
+	m.Write([]byte(c.aname))
+	return m.Sum(nil)
+}
+
+func (c *hmacConv) Step(in []byte) ([]byte, bool, error) {
+	var err error
+
+	switch {
+	case c.server && c.snonce == nil:
+		c.snonce, err = nonce()
+		return c.snonce, false, err
+
+	case c.server:
+		if len(in) != nonceSize+sha256.Size {
+			return nil, false, Eprotocol
+		}
+
+		c.cnonce = in[0:nonceSize]
+		if !hmac.Equal(in[nonceSize:], c.sum("client")) {
+			return nil, false, Eauth
+		}
+
+		return c.sum("server"), true, nil
+
+	case c.snonce == nil:
+		if len(in) != nonceSize {
+			return nil, false, Eprotocol
+		}
+
+		c.snonce = in
+		c.cnonce, err = nonce()
+		if err != nil {
+			return nil, false, err
+		}
+
+		return append(append([]byte(nil), c.cnonce...), c.sum("client")...), false, nil
+
+	default:
+		if !hmac.Equal(in, c.sum("server")) {
+			return nil, false, Eauth
+		}
+
+		return nil, true, nil
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+import (
+	"fmt"
+	"testing"
+)
+
+var benchMsizes = []uint32{8192, 65536, 262144, 1048576}
+
+// Packs and unpacks a Tread and its Rread with pooled Fcalls.
+func BenchmarkTread(b *testing.B) {
+	for _, msize := range benchMsizes {
+		b.Run(fmt.Sprintf("msize=%d", msize), func(b *testing.B) {
+			data := make([]byte, msize-IOHDRSZ)
+			tc, rc := AllocFcall(msize), AllocFcall(msize)
+			fc := AllocFcall(msize)
+			defer FreeFcall(tc)
+			defer FreeFcall(rc)
+			defer FreeFcall(fc)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				PackTread(tc, 1, uint64(i), uint32(len(data)))
+				if _, err := UnpackInto(fc, tc.Pkt, true); err != nil {
+					b.Fatal(err)
+				}
+
+				PackRread(rc, data)
+				if _, err := UnpackInto(fc, rc.Pkt, true); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Packs and unpacks a Twrite and its Rwrite with pooled Fcalls.
+func BenchmarkTwrite(b *testing.B) {
+	for _, msize := range benchMsizes {
+		b.Run(fmt.Sprintf("msize=%d", msize), func(b *testing.B) {
+			data := make([]byte, msize-IOHDRSZ)
+			tc, rc := AllocFcall(msize), AllocFcall(msize)
+			fc := AllocFcall(msize)
+			defer FreeFcall(tc)
+			defer FreeFcall(rc)
+			defer FreeFcall(fc)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				PackTwrite(tc, 1, uint64(i), uint32(len(data)), data)
+				if _, err := UnpackInto(fc, tc.Pkt, true); err != nil {
+					b.Fatal(err)
+				}
+
+				PackRwrite(rc, uint32(len(data)))
+				if _, err := UnpackInto(fc, rc.Pkt, true); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
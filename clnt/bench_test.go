@@ -0,0 +1,104 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt_test
+
+import (
+	"fmt"
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"testing"
+)
+
+var benchMsizes = []uint32{8192, 65536, 262144, 1048576}
+
+// A file that reads as zeroes and discards the data written to it.
+type zeroFile struct {
+	srv.File
+}
+
+func (*zeroFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	return len(buf), nil
+}
+
+func (*zeroFile) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
+	return len(data), nil
+}
+
+// Starts a file server with a zero file, mounts it over a pipe with
+// the specified msize and opens the file.
+func benchOpen(b *testing.B, msize uint32) (*clnt.File, func()) {
+	user := srvtest.User()
+	root := srvtest.Root(b, 0555)
+	zero := new(zeroFile)
+	if err := root.Add(&zero.File, "zero", user, nil, 0666, zero); err != nil {
+		b.Fatal(err)
+	}
+
+	s := srvtest.FileSrv(b, root)
+	s.Msize = msize
+	s.NoCopy = true
+	sc, cc := srvtest.Pipe(nil)
+	s.NewConn(sc)
+	c, err := clnt.Connect(cc, msize, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	c.Root, err = c.Attach(nil, user, "")
+	if err != nil {
+		c.Unmount()
+		b.Fatal(err)
+	}
+
+	file, err := c.FOpen("/zero", ixp.ORDWR)
+	if err != nil {
+		c.Unmount()
+		b.Fatal(err)
+	}
+
+	return file, func() { file.Close(); c.Unmount() }
+}
+
+// Reads a message worth of data per iteration.
+func BenchmarkTread(b *testing.B) {
+	for _, msize := range benchMsizes {
+		b.Run(fmt.Sprintf("msize=%d", msize), func(b *testing.B) {
+			file, done := benchOpen(b, msize)
+			defer done()
+
+			buf := make([]byte, msize-ixp.IOHDRSZ)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(buf)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := file.ReadAt(buf, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Writes a message worth of data per iteration.
+func BenchmarkTwrite(b *testing.B) {
+	for _, msize := range benchMsizes {
+		b.Run(fmt.Sprintf("msize=%d", msize), func(b *testing.B) {
+			file, done := benchOpen(b, msize)
+			defer done()
+
+			buf := make([]byte, msize-ixp.IOHDRSZ)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(buf)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := file.WriteAt(buf, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
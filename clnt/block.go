@@ -0,0 +1,63 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import "github.com/jsouthworth/ixp"
+
+// Reads count bytes starting from offset from the file with the
+// specified fileid (the Path of the file's Qid), without walking to or
+// opening the file. Returns a slice with the data read, or an Error.
+func (clnt *Clnt) Bread(fileid uint64, offset uint64, count uint32) ([]byte, error) {
+	if count > clnt.Msize-ixp.BIOHDRSZ {
+		count = clnt.Msize - ixp.BIOHDRSZ
+	}
+
+	tc := clnt.NewFcall()
+	err := ixp.PackTbread(tc, fileid, offset, count)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc.Data, nil
+}
+
+// Writes up to len(data) bytes starting from offset to the file with
+// the specified fileid. Returns the number of bytes written, or an Error.
+func (clnt *Clnt) Bwrite(fileid uint64, data []byte, offset uint64) (int, error) {
+	if uint32(len(data)) > clnt.Msize-ixp.BIOHDRSZ {
+		data = data[0 : clnt.Msize-ixp.BIOHDRSZ]
+	}
+
+	tc := clnt.NewFcall()
+	err := ixp.PackTbwrite(tc, fileid, offset, data)
+	if err != nil {
+		return 0, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rc.Count), nil
+}
+
+// Truncates the file with the specified fileid to size bytes. Returns
+// nil if the operation is successful.
+func (clnt *Clnt) Btrunc(fileid uint64, size uint64) error {
+	tc := clnt.NewFcall()
+	err := ixp.PackTbtrunc(tc, fileid, size)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	return err
+}
@@ -0,0 +1,412 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"context"
+	"github.com/jsouthworth/ixp"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The Cache type keeps the metadata and the data of the files used by
+// a client, so that FWalk, FStat and File.Read don't need to go to the
+// server while the files don't change. It is enabled by setting the
+// Cache field of the client.
+//
+// The cache consists of:
+//
+//   - a walk cache, which maps the paths walked by FWalk to the Qids of
+//     the files, and remembers the paths that don't exist for WalkTTL
+//   - a stat cache, which keeps the result of FStat for StatTTL
+//   - a page cache, which keeps the data read from the files, in pages
+//     of PageSize bytes, keyed by the Qid path and version of the file
+//
+// The client records the version of each Qid it receives from the
+// server (Rwalk, Ropen, Rcreate, Rstat). When a fresh Qid has a new
+// version, the cached pages and the stat of the file are dropped. The
+// files changed by the client itself (Write, Wstat) are not cached
+// until the server returns a Qid with a new version. Renames, removes
+// and creates drop the walk and the stat caches.
+//
+// Only the data of the files that can be read at any offset is cached.
+// Many synthetic file servers don't change the version of the Qid when
+// the content of the file changes, so the files with version 0 are not
+// cached unless Unversioned is set.
+type Cache struct {
+	sync.Mutex
+	WalkTTL     time.Duration // how long a path that doesn't exist is remembered
+	StatTTL     time.Duration // how long the result of FStat is used
+	PageSize    int           // size of the cached pages
+	MaxPages    int           // maximum number of cached pages, 0 for no limit
+	Unversioned bool          // if true, the files with version 0 are cached too
+
+	walks  map[cacheKey]*walkEntry
+	stats  map[cacheKey]*statEntry
+	files  map[uint64]*cacheFile // by Qid path
+	npages int
+	cs     CacheStats
+}
+
+// CacheStats contains a snapshot of the counters of a Cache.
+type CacheStats struct {
+	WalkHits      uint64 // walks of paths known not to exist
+	WalkMisses    uint64 // walks sent to the server
+	StatHits      uint64 // FStat calls served from the cache
+	StatMisses    uint64 // FStat calls sent to the server
+	PageHits      uint64 // pages read from the cache
+	PageMisses    uint64 // pages read from the server
+	Invalidations uint64 // number of times the pages of a file were dropped
+	Pages         int    // number of cached pages
+}
+
+type cacheKey struct {
+	aname string
+	path  string
+}
+
+type walkEntry struct {
+	qid   *ixp.Qid // nil if the path doesn't exist
+	err   error    // error returned by the walk
+	stamp time.Time
+}
+
+type statEntry struct {
+	dir   ixp.Dir
+	stamp time.Time
+}
+
+type cacheFile struct {
+	version uint32
+	dirty   bool // changed by the client, the version is not known
+	pages   map[int64][]byte
+}
+
+// Creates an empty cache. The walk and stat entries are valid for
+// a second, and up to 1024 pages of 8 KB are kept.
+func NewCache() *Cache {
+	c := new(Cache)
+	c.WalkTTL = time.Second
+	c.StatTTL = time.Second
+	c.PageSize = 8192
+	c.MaxPages = 1024
+	c.clear()
+	return c
+}
+
+func (c *Cache) clear() {
+	c.walks = make(map[cacheKey]*walkEntry)
+	c.stats = make(map[cacheKey]*statEntry)
+	c.files = make(map[uint64]*cacheFile)
+	c.npages = 0
+}
+
+// Drops all entries from the cache.
+func (c *Cache) Clear() {
+	c.Lock()
+	c.clear()
+	c.Unlock()
+}
+
+// Returns the counters of the cache.
+func (c *Cache) Stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	cs := c.cs
+	cs.Pages = c.npages
+	return cs
+}
+
+// Returns the cache key of the file with the names walked from the
+// attach point of fid.
+func (fid *Fid) cacheKey(names ...string) cacheKey {
+	fid.Lock()
+	path := append(append([]string(nil), fid.path...), names...)
+	aname := fid.aname
+	fid.Unlock()
+	return cacheKey{aname, "/" + strings.Join(path, "/")}
+}
+
+// Returns the error of the last walk to the path if the path is
+// known not to exist, or nil.
+func (c *Cache) missing(key cacheKey) error {
+	if c == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if e := c.walks[key]; e != nil && e.qid == nil && time.Since(e.stamp) < c.WalkTTL {
+		c.cs.WalkHits++
+		return e.err
+	}
+
+	c.cs.WalkMisses++
+	return nil
+}
+
+// Records the Qid of the walked path.
+func (c *Cache) walked(key cacheKey, qid ixp.Qid) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	c.seenLocked(qid)
+	c.walks[key] = &walkEntry{&qid, nil, time.Now()}
+	c.Unlock()
+}
+
+// Records that the walk to the path failed. Only the errors returned
+// by the server for files that don't exist are remembered (9P2000
+// servers don't send an error number).
+func (c *Cache) notFound(key cacheKey, err error) {
+	if c == nil {
+		return
+	}
+
+	if e, ok := err.(*ixp.Error); !ok || (e.Errornum != ixp.ENOENT && e.Errornum != 0) {
+		return
+	}
+
+	c.Lock()
+	c.walks[key] = &walkEntry{nil, err, time.Now()}
+	c.Unlock()
+}
+
+// Returns the cached metadata of the file, or nil.
+func (c *Cache) stat(key cacheKey) *ixp.Dir {
+	if c == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	e := c.stats[key]
+	if e == nil || time.Since(e.stamp) >= c.StatTTL || !c.current(e.dir.Qid) {
+		c.cs.StatMisses++
+		return nil
+	}
+
+	/* the Qid of the last walk to the path must match too */
+	if w := c.walks[key]; w != nil && (w.qid == nil || *w.qid != e.dir.Qid) {
+		c.cs.StatMisses++
+		return nil
+	}
+
+	c.cs.StatHits++
+	d := e.dir
+	return &d
+}
+
+// Records the metadata of the file.
+func (c *Cache) setStat(key cacheKey, d *ixp.Dir) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.seenLocked(d.Qid)
+	c.stats[key] = &statEntry{*d, time.Now()}
+}
+
+// Records a Qid returned by the server. If the version of the file
+// changed, its pages are dropped.
+func (c *Cache) seen(qid ixp.Qid) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	c.seenLocked(qid)
+	c.Unlock()
+}
+
+func (c *Cache) seenLocked(qid ixp.Qid) {
+	f := c.files[qid.Path]
+	if f == nil {
+		c.files[qid.Path] = &cacheFile{version: qid.Version}
+		return
+	}
+
+	if f.version != qid.Version {
+		c.drop(f)
+		f.version = qid.Version
+		f.dirty = false
+	}
+}
+
+// Returns true if qid is the last known version of the file.
+func (c *Cache) current(qid ixp.Qid) bool {
+	f := c.files[qid.Path]
+	return f != nil && !f.dirty && f.version == qid.Version
+}
+
+// Drops the pages of the file.
+func (c *Cache) drop(f *cacheFile) {
+	if len(f.pages) > 0 {
+		c.cs.Invalidations++
+	}
+
+	c.npages -= len(f.pages)
+	f.pages = nil
+}
+
+// Marks the file as changed by the client. The file is not cached
+// until the server returns its new version.
+func (c *Cache) changed(qid ixp.Qid) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	f := c.files[qid.Path]
+	if f == nil {
+		f = &cacheFile{version: qid.Version}
+		c.files[qid.Path] = f
+	}
+
+	c.drop(f)
+	f.dirty = true
+}
+
+// Drops the walk and stat caches after a file is created, removed or
+// renamed.
+func (c *Cache) renamed() {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	c.walks = make(map[cacheKey]*walkEntry)
+	c.stats = make(map[cacheKey]*statEntry)
+	c.Unlock()
+}
+
+// Returns true if the data of the file can be cached.
+func (c *Cache) cacheable(fid *Fid) bool {
+	if fid.Type&(ixp.QTDIR|ixp.QTAPPEND|ixp.QTEXCL|ixp.QTAUTH|ixp.QTTMP) != 0 {
+		return false
+	}
+
+	return fid.Version != 0 || c.Unversioned
+}
+
+// Returns the cached page of the file, or nil.
+func (c *Cache) page(qid ixp.Qid, idx int64) []byte {
+	c.Lock()
+	defer c.Unlock()
+	f := c.files[qid.Path]
+	if f == nil || f.dirty || f.version != qid.Version || f.pages[idx] == nil {
+		c.cs.PageMisses++
+		return nil
+	}
+
+	c.cs.PageHits++
+	return f.pages[idx]
+}
+
+// Adds the page to the cache if the file wasn't changed since the fid
+// was opened.
+func (c *Cache) setPage(qid ixp.Qid, idx int64, page []byte) {
+	c.Lock()
+	defer c.Unlock()
+	f := c.files[qid.Path]
+	if f == nil || f.dirty || f.version != qid.Version {
+		return
+	}
+
+	if f.pages == nil {
+		f.pages = make(map[int64][]byte)
+	}
+
+	if f.pages[idx] == nil {
+		if c.MaxPages > 0 && c.npages >= c.MaxPages {
+			c.evict()
+		}
+
+		c.npages++
+	}
+
+	f.pages[idx] = page
+}
+
+// Drops a page to make room for a new one.
+func (c *Cache) evict() {
+	for _, f := range c.files {
+		for idx := range f.pages {
+			delete(f.pages, idx)
+			c.npages--
+			return
+		}
+	}
+}
+
+// Reads the data of the file from the cached pages. The pages that
+// are not cached are read from the server.
+func (c *Cache) readAt(ctx context.Context, file *File, buf []byte, offset int64) (int, error) {
+	qid := file.fid.Qid
+	psz := int64(c.PageSize)
+	n := 0
+	for n < len(buf) {
+		off := offset + int64(n)
+		idx := off / psz
+		page := c.page(qid, idx)
+		if page == nil {
+			var err error
+			page, err = c.fetch(ctx, file, idx)
+			if err != nil {
+				if n > 0 {
+					break
+				}
+
+				return 0, err
+			}
+
+			c.setPage(qid, idx, page)
+		}
+
+		po := int(off - idx*psz)
+		if po >= len(page) {
+			break
+		}
+
+		n += copy(buf[n:], page[po:])
+		if int64(len(page)) < psz {
+			/* end-of-file */
+			break
+		}
+	}
+
+	if n == 0 {
+		return 0, io.EOF
+	}
+
+	return n, nil
+}
+
+// Reads a page of the file from the server.
+func (c *Cache) fetch(ctx context.Context, file *File, idx int64) ([]byte, error) {
+	page := make([]byte, c.PageSize)
+	off := idx * int64(c.PageSize)
+	n := 0
+	for n < len(page) {
+		m, err := file.readRpc(ctx, page[n:], off+int64(n))
+		n += m
+		if err == io.EOF || m == 0 {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return page[0:n], nil
+}
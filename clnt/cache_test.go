@@ -0,0 +1,230 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt_test
+
+import (
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A file that counts the Treads it receives. Its Qid version is
+// changed by the test.
+type countFile struct {
+	srv.File
+	sync.Mutex
+	data  []byte
+	reads int
+}
+
+func (f *countFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.reads++
+	if offset >= uint64(len(f.data)) {
+		return 0, nil
+	}
+
+	return copy(buf, f.data[offset:]), nil
+}
+
+func (f *countFile) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	copy(f.data[offset:], data)
+	return len(data), nil
+}
+
+// Returns the number of Treads received since the last call.
+func (f *countFile) nreads() int {
+	f.Lock()
+	defer f.Unlock()
+	n := f.reads
+	f.reads = 0
+	return n
+}
+
+// Sets the content and the Qid version of the file.
+func (f *countFile) set(data string, version uint32) {
+	f.Lock()
+	f.data = []byte(data)
+	f.Qid.Version = version
+	f.Length = uint64(len(data))
+	f.Unlock()
+}
+
+// Serves the files "v", with Qid version 1, and "u", with version 0,
+// to a client with a cache.
+func cacheTree(t *testing.T) (v, u *countFile, c *clnt.Clnt) {
+	root := srvtest.Root(t, 0777)
+	v, u = new(countFile), new(countFile)
+	for name, f := range map[string]*countFile{"v": v, "u": u} {
+		if err := root.Add(&f.File, name, srvtest.User(), nil, 0666, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v.set("version 1", 1)
+	u.set("unversioned", 0)
+	c, unmount, err := srvtest.Loopback(srvtest.FileSrv(t, root), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(unmount)
+
+	c.Cache = clnt.NewCache()
+	return v, u, c
+}
+
+// Reads the file from the start.
+func readAll(t *testing.T, f *clnt.File) string {
+	buf := make([]byte, 64)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf[0:n])
+}
+
+func TestCacheStat(t *testing.T) {
+	_, _, c := cacheTree(t)
+	c.Cache.StatTTL = time.Hour
+	for i := 0; i < 2; i++ {
+		if _, err := c.FStat("/v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if cs := c.Cache.Stats(); cs.StatMisses != 1 || cs.StatHits != 1 {
+		t.Errorf("stats of FStat: %+v", cs)
+	}
+
+	/* the entry expires */
+	c.Cache.StatTTL = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	if _, err := c.FStat("/v"); err != nil {
+		t.Fatal(err)
+	}
+
+	if cs := c.Cache.Stats(); cs.StatMisses != 2 || cs.StatHits != 1 {
+		t.Errorf("stats of FStat after the TTL: %+v", cs)
+	}
+}
+
+func TestCachePages(t *testing.T) {
+	v, _, c := cacheTree(t)
+	f, err := c.FOpen("/v", ixp.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 2; i++ {
+		if data := readAll(t, f); data != "version 1" {
+			t.Fatalf("read %q", data)
+		}
+
+		if n := v.nreads(); (n == 0) != (i == 1) {
+			t.Errorf("%d Treads for read %d of a cached file", n, i)
+		}
+	}
+
+	if cs := c.Cache.Stats(); cs.PageMisses != 1 || cs.PageHits != 1 || cs.Pages != 1 {
+		t.Errorf("stats after two reads: %+v", cs)
+	}
+
+	/* the pages of the old version are dropped when the new one is seen */
+	v.set("version 2", 2)
+	f2, err := c.FOpen("/v", ixp.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	if cs := c.Cache.Stats(); cs.Invalidations != 1 || cs.Pages != 0 {
+		t.Errorf("stats after the version changed: %+v", cs)
+	}
+
+	if data := readAll(t, f2); data != "version 2" || v.nreads() == 0 {
+		t.Errorf("read of the new version: %q", data)
+	}
+
+	/* the old fid isn't served from the pages of the new version */
+	if data := readAll(t, f); data != "version 2" || v.nreads() == 0 {
+		t.Errorf("read of the old fid: %q", data)
+	}
+}
+
+func TestCacheWrite(t *testing.T) {
+	v, _, c := cacheTree(t)
+	f, err := c.FOpen("/v", ixp.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	readAll(t, f)
+	v.nreads()
+
+	/* the server doesn't change the version, the file isn't cached anymore */
+	if _, err := f.WriteAt([]byte("VERSION"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if data := readAll(t, f); data != "VERSION 1" || v.nreads() == 0 {
+			t.Errorf("read %d after write: %q, served from the cache", i, data)
+		}
+	}
+
+	if cs := c.Cache.Stats(); cs.Invalidations != 1 || cs.Pages != 0 {
+		t.Errorf("stats after write: %+v", cs)
+	}
+
+	/* until the server returns a new version */
+	v.set("version 3", 3)
+	f2, err := c.FOpen("/v", ixp.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	readAll(t, f2)
+	v.nreads()
+	if data := readAll(t, f2); data != "version 3" || v.nreads() != 0 {
+		t.Errorf("second read of the new version: %q, not served from the cache", data)
+	}
+}
+
+func TestCacheUnversioned(t *testing.T) {
+	_, u, c := cacheTree(t)
+	f, err := c.FOpen("/u", ixp.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 2; i++ {
+		if data := readAll(t, f); data != "unversioned" || u.nreads() == 0 {
+			t.Errorf("read %d of a file with version 0: %q, served from the cache", i, data)
+		}
+	}
+
+	if cs := c.Cache.Stats(); cs.PageMisses != 0 || cs.PageHits != 0 || cs.Pages != 0 {
+		t.Errorf("stats of a file with version 0: %+v", cs)
+	}
+
+	c.Cache.Unversioned = true
+	readAll(t, f)
+	u.nreads()
+	if data := readAll(t, f); data != "unversioned" || u.nreads() != 0 {
+		t.Errorf("read of a file with version 0 with Unversioned set: %q, not served from the cache", data)
+	}
+}
@@ -7,11 +7,14 @@
 package clnt
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"github.com/jsouthworth/ixp"
-	"log"
-	"net"
+	"io"
+	"log/slog"
 	"sync"
+	"syscall"
+	"time"
 )
 
 // Debug flags
@@ -22,9 +25,12 @@ const (
 	DbgLogPackets                 // keep the last N 9P messages (can be accessed over http)
 )
 
+// The StatsOps interface is implemented by Clnt when the package is
+// built with the httpstats tag. The stats pages list the clients
+// returned by Clnts, so the clients only need to register the pages
+// when they are created.
 type StatsOps interface {
 	statsRegister()
-	statsUnregister()
 }
 
 // The Clnt type represents a 9P2000 client. The client is connected to
@@ -32,14 +38,24 @@ type StatsOps interface {
 // the files exported by the server.
 type Clnt struct {
 	sync.Mutex
-	Debuglevel int    // =0 don't print anything, >0 print Fcalls, >1 print raw packets
-	Msize      uint32 // Maximum size of the 9P messages
-	Dotu       bool   // If true, 9P2000.u protocol is spoken
-	Root       *Fid   // Fid that points to the rood directory
-	Id         string // Used when printing debug messages
+	Debuglevel int         // =0 don't print anything, >0 print Fcalls, >1 print raw packets
+	Msize      uint32      // Maximum size of the 9P messages
+	Dialect    ixp.Dialect // Dialect negotiated with the server
+	Root       *Fid        // Fid that points to the rood directory
+	Id         string      // Used when printing debug messages
 	Log        *ixp.Logger
-
-	conn     net.Conn
+	Slog       *slog.Logger // Structured logger for the diagnostics, with the clnt attribute
+	Window     int          // Maximum number of Tread/Twrite requests in flight for a File operation
+	Cache      *Cache       // If set, the metadata and the data of the files are cached
+
+	// If Dial is set, the client reconnects with it when the connection
+	// to the server is lost. The transport can be a net.Conn or any
+	// other io.ReadWriteCloser. Hooks, if set, is notified about the
+	// reconnect events.
+	Dial  func() (io.ReadWriteCloser, error)
+	Hooks ReconnectOps
+
+	conn     io.ReadWriteCloser
 	tagpool  *pool
 	fidpool  *pool
 	reqout   chan *Req
@@ -48,9 +64,23 @@ type Clnt struct {
 	reqlast  *Req
 	err      error
 
-	reqchan chan *Req
-	tchan   chan *ixp.Fcall
-
+	reqfree []*Req // freed requests, each one keeps its tag
+
+	// reconnect
+	gen       uint64          // number of the current connection, starts from 1
+	dead      chan bool       // closed when the current connection is lost
+	unmounted bool            // true if Unmount was called
+	rlock     sync.Mutex      // serializes the reconnects
+	fids      map[uint32]*Fid // fids that can be reestablished (if Dial is set)
+
+	// stats
+	serial     uint64           // number of the client in the registry
+	nrpcs      map[uint8]uint64 // number of requests sent, by message type
+	tsz        uint64           // total size of the T messages sent
+	rsz        uint64           // total size of the R messages received
+	npend      int              // number of requests waiting for a response
+	maxpend    int              // maximum number of pending requests
+	nreconn    uint64           // number of successful reconnects
 	next, prev *Clnt
 }
 
@@ -65,6 +95,14 @@ type Fid struct {
 	Fid      uint32 // Fid number
 	ixp.User        // The user the fid belongs to
 	walked   bool   // true if the fid points to a walked file on the server
+	dir      *Fid   // unopened clone of a directory opened with Tlopen
+
+	// used to reestablish the fid after reconnect
+	aname     string   // attach name
+	path      []string // names walked from the attach point
+	opened    bool     // true if the fid is opened
+	norestore bool     // true if the fid can't be reestablished
+	gen       uint64   // connection the fid is valid on (0 if unknown)
 }
 
 // The file is similar to the Fid, but is used in the high-level client
@@ -72,6 +110,7 @@ type Fid struct {
 type File struct {
 	fid    *Fid
 	offset uint64
+	win    int // number of requests in flight, 0 if the client's Window is used
 }
 
 type pool struct {
@@ -92,11 +131,16 @@ type Req struct {
 	tag        uint16
 	prev, next *Req
 	fid        *Fid
+	done       chan *Req // used as Done by Rpc, kept when the request is freed
+	start      time.Time // when the request was sent
 }
 
 var DefaultDebuglevel int
 var DefaultLogger *ixp.Logger
 
+// The structured logger of the new clients, slog.Default() if nil.
+var DefaultSlog *slog.Logger
+
 func (clnt *Clnt) Rpcnb(r *Req) error {
 	var tag uint16
 
@@ -107,12 +151,15 @@ func (clnt *Clnt) Rpcnb(r *Req) error {
 	}
 
 	ixp.SetTag(r.Tc, tag)
+	r.start = time.Now()
 	clnt.Lock()
 	if clnt.err != nil {
 		clnt.Unlock()
 		return clnt.err
 	}
 
+	dead := clnt.dead
+
 	if clnt.reqlast != nil {
 		clnt.reqlast.next = r
 	} else {
@@ -121,155 +168,288 @@ func (clnt *Clnt) Rpcnb(r *Req) error {
 
 	r.prev = clnt.reqlast
 	clnt.reqlast = r
+	clnt.nrpcs[r.Tc.Type]++
+	clnt.tsz += uint64(r.Tc.Size)
+	clnt.npend++
+	if clnt.npend > clnt.maxpend {
+		clnt.maxpend = clnt.npend
+	}
 	clnt.Unlock()
 
-	clnt.reqout <- r
+	select {
+	case clnt.reqout <- r:
+	case <-dead:
+		/* the connection is lost, r gets an error on r.Done */
+	}
+
 	return nil
 }
 
 func (clnt *Clnt) Rpc(tc *ixp.Fcall) (rc *ixp.Fcall, err error) {
+	return clnt.RpcContext(context.Background(), tc)
+}
+
+// Sends the request and waits for the response. If the context is
+// cancelled before the response arrives, the request is flushed: Tflush
+// is sent for its tag and the call waits for Rflush before the tag is
+// reused. If the server answered the request before Rflush, the response
+// is returned, otherwise the error of the context is returned.
+func (clnt *Clnt) RpcContext(ctx context.Context, tc *ixp.Fcall) (rc *ixp.Fcall, err error) {
+	rc, _, err = clnt.rpcgen(ctx, tc)
+	return
+}
+
+func (clnt *Clnt) rpc(ctx context.Context, tc *ixp.Fcall) (rc *ixp.Fcall, err error) {
+	rc, err = clnt.rpcKeep(ctx, tc)
+	clnt.FreeFcall(tc)
+	return
+}
+
+// Same as rpc, but doesn't free tc, so it can be sent again.
+func (clnt *Clnt) rpcKeep(ctx context.Context, tc *ixp.Fcall) (rc *ixp.Fcall, err error) {
 	r := clnt.ReqAlloc()
 	r.Tc = tc
-	r.Done = make(chan *Req)
+	r.Done = r.wait()
 	err = clnt.Rpcnb(r)
 	if err != nil {
+		r.Tc = nil
+		clnt.ReqFree(r)
 		return
 	}
 
-	<-r.Done
-	rc = r.Rc
-	err = r.Err
+	select {
+	case <-r.Done:
+		rc = r.Rc
+		err = r.Err
+
+	case <-ctx.Done():
+		if clnt.flush(r) {
+			rc = r.Rc
+			err = r.Err
+		} else {
+			err = ctx.Err()
+		}
+	}
+
+	/* the caller owns tc */
+	r.Tc = nil
 	clnt.ReqFree(r)
 	return
 }
 
-func (clnt *Clnt) recv() {
+// Flushes the pending request r and waits for the flush to complete.
+// Returns true if the response to r arrived before Rflush.
+func (clnt *Clnt) flush(r *Req) bool {
+	fr := clnt.ReqAlloc()
+	fr.Tc = clnt.NewFcall()
+	fr.Done = fr.wait()
+	err := ixp.PackTflush(fr.Tc, r.tag)
+	if err == nil {
+		err = clnt.Rpcnb(fr)
+	}
+
+	if err != nil {
+		/* the connection is closed, r gets an error on r.Done */
+		clnt.ReqFree(fr)
+		<-r.Done
+		return true
+	}
+
+	done := false
+	select {
+	case <-r.Done:
+		done = true
+		<-fr.Done
+
+	case <-fr.Done:
+		if !clnt.unlink(r) {
+			/* the response arrived together with Rflush */
+			<-r.Done
+			done = true
+		}
+	}
+
+	clnt.ReqFree(fr)
+	return done
+}
+
+// Removes the request from the list of pending requests. Returns false
+// if the request is not pending anymore.
+func (clnt *Clnt) unlink(r *Req) bool {
+	clnt.Lock()
+	defer clnt.Unlock()
+	for p := clnt.reqfirst; p != nil; p = p.next {
+		if p != r {
+			continue
+		}
+
+		if r.prev != nil {
+			r.prev.next = r.next
+		} else {
+			clnt.reqfirst = r.next
+		}
+
+		if r.next != nil {
+			r.next.prev = r.prev
+		} else {
+			clnt.reqlast = r.prev
+		}
+		clnt.npend--
+		return true
+	}
+
+	return false
+}
+
+func (clnt *Clnt) recv(c io.ReadWriteCloser) {
 	var err error
 
-	err = nil
-	buf := make([]byte, clnt.Msize*8)
-	pos := 0
+	rd := ixp.NewFcallReader(c)
+	data := clnt.readBuf
 	for {
-		if len(buf) < int(clnt.Msize) {
-			b := make([]byte, clnt.Msize*8)
-			copy(b, buf[0:pos])
-			buf = b
-			b = nil
-		}
+		clnt.Lock()
+		msize, dotu := clnt.Msize, clnt.Dialect.Dotu()
+		clnt.Unlock()
 
-		n, oerr := clnt.conn.Read(buf[pos:])
-		if oerr != nil || n == 0 {
-			err = &ixp.Error{oerr.Error(), ixp.EIO}
+		fc := ixp.AllocFcall(msize)
+		err = rd.ReadFcallData(fc, msize, dotu, data)
+		if err != nil {
+			var e *ixp.Error
+			if !errors.As(err, &e) {
+				err = &ixp.Error{err.Error(), ixp.EIO}
+			}
+
+			ixp.FreeFcall(fc)
 			clnt.Lock()
 			clnt.err = err
 			clnt.Unlock()
 			goto closed
 		}
 
-		pos += n
-		for pos > 4 {
-			sz, _ := ixp.Gint32(buf)
-			if pos < int(sz) {
-				if len(buf) < int(sz) {
-					b := make([]byte, clnt.Msize*8)
-					copy(b, buf[0:pos])
-					buf = b
-					b = nil
-				}
+		clnt.Lock()
+		if clnt.Debuglevel > 0 {
+			clnt.logFcall(fc)
+		}
 
+		var r *Req = nil
+		for r = clnt.reqfirst; r != nil; r = r.next {
+			if r.Tc.Tag == fc.Tag {
 				break
 			}
+		}
 
-			fc, err, fcsize := ixp.Unpack(buf, clnt.Dotu)
-			clnt.Lock()
-			if err != nil {
-				clnt.err = err
-				clnt.conn.Close()
-				clnt.Unlock()
-				goto closed
-			}
+		if r == nil {
+			clnt.Slog.LogAttrs(context.Background(), slog.LevelWarn, "unexpected response", ixp.FcallAttrs(fc)...)
+			clnt.err = &ixp.Error{"unexpected response", ixp.EINVAL}
+			clnt.conn.Close()
+			ixp.FreeFcall(fc)
+			clnt.Unlock()
+			goto closed
+		}
 
-			if clnt.Debuglevel > 0 {
-				clnt.logFcall(fc)
-				if clnt.Debuglevel&DbgPrintPackets != 0 {
-					log.Println("}-}", clnt.Id, fmt.Sprint(fc.Pkt))
-				}
+		r.Rc = fc
+		if r.prev != nil {
+			r.prev.next = r.next
+		} else {
+			clnt.reqfirst = r.next
+		}
 
-				if clnt.Debuglevel&DbgPrintFcalls != 0 {
-					log.Println("}}}", clnt.Id, fc.String())
-				}
-			}
+		if r.next != nil {
+			r.next.prev = r.prev
+		} else {
+			clnt.reqlast = r.prev
+		}
+		clnt.rsz += uint64(fc.Size)
+		clnt.npend--
+		clnt.Unlock()
+		clnt.trace(r, fc, "received")
 
-			var r *Req = nil
-			for r = clnt.reqfirst; r != nil; r = r.next {
-				if r.Tc.Tag == fc.Tag {
-					break
+		if r.Tc.Type != r.Rc.Type-1 {
+			switch r.Rc.Type {
+			case ixp.Rerror:
+				if r.Err == nil {
+					r.Err = &ixp.Error{r.Rc.Error, r.Rc.Errornum}
 				}
-			}
-
-			if r == nil {
-				clnt.err = &ixp.Error{"unexpected response", ixp.EINVAL}
-				clnt.conn.Close()
-				clnt.Unlock()
-				goto closed
-			}
 
-			r.Rc = fc
-			if r.prev != nil {
-				r.prev.next = r.next
-			} else {
-				clnt.reqfirst = r.next
-			}
-
-			if r.next != nil {
-				r.next.prev = r.prev
-			} else {
-				clnt.reqlast = r.prev
-			}
-			clnt.Unlock()
-
-			if r.Tc.Type != r.Rc.Type-1 {
-				if r.Rc.Type != ixp.Rerror {
-					r.Err = &ixp.Error{"invalid response", ixp.EINVAL}
-					log.Println(fmt.Sprintf("TTT %v", r.Tc))
-					log.Println(fmt.Sprintf("RRR %v", r.Rc))
-				} else {
-					if r.Err == nil {
-						r.Err = &ixp.Error{r.Rc.Error, r.Rc.Errornum}
-					}
+			case ixp.Rlerror:
+				if r.Err == nil {
+					r.Err = &ixp.Error{syscall.Errno(r.Rc.Errornum).Error(), r.Rc.Errornum}
 				}
-			}
 
-			if r.Done != nil {
-				r.Done <- r
+			default:
+				r.Err = &ixp.Error{"invalid response", ixp.EINVAL}
+				clnt.Slog.Warn("invalid response", "tc", r.Tc.String(), "rc", r.Rc.String())
 			}
+		}
 
-			pos -= fcsize
-			buf = buf[fcsize:]
+		if r.Done != nil {
+			r.Done <- r
 		}
 	}
 
 closed:
 	clnt.done <- true
+	c.Close()
 
 	/* send error to all pending requests */
 	clnt.Lock()
 	r := clnt.reqfirst
 	clnt.reqfirst = nil
 	clnt.reqlast = nil
+	clnt.npend = 0
 	if err == nil {
 		err = clnt.err
 	}
+
+	cause := err
+	lost := clnt.Dial != nil && !clnt.unmounted
+	if lost {
+		/* the requests can be retried after reconnect */
+		err = Edisconnected
+		clnt.err = err
+	}
+	close(clnt.dead)
 	clnt.Unlock()
-	for ; r != nil; r = r.next {
+
+	if lost {
+		if clnt.Hooks != nil {
+			clnt.Hooks.Disconnected(clnt, cause)
+		}
+	} else {
+		clnt.statsUnlink()
+	}
+
+	for r != nil {
+		/* r can be freed as soon as it is sent to Done */
+		next := r.next
 		r.Err = err
 		if r.Done != nil {
 			r.Done <- r
 		}
+		r = next
 	}
 }
 
-func (clnt *Clnt) send() {
+// Returns the buffer the data of the Rread for the tag should be read
+// into, or nil. The buffer is set as the Data of the Tread message.
+func (clnt *Clnt) readBuf(tag uint16) []byte {
+	clnt.Lock()
+	defer clnt.Unlock()
+	for r := clnt.reqfirst; r != nil; r = r.next {
+		if r.Tc.Tag == tag {
+			if r.Tc.Type == ixp.Tread {
+				return r.Tc.Data
+			}
+
+			break
+		}
+	}
+
+	return nil
+}
+
+func (clnt *Clnt) send(c io.ReadWriteCloser) {
+	wr := ixp.NewFcallWriter(c)
 	for {
 		select {
 		case <-clnt.done:
@@ -278,64 +458,81 @@ func (clnt *Clnt) send() {
 		case req := <-clnt.reqout:
 			if clnt.Debuglevel > 0 {
 				clnt.logFcall(req.Tc)
-				if clnt.Debuglevel&DbgPrintPackets != 0 {
-					log.Println("{-{", clnt.Id, fmt.Sprint(req.Tc.Pkt))
-				}
-
-				if clnt.Debuglevel&DbgPrintFcalls != 0 {
-					log.Println("{{{", clnt.Id, req.Tc.String())
-				}
 			}
+			clnt.trace(req, req.Tc, "sent")
 
-			for buf := req.Tc.Pkt; len(buf) > 0; {
-				n, err := clnt.conn.Write(buf)
-				if err != nil {
-					/* just close the socket, will get signal on clnt.done */
-					clnt.conn.Close()
-					break
-				}
-
-				buf = buf[n:]
+			err := wr.WriteFcall(req.Tc)
+			if err != nil {
+				/* just close the socket, will get signal on clnt.done */
+				c.Close()
 			}
 		}
 	}
 }
 
 // Creates and initializes a new Clnt object. Doesn't send any data
-// on the wire.
-func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
+// on the wire. The connection can be any transport (see
+// ixp.AddrTransport), not only a net.Conn.
+func NewClnt(c io.ReadWriteCloser, msize uint32, dotu bool) *Clnt {
 	clnt := new(Clnt)
 	clnt.conn = c
 	clnt.Msize = msize
-	clnt.Dotu = dotu
+	clnt.Dialect = ixp.Dialect9P2000
+	if dotu {
+		clnt.Dialect = ixp.Dialect9P2000u
+	}
 	clnt.Debuglevel = DefaultDebuglevel
 	clnt.Log = DefaultLogger
-	clnt.Id = c.RemoteAddr().String() + ":"
+	clnt.Window = DefaultWindow
+	clnt.Id = ixp.RemoteAddr(c, "") + ":"
+	clnt.Slog = DefaultSlog
+	if clnt.Slog == nil {
+		clnt.Slog = slog.Default()
+	}
+	clnt.Slog = clnt.Slog.With("clnt", clnt.Id)
 	clnt.tagpool = newPool(uint32(ixp.NOTAG))
 	clnt.fidpool = newPool(ixp.NOFID)
 	clnt.reqout = make(chan *Req)
 	clnt.done = make(chan bool)
-	clnt.reqchan = make(chan *Req, 16)
-	clnt.tchan = make(chan *ixp.Fcall, 16)
+	clnt.nrpcs = make(map[uint8]uint64)
+	clnt.gen = 1
+	clnt.dead = make(chan bool)
+	clnt.fids = make(map[uint32]*Fid)
+	clnt.statsLink()
 
-	go clnt.recv()
-	go clnt.send()
+	go clnt.recv(c)
+	go clnt.send(c)
 
 	return clnt
 }
 
+// Returns the Id of the client.
+func (clnt *Clnt) String() string {
+	return clnt.Id
+}
+
 // Establishes a new socket connection to the 9P server and creates
 // a client object for it. Negotiates the dialect and msize for the
 // connection. Returns a Clnt object, or Error.
-func Connect(c net.Conn, msize uint32, dotu bool) (*Clnt, error) {
-	clnt := NewClnt(c, msize, dotu)
-	ver := "9P2000"
-	if clnt.Dotu {
-		ver = "9P2000.u"
+func Connect(c io.ReadWriteCloser, msize uint32, dotu bool) (*Clnt, error) {
+	dialect := ixp.Dialect9P2000
+	if dotu {
+		dialect = ixp.Dialect9P2000u
 	}
 
+	return ConnectDialect(c, msize, dialect)
+}
+
+// Same as Connect, but asks the server for the specified dialect. The
+// dialect the server agreed to is available in the Dialect field of the
+// returned client.
+func ConnectDialect(c io.ReadWriteCloser, msize uint32, dialect ixp.Dialect) (*Clnt, error) {
+	clnt := NewClnt(c, msize, dialect.Dotu())
+	clnt.Lock()
+	clnt.Dialect = dialect
+	clnt.Unlock()
 	tc := ixp.NewFcall(clnt.Msize)
-	err := ixp.PackTversion(tc, clnt.Msize, ver)
+	err := ixp.PackTversion(tc, clnt.Msize, dialect.String())
 	if err != nil {
 		return nil, err
 	}
@@ -345,55 +542,73 @@ func Connect(c net.Conn, msize uint32, dotu bool) (*Clnt, error) {
 		return nil, err
 	}
 
+	rdialect, _ := ixp.ParseDialect(rc.Version)
+	if rdialect > dialect {
+		rdialect = ixp.Dialect9P2000
+	}
+
+	clnt.Lock()
 	if rc.Msize < clnt.Msize {
 		clnt.Msize = rc.Msize
 	}
-
-	clnt.Dotu = rc.Version == "9P2000.u" && clnt.Dotu
+	clnt.Dialect = rdialect
+	clnt.Unlock()
 	return clnt, nil
 }
 
+// Returns true if the 9P2000.u encoding is used for the messages, i.e.
+// if 9P2000.u or 9P2000.L is spoken.
+func (clnt *Clnt) Dotu() bool {
+	return clnt.Dialect.Dotu()
+}
+
 // Creates a new Fid object for the client
 func (clnt *Clnt) FidAlloc() *Fid {
 	fid := new(Fid)
 	fid.Fid = clnt.fidpool.getId()
 	fid.Clnt = clnt
+	clnt.Lock()
+	if clnt.Dial != nil {
+		clnt.fids[fid.Fid] = fid
+	}
+	clnt.Unlock()
 
 	return fid
 }
 
+// Returns a Fcall big enough for the messages of the client. The
+// Fcall should be freed with FreeFcall when no longer used.
 func (clnt *Clnt) NewFcall() *ixp.Fcall {
-	select {
-	case tc := <-clnt.tchan:
-		return tc
-	default:
-	}
-	return ixp.NewFcall(clnt.Msize)
+	return ixp.AllocFcall(clnt.Msize)
 }
 
+// Returns the Fcall to the pool. The data of the Fcall can't be
+// used after the call.
 func (clnt *Clnt) FreeFcall(fc *ixp.Fcall) {
-	if fc != nil && len(fc.Buf) >= int(clnt.Msize) {
-		select {
-		case clnt.tchan <- fc:
-			break
-		default:
-		}
-	}
+	ixp.FreeFcall(fc)
 }
 
 func (clnt *Clnt) ReqAlloc() *Req {
 	var req *Req
-	select {
-	case req = <-clnt.reqchan:
-		break
-	default:
+
+	clnt.Lock()
+	if n := len(clnt.reqfree); n > 0 {
+		req = clnt.reqfree[n-1]
+		clnt.reqfree = clnt.reqfree[0 : n-1]
+	}
+	clnt.Unlock()
+
+	if req == nil {
 		req = new(Req)
 		req.Clnt = clnt
 		req.tag = uint16(clnt.tagpool.getId())
 	}
+
 	return req
 }
 
+// Frees the request and its T-message. The tag of the request is
+// kept for reuse by ReqAlloc.
 func (clnt *Clnt) ReqFree(req *Req) {
 	clnt.FreeFcall(req.Tc)
 	req.Tc = nil
@@ -403,18 +618,24 @@ func (clnt *Clnt) ReqFree(req *Req) {
 	req.next = nil
 	req.prev = nil
 
-	select {
-	case clnt.reqchan <- req:
-		break
-	default:
-		clnt.tagpool.putId(uint32(req.tag))
+	clnt.Lock()
+	clnt.reqfree = append(clnt.reqfree, req)
+	clnt.Unlock()
+}
+
+// Returns the channel the request waits on in Rpc.
+func (r *Req) wait() chan *Req {
+	if r.done == nil {
+		r.done = make(chan *Req, 1)
 	}
+
+	return r.done
 }
 
 func (clnt *Clnt) logFcall(fc *ixp.Fcall) {
 	if clnt.Debuglevel&DbgLogPackets != 0 {
-		pkt := make([]byte, len(fc.Pkt))
-		copy(pkt, fc.Pkt)
+		pkt := make([]byte, 0, len(fc.Pkt)+len(fc.Payload))
+		pkt = append(append(pkt, fc.Pkt...), fc.Payload...)
 		clnt.Log.Log(pkt, clnt, DbgLogPackets)
 	}
 
@@ -422,6 +643,39 @@ func (clnt *Clnt) logFcall(fc *ixp.Fcall) {
 		f := new(ixp.Fcall)
 		*f = *fc
 		f.Pkt = nil
+		f.Buf = nil
+		f.Data = append([]byte(nil), fc.Data...)
 		clnt.Log.Log(f, clnt, DbgLogFcalls)
 	}
 }
+
+// Logs the message sent or received for the request. The message is
+// logged at LevelTrace, or at LevelInfo if the debug level of the
+// client prints the messages.
+func (clnt *Clnt) trace(req *Req, fc *ixp.Fcall, msg string) {
+	level := ixp.LevelTrace
+	if clnt.Debuglevel&(DbgPrintFcalls|DbgPrintPackets) != 0 {
+		level = slog.LevelInfo
+	}
+
+	ctx := context.Background()
+	if !clnt.Slog.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := ixp.FcallAttrs(fc)
+	if req.fid != nil && req.fid.User != nil {
+		attrs = append(attrs, slog.String("user", req.fid.User.Name()))
+	}
+
+	if fc == req.Rc {
+		attrs = append(attrs, slog.Duration("latency", time.Since(req.start)))
+	}
+
+	attrs = append(attrs, slog.String("fcall", fc.String()))
+	if clnt.Debuglevel&DbgPrintPackets != 0 {
+		attrs = append(attrs, slog.Any("packet", fc.Pkt))
+	}
+
+	clnt.Slog.LogAttrs(ctx, level, msg, attrs...)
+}
@@ -0,0 +1,144 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt_test
+
+import (
+	"context"
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A file whose reads block until the test releases them.
+type holdFile struct {
+	srv.File
+	started chan bool
+	release chan bool
+}
+
+func (f *holdFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	f.started <- true
+	<-f.release
+	return 0, nil
+}
+
+// A file server that records the tags of the requests, and passes
+// the flushed requests to the test, which decides when Rflush is
+// sent.
+type flushSrv struct {
+	*srv.Fsrv
+	sync.Mutex
+	tags    []uint16
+	flushes chan *srv.Req
+}
+
+func (s *flushSrv) ReqProcess(req *srv.Req) {
+	if req.Tc.Type != ixp.Tflush {
+		s.Lock()
+		s.tags = append(s.tags, req.Tc.Tag)
+		s.Unlock()
+	}
+
+	req.Process()
+}
+
+func (s *flushSrv) ReqRespond(req *srv.Req) {
+	req.PostProcess()
+}
+
+func (s *flushSrv) Flush(req *srv.Req) {
+	s.flushes <- req
+}
+
+// Returns true if a request with the tag was received since the last
+// call.
+func (s *flushSrv) used(tag uint16) bool {
+	s.Lock()
+	defer s.Unlock()
+	tags := s.tags
+	s.tags = nil
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestFlush(t *testing.T) {
+	root := srvtest.Root(t, 0777)
+	hf := &holdFile{started: make(chan bool, 1), release: make(chan bool)}
+	if err := root.Add(&hf.File, "f", srvtest.User(), nil, 0644, hf); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &flushSrv{Fsrv: srv.NewFileSrv(root), flushes: make(chan *srv.Req, 1)}
+	s.Dialect = ixp.Dialect9P2000u
+	if !s.Start(s) {
+		t.Fatal("can't start the file server")
+	}
+	t.Cleanup(func() { s.Close() })
+
+	c, unmount, err := srvtest.Loopback(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmount()
+
+	f, err := c.FOpen("/f", ixp.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.ReadContext(ctx, make([]byte, 64))
+		done <- err
+	}()
+
+	<-hf.started
+	cancel()
+	r := <-s.flushes
+	tag := r.Tc.Tag
+	s.used(tag)
+
+	/* the tag of the flushed request stays in use until Rflush */
+	for i := 0; i < 5; i++ {
+		if _, err := c.FStat("/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.used(tag) {
+		t.Errorf("tag %d reused before Rflush", tag)
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("read returned %v before Rflush", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	r.Flush()
+	close(hf.release)
+	if err := <-done; err != context.Canceled {
+		t.Errorf("flushed read: %v, want %v", err, context.Canceled)
+	}
+
+	/* the lowest free tag is handed out first */
+	if _, err := c.FStat("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.used(tag) {
+		t.Errorf("tag %d not reused after Rflush", tag)
+	}
+}
@@ -9,7 +9,14 @@ import "github.com/jsouthworth/ixp"
 // Clunks a fid. Returns nil if successful.
 func (clnt *Clnt) Clunk(fid *Fid) (err error) {
 	err = nil
-	if fid.walked {
+	clnt.fidForget(fid)
+	fid.Lock()
+	gen := fid.gen
+	fid.Unlock()
+	clnt.Lock()
+	stale := gen != 0 && gen != clnt.gen
+	clnt.Unlock()
+	if fid.walked && !stale {
 		tc := clnt.NewFcall()
 		err := ixp.PackTclunk(tc, fid.Fid)
 		if err != nil {
@@ -20,11 +27,23 @@ func (clnt *Clnt) Clunk(fid *Fid) (err error) {
 	}
 
 	clnt.fidpool.putId(fid.Fid)
+	clnt.clunkDir(fid)
 	fid.walked = false
 	fid.Fid = ixp.NOFID
 	return
 }
 
+// Clunks the clone of the directory kept by Lopen, if any.
+func (clnt *Clnt) clunkDir(fid *Fid) {
+	fid.Lock()
+	dir := fid.dir
+	fid.dir = nil
+	fid.Unlock()
+	if dir != nil {
+		clnt.Clunk(dir)
+	}
+}
+
 // Closes a file. Returns nil if successful.
 func (file *File) Close() error {
 	// Should we cancel all pending requests for the File
@@ -0,0 +1,67 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"github.com/jsouthworth/ixp"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// The cmdStream type closes the pipes of a subprocess and
+// waits for it to exit.
+type cmdStream struct {
+	ixp.AddrTransport
+	cmd *exec.Cmd
+}
+
+func (s *cmdStream) Close() error {
+	err := s.AddrTransport.Close()
+	go s.cmd.Wait()
+	return err
+}
+
+// Starts a file server as a subprocess and mounts it. The server
+// should serve 9P on its standard input and output (see srv.ServeConn),
+// no sockets are involved. cmd.Stderr is left as set by the caller.
+// Unmount closes the pipes, which should make the server exit.
+func MountCmd(cmd *exec.Cmd, aname string, user ixp.User) (*Clnt, error) {
+	c, err := StartCmd(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	clnt, err := MountConn(c, aname, user)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return clnt, nil
+}
+
+// Starts the command and returns a transport connected to its
+// standard input and output.
+func StartCmd(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, &ixp.Error{err.Error(), ixp.EIO}
+	}
+
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		w.Close()
+		return nil, &ixp.Error{err.Error(), ixp.EIO}
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, &ixp.Error{err.Error(), ixp.EIO}
+	}
+
+	addr := &ixp.Addr{"cmd", strings.Join(cmd.Args, " ")}
+	return &cmdStream{ixp.NewStream(r, w, nil, addr), cmd}, nil
+}
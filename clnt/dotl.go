@@ -0,0 +1,565 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"context"
+	"github.com/jsouthworth/ixp"
+	"path"
+	"strings"
+)
+
+// Converts 9P2000 open mode to 9P2000.L open flags.
+func lopenFlags(mode uint8) uint32 {
+	flags := uint32(mode & 3)
+	if flags == ixp.OEXEC {
+		flags = ixp.LO_RDONLY
+	}
+
+	if mode&ixp.OTRUNC != 0 {
+		flags |= ixp.LO_TRUNC
+	}
+
+	return flags
+}
+
+// Returns the group ID sent in the 9P2000.L requests that create files
+// for the user.
+func userGid(user ixp.User) uint32 {
+	if user == nil {
+		return ixp.NOUID
+	}
+
+	if groups := user.Groups(); len(groups) > 0 {
+		return uint32(groups[0].Id())
+	}
+
+	return uint32(user.Id())
+}
+
+// Returns the name of the file associated with the fid, "/" for the
+// attach point.
+func (fid *Fid) name() string {
+	fid.Lock()
+	p := path.Clean("/" + strings.Join(fid.path, "/"))
+	fid.Unlock()
+	return path.Base(p)
+}
+
+// Implements Create for 9P2000.L. Files are created with Tlcreate,
+// directories with Tmkdir, followed by a walk to the new directory and
+// Tlopen. The special files can't be created with Create.
+func (clnt *Clnt) lcreate(fid *Fid, name string, perm uint32, mode uint8) error {
+	gid := userGid(fid.User)
+	switch {
+	case perm&ixp.DMDIR != 0:
+		_, err := clnt.Mkdir(fid, name, ixp.LinuxMode(perm)&07777, gid)
+		if err != nil {
+			return err
+		}
+
+		_, err = clnt.Walk(fid, fid, []string{name})
+		if err != nil {
+			return err
+		}
+
+		return clnt.Lopen(fid, lopenFlags(mode))
+
+	case perm&(ixp.DMSYMLINK|ixp.DMLINK|ixp.DMDEVICE|ixp.DMNAMEDPIPE|ixp.DMSOCKET) != 0:
+		return &ixp.Error{"use Symlink, Link or Mknod to create special files", ixp.EINVAL}
+	}
+
+	flags := lopenFlags(mode) | ixp.LO_CREAT | ixp.LO_EXCL
+	return clnt.Lcreate(fid, name, flags, ixp.LinuxMode(perm)&07777, gid)
+}
+
+// Implements Stat for 9P2000.L with Tgetattr.
+func (clnt *Clnt) lstat(ctx context.Context, fid *Fid) (*ixp.Dir, error) {
+	attr, err := clnt.GetattrContext(ctx, fid, ixp.GETATTR_BASIC)
+	if err != nil {
+		return nil, err
+	}
+
+	return attr.Dir(fid.name()), nil
+}
+
+// Reads the entries of the directory associated with the File with a
+// single Treaddir, starting at the offset of the File. Returns at most
+// num entries (all entries read if num is 0), and true if the end of
+// the directory was reached. The "." and ".." entries are skipped.
+func (file *File) readdirChunk(ctx context.Context, num int) ([]*ixp.Dir, bool, error) {
+	clnt := file.fid.Clnt
+	ents, err := clnt.ReaddirContext(ctx, file.fid, file.offset, file.fid.Iounit)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(ents) == 0 {
+		return nil, true, nil
+	}
+
+	var dents []*ixp.Dirent
+	for _, d := range ents {
+		if num > 0 && len(dents) >= num {
+			break
+		}
+
+		file.offset = d.Offset
+		if d.Name != "." && d.Name != ".." {
+			dents = append(dents, d)
+		}
+	}
+
+	dirs, err := clnt.direntDirs(ctx, file.fid, dents)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return dirs, false, nil
+}
+
+// Converts the entries read from the directory associated with the
+// opened fid to Dirs. The attributes of each entry are read with
+// Tgetattr through a fid walked from the clone of the directory kept
+// by Lopen. If the entry can't be walked or stat'ed because the server
+// returned an error (for example the entry was removed after the
+// directory was read), or the fid wasn't opened with Lopen, only the
+// fields known from the entry (name, Qid and mode type bits) are set.
+// Other errors, like a cancelled context, are returned.
+func (clnt *Clnt) direntDirs(ctx context.Context, fid *Fid, dents []*ixp.Dirent) ([]*ixp.Dir, error) {
+	dirs := make([]*ixp.Dir, len(dents))
+	for i, d := range dents {
+		dirs[i] = d.Dir()
+	}
+
+	fid.Lock()
+	dir := fid.dir
+	fid.Unlock()
+	if dir == nil {
+		return dirs, nil
+	}
+
+	for i, d := range dents {
+		efid, _, err := clnt.walkAll(ctx, dir, []string{d.Name})
+		if err == nil {
+			var attr *ixp.Attr
+			attr, err = clnt.GetattrContext(ctx, efid, ixp.GETATTR_BASIC)
+			clnt.Clunk(efid)
+			if err == nil {
+				dirs[i] = attr.Dir(d.Name)
+				continue
+			}
+		}
+
+		if _, ok := err.(*ixp.Error); !ok {
+			return nil, err
+		}
+	}
+
+	return dirs, nil
+}
+
+func (clnt *Clnt) setIounit(fid *Fid, iounit uint32) {
+	fid.Iounit = iounit
+	if fid.Iounit == 0 || fid.Iounit > clnt.Msize-ixp.IOHDRSZ {
+		fid.Iounit = clnt.Msize - ixp.IOHDRSZ
+	}
+}
+
+// Returns the file system information for the file system containing
+// the file associated with the fid, or an Error.
+func (clnt *Clnt) Statfs(fid *Fid) (*ixp.Statfs, error) {
+	tc := clnt.NewFcall()
+	err := ixp.PackTstatfs(tc, fid.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Statfs, nil
+}
+
+// Opens the file associated with the fid using Linux open flags
+// (ixp.LO_* values). Returns nil if the operation is successful. If
+// the fid is a directory, an unopened clone of it is kept until the fid
+// is clunked, to stat the entries read by File.Readdir.
+func (clnt *Clnt) Lopen(fid *Fid, flags uint32) error {
+	return clnt.LopenContext(context.Background(), fid, flags)
+}
+
+// Same as Lopen, but the request is flushed if the context is cancelled.
+func (clnt *Clnt) LopenContext(ctx context.Context, fid *Fid, flags uint32) error {
+	tc := clnt.NewFcall()
+	err := ixp.PackTlopen(tc, fid.Fid, flags)
+	if err != nil {
+		return err
+	}
+
+	/* the opened directory can't be walked to stat its entries, keep a clone */
+	var dir *Fid
+	if fid.Qid.Type&ixp.QTDIR != 0 {
+		dir, _, err = clnt.walkAll(ctx, fid, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		if dir != nil {
+			clnt.Clunk(dir)
+		}
+
+		return err
+	}
+
+	fid.Lock()
+	fid.dir = dir
+	fid.Unlock()
+	fid.Qid = rc.Qid
+	clnt.Cache.seen(rc.Qid)
+	clnt.setIounit(fid, rc.Iounit)
+	fid.Mode = uint8(flags & 3)
+	fid.opened = true
+	return nil
+}
+
+// Creates and opens a regular file in the directory associated with
+// the fid. After the call the fid points to the new file. Returns nil
+// if the operation is successful.
+func (clnt *Clnt) Lcreate(fid *Fid, name string, flags uint32, mode uint32, gid uint32) error {
+	tc := clnt.NewFcall()
+	err := ixp.PackTlcreate(tc, fid.Fid, name, flags, mode, gid)
+	if err != nil {
+		return err
+	}
+
+	rc, gen, err := clnt.rpcgen(context.Background(), tc)
+	if err != nil {
+		return err
+	}
+
+	fid.Qid = rc.Qid
+	clnt.setIounit(fid, rc.Iounit)
+	fid.Mode = uint8(flags & 3)
+	fid.opened = true
+	fid.setPath(fid.aname, append(append([]string(nil), fid.path...), name), gen)
+	clnt.Cache.renamed()
+	return nil
+}
+
+// Creates a symbolic link in the directory associated with the fid.
+// Returns the Qid of the link, or an Error.
+func (clnt *Clnt) Symlink(dfid *Fid, name, target string, gid uint32) (*ixp.Qid, error) {
+	tc := clnt.NewFcall()
+	err := ixp.PackTsymlink(tc, dfid.Fid, name, target, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	clnt.Cache.renamed()
+	return &rc.Qid, nil
+}
+
+// Creates a device node, named pipe or socket in the directory
+// associated with the fid. Returns the Qid of the node, or an Error.
+func (clnt *Clnt) Mknod(dfid *Fid, name string, mode, major, minor, gid uint32) (*ixp.Qid, error) {
+	tc := clnt.NewFcall()
+	err := ixp.PackTmknod(tc, dfid.Fid, name, mode, major, minor, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	clnt.Cache.renamed()
+	return &rc.Qid, nil
+}
+
+// Moves the file associated with the fid to the directory dfid with
+// the new name. Returns nil if the operation is successful.
+func (clnt *Clnt) Rename(fid, dfid *Fid, name string) error {
+	tc := clnt.NewFcall()
+	err := ixp.PackTrename(tc, fid.Fid, dfid.Fid, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	clnt.Cache.renamed()
+	return err
+}
+
+// Returns the target of the symbolic link associated with the fid, or
+// an Error.
+func (clnt *Clnt) Readlink(fid *Fid) (string, error) {
+	tc := clnt.NewFcall()
+	err := ixp.PackTreadlink(tc, fid.Fid)
+	if err != nil {
+		return "", err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return "", err
+	}
+
+	return rc.Target, nil
+}
+
+// Returns the attributes selected by mask (ixp.GETATTR_* values) for
+// the file associated with the fid, or an Error. The Valid field of
+// the result shows which of the attributes the server returned.
+func (clnt *Clnt) Getattr(fid *Fid, mask uint64) (*ixp.Attr, error) {
+	return clnt.GetattrContext(context.Background(), fid, mask)
+}
+
+// Same as Getattr, but the request is flushed if the context is
+// cancelled.
+func (clnt *Clnt) GetattrContext(ctx context.Context, fid *Fid, mask uint64) (*ixp.Attr, error) {
+	tc := clnt.NewFcall()
+	err := ixp.PackTgetattr(tc, fid.Fid, mask)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	clnt.Cache.seen(rc.Attr.Qid)
+	return &rc.Attr, nil
+}
+
+// Modifies the attributes of the file associated with the fid. Only
+// the attributes selected in attr.Valid are changed. Returns nil if
+// the operation is successful.
+func (clnt *Clnt) Setattr(fid *Fid, attr *ixp.SetAttr) error {
+	tc := clnt.NewFcall()
+	err := ixp.PackTsetattr(tc, fid.Fid, attr)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	clnt.Cache.changed(fid.Qid)
+	return err
+}
+
+// Prepares newfid for reading the extended attribute name of the file
+// associated with fid. If name is empty, newfid reads the list of the
+// attribute names. Returns the size of the attribute, or an Error.
+func (clnt *Clnt) Xattrwalk(fid, newfid *Fid, name string) (uint64, error) {
+	tc := clnt.NewFcall()
+	err := ixp.PackTxattrwalk(tc, fid.Fid, newfid.Fid, name)
+	if err != nil {
+		return 0, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return 0, err
+	}
+
+	newfid.Qid = fid.Qid
+	newfid.User = fid.User
+	newfid.Mode = ixp.OREAD
+	newfid.walked = true
+	newfid.norestore = true
+	clnt.setIounit(newfid, 0)
+	return rc.Xattrsize, nil
+}
+
+// Prepares the fid for writing the value of the extended attribute
+// name. The value is set when the fid is clunked. Returns nil if the
+// operation is successful.
+func (clnt *Clnt) Xattrcreate(fid *Fid, name string, size uint64, flags uint32) error {
+	tc := clnt.NewFcall()
+	err := ixp.PackTxattrcreate(tc, fid.Fid, name, size, flags)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	if err != nil {
+		return err
+	}
+
+	fid.Mode = ixp.OWRITE
+	fid.norestore = true
+	clnt.setIounit(fid, 0)
+	return nil
+}
+
+// Reads up to count bytes of directory entries from the open directory
+// associated with the fid, starting at offset. Returns the entries
+// read, or an Error. The following call should use the Offset of the
+// last entry.
+func (clnt *Clnt) Readdir(fid *Fid, offset uint64, count uint32) ([]*ixp.Dirent, error) {
+	return clnt.ReaddirContext(context.Background(), fid, offset, count)
+}
+
+// Same as Readdir, but the request is flushed if the context is
+// cancelled.
+func (clnt *Clnt) ReaddirContext(ctx context.Context, fid *Fid, offset uint64, count uint32) ([]*ixp.Dirent, error) {
+	if count > clnt.Msize-ixp.IOHDRSZ {
+		count = clnt.Msize - ixp.IOHDRSZ
+	}
+
+	tc := clnt.NewFcall()
+	err := ixp.PackTreaddir(tc, fid.Fid, offset, count)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirents []*ixp.Dirent
+	for b := rc.Data; len(b) > 0; {
+		d, sz, err := ixp.UnpackDirent(b)
+		if err != nil {
+			return dirents, err
+		}
+
+		dirents = append(dirents, d)
+		b = b[sz:]
+	}
+
+	return dirents, nil
+}
+
+// Flushes the data of the file associated with the fid to stable
+// storage. If datasync is true, only the data, but not the metadata is
+// flushed. Returns nil if the operation is successful.
+func (clnt *Clnt) Fsync(fid *Fid, datasync bool) error {
+	var ds uint32
+
+	if datasync {
+		ds = 1
+	}
+
+	tc := clnt.NewFcall()
+	err := ixp.PackTfsync(tc, fid.Fid, ds)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	return err
+}
+
+// Acquires or releases a POSIX byte range lock on the file associated
+// with the fid. Returns the status of the lock (one of ixp.LOCK_SUCCESS,
+// ixp.LOCK_BLOCKED, ixp.LOCK_ERROR or ixp.LOCK_GRACE), or an Error.
+func (clnt *Clnt) Flock(fid *Fid, lk *ixp.Flock) (uint8, error) {
+	tc := clnt.NewFcall()
+	err := ixp.PackTlock(tc, fid.Fid, lk)
+	if err != nil {
+		return 0, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return 0, err
+	}
+
+	return rc.Status, nil
+}
+
+// Tests for the existence of a POSIX byte range lock on the file
+// associated with the fid. Returns the conflicting lock, or a lock
+// with Type ixp.LOCK_TYPE_UNLCK if the lock could be placed.
+func (clnt *Clnt) Getlock(fid *Fid, lk *ixp.Flock) (*ixp.Flock, error) {
+	tc := clnt.NewFcall()
+	err := ixp.PackTgetlock(tc, fid.Fid, lk)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Flock, nil
+}
+
+// Creates a hard link with the specified name in the directory dfid
+// to the file associated with the fid. Returns nil if the operation
+// is successful.
+func (clnt *Clnt) Link(dfid, fid *Fid, name string) error {
+	tc := clnt.NewFcall()
+	err := ixp.PackTlink(tc, dfid.Fid, fid.Fid, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	clnt.Cache.renamed()
+	return err
+}
+
+// Creates a directory in the directory associated with the fid.
+// Returns the Qid of the new directory, or an Error.
+func (clnt *Clnt) Mkdir(dfid *Fid, name string, mode uint32, gid uint32) (*ixp.Qid, error) {
+	tc := clnt.NewFcall()
+	err := ixp.PackTmkdir(tc, dfid.Fid, name, mode, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.Rpc(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	clnt.Cache.renamed()
+	return &rc.Qid, nil
+}
+
+// Renames the file oldname in the directory olddir to newname in the
+// directory newdir. Returns nil if the operation is successful.
+func (clnt *Clnt) Renameat(olddir *Fid, oldname string, newdir *Fid, newname string) error {
+	tc := clnt.NewFcall()
+	err := ixp.PackTrenameat(tc, olddir.Fid, oldname, newdir.Fid, newname)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	clnt.Cache.renamed()
+	return err
+}
+
+// Removes the file name from the directory associated with the fid.
+// The flags can be ixp.AT_REMOVEDIR to remove a directory. Returns nil
+// if the operation is successful.
+func (clnt *Clnt) Unlinkat(dfid *Fid, name string, flags uint32) error {
+	tc := clnt.NewFcall()
+	err := ixp.PackTunlinkat(tc, dfid.Fid, name, flags)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.Rpc(tc)
+	clnt.Cache.renamed()
+	return err
+}
@@ -0,0 +1,269 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt_test
+
+import (
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// A 9P2000.L server for a tree of synthetic files. Only the messages
+// used by Open, Create, Stat and Readdir are implemented.
+type lsrv struct {
+	*srv.Fsrv
+	sync.Mutex
+	user  ixp.User
+	names map[*srv.File][]string // names of the children, in the order of the entries
+	nmsgs map[uint8]int          // number of messages received, by type
+}
+
+func (s *lsrv) count(req *srv.Req) {
+	s.Lock()
+	s.nmsgs[req.Tc.Type]++
+	s.Unlock()
+}
+
+func (s *lsrv) add(dir *srv.File, name string, mode uint32) (*srv.File, error) {
+	f := new(srv.File)
+	if err := dir.Add(f, name, s.user, nil, mode, nil); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	s.names[dir] = append(s.names[dir], name)
+	s.Unlock()
+	return f, nil
+}
+
+func (s *lsrv) Lopen(req *srv.Req) {
+	s.count(req)
+	req.RespondRlopen(&req.Fid.Aux.(*srv.FFid).F.Qid, 0)
+}
+
+func (s *lsrv) Lcreate(req *srv.Req) {
+	s.count(req)
+	fid := req.Fid.Aux.(*srv.FFid)
+	f, err := s.add(fid.F, req.Tc.Name, ixp.AttrMode(req.Tc.Perm))
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	fid.F = f
+	req.RespondRlcreate(&f.Qid, 0)
+}
+
+func (s *lsrv) Mkdir(req *srv.Req) {
+	s.count(req)
+	fid := req.Fid.Aux.(*srv.FFid)
+	f, err := s.add(fid.F, req.Tc.Name, ixp.DMDIR|ixp.AttrMode(req.Tc.Perm))
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRmkdir(&f.Qid)
+}
+
+func (s *lsrv) Getattr(req *srv.Req) {
+	s.count(req)
+	f := req.Fid.Aux.(*srv.FFid).F
+	attr := &ixp.Attr{
+		Valid:    ixp.GETATTR_BASIC,
+		Qid:      f.Qid,
+		Mode:     ixp.LinuxMode(f.Mode),
+		Uid:      1000,
+		Gid:      100,
+		Nlink:    1,
+		Size:     f.Length,
+		MtimeSec: uint64(f.Mtime),
+	}
+
+	req.RespondRgetattr(attr)
+}
+
+func (s *lsrv) Readdir(req *srv.Req) {
+	s.count(req)
+	dir := req.Fid.Aux.(*srv.FFid).F
+	s.Lock()
+	names := append([]string{".", ".."}, s.names[dir]...)
+	s.Unlock()
+
+	var dirents []ixp.Dirent
+	for i := int(req.Tc.Offset); i < len(names); i++ {
+		d := ixp.Dirent{Qid: dir.Qid, Offset: uint64(i + 1), Type: uint8(ixp.S_IFDIR >> 12), Name: names[i]}
+		if f := dir.Find(names[i]); f != nil {
+			d.Qid = f.Qid
+			d.Type = uint8(ixp.LinuxMode(f.Mode) >> 12)
+		}
+
+		dirents = append(dirents, d)
+	}
+
+	req.RespondRreaddir(dirents)
+}
+
+func (s *lsrv) enosys(req *srv.Req) {
+	req.RespondError(syscall.ENOSYS)
+}
+
+func (s *lsrv) Statfs(req *srv.Req)      { s.enosys(req) }
+func (s *lsrv) Symlink(req *srv.Req)     { s.enosys(req) }
+func (s *lsrv) Mknod(req *srv.Req)       { s.enosys(req) }
+func (s *lsrv) Rename(req *srv.Req)      { s.enosys(req) }
+func (s *lsrv) Readlink(req *srv.Req)    { s.enosys(req) }
+func (s *lsrv) Setattr(req *srv.Req)     { s.enosys(req) }
+func (s *lsrv) Xattrwalk(req *srv.Req)   { s.enosys(req) }
+func (s *lsrv) Xattrcreate(req *srv.Req) { s.enosys(req) }
+func (s *lsrv) Fsync(req *srv.Req)       { s.enosys(req) }
+func (s *lsrv) Flock(req *srv.Req)       { s.enosys(req) }
+func (s *lsrv) Getlock(req *srv.Req)     { s.enosys(req) }
+func (s *lsrv) Link(req *srv.Req)        { s.enosys(req) }
+func (s *lsrv) Renameat(req *srv.Req)    { s.enosys(req) }
+func (s *lsrv) Unlinkat(req *srv.Req)    { s.enosys(req) }
+
+func TestDotl(t *testing.T) {
+	user := srvtest.User()
+	root := srvtest.Root(t, 0777)
+	s := &lsrv{user: user, names: make(map[*srv.File][]string), nmsgs: make(map[uint8]int)}
+	s.Fsrv = srv.NewFileSrv(root)
+	s.Dialect = ixp.Dialect9P2000L
+	if !s.Start(s) {
+		t.Fatal("Start failed")
+	}
+
+	sc, cc := srvtest.Pipe(nil)
+	s.NewConn(sc)
+	c, err := clnt.MountConnDialect(cc, "", user, ixp.Dialect9P2000L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Unmount()
+
+	if c.Dialect != ixp.Dialect9P2000L {
+		t.Fatalf("dialect %v, want 9P2000.L", c.Dialect)
+	}
+
+	f, err := c.FCreate("/file", 0640, ixp.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	d, err := c.FCreate("/dir", ixp.DMDIR|0750, ixp.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	st, err := c.FStat("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Name != "dir" || st.Mode != ixp.DMDIR|0750 || st.Uid != "1000" || st.Gidnum != 100 {
+		t.Errorf("stat of /dir: %v", st)
+	}
+
+	dir, err := c.FOpen("/", ixp.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	dirs, err := dir.Readdir(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name < dirs[j].Name })
+	if len(dirs) != 2 || dirs[0].Name != "dir" || dirs[1].Name != "file" {
+		t.Fatalf("readdir: %v", dirs)
+	}
+
+	if dirs[0].Mode != ixp.DMDIR|0750 || dirs[1].Mode != 0640 || dirs[1].Uid != "1000" {
+		t.Errorf("readdir: %v", dirs)
+	}
+
+	/* the errno of the server's error is sent in Rlerror */
+	_, err = c.Statfs(c.Root)
+	if e, ok := err.(*ixp.Error); !ok || e.Errornum != uint32(syscall.ENOSYS) {
+		t.Errorf("Statfs: %v, want ENOSYS", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for _, typ := range []uint8{ixp.Tlcreate, ixp.Tmkdir, ixp.Tlopen, ixp.Tgetattr, ixp.Treaddir} {
+		if s.nmsgs[typ] == 0 {
+			t.Errorf("no %s received", ixp.TypeName(typ))
+		}
+	}
+}
+
+func TestDotlReaddir(t *testing.T) {
+	user := srvtest.User()
+	root := srvtest.Root(t, 0777)
+	s := &lsrv{user: user, names: make(map[*srv.File][]string), nmsgs: make(map[uint8]int)}
+	s.Fsrv = srv.NewFileSrv(root)
+	s.Dialect = ixp.Dialect9P2000L
+	if !s.Start(s) {
+		t.Fatal("Start failed")
+	}
+
+	sc, cc := srvtest.Pipe(nil)
+	s.NewConn(sc)
+	c, err := clnt.MountConnDialect(cc, "", user, ixp.Dialect9P2000L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Unmount()
+
+	d, err := s.add(root, "dir", ixp.DMDIR|0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.add(d, "a", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	/* an entry that can't be walked keeps the fields of the dirent */
+	s.Lock()
+	s.names[d] = append(s.names[d], "gone")
+	s.Unlock()
+
+	dir, err := c.FOpen("/dir", ixp.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	/* the entries are stat'ed through the directory, not its path from the root */
+	croot := c.Root
+	c.Root = nil
+	dirs, err := dir.Readdir(0)
+	c.Root = croot
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dirs) != 2 || dirs[0].Name != "a" || dirs[1].Name != "gone" {
+		t.Fatalf("readdir: %v", dirs)
+	}
+
+	if dirs[0].Mode != 0600 || dirs[0].Uid != "1000" {
+		t.Errorf("readdir of a: %v", dirs[0])
+	}
+
+	if dirs[1].Uid != "" {
+		t.Errorf("readdir of gone: %v", dirs[1])
+	}
+}
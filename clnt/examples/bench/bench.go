@@ -0,0 +1,186 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Measures the throughput and the allocations of the Tread and Twrite
+// messages, both for packing and unpacking only, and for a client
+// talking to a file server over a pipe or a TCP connection.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/srv"
+	"log"
+	"net"
+	"os"
+	"testing"
+)
+
+var network = flag.String("net", "pipe", "transport to use: pipe or tcp")
+var codec = flag.Bool("codec", true, "run the pack/unpack benchmarks")
+var rpc = flag.Bool("rpc", true, "run the client/server benchmarks")
+
+var msizes = []uint32{8192, 65536, 262144, 1048576}
+
+// File that reads as zeroes and discards the data written to it.
+type Zero struct {
+	srv.File
+}
+
+func (*Zero) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	return len(buf), nil
+}
+
+func (*Zero) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
+	return len(data), nil
+}
+
+func report(name string, msize uint32, r testing.BenchmarkResult) {
+	fmt.Printf("%-12s msize %8d %s %s\n", name, msize, r.String(), r.MemString())
+}
+
+func benchCodec(msize uint32) {
+	data := make([]byte, msize-ixp.IOHDRSZ)
+
+	report("pack Tread", msize, testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		tc := ixp.AllocFcall(msize)
+		rc := ixp.AllocFcall(msize)
+		for i := 0; i < b.N; i++ {
+			ixp.PackTread(tc, 1, uint64(i), uint32(len(data)))
+			ixp.UnpackInto(rc, tc.Pkt, true)
+		}
+	}))
+
+	report("pack Twrite", msize, testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		tc := ixp.AllocFcall(msize)
+		rc := ixp.AllocFcall(msize)
+		for i := 0; i < b.N; i++ {
+			ixp.PackTwrite(tc, 1, uint64(i), uint32(len(data)), data)
+			ixp.UnpackInto(rc, tc.Pkt, true)
+		}
+	}))
+}
+
+// Starts a file server with a single file and mounts it with the
+// specified msize.
+func mount(msize uint32) (*clnt.Clnt, func(), error) {
+	user := ixp.OsUsers.Uid2User(os.Geteuid())
+	root := new(srv.File)
+	err := root.Add(root, "/", user, nil, ixp.DMDIR|0555, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	zero := new(Zero)
+	err = root.Add(&zero.File, "zero", user, nil, 0666, zero)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := srv.NewFileSrv(root)
+	s.Dialect = ixp.Dialect9P2000u
+	s.Msize = msizes[len(msizes)-1] + ixp.IOHDRSZ
+	s.NoCopy = true // the zero file doesn't keep the data
+	s.Start(s)
+
+	var c net.Conn
+	switch *network {
+	case "pipe":
+		var sc net.Conn
+		c, sc = net.Pipe()
+		s.NewConn(sc)
+
+	case "tcp":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		go s.Serve(l)
+		c, err = net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			s.Close()
+			return nil, nil, err
+		}
+
+	default:
+		return nil, nil, &ixp.Error{"unknown transport", ixp.EINVAL}
+	}
+
+	cl, err := clnt.Connect(c, msize, true)
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+
+	cl.Root, err = cl.Attach(nil, user, "")
+	if err != nil {
+		cl.Unmount()
+		s.Close()
+		return nil, nil, err
+	}
+
+	return cl, func() { cl.Unmount(); s.Close() }, nil
+}
+
+func benchRpc(msize uint32) error {
+	c, done, err := mount(msize)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	file, err := c.FOpen("/zero", ixp.ORDWR)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := make([]byte, msize-ixp.IOHDRSZ)
+	report("Tread", msize, testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(buf)))
+		for i := 0; i < b.N; i++ {
+			_, err := file.ReadAt(buf, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}))
+
+	report("Twrite", msize, testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(buf)))
+		for i := 0; i < b.N; i++ {
+			_, err := file.WriteAt(buf, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}))
+
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	for _, msize := range msizes {
+		if *codec {
+			benchCodec(msize)
+		}
+
+		if *rpc {
+			err := benchRpc(msize)
+			if err != nil {
+				log.Println(fmt.Sprintf("Error: %s", err))
+				return
+			}
+		}
+	}
+}
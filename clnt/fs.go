@@ -0,0 +1,322 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"context"
+	"errors"
+	"github.com/jsouthworth/ixp"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The FS type presents the file tree of a mounted client as io/fs
+// file system. It implements fs.FS, fs.StatFS, fs.ReadDirFS and
+// fs.ReadFileFS. The names are resolved relative to clnt.Root. The
+// files are opened for reading only.
+type FS struct {
+	Clnt *Clnt
+}
+
+// The fsFile type implements fs.File, fs.ReadDirFile, io.ReaderAt
+// and io.Seeker for a file opened through FS.
+type fsFile struct {
+	*File
+	name string
+	dir  *ixp.Dir
+	ents []*ixp.Dir // directory entries read, but not returned yet
+	eof  bool       // true if all directory entries were read
+	done bool       // true if the file was closed
+}
+
+// Returns an io/fs view of the files served by the client.
+func (clnt *Clnt) FS() *FS {
+	return &FS{clnt}
+}
+
+// Converts 9P errors to the io/fs errors, so they can be
+// checked with errors.Is.
+func fsError(op, name string, err error) error {
+	if e, ok := err.(*ixp.Error); ok {
+		switch {
+		case e.Errornum == ixp.ENOENT, strings.Contains(e.Err, "not found"),
+			strings.Contains(e.Err, "does not exist"):
+			err = fs.ErrNotExist
+
+		case e.Errornum == ixp.EPERM, e.Errornum == ixp.EACCES,
+			strings.Contains(e.Err, "permission denied"):
+			err = fs.ErrPermission
+
+		case e.Errornum == ixp.EEXIST, strings.Contains(e.Err, "exists"):
+			err = fs.ErrExist
+		}
+	}
+
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func fsPath(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		return "", nil
+	}
+
+	return name, nil
+}
+
+// Opens the named file for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	p, err := fsPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	clnt := fsys.Clnt
+	fid, err := clnt.FWalk(p)
+	if err != nil {
+		return nil, fsError("open", name, err)
+	}
+
+	d, err := clnt.Stat(fid)
+	if err == nil {
+		err = clnt.Open(fid, ixp.OREAD)
+	}
+
+	if err != nil {
+		clnt.Clunk(fid)
+		return nil, fsError("open", name, err)
+	}
+
+	d.Name = path.Base(name)
+	return &fsFile{File: &File{fid: fid}, name: name, dir: d}, nil
+}
+
+// Returns the metadata of the named file.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	p, err := fsPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := fsys.Clnt.FStat(p)
+	if err != nil {
+		return nil, fsError("stat", name, err)
+	}
+
+	d.Name = path.Base(name)
+	return d.FileInfo(), nil
+}
+
+// Reads the named directory and returns its entries sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ff := f.(*fsFile)
+	if !ff.dir.FileInfo().IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	ents, err := ff.ReadDir(-1)
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
+	return ents, err
+}
+
+// Reads the named file and returns its content.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	/* the length is only a hint, don't trust it for the allocation */
+	ff := f.(*fsFile)
+	size := ff.dir.Length
+	if size > 1<<20 {
+		size = 1 << 20
+	}
+
+	buf := make([]byte, 0, size)
+	b := make([]byte, ff.fid.Iounit)
+	for {
+		n, err := ff.Read(b)
+		buf = append(buf, b[0:n]...)
+		if err == io.EOF {
+			return buf, nil
+		}
+
+		if err != nil {
+			return buf, err
+		}
+	}
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.dir.FileInfo(), nil
+}
+
+// Closes the file. Closing the file more than once returns
+// fs.ErrClosed.
+func (f *fsFile) Close() error {
+	if f.done {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	f.done = true
+	return f.File.Close()
+}
+
+func (f *fsFile) Read(buf []byte) (int, error) {
+	if f.dir.Mode&ixp.DMDIR != 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	n, err := f.File.Read(buf)
+	if err != nil && err != io.EOF {
+		err = fsError("read", f.name, err)
+	}
+
+	return n, err
+}
+
+func (f *fsFile) WriteTo(w io.Writer) (int64, error) {
+	if f.dir.Mode&ixp.DMDIR != 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+
+	n, err := f.File.WriteTo(w)
+	if err != nil {
+		err = fsError("read", f.name, err)
+	}
+
+	return n, err
+}
+
+func (f *fsFile) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "readat", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	ret := 0
+	for len(buf) > 0 {
+		n, err := f.File.ReadAt(buf, offset)
+		ret += n
+		if err == io.EOF {
+			return ret, err
+		}
+
+		if err != nil {
+			return ret, fsError("readat", f.name, err)
+		}
+
+		buf = buf[n:]
+		offset += int64(n)
+	}
+
+	return ret, nil
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+
+	case io.SeekCurrent:
+		offset += int64(f.offset)
+
+	case io.SeekEnd:
+		offset += int64(f.dir.Length)
+
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	f.offset = uint64(offset)
+	return offset, nil
+}
+
+// Reads the next directory chunk from the server.
+func (f *fsFile) readChunk() error {
+	if f.fid.Clnt.Dialect == ixp.Dialect9P2000L {
+		d, eof, err := f.File.readdirChunk(context.Background(), 0)
+		if err != nil {
+			return fsError("readdir", f.name, err)
+		}
+
+		f.eof = eof
+		f.ents = append(f.ents, d...)
+		return nil
+	}
+
+	buf := make([]byte, f.fid.Iounit)
+	n, err := f.File.Read(buf)
+	if err == io.EOF || (err == nil && n == 0) {
+		f.eof = true
+		return nil
+	}
+
+	if err != nil {
+		return fsError("readdir", f.name, err)
+	}
+
+	for b := buf[0:n]; len(b) > 0; {
+		d, err := ixp.UnpackDir(b, f.fid.Clnt.Dotu())
+		if err != nil {
+			return fsError("readdir", f.name, err)
+		}
+
+		b = b[d.Size+2:]
+		f.ents = append(f.ents, d)
+	}
+
+	return nil
+}
+
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.dir.Mode&ixp.DMDIR == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+
+	for !f.eof && (n <= 0 || len(f.ents) < n) {
+		err := f.readChunk()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m := len(f.ents)
+	if n > 0 && m > n {
+		m = n
+	}
+
+	ents := make([]fs.DirEntry, m)
+	for i := 0; i < m; i++ {
+		ents[i] = f.ents[i].DirEntry()
+	}
+	f.ents = f.ents[m:]
+
+	if n > 0 && m == 0 {
+		return ents, io.EOF
+	}
+
+	return ents, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt_test
+
+import (
+	"errors"
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+// A file with fixed content.
+type dataFile struct {
+	srv.File
+	data []byte
+}
+
+func (f *dataFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	if offset >= uint64(len(f.data)) {
+		return 0, nil
+	}
+
+	return copy(buf, f.data[offset:]), nil
+}
+
+func TestFS(t *testing.T) {
+	user := srvtest.User()
+	root := srvtest.Root(t, 0777)
+	dir := new(srv.File)
+	if err := root.Add(dir, "dir", user, nil, ixp.DMDIR|0755, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]*srv.File{"a": root, "dir/b": dir}
+	for name, parent := range files {
+		f := &dataFile{data: []byte("content of " + name)}
+		if err := parent.Add(&f.File, name[len(name)-1:], user, nil, 0644, f); err != nil {
+			t.Fatal(err)
+		}
+
+		f.Length = uint64(len(f.data))
+	}
+
+	c, unmount, err := srvtest.Loopback(srvtest.FileSrv(t, root), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmount()
+
+	fsys := c.FS()
+	if err := fstest.TestFS(fsys, "a", "dir/b"); err != nil {
+		t.Error(err)
+	}
+
+	/* a file that claims to be much bigger than it is */
+	big := &dataFile{data: []byte("small")}
+	if err := root.Add(&big.File, "big", user, nil, 0644, big); err != nil {
+		t.Fatal(err)
+	}
+	big.Length = 1 << 40
+
+	data, err := fsys.ReadFile("big")
+	if err != nil || string(data) != "small" {
+		t.Errorf("ReadFile: %q %v", data, err)
+	}
+
+	f, err := fsys.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.(io.Seeker).Seek(0, 42); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Seek with an invalid whence: %v", err)
+	}
+}
@@ -5,16 +5,27 @@
 package clnt
 
 import (
+	"context"
 	"github.com/jsouthworth/ixp"
+	"io"
 	"net"
 )
 
+// The Authenticator interface is implemented by the client side of the
+// authentication protocols. Authenticate is called with the authentication
+// fid, and should carry out the conversation with the server by reading
+// from and writing to it. It should return nil if the server accepted
+// the user.
+type Authenticator interface {
+	Authenticate(afid io.ReadWriter, user ixp.User, aname string) error
+}
+
 // Creates an authentication fid for the specified user. Returns the fid, if
 // successful, or an Error.
 func (clnt *Clnt) Auth(user ixp.User, aname string) (*Fid, error) {
 	fid := clnt.FidAlloc()
 	tc := clnt.NewFcall()
-	err := ixp.PackTauth(tc, fid.Fid, user.Name(), aname, uint32(user.Id()), clnt.Dotu)
+	err := ixp.PackTauth(tc, fid.Fid, user.Name(), aname, uint32(user.Id()), clnt.Dotu())
 	if err != nil {
 		return nil, err
 	}
@@ -26,6 +37,8 @@ func (clnt *Clnt) Auth(user ixp.User, aname string) (*Fid, error) {
 
 	fid.User = user
 	fid.walked = true
+	fid.norestore = true
+	clnt.setIounit(fid, 0)
 	return fid, nil
 }
 
@@ -33,6 +46,12 @@ func (clnt *Clnt) Auth(user ixp.User, aname string) (*Fid, error) {
 // of the file server's file tree. Returns a Fid pointing to the root,
 // if successful, or an Error.
 func (clnt *Clnt) Attach(afid *Fid, user ixp.User, aname string) (*Fid, error) {
+	return clnt.AttachContext(context.Background(), afid, user, aname)
+}
+
+// Same as Attach, but the request is flushed if the context is
+// cancelled.
+func (clnt *Clnt) AttachContext(ctx context.Context, afid *Fid, user ixp.User, aname string) (*Fid, error) {
 	var afno uint32
 
 	if afid != nil {
@@ -43,39 +62,77 @@ func (clnt *Clnt) Attach(afid *Fid, user ixp.User, aname string) (*Fid, error) {
 
 	fid := clnt.FidAlloc()
 	tc := clnt.NewFcall()
-	err := ixp.PackTattach(tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), clnt.Dotu)
+	err := ixp.PackTattach(tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), clnt.Dotu())
 	if err != nil {
 		return nil, err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, gen, err := clnt.rpcgen(ctx, tc)
 	if err != nil {
+		clnt.fidpool.putId(fid.Fid)
 		return nil, err
 	}
 
 	fid.Qid = rc.Qid
 	fid.User = user
 	fid.walked = true
+	fid.norestore = afid != nil
+	fid.setPath(aname, nil, gen)
 	return fid, nil
 }
 
 // Connects to a file server and attaches to it as the specified user.
 func Mount(ntype, addr, aname string, user ixp.User) (*Clnt, error) {
+	return MountAuth(ntype, addr, aname, user, nil)
+}
+
+// Connects to a file server, authenticates the user using auth and
+// attaches to it using the authentication fid. If auth is nil, the
+// user is not authenticated.
+func MountAuth(ntype, addr, aname string, user ixp.User, auth Authenticator) (*Clnt, error) {
 	c, e := net.Dial(ntype, addr)
 	if e != nil {
 		return nil, &ixp.Error{e.Error(), ixp.EIO}
 	}
 
-	return MountConn(c, aname, user)
+	return MountConnAuth(c, aname, user, ixp.Dialect9P2000u, auth)
+}
+
+func MountConn(c io.ReadWriteCloser, aname string, user ixp.User) (*Clnt, error) {
+	return MountConnDialect(c, aname, user, ixp.Dialect9P2000u)
 }
 
-func MountConn(c net.Conn, aname string, user ixp.User) (*Clnt, error) {
-	clnt, err := Connect(c, 8192+ixp.IOHDRSZ, true)
+// Same as MountConn, but negotiates the specified dialect with the server.
+func MountConnDialect(c io.ReadWriteCloser, aname string, user ixp.User, dialect ixp.Dialect) (*Clnt, error) {
+	return MountConnAuth(c, aname, user, dialect, nil)
+}
+
+// Same as MountConnDialect, but authenticates the user using auth
+// before attaching. If auth is nil, the user is not authenticated.
+func MountConnAuth(c io.ReadWriteCloser, aname string, user ixp.User, dialect ixp.Dialect, auth Authenticator) (*Clnt, error) {
+	clnt, err := ConnectDialect(c, 8192+ixp.IOHDRSZ, dialect)
 	if err != nil {
 		return nil, err
 	}
 
-	fid, err := clnt.Attach(nil, user, aname)
+	var afid *Fid
+	if auth != nil {
+		afid, err = clnt.Auth(user, aname)
+		if err == nil {
+			err = auth.Authenticate(&File{fid: afid}, user, aname)
+		}
+
+		if err != nil {
+			clnt.Unmount()
+			return nil, err
+		}
+	}
+
+	fid, err := clnt.Attach(afid, user, aname)
+	if afid != nil {
+		clnt.Clunk(afid)
+	}
+
 	if err != nil {
 		clnt.Unmount()
 		return nil, err
@@ -88,7 +145,12 @@ func MountConn(c net.Conn, aname string, user ixp.User) (*Clnt, error) {
 // Closes the connection to the file sever.
 func (clnt *Clnt) Unmount() {
 	clnt.Lock()
+	lost := clnt.err == Edisconnected
 	clnt.err = &ixp.Error{"connection closed", ixp.EIO}
+	clnt.unmounted = true
 	clnt.conn.Close()
 	clnt.Unlock()
+	if lost {
+		clnt.statsUnlink()
+	}
 }
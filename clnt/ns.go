@@ -0,0 +1,584 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/jsouthworth/ixp"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Flags for Bind and Mount.
+const (
+	MREPL   = 0x0000 // replace the old file
+	MBEFORE = 0x0001 // add the new file before the old one in the union
+	MAFTER  = 0x0002 // add the new file after the old one in the union
+	MORDER  = 0x0003 // mask for the flags above
+	MCREATE = 0x0004 // files created in the union are created in the new file
+)
+
+// The Server interface is implemented by the local file servers that
+// can be mounted in a namespace, for example srv.Srv and the types
+// that embed it.
+type Server interface {
+	NewConn(c io.ReadWriteCloser)
+}
+
+// The Namespace type composes the file trees of several clients into
+// a single tree, as a Plan 9 process namespace. The file trees are
+// mounted, and the files of the namespace bound, at arbitrary paths.
+// If more than one directory is mounted at the same path, the path is
+// a union directory. The names in a union are looked up in the
+// directories in order, Readdir returns the files of all of them, and
+// the files are created in the first directory mounted with MCREATE.
+//
+// The paths are cleaned lexically (see path.Clean) before they are
+// resolved. The mount points are identified by their paths.
+type Namespace struct {
+	sync.Mutex
+	mounts map[string][]*nsMount // unions, by mount point
+	clnts  map[*Clnt]bool        // clients unmounted by Close
+}
+
+// The nsMount type represents a directory mounted in a union.
+type nsMount struct {
+	fid    *Fid // walked to the directory, owned by the namespace
+	create bool // files are created in this directory
+}
+
+// Creates an empty namespace. The first file tree should be mounted
+// at "/".
+func NewNamespace() *Namespace {
+	ns := new(Namespace)
+	ns.mounts = make(map[string][]*nsMount)
+	ns.clnts = make(map[*Clnt]bool)
+	return ns
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// Returns the union mounted at the longest mount point that is a prefix
+// of the path, and the names of the path after the mount point.
+func (ns *Namespace) lookup(p string) ([]*nsMount, []string) {
+	ns.Lock()
+	defer ns.Unlock()
+	union := ns.mounts["/"]
+	var names []string
+	cur := "/"
+	for _, name := range splitPath(cleanPath(p)) {
+		cur = path.Join(cur, name)
+		if u, ok := ns.mounts[cur]; ok {
+			union, names = u, nil
+		} else {
+			names = append(names, name)
+		}
+	}
+
+	return append([]*nsMount(nil), union...), names
+}
+
+// Walks the names from the directories of the union. The first name
+// is looked up in the directories in order, the rest of the names are
+// walked from the first directory that has it.
+func walkUnion(ctx context.Context, union []*nsMount, names []string) (*Fid, error) {
+	var err error = &ixp.Error{"file not found", ixp.ENOENT}
+	for _, m := range union {
+		var fid *Fid
+		var n int
+		fid, n, err = m.fid.Clnt.walkAll(ctx, m.fid, names)
+		if err == nil {
+			return fid, nil
+		}
+
+		if n > 0 {
+			break
+		}
+	}
+
+	return nil, err
+}
+
+// Walks to a file of the namespace. Returns a Fid associated with the
+// file, or an Error. The Fid should be clunked with fid.Clnt.Clunk.
+func (ns *Namespace) Walk(p string) (*Fid, error) {
+	return ns.WalkContext(context.Background(), p)
+}
+
+// Same as Walk, but the requests are flushed if the context is
+// cancelled.
+func (ns *Namespace) WalkContext(ctx context.Context, p string) (*Fid, error) {
+	union, names := ns.lookup(p)
+	return walkUnion(ctx, union, names)
+}
+
+// Opens a file of the namespace. Returns a File, or an Error.
+func (ns *Namespace) Open(p string, mode uint8) (*File, error) {
+	fid, err := ns.Walk(p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fid.Clnt.Open(fid, mode)
+	if err != nil {
+		fid.Clnt.Clunk(fid)
+		return nil, err
+	}
+
+	return &File{fid: fid}, nil
+}
+
+// Creates and opens a file of the namespace. If the parent directory
+// is a mount point, the file is created in the first directory of the
+// union that was mounted with MCREATE. Returns a File, or an Error.
+func (ns *Namespace) Create(p string, perm uint32, mode uint8) (*File, error) {
+	dir, name := path.Split(cleanPath(p))
+	if name == "" {
+		return nil, &ixp.Error{"file exists", ixp.EEXIST}
+	}
+
+	union, names := ns.lookup(dir)
+	if len(names) == 0 {
+		/* the parent is a mount point */
+		var cm *nsMount
+		for _, m := range union {
+			if m.create {
+				cm = m
+				break
+			}
+		}
+
+		if cm == nil {
+			return nil, &ixp.Error{"mounted directory forbids creation", ixp.EPERM}
+		}
+
+		union = []*nsMount{cm}
+	}
+
+	fid, err := walkUnion(context.Background(), union, names)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fid.Clnt.Create(fid, name, perm, mode, "")
+	if err != nil {
+		fid.Clnt.Clunk(fid)
+		return nil, err
+	}
+
+	return &File{fid: fid}, nil
+}
+
+// Removes a file of the namespace. Returns nil if the operation is
+// successful.
+func (ns *Namespace) Remove(p string) error {
+	fid, err := ns.Walk(p)
+	if err != nil {
+		return err
+	}
+
+	return fid.Clnt.Remove(fid)
+}
+
+// Returns the metadata of a file of the namespace, or an Error.
+func (ns *Namespace) Stat(p string) (*ixp.Dir, error) {
+	fid, err := ns.Walk(p)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := fid.Clnt.Stat(fid)
+	fid.Clnt.Clunk(fid)
+	return d, err
+}
+
+// Reads the content of a directory of the namespace. If the directory
+// is a union, returns the files of all its directories. If more than
+// one directory has a file with the same name, only the first one is
+// returned, the same one that is found by Walk.
+func (ns *Namespace) Readdir(p string) ([]*ixp.Dir, error) {
+	union, names := ns.lookup(p)
+	if len(names) > 0 {
+		/* not a mount point, only the first directory that has it is read */
+		fid, err := ns.Walk(p)
+		if err != nil {
+			return nil, err
+		}
+
+		union = []*nsMount{{fid, false}}
+		defer fid.Clnt.Clunk(fid)
+	}
+
+	var dirs []*ixp.Dir
+	seen := make(map[string]bool)
+	for _, m := range union {
+		fid, _, err := m.fid.Clnt.walkAll(context.Background(), m.fid, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		err = fid.Clnt.Open(fid, ixp.OREAD)
+		if err != nil {
+			fid.Clnt.Clunk(fid)
+			return nil, err
+		}
+
+		file := &File{fid: fid}
+		ds, err := file.Readdir(0)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range ds {
+			if !seen[d.Name] {
+				seen[d.Name] = true
+				dirs = append(dirs, d)
+			}
+		}
+	}
+
+	return dirs, nil
+}
+
+// Adds the directories to the union at the mount point old, as
+// specified by flags. Unless old is "/" in an empty namespace, it
+// should exist. The namespace takes over the fids of the directories.
+func (ns *Namespace) add(old string, ms []*nsMount, flags int) error {
+	old = cleanPath(old)
+	ns.Lock()
+	_, mounted := ns.mounts[old]
+	empty := len(ns.mounts) == 0
+	ns.Unlock()
+
+	/* a directory that is not a mount point becomes the first one in the union */
+	var cur *nsMount
+	if !mounted && !(old == "/" && empty) {
+		fid, err := ns.Walk(old)
+		if err != nil {
+			clunkMounts(ms)
+			return err
+		}
+
+		cur = &nsMount{fid, false}
+	}
+
+	for _, m := range ms {
+		m.create = flags&MCREATE != 0
+	}
+
+	ns.Lock()
+	union := ns.mounts[old]
+	if cur != nil && len(union) == 0 {
+		union = []*nsMount{cur}
+		cur = nil
+	}
+
+	var drop []*nsMount
+	switch flags & MORDER {
+	case MBEFORE:
+		union = append(append([]*nsMount(nil), ms...), union...)
+
+	case MAFTER:
+		union = append(append([]*nsMount(nil), union...), ms...)
+
+	default:
+		drop = union
+		union = ms
+	}
+
+	ns.mounts[old] = union
+	ns.Unlock()
+
+	if cur != nil {
+		drop = append(drop, cur)
+	}
+
+	clunkMounts(drop)
+	return nil
+}
+
+func clunkMounts(ms []*nsMount) {
+	for _, m := range ms {
+		m.fid.Clnt.Clunk(m.fid)
+	}
+}
+
+// Mounts the file tree of the client (starting from clnt.Root) at the
+// path old. The flags are MREPL, MBEFORE or MAFTER, optionally with
+// MCREATE. Returns nil if the operation is successful.
+func (ns *Namespace) Mount(clnt *Clnt, old string, flags int) error {
+	fid, _, err := clnt.walkAll(context.Background(), clnt.Root, nil)
+	if err != nil {
+		return err
+	}
+
+	return ns.add(old, []*nsMount{{fid, false}}, flags)
+}
+
+// Connects to a local file server, attaches to it as the specified
+// user, and mounts its file tree at the path old (see Mount). The
+// client is unmounted by Close.
+func (ns *Namespace) MountServer(s Server, aname string, user ixp.User, old string, flags int) error {
+	c, sc := net.Pipe()
+	s.NewConn(sc)
+	clnt, err := MountConn(c, aname, user)
+	if err != nil {
+		return err
+	}
+
+	err = ns.Mount(clnt, old, flags)
+	if err != nil {
+		clnt.Unmount()
+		return err
+	}
+
+	ns.Lock()
+	ns.clnts[clnt] = true
+	ns.Unlock()
+	return nil
+}
+
+// Binds the file new of the namespace at the path old. If new is a
+// mount point, all directories of its union are bound. The flags are
+// the same as for Mount. Returns nil if the operation is successful.
+func (ns *Namespace) Bind(new, old string, flags int) error {
+	union, names := ns.lookup(new)
+	if len(names) > 0 {
+		fid, err := ns.Walk(new)
+		if err != nil {
+			return err
+		}
+
+		return ns.add(old, []*nsMount{{fid, false}}, flags)
+	}
+
+	var ms []*nsMount
+	for _, m := range union {
+		fid, _, err := m.fid.Clnt.walkAll(context.Background(), m.fid, nil)
+		if err != nil {
+			clunkMounts(ms)
+			return err
+		}
+
+		ms = append(ms, &nsMount{fid, false})
+	}
+
+	if len(ms) == 0 {
+		return &ixp.Error{"file not found", ixp.ENOENT}
+	}
+
+	return ns.add(old, ms, flags)
+}
+
+// Removes the directory new from the union at the path old. If new is
+// empty, removes all directories mounted at old. Returns nil if the
+// operation is successful.
+func (ns *Namespace) Unmount(new, old string) error {
+	old = cleanPath(old)
+	var fid *Fid
+	if new != "" {
+		var err error
+		fid, err = ns.Walk(new)
+		if err != nil {
+			return err
+		}
+
+		defer fid.Clnt.Clunk(fid)
+	}
+
+	ns.Lock()
+	union, ok := ns.mounts[old]
+	if !ok {
+		ns.Unlock()
+		return &ixp.Error{"not mounted", ixp.EINVAL}
+	}
+
+	var keep, drop []*nsMount
+	for _, m := range union {
+		if fid == nil || (m.fid.Clnt == fid.Clnt && m.fid.Qid == fid.Qid) {
+			drop = append(drop, m)
+		} else {
+			keep = append(keep, m)
+		}
+	}
+
+	if len(drop) == 0 {
+		ns.Unlock()
+		return &ixp.Error{"not mounted", ixp.EINVAL}
+	}
+
+	if len(keep) == 0 {
+		delete(ns.mounts, old)
+	} else {
+		ns.mounts[old] = keep
+	}
+	ns.Unlock()
+
+	clunkMounts(drop)
+	return nil
+}
+
+// Removes all mounts from the namespace.
+func (ns *Namespace) Clear() {
+	ns.Lock()
+	mounts := ns.mounts
+	ns.mounts = make(map[string][]*nsMount)
+	ns.Unlock()
+
+	for _, union := range mounts {
+		clunkMounts(union)
+	}
+}
+
+// Removes all mounts from the namespace and unmounts the clients
+// created by the namespace (MountServer, Load).
+func (ns *Namespace) Close() {
+	ns.Clear()
+	ns.Lock()
+	clnts := ns.clnts
+	ns.clnts = make(map[*Clnt]bool)
+	ns.Unlock()
+
+	for c := range clnts {
+		c.Unmount()
+	}
+}
+
+// Reads a Plan 9 namespace file and applies it to the namespace. The
+// lines of the file are:
+//
+//	mount [-abc] servename old [spec]
+//	bind [-abc] new old
+//	unmount [new] old
+//	clear
+//	cd dir
+//
+// The flags -b, -a and -c stand for MBEFORE, MAFTER and MCREATE. The
+// environment variables ($name) are expanded, the empty lines and the
+// comments (starting with #) are skipped, and cd is ignored. For mount,
+// dial is called with servename and spec, and returns a client attached
+// to the file server. The clients are unmounted by Close. Returns an
+// Error with the number of the line that can't be applied.
+func (ns *Namespace) Load(r io.Reader, dial func(servename, spec string) (*Clnt, error)) error {
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[0:i]
+		}
+
+		args := strings.Fields(os.ExpandEnv(line))
+		if len(args) == 0 {
+			continue
+		}
+
+		err := ns.apply(args, dial)
+		if err != nil {
+			e, ok := err.(*ixp.Error)
+			if !ok {
+				e = &ixp.Error{err.Error(), ixp.EIO}
+			}
+
+			return &ixp.Error{fmt.Sprintf("namespace line %d: %s", n, e.Err), e.Errornum}
+		}
+	}
+
+	if s.Err() != nil {
+		return &ixp.Error{s.Err().Error(), ixp.EIO}
+	}
+
+	return nil
+}
+
+var Ebadns = &ixp.Error{"bad namespace command", ixp.EINVAL}
+
+func (ns *Namespace) apply(args []string, dial func(servename, spec string) (*Clnt, error)) error {
+	cmd := args[0]
+	args = args[1:]
+	flags := MREPL
+	if (cmd == "mount" || cmd == "bind") && len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		for _, c := range args[0][1:] {
+			switch c {
+			case 'b':
+				flags |= MBEFORE
+			case 'a':
+				flags |= MAFTER
+			case 'c':
+				flags |= MCREATE
+			case 'C':
+				/* caching is set on the client */
+			default:
+				return Ebadns
+			}
+		}
+
+		args = args[1:]
+		if flags&MORDER == MORDER {
+			return Ebadns
+		}
+	}
+
+	switch cmd {
+	case "mount":
+		if len(args) != 2 && len(args) != 3 {
+			return Ebadns
+		}
+
+		spec := ""
+		if len(args) == 3 {
+			spec = args[2]
+		}
+
+		if dial == nil {
+			return &ixp.Error{"no dial function", ixp.EINVAL}
+		}
+
+		c, err := dial(args[0], spec)
+		if err != nil {
+			return err
+		}
+
+		ns.Lock()
+		ns.clnts[c] = true
+		ns.Unlock()
+		return ns.Mount(c, args[1], flags)
+
+	case "bind":
+		if len(args) != 2 {
+			return Ebadns
+		}
+
+		return ns.Bind(args[0], args[1], flags)
+
+	case "unmount":
+		switch len(args) {
+		case 1:
+			return ns.Unmount("", args[0])
+		case 2:
+			return ns.Unmount(args[0], args[1])
+		}
+
+		return Ebadns
+
+	case "clear":
+		ns.Clear()
+		return nil
+
+	case "cd":
+		/* the namespace has no current directory */
+		return nil
+	}
+
+	return &ixp.Error{"unknown command " + cmd, ixp.EINVAL}
+}
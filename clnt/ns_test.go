@@ -0,0 +1,234 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt_test
+
+import (
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// A directory the files can be created in.
+type createDir struct {
+	srv.File
+}
+
+func (d *createDir) Create(fid *srv.FFid, name string, perm uint32) (*srv.File, error) {
+	f := new(dataFile)
+	if err := d.Add(&f.File, name, fid.Fid.User, nil, perm, f); err != nil {
+		return nil, err
+	}
+
+	return &f.File, nil
+}
+
+// Mounts a tree with the files, named by their paths, with the names
+// as their content. The directories on the paths are created, and the
+// files can be created in the root.
+func nsTree(t *testing.T, files ...string) *clnt.Clnt {
+	user := srvtest.User()
+	root := new(createDir)
+	if err := root.Add(&root.File, "/", user, nil, ixp.DMDIR|0777, root); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range files {
+		dir := &root.File
+		elems := strings.Split(name, "/")
+		for _, e := range elems[0 : len(elems)-1] {
+			sub := dir.Find(e)
+			if sub == nil {
+				sub = new(srv.File)
+				if err := dir.Add(sub, e, user, nil, ixp.DMDIR|0777, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dir = sub
+		}
+
+		if elems[len(elems)-1] == "" {
+			continue
+		}
+
+		f := &dataFile{data: []byte(name)}
+		if err := dir.Add(&f.File, elems[len(elems)-1], user, nil, 0644, f); err != nil {
+			t.Fatal(err)
+		}
+		f.Length = uint64(len(f.data))
+	}
+
+	c, unmount, err := srvtest.Loopback(srvtest.FileSrv(t, &root.File), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(unmount)
+
+	return c
+}
+
+// Returns the content of a file of the namespace.
+func nsRead(ns *clnt.Namespace, p string) (string, error) {
+	f, err := ns.Open(p, ixp.OREAD)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+func TestNamespaceUnion(t *testing.T) {
+	a := nsTree(t, "before/both", "before/a", "after/both", "after/a", "repl/a", "b/")
+	b := nsTree(t, "both", "b")
+	ns := clnt.NewNamespace()
+	defer ns.Close()
+
+	if err := ns.Mount(a, "/", clnt.MREPL); err != nil {
+		t.Fatal(err)
+	}
+
+	for old, flags := range map[string]int{"/before": clnt.MBEFORE, "/after": clnt.MAFTER, "/repl": clnt.MREPL, "/b": clnt.MREPL} {
+		if err := ns.Mount(b, old, flags); err != nil {
+			t.Fatalf("mount at %s: %v", old, err)
+		}
+	}
+
+	/* the names are looked up in the order of the union */
+	for p, want := range map[string]string{
+		"/before/both": "both",
+		"/before/a":    "before/a",
+		"/after/both":  "after/both",
+		"/after/b":     "b",
+		"/repl/b":      "b",
+	} {
+		if data, err := nsRead(ns, p); data != want || err != nil {
+			t.Errorf("%s: %q %v, want %q", p, data, err, want)
+		}
+	}
+
+	if _, err := ns.Walk("/repl/a"); err == nil {
+		t.Error("/repl/a found in the replaced directory")
+	}
+
+	/* the first file of the union with the name is returned */
+	dirs, err := ns.Readdir("/after")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name < dirs[j].Name })
+	if len(dirs) != 3 || dirs[0].Name != "a" || dirs[1].Name != "b" || dirs[2].Name != "both" {
+		t.Fatalf("readdir of the union: %v", dirs)
+	}
+
+	if dirs[2].Length != uint64(len("after/both")) {
+		t.Errorf("readdir of the union: both from the second directory: %v", dirs[2])
+	}
+
+	/* b is mounted at /b too, that mount is the one removed from /after */
+	if err := ns.Unmount("/b", "/after"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ns.Walk("/after/b"); err == nil {
+		t.Error("/after/b found after unmount")
+	}
+
+	if data, err := nsRead(ns, "/after/a"); data != "after/a" || err != nil {
+		t.Errorf("/after/a after unmount: %q %v", data, err)
+	}
+
+	if err := ns.Unmount("/b", "/after"); err == nil {
+		t.Error("second unmount succeeded")
+	}
+}
+
+func TestNamespaceCreate(t *testing.T) {
+	a := nsTree(t, "union/a")
+	b := nsTree(t, "b")
+	ns := clnt.NewNamespace()
+	defer ns.Close()
+
+	if err := ns.Mount(a, "/", clnt.MREPL); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ns.Mount(b, "/union", clnt.MAFTER); err != nil {
+		t.Fatal(err)
+	}
+
+	if f, err := ns.Create("/union/new", 0644, ixp.OWRITE); err == nil {
+		t.Error("created in a union without MCREATE")
+		f.Close()
+	}
+
+	if err := ns.Mount(b, "/union", clnt.MAFTER|clnt.MCREATE); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ns.Create("/union/new", 0644, ixp.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	/* the file is created in the directory mounted with MCREATE */
+	if _, err := b.FStat("/new"); err != nil {
+		t.Errorf("the created file: %v", err)
+	}
+
+	if _, err := a.FStat("/union/new"); err == nil {
+		t.Error("the file created in the first directory of the union")
+	}
+}
+
+func TestNamespaceLoad(t *testing.T) {
+	a := nsTree(t, "mnt/", "a")
+	b := nsTree(t, "b")
+	dial := func(servename, spec string) (*clnt.Clnt, error) {
+		switch servename {
+		case "a":
+			return a, nil
+		case "b":
+			return b, nil
+		}
+
+		return nil, &ixp.Error{"unknown server " + servename, ixp.ENOENT}
+	}
+
+	ns := clnt.NewNamespace()
+	defer ns.Clear()
+
+	err := ns.Load(strings.NewReader("mount a /\n# comment\n\nmount -a b /mnt\nbind /mnt/b /a\n"), dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := nsRead(ns, "/a"); data != "b" || err != nil {
+		t.Errorf("/a after bind: %q %v", data, err)
+	}
+
+	for text, want := range map[string]string{
+		"mount a /\nbind\n":             "namespace line 2: bad namespace command",
+		"\n\nmount -x a /\n":            "namespace line 3: bad namespace command",
+		"mount -ba a /\n":               "namespace line 1: bad namespace command",
+		"mount a /\nmount c /mnt\n":     "namespace line 2: unknown server c",
+		"mount a /\nbind /none /mnt\n":  "namespace line 2: file not found",
+		"mount a /\nfrob /\n":           "namespace line 2: unknown command frob",
+		"mount a /\nunmount /none /a\n": "namespace line 2: file not found",
+	} {
+		err := ns.Load(strings.NewReader(text), dial)
+		if e, ok := err.(*ixp.Error); !ok || !strings.HasPrefix(e.Err, want) {
+			t.Errorf("Load(%q): %v, want %q", text, err, want)
+		}
+	}
+}
@@ -5,43 +5,62 @@
 package clnt
 
 import (
+	"context"
 	"github.com/jsouthworth/ixp"
 	"strings"
 )
 
 // Opens the file associated with the fid. Returns nil if
-// the operation is successful.
+// the operation is successful. If the 9P2000.L dialect is spoken,
+// the file is opened with Tlopen.
 func (clnt *Clnt) Open(fid *Fid, mode uint8) error {
+	return clnt.OpenContext(context.Background(), fid, mode)
+}
+
+// Same as Open, but the request is flushed if the context is cancelled.
+func (clnt *Clnt) OpenContext(ctx context.Context, fid *Fid, mode uint8) error {
+	if clnt.Dialect == ixp.Dialect9P2000L {
+		return clnt.LopenContext(ctx, fid, lopenFlags(mode))
+	}
+
 	tc := clnt.NewFcall()
 	err := ixp.PackTopen(tc, fid.Fid, mode)
 	if err != nil {
 		return err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return err
 	}
 
 	fid.Qid = rc.Qid
+	clnt.Cache.seen(rc.Qid)
 	fid.Iounit = rc.Iounit
 	if fid.Iounit == 0 || fid.Iounit > clnt.Msize-ixp.IOHDRSZ {
 		fid.Iounit = clnt.Msize - ixp.IOHDRSZ
 	}
 	fid.Mode = mode
+	fid.opened = true
 	return nil
 }
 
 // Creates a file in the directory associated with the fid. Returns nil
-// if the operation is successful.
+// if the operation is successful. If the 9P2000.L dialect is spoken,
+// the file is created with Tlcreate, or Tmkdir for a directory, and ext
+// is ignored.
 func (clnt *Clnt) Create(fid *Fid, name string, perm uint32, mode uint8, ext string) error {
+	if clnt.Dialect == ixp.Dialect9P2000L {
+		return clnt.lcreate(fid, name, perm, mode)
+	}
+
 	tc := clnt.NewFcall()
-	err := ixp.PackTcreate(tc, fid.Fid, name, perm, mode, ext, clnt.Dotu)
+	err := ixp.PackTcreate(tc, fid.Fid, name, perm, mode, ext, clnt.Dotu())
 	if err != nil {
 		return err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, gen, err := clnt.rpcgen(context.Background(), tc)
 	if err != nil {
 		return err
 	}
@@ -52,6 +71,9 @@ func (clnt *Clnt) Create(fid *Fid, name string, perm uint32, mode uint8, ext str
 		fid.Iounit = clnt.Msize - ixp.IOHDRSZ
 	}
 	fid.Mode = mode
+	fid.opened = true
+	fid.setPath(fid.aname, append(append([]string(nil), fid.path...), name), gen)
+	clnt.Cache.renamed()
 	return nil
 }
 
@@ -78,21 +100,27 @@ func (clnt *Clnt) FCreate(path string, perm uint32, mode uint8) (*File, error) {
 		return nil, err
 	}
 
-	return &File{fid, 0}, nil
+	return &File{fid: fid}, nil
 }
 
 // Opens a named file. Returns the opened file, or an Error.
 func (clnt *Clnt) FOpen(path string, mode uint8) (*File, error) {
-	fid, err := clnt.FWalk(path)
+	return clnt.FOpenContext(context.Background(), path, mode)
+}
+
+// Same as FOpen, but the requests are flushed if the context is
+// cancelled.
+func (clnt *Clnt) FOpenContext(ctx context.Context, path string, mode uint8) (*File, error) {
+	fid, err := clnt.FWalkContext(ctx, path)
 	if err != nil {
 		return nil, err
 	}
 
-	err = clnt.Open(fid, mode)
+	err = clnt.OpenContext(ctx, fid, mode)
 	if err != nil {
 		clnt.Clunk(fid)
 		return nil, err
 	}
 
-	return &File{fid, 0}, nil
+	return &File{fid: fid}, nil
 }
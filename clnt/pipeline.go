@@ -0,0 +1,266 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"context"
+	"github.com/jsouthworth/ixp"
+	"io"
+)
+
+// Default number of Tread/Twrite requests the File operations keep in
+// flight. More than one request helps over links with high latency,
+// but is correct only for files that can be read and written at any
+// offset, so it is off by default.
+var DefaultWindow = 1
+
+// Result of a single Tread or Twrite.
+type ioResult struct {
+	n   int
+	err error
+}
+
+// Buffer used by ReadFrom and WriteTo, with the result of the
+// request that uses it.
+type ioSlot struct {
+	ioResult
+	buf  []byte
+	len  int   // bytes to write
+	off  int64 // offset of the request
+	busy bool  // request in flight
+	done chan bool
+}
+
+// Sets how many Tread/Twrite requests of up to Iounit bytes a single
+// Read, ReadAt, Write, WriteAt, ReadFrom or WriteTo keeps in flight.
+// If n is 0, the Window of the client is used. The window is ignored
+// for directories and append-only files.
+func (file *File) SetWindow(n int) {
+	file.win = n
+}
+
+func (file *File) window() int {
+	w := file.win
+	if w == 0 {
+		w = file.fid.Clnt.Window
+	}
+
+	if w < 1 || file.fid.Type&(ixp.QTDIR|ixp.QTAPPEND) != 0 {
+		w = 1
+	}
+
+	return w
+}
+
+// Transfers buf starting from offset by calling op for the consecutive
+// chunks of up to Iounit bytes, with up to window calls in flight. The
+// transfer stops at the first chunk that fails or is short. Returns the
+// number of bytes transferred up to that chunk, and its error. The
+// chunks after it that were already in flight are not undone, so a
+// failed write may have changed the file past the returned count.
+func (file *File) pipeline(ctx context.Context, buf []byte, offset int64, op func(context.Context, []byte, int64) (int, error)) (int, error) {
+	iounit := int(file.fid.Iounit)
+	win := file.window()
+	nchunks := (len(buf) + iounit - 1) / iounit
+	res := make([]ioResult, nchunks)
+	done := make(chan int, nchunks)
+	chunk := func(i int) []byte {
+		if (i+1)*iounit < len(buf) {
+			return buf[i*iounit : (i+1)*iounit]
+		}
+
+		return buf[i*iounit:]
+	}
+
+	stop := nchunks
+	next, pending := 0, 0
+	for next < stop || pending > 0 {
+		for ; next < stop && pending < win; next++ {
+			go func(i int) {
+				res[i].n, res[i].err = op(ctx, chunk(i), offset+int64(i*iounit))
+				done <- i
+			}(next)
+			pending++
+		}
+
+		/* the chunks after a failed or short one are discarded */
+		i := <-done
+		pending--
+		if (res[i].err != nil || res[i].n < len(chunk(i))) && i+1 < stop {
+			stop = i + 1
+		}
+	}
+
+	n := 0
+	for i := 0; i < stop; i++ {
+		n += res[i].n
+		if res[i].err != nil {
+			return n, res[i].err
+		}
+	}
+
+	return n, nil
+}
+
+func newSlots(n, size int) []ioSlot {
+	slots := make([]ioSlot, n)
+	for i := range slots {
+		slots[i].buf = make([]byte, size)
+		slots[i].done = make(chan bool, 1)
+	}
+
+	return slots
+}
+
+// Waits for the request that uses the slot, if any.
+func (s *ioSlot) wait() bool {
+	if !s.busy {
+		return false
+	}
+
+	<-s.done
+	s.busy = false
+	return true
+}
+
+// Reads the file from the current offset until end-of-file and writes
+// the data to w. Keeps up to window Treads in flight, the data is
+// written to w in order. Implements io.WriterTo.
+func (file *File) WriteTo(w io.Writer) (int64, error) {
+	return file.WriteToContext(context.Background(), w)
+}
+
+// Same as WriteTo, but the requests are flushed if the context is
+// cancelled.
+func (file *File) WriteToContext(ctx context.Context, w io.Writer) (int64, error) {
+	var total int64
+	var err error
+
+	win := file.window()
+	slots := newSlots(win, int(file.fid.Iounit))
+	off := int64(file.offset)
+	read := func(s *ioSlot) {
+		s.off = off
+		s.busy = true
+		off += int64(len(s.buf))
+		go func() {
+			s.n, s.err = file.readAt(ctx, s.buf, s.off)
+			s.done <- true
+		}()
+	}
+
+	/* the slots are used in order, starting from k */
+	restart := func(k int) {
+		for i := 0; i < win; i++ {
+			slots[(k+i)%win].wait()
+		}
+
+		for i := 0; i < win; i++ {
+			read(&slots[(k+i)%win])
+		}
+	}
+
+	restart(0)
+	for k := 0; err == nil; k = (k + 1) % win {
+		s := &slots[k]
+		s.wait()
+		if s.err != nil {
+			if s.err != io.EOF {
+				err = s.err
+			}
+
+			break
+		}
+
+		n, werr := w.Write(s.buf[0:s.n])
+		total += int64(n)
+		if werr != nil {
+			err = werr
+			break
+		}
+
+		if s.n < len(s.buf) {
+			/* short read, the data after it is read again */
+			off = s.off + int64(s.n)
+			restart((k + 1) % win)
+		} else {
+			read(s)
+		}
+	}
+
+	for i := range slots {
+		slots[i].wait()
+	}
+
+	file.offset += uint64(total)
+	return total, err
+}
+
+// Reads the data from r until EOF and writes it to the file, starting
+// from the current offset. Keeps up to window Twrites in flight. If a
+// Twrite fails or is short, the writes after it are not counted in
+// the returned number of bytes. Implements io.ReaderFrom.
+func (file *File) ReadFrom(r io.Reader) (int64, error) {
+	return file.ReadFromContext(context.Background(), r)
+}
+
+// Same as ReadFrom, but the requests are flushed if the context is
+// cancelled.
+func (file *File) ReadFromContext(ctx context.Context, r io.Reader) (int64, error) {
+	var total int64
+	var err, rerr error
+
+	win := file.window()
+	slots := newSlots(win, int(file.fid.Iounit))
+	off := int64(file.offset)
+
+	/* checks the result of the write that used the slot */
+	check := func(s *ioSlot) {
+		if s.wait() && err == nil {
+			if s.err != nil {
+				err = s.err
+			} else if s.n < s.len {
+				err = io.ErrShortWrite
+			} else {
+				total += int64(s.n)
+			}
+		}
+	}
+
+	k := 0
+	for rerr == nil {
+		s := &slots[k]
+		check(s)
+		if err != nil {
+			break
+		}
+
+		var n int
+		n, rerr = r.Read(s.buf)
+		if n > 0 {
+			s.len = n
+			s.off = off
+			s.busy = true
+			off += int64(n)
+			go func() {
+				s.n, s.err = file.writeAt(ctx, s.buf[0:s.len], s.off)
+				s.done <- true
+			}()
+
+			k = (k + 1) % win
+		}
+	}
+
+	for i := 0; i < win; i++ {
+		check(&slots[(k+i)%win])
+	}
+
+	if err == nil && rerr != io.EOF {
+		err = rerr
+	}
+
+	file.offset += uint64(total)
+	return total, err
+}
@@ -0,0 +1,223 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt_test
+
+import (
+	"bytes"
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A file that returns at most max bytes for each Tread and Twrite, and
+// records how many of them were in flight at the same time.
+type shortFile struct {
+	srv.File
+	sync.Mutex
+	data     []byte
+	max      int
+	inflight int
+	peak     int
+}
+
+func (f *shortFile) enter() {
+	f.Lock()
+	f.inflight++
+	if f.inflight > f.peak {
+		f.peak = f.inflight
+	}
+	f.Unlock()
+
+	/* gives the other requests of the window time to arrive */
+	time.Sleep(2 * time.Millisecond)
+}
+
+func (f *shortFile) leave() {
+	f.Lock()
+	f.inflight--
+	f.Unlock()
+}
+
+func (f *shortFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	f.enter()
+	defer f.leave()
+	f.Lock()
+	defer f.Unlock()
+	if offset >= uint64(len(f.data)) {
+		return 0, nil
+	}
+
+	if f.max > 0 && len(buf) > f.max {
+		buf = buf[0:f.max]
+	}
+
+	return copy(buf, f.data[offset:]), nil
+}
+
+func (f *shortFile) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
+	f.enter()
+	defer f.leave()
+	f.Lock()
+	defer f.Unlock()
+	if f.max > 0 && len(data) > f.max {
+		data = data[0:f.max]
+	}
+
+	if end := int(offset) + len(data); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+
+	copy(f.data[offset:], data)
+	f.Length = uint64(len(f.data))
+	return len(data), nil
+}
+
+// Returns the peak number of requests in flight since the last call.
+func (f *shortFile) resetPeak() int {
+	f.Lock()
+	defer f.Unlock()
+	peak := f.peak
+	f.peak = 0
+	return peak
+}
+
+func pattern(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	return data
+}
+
+// Serves a shortFile named "f" with the data, and opens it.
+func openShort(t *testing.T, data []byte, max int) (*shortFile, *clnt.Clnt, *clnt.File) {
+	root := srvtest.Root(t, 0777)
+	sf := &shortFile{data: data, max: max}
+	if err := root.Add(&sf.File, "f", srvtest.User(), nil, 0644, sf); err != nil {
+		t.Fatal(err)
+	}
+	sf.Length = uint64(len(data))
+
+	c, unmount, err := srvtest.Loopback(srvtest.FileSrv(t, root), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(unmount)
+
+	f, err := c.FOpen("/f", ixp.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	return sf, c, f
+}
+
+func TestReadAtWindow(t *testing.T) {
+	data := pattern(100000)
+	sf, _, f := openShort(t, data, 3000)
+	f.SetWindow(4)
+
+	/* the data after the short reads is read again */
+	buf := make([]byte, 40000)
+	n, err := f.ReadAt(buf, 5)
+	if n != len(buf) || err != nil {
+		t.Fatalf("ReadAt: %d %v, want %d <nil>", n, err, len(buf))
+	}
+
+	if !bytes.Equal(buf, data[5:5+len(buf)]) {
+		t.Error("ReadAt: data differs")
+	}
+
+	if peak := sf.resetPeak(); peak < 2 {
+		t.Errorf("ReadAt: %d Treads in flight, want more than 1", peak)
+	}
+
+	/* less data than requested only at end-of-file */
+	n, err = f.ReadAt(buf, int64(len(data)-1000))
+	if n != 1000 || err != io.EOF {
+		t.Errorf("ReadAt at the end: %d %v, want 1000 EOF", n, err)
+	}
+
+	if !bytes.Equal(buf[0:1000], data[len(data)-1000:]) {
+		t.Error("ReadAt at the end: data differs")
+	}
+
+	f.SetWindow(1)
+	sf.resetPeak()
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if peak := sf.resetPeak(); peak != 1 {
+		t.Errorf("ReadAt with window 1: %d Treads in flight", peak)
+	}
+}
+
+func TestWriteToWindow(t *testing.T) {
+	data := pattern(100000)
+	sf, _, f := openShort(t, data, 3000)
+	f.SetWindow(4)
+
+	head := make([]byte, 10)
+	if _, err := f.Read(head); err != nil {
+		t.Fatal(err)
+	}
+
+	/* the short reads restart the window, the data is delivered in order */
+	var out bytes.Buffer
+	n, err := f.WriteTo(&out)
+	if n != int64(len(data)-10) || err != nil {
+		t.Fatalf("WriteTo: %d %v, want %d <nil>", n, err, len(data)-10)
+	}
+
+	if !bytes.Equal(out.Bytes(), data[10:]) {
+		t.Error("WriteTo: data differs")
+	}
+
+	if peak := sf.resetPeak(); peak < 2 {
+		t.Errorf("WriteTo: %d Treads in flight, want more than 1", peak)
+	}
+
+	/* the offset of the file is at end-of-file */
+	if n, err := f.Read(head); n != 0 || err != io.EOF {
+		t.Errorf("Read after WriteTo: %d %v, want 0 EOF", n, err)
+	}
+}
+
+func TestReadFromWindow(t *testing.T) {
+	data := pattern(100000)
+	sf, c, f := openShort(t, nil, 0)
+
+	/* the window of the client is used if the file has none */
+	c.Window = 4
+	n, err := f.ReadFrom(bytes.NewReader(data))
+	if n != int64(len(data)) || err != nil {
+		t.Fatalf("ReadFrom: %d %v, want %d <nil>", n, err, len(data))
+	}
+
+	sf.Lock()
+	if !bytes.Equal(sf.data, data) {
+		t.Error("ReadFrom: data differs")
+	}
+	sf.max = 3000
+	sf.Unlock()
+
+	if peak := sf.resetPeak(); peak < 2 {
+		t.Errorf("ReadFrom: %d Twrites in flight, want more than 1", peak)
+	}
+
+	/* the short Twrite ends the transfer, the writes after it aren't counted */
+	n, err = f.ReadFrom(bytes.NewReader(data))
+	if n >= int64(len(data)) || err != io.ErrShortWrite {
+		t.Errorf("ReadFrom with short writes: %d %v, want %v", n, err, io.ErrShortWrite)
+	}
+}
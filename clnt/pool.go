@@ -4,6 +4,8 @@
 
 package clnt
 
+import "math/bits"
+
 var m2id = [...]uint8{
 	0, 1, 0, 2, 0, 1, 0, 3,
 	0, 1, 0, 2, 0, 1, 0, 4,
@@ -95,3 +97,15 @@ func (p *pool) putId(id uint32) {
 	p.imap[id/8] &= ^(1 << (id % 8))
 	p.Unlock()
 }
+
+// Returns the number of ids currently allocated from the pool.
+func (p *pool) count() int {
+	n := 0
+	p.Lock()
+	for _, b := range p.imap {
+		n += bits.OnesCount8(b)
+	}
+	p.Unlock()
+
+	return n
+}
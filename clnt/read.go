@@ -5,6 +5,7 @@
 package clnt
 
 import (
+	"context"
 	"github.com/jsouthworth/ixp"
 	"io"
 )
@@ -13,6 +14,11 @@ import (
 // Returns a slice with the data read, if the operation was successful, or an
 // Error.
 func (clnt *Clnt) Read(fid *Fid, offset uint64, count uint32) ([]byte, error) {
+	return clnt.ReadContext(context.Background(), fid, offset, count)
+}
+
+// Same as Read, but the request is flushed if the context is cancelled.
+func (clnt *Clnt) ReadContext(ctx context.Context, fid *Fid, offset uint64, count uint32) ([]byte, error) {
 	if count > fid.Iounit {
 		count = fid.Iounit
 	}
@@ -23,7 +29,7 @@ func (clnt *Clnt) Read(fid *Fid, offset uint64, count uint32) ([]byte, error) {
 		return nil, err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
@@ -34,9 +40,16 @@ func (clnt *Clnt) Read(fid *Fid, offset uint64, count uint32) ([]byte, error) {
 // Reads up to len(buf) bytes from the File. Returns the number
 // of bytes read, or an Error.
 func (file *File) Read(buf []byte) (int, error) {
-	n, err := file.ReadAt(buf, int64(file.offset))
-	if err == nil {
-		file.offset += uint64(n)
+	return file.ReadContext(context.Background(), buf)
+}
+
+// Same as Read, but the request is flushed if the context is cancelled.
+func (file *File) ReadContext(ctx context.Context, buf []byte) (int, error) {
+	n, err := file.ReadAtContext(ctx, buf, int64(file.offset))
+	file.offset += uint64(n)
+	if n > 0 && err == io.EOF {
+		/* the data before end-of-file is returned first */
+		err = nil
 	}
 
 	return n, err
@@ -45,26 +58,95 @@ func (file *File) Read(buf []byte) (int, error) {
 // Reads up to len(buf) bytes from the file starting from offset.
 // Returns the number of bytes read, or an Error.
 func (file *File) ReadAt(buf []byte, offset int64) (int, error) {
-	b, err := file.fid.Clnt.Read(file.fid, uint64(offset), uint32(len(buf)))
+	return file.ReadAtContext(context.Background(), buf, offset)
+}
+
+// Same as ReadAt, but the requests are flushed if the context is
+// cancelled. If buf is bigger than Iounit and the window of the file
+// allows it, the data is read by multiple concurrent Treads (see
+// SetWindow). The data after a short Tread is then read again, so
+// less than len(buf) bytes are returned only with an error, io.EOF
+// at end-of-file.
+func (file *File) ReadAtContext(ctx context.Context, buf []byte, offset int64) (int, error) {
+	if len(buf) > int(file.fid.Iounit) && file.window() > 1 {
+		n := 0
+		for n < len(buf) {
+			m, err := file.pipeline(ctx, buf[n:], offset+int64(n), file.readAt)
+			n += m
+			if err != nil {
+				return n, err
+			}
+		}
+
+		return n, nil
+	}
+
+	return file.readAt(ctx, buf, offset)
+}
+
+// Reads up to Iounit bytes with a single Tread, or from the cache of
+// the client.
+func (file *File) readAt(ctx context.Context, buf []byte, offset int64) (int, error) {
+	if c := file.fid.Clnt.Cache; c != nil && c.cacheable(file.fid) {
+		return c.readAt(ctx, file, buf, offset)
+	}
+
+	return file.readRpc(ctx, buf, offset)
+}
+
+// Reads up to Iounit bytes with a single Tread.
+func (file *File) readRpc(ctx context.Context, buf []byte, offset int64) (int, error) {
+	clnt := file.fid.Clnt
+	count := uint32(len(buf))
+	if count > file.fid.Iounit {
+		count = file.fid.Iounit
+	}
+
+	tc := clnt.NewFcall()
+	err := ixp.PackTread(tc, file.fid.Fid, uint64(offset), count)
+	if err != nil {
+		return 0, err
+	}
+
+	/* the data of Rread is received directly into buf (see readBuf) */
+	tc.Data = buf[0:count]
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return 0, err
 	}
 
-	if len(b) == 0 {
+	n := len(rc.Data)
+	if n > 0 && (count == 0 || &rc.Data[0] != &buf[0]) {
+		/* the data wasn't received into buf */
+		n = copy(buf, rc.Data)
+	}
+
+	clnt.FreeFcall(rc)
+	if n == 0 {
 		return 0, io.EOF
 	}
 
-	copy(buf, b)
-	return len(b), nil
+	return n, nil
 }
 
 // Reads exactly len(buf) bytes from the File starting from offset.
 // Returns the number of bytes read (could be less than len(buf) if
 // end-of-file is reached), or an Error.
 func (file *File) Readn(buf []byte, offset uint64) (int, error) {
+	return file.ReadnContext(context.Background(), buf, offset)
+}
+
+// Same as Readn, but stops and flushes the outstanding request if the
+// context is cancelled.
+func (file *File) ReadnContext(ctx context.Context, buf []byte, offset uint64) (int, error) {
 	ret := 0
 	for len(buf) > 0 {
-		n, err := file.ReadAt(buf, int64(offset))
+		n, err := file.ReadAtContext(ctx, buf, int64(offset))
+		ret += n
+		if err == io.EOF {
+			break
+		}
+
 		if err != nil {
 			return 0, err
 		}
@@ -75,7 +157,6 @@ func (file *File) Readn(buf []byte, offset uint64) (int, error) {
 
 		buf = buf[n:]
 		offset += uint64(n)
-		ret += n
 	}
 
 	return ret, nil
@@ -84,13 +165,43 @@ func (file *File) Readn(buf []byte, offset uint64) (int, error) {
 // Reads the content of the directory associated with the File.
 // Returns an array of maximum num entries (if num is 0, returns
 // all entries from the directory). If the operation fails, returns
-// an Error.
+// an Error. If the 9P2000.L dialect is spoken, the entries are read
+// with Treaddir.
 func (file *File) Readdir(num int) ([]*ixp.Dir, error) {
+	return file.ReaddirContext(context.Background(), num)
+}
+
+// Same as Readdir, but the requests are flushed if the context is
+// cancelled.
+func (file *File) ReaddirContext(ctx context.Context, num int) ([]*ixp.Dir, error) {
+	if file.fid.Clnt.Dialect == ixp.Dialect9P2000L {
+		dirs := make([]*ixp.Dir, 0, 32)
+		for num == 0 || len(dirs) < num {
+			n := 0
+			if num != 0 {
+				n = num - len(dirs)
+			}
+
+			d, eof, err := file.readdirChunk(ctx, n)
+			if err != nil {
+				return nil, err
+			}
+
+			if eof {
+				break
+			}
+
+			dirs = append(dirs, d...)
+		}
+
+		return dirs, nil
+	}
+
 	buf := make([]byte, file.fid.Clnt.Msize-ixp.IOHDRSZ)
 	dirs := make([]*ixp.Dir, 32)
 	pos := 0
 	for {
-		n, err := file.Read(buf)
+		n, err := file.ReadContext(ctx, buf)
 		if err != nil && err != io.EOF {
 			return nil, err
 		}
@@ -100,7 +211,7 @@ func (file *File) Readdir(num int) ([]*ixp.Dir, error) {
 		}
 
 		for b := buf[0:n]; len(b) > 0; {
-			d, perr := ixp.UnpackDir(b, file.fid.Clnt.Dotu)
+			d, perr := ixp.UnpackDir(b, file.fid.Clnt.Dotu())
 			if perr != nil {
 				return nil, perr
 			}
@@ -0,0 +1,353 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"context"
+	"github.com/jsouthworth/ixp"
+	"io"
+)
+
+// Number of times a request is retried if the connection is lost
+// while it is pending.
+const maxRetries = 3
+
+// Returned for the requests that were pending when the connection to
+// the server was lost. If the client can reconnect (Dial is set), the
+// following requests will cause a reconnect.
+var Edisconnected error = &ixp.Error{"connection lost", ixp.EIO}
+
+// Returned when a fid that was created before the reconnect can't be
+// reestablished on the new connection.
+var Enotrestored error = &ixp.Error{"fid lost on reconnect", ixp.EIO}
+
+// The ReconnectOps interface can be implemented to get notified
+// about the connection of a client being lost and reestablished.
+// The operations are called only if the Dial field of the client
+// is set.
+type ReconnectOps interface {
+	Disconnected(clnt *Clnt, err error)
+	Reconnected(clnt *Clnt)
+	ReconnectFailed(clnt *Clnt, err error)
+}
+
+// Connects to a file server using the dial function and attaches to
+// it as the specified user. If the connection is lost, the client
+// redials, negotiates the same msize and dialect and reestablishes the
+// fids when they are used next: each fid is attached and walked again
+// using the path recorded from its attach point, and opened with its
+// saved Mode. The requests that are safe to repeat (walk, open, read,
+// stat, clunk) are retried transparently, the rest fail with
+// Edisconnected. Fids that were authenticated, or were created using
+// the Tag interface, are not reestablished. The dial function can return
+// a net.Conn or any other io.ReadWriteCloser.
+func MountResilient(dial func() (io.ReadWriteCloser, error), aname string, user ixp.User, hooks ReconnectOps) (*Clnt, error) {
+	c, err := dial()
+	if err != nil {
+		return nil, &ixp.Error{err.Error(), ixp.EIO}
+	}
+
+	clnt, err := Connect(c, 8192+ixp.IOHDRSZ, true)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	clnt.Lock()
+	clnt.Dial = dial
+	clnt.Hooks = hooks
+	clnt.Unlock()
+	fid, err := clnt.Attach(nil, user, aname)
+	if err != nil {
+		clnt.Unmount()
+		return nil, err
+	}
+
+	clnt.Root = fid
+	return clnt, nil
+}
+
+// Returns true if the request can be sent again if the connection was
+// lost while it was pending.
+func idempotent(tc *ixp.Fcall) bool {
+	switch tc.Type {
+	case ixp.Twalk, ixp.Tread, ixp.Tstat, ixp.Tclunk, ixp.Tbread,
+		ixp.Tstatfs, ixp.Tlopen, ixp.Treadlink, ixp.Tgetattr, ixp.Treaddir:
+		return true
+
+	case ixp.Topen:
+		return tc.Mode&ixp.ORCLOSE == 0
+	}
+
+	return false
+}
+
+// Sends the request, reconnecting and reestablishing the fids used by
+// it if necessary. Returns the response and the number of the
+// connection the request was sent on. The request is freed once no
+// more attempts are made.
+func (clnt *Clnt) rpcgen(ctx context.Context, tc *ixp.Fcall) (*ixp.Fcall, uint64, error) {
+	defer clnt.FreeFcall(tc)
+	for i := 0; ; i++ {
+		gen, err := clnt.restore(ctx, tc)
+		if err != nil {
+			return nil, gen, err
+		}
+
+		rc, err := clnt.rpcKeep(ctx, tc)
+		if err != Edisconnected {
+			return rc, gen, err
+		}
+
+		if tc.Type == ixp.Tclunk {
+			/* the fid is gone together with the connection */
+			return nil, gen, nil
+		}
+
+		if i >= maxRetries || !idempotent(tc) || ctx.Err() != nil {
+			return nil, gen, err
+		}
+	}
+}
+
+// Reconnects if the connection is lost and reestablishes the fids used
+// by the request. Returns the number of the current connection.
+func (clnt *Clnt) restore(ctx context.Context, tc *ixp.Fcall) (uint64, error) {
+	clnt.Lock()
+	gen := clnt.gen
+	lost := clnt.Dial != nil && clnt.err == Edisconnected
+	clnt.Unlock()
+
+	if lost {
+		err := clnt.reconnect(gen)
+		if err != nil {
+			return gen, err
+		}
+
+		clnt.Lock()
+		gen = clnt.gen
+		clnt.Unlock()
+	}
+
+	var fids []uint32
+	switch tc.Type {
+	case ixp.Tversion, ixp.Tauth, ixp.Tattach, ixp.Tflush,
+		ixp.Tbread, ixp.Tbwrite, ixp.Tbtrunc:
+		return gen, nil
+
+	case ixp.Trename, ixp.Tlink, ixp.Trenameat:
+		fids = []uint32{tc.Fid, tc.Dfid}
+
+	default:
+		fids = []uint32{tc.Fid}
+	}
+
+	for _, n := range fids {
+		clnt.Lock()
+		fid := clnt.fids[n]
+		clnt.Unlock()
+		if fid != nil {
+			err := clnt.restoreFid(ctx, fid, gen)
+			if err != nil {
+				return gen, err
+			}
+		}
+	}
+
+	return gen, nil
+}
+
+// Attaches, walks and opens the fid on the current connection, if it
+// was created on an earlier one.
+func (clnt *Clnt) restoreFid(ctx context.Context, fid *Fid, gen uint64) error {
+	fid.Lock()
+	defer fid.Unlock()
+	if !fid.walked || fid.gen == 0 || fid.gen == gen {
+		return nil
+	}
+
+	if fid.norestore {
+		return Enotrestored
+	}
+
+	tc := clnt.NewFcall()
+	err := ixp.PackTattach(tc, fid.Fid, ixp.NOFID, fid.User.Name(), fid.aname, uint32(fid.User.Id()), clnt.Dotu())
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.rpc(ctx, tc)
+	if err != nil {
+		return err
+	}
+
+	for path := fid.path; len(path) > 0; {
+		n := len(path)
+		if n > 16 {
+			n = 16
+		}
+
+		tc = clnt.NewFcall()
+		err = ixp.PackTwalk(tc, fid.Fid, fid.Fid, path[0:n])
+		if err != nil {
+			return err
+		}
+
+		rc, err := clnt.rpc(ctx, tc)
+		if err != nil {
+			return err
+		}
+
+		if len(rc.Wqid) != n {
+			return Enotrestored
+		}
+
+		path = path[n:]
+	}
+
+	if fid.opened {
+		mode := fid.Mode &^ ixp.OTRUNC
+		tc = clnt.NewFcall()
+		if clnt.Dialect == ixp.Dialect9P2000L {
+			err = ixp.PackTlopen(tc, fid.Fid, lopenFlags(mode))
+		} else {
+			err = ixp.PackTopen(tc, fid.Fid, mode)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = clnt.rpc(ctx, tc)
+		if err != nil {
+			return err
+		}
+	}
+
+	fid.gen = gen
+	return nil
+}
+
+// Dials the server again and negotiates the version, unless another
+// goroutine already reconnected since the connection number gen was
+// lost.
+func (clnt *Clnt) reconnect(gen uint64) error {
+	clnt.rlock.Lock()
+	defer clnt.rlock.Unlock()
+
+	clnt.Lock()
+	if clnt.gen != gen || clnt.err != Edisconnected {
+		err := clnt.err
+		clnt.Unlock()
+		return err
+	}
+	clnt.Unlock()
+
+	c, err := clnt.Dial()
+	if err == nil {
+		err = clnt.version(c)
+		if err != nil {
+			c.Close()
+		}
+	} else {
+		err = &ixp.Error{err.Error(), ixp.EIO}
+	}
+
+	if err != nil {
+		if clnt.Hooks != nil {
+			clnt.Hooks.ReconnectFailed(clnt, err)
+		}
+
+		return err
+	}
+
+	clnt.Lock()
+	if clnt.unmounted {
+		err = clnt.err
+		clnt.Unlock()
+		c.Close()
+		return err
+	}
+
+	clnt.conn = c
+	clnt.err = nil
+	clnt.gen++
+	clnt.nreconn++
+	clnt.dead = make(chan bool)
+	clnt.Unlock()
+
+	go clnt.recv(c)
+	go clnt.send(c)
+	if clnt.Hooks != nil {
+		clnt.Hooks.Reconnected(clnt)
+	}
+
+	return nil
+}
+
+// Sends Tversion on a new connection and checks that the server agrees
+// to the msize and the dialect used by the client.
+func (clnt *Clnt) version(c io.ReadWriteCloser) error {
+	tc := ixp.NewFcall(clnt.Msize)
+	err := ixp.PackTversion(tc, clnt.Msize, clnt.Dialect.String())
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Write(tc.Pkt)
+	if err != nil {
+		return &ixp.Error{err.Error(), ixp.EIO}
+	}
+
+	buf := make([]byte, clnt.Msize)
+	_, err = io.ReadFull(c, buf[0:4])
+	if err != nil {
+		return &ixp.Error{err.Error(), ixp.EIO}
+	}
+
+	sz, _ := ixp.Gint32(buf)
+	if sz < 7 || sz > clnt.Msize {
+		return &ixp.Error{"invalid response", ixp.EINVAL}
+	}
+
+	_, err = io.ReadFull(c, buf[4:sz])
+	if err != nil {
+		return &ixp.Error{err.Error(), ixp.EIO}
+	}
+
+	rc, err, _ := ixp.Unpack(buf[0:sz], clnt.Dotu())
+	if err != nil {
+		return err
+	}
+
+	switch rc.Type {
+	case ixp.Rerror:
+		return &ixp.Error{rc.Error, rc.Errornum}
+
+	case ixp.Rversion:
+		if rc.Msize < clnt.Msize || rc.Version != clnt.Dialect.String() {
+			return &ixp.Error{"server changed msize or version", ixp.EIO}
+		}
+
+		return nil
+	}
+
+	return &ixp.Error{"invalid response", ixp.EINVAL}
+}
+
+// Records how the fid can be reestablished after reconnect.
+func (fid *Fid) setPath(aname string, path []string, gen uint64) {
+	fid.Lock()
+	fid.aname = aname
+	fid.path = path
+	fid.gen = gen
+	fid.Unlock()
+}
+
+// Removes the fid from the fids that are reestablished after reconnect.
+func (clnt *Clnt) fidForget(fid *Fid) {
+	clnt.Lock()
+	delete(clnt.fids, fid.Fid)
+	clnt.Unlock()
+}
@@ -0,0 +1,96 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt_test
+
+import (
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"io"
+	"sync"
+	"testing"
+)
+
+// A file whose first read blocks until the link it was received on is
+// cut.
+type stallFile struct {
+	srv.File
+	sync.Mutex
+	stall   chan bool // closed when the first read is received
+	release chan bool // closed to let the first read return
+	nreads  int
+}
+
+func (f *stallFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	f.Lock()
+	f.nreads++
+	first := f.nreads == 1
+	f.Unlock()
+	if first {
+		close(f.stall)
+		<-f.release
+	}
+
+	return copy(buf, "data"), nil
+}
+
+func TestReconnectRetry(t *testing.T) {
+	user := srvtest.User()
+	root := srvtest.Root(t, 0777)
+	f := &stallFile{stall: make(chan bool), release: make(chan bool)}
+	if err := root.Add(&f.File, "f", user, nil, 0444, f); err != nil {
+		t.Fatal(err)
+	}
+
+	s := srvtest.FileSrv(t, root)
+	var mu sync.Mutex
+	var faults *srvtest.Faults
+	dial := func() (io.ReadWriteCloser, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		faults = new(srvtest.Faults)
+		sc, cc := srvtest.Pipe(faults)
+		s.NewConn(sc)
+		return cc, nil
+	}
+
+	c, err := clnt.MountResilient(dial, "", user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Unmount()
+
+	file, err := c.FOpen("/f", ixp.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		/* cut the link while the Tread is pending */
+		<-f.stall
+		mu.Lock()
+		faults.Cut()
+		mu.Unlock()
+		close(f.release)
+	}()
+
+	buf := make([]byte, 16)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("the read wasn't retried after reconnect: %v", err)
+	}
+
+	if string(buf[0:n]) != "data" {
+		t.Errorf("read %q, want %q", buf[0:n], "data")
+	}
+
+	f.Lock()
+	nreads := f.nreads
+	f.Unlock()
+	if nreads != 2 {
+		t.Errorf("the server got %d reads, want 2", nreads)
+	}
+}
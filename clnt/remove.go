@@ -16,7 +16,11 @@ func (clnt *Clnt) Remove(fid *Fid) error {
 	}
 
 	_, err = clnt.Rpc(tc)
+	clnt.Cache.renamed()
+	clnt.Cache.changed(fid.Qid)
+	clnt.fidForget(fid)
 	clnt.fidpool.putId(fid.Fid)
+	clnt.clunkDir(fid)
 	fid.Fid = ixp.NOFID
 
 	return err
@@ -4,32 +4,65 @@
 
 package clnt
 
-import "github.com/jsouthworth/ixp"
+import (
+	"context"
+	"github.com/jsouthworth/ixp"
+)
 
 // Returns the metadata for the file associated with the Fid, or an Error.
+// If the 9P2000.L dialect is spoken, the metadata is read with Tgetattr.
 func (clnt *Clnt) Stat(fid *Fid) (*ixp.Dir, error) {
+	return clnt.StatContext(context.Background(), fid)
+}
+
+// Same as Stat, but the request is flushed if the context is cancelled.
+func (clnt *Clnt) StatContext(ctx context.Context, fid *Fid) (*ixp.Dir, error) {
+	if clnt.Dialect == ixp.Dialect9P2000L {
+		d, err := clnt.lstat(ctx, fid)
+		if err != nil {
+			return nil, err
+		}
+
+		clnt.Cache.setStat(fid.cacheKey(), d)
+		return d, nil
+	}
+
 	tc := clnt.NewFcall()
 	err := ixp.PackTstat(tc, fid.Fid)
 	if err != nil {
 		return nil, err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
 
+	clnt.Cache.setStat(fid.cacheKey(), &rc.Dir)
 	return &rc.Dir, nil
 }
 
 // Returns the metadata for a named file, or an Error.
 func (clnt *Clnt) FStat(path string) (*ixp.Dir, error) {
-	fid, err := clnt.FWalk(path)
+	return clnt.FStatContext(context.Background(), path)
+}
+
+// Same as FStat, but the requests are flushed if the context is
+// cancelled. If the client has a Cache, the metadata may be returned
+// from it.
+func (clnt *Clnt) FStatContext(ctx context.Context, path string) (*ixp.Dir, error) {
+	if clnt.Cache != nil {
+		if d := clnt.Cache.stat(clnt.Root.cacheKey(splitPath(path)...)); d != nil {
+			return d, nil
+		}
+	}
+
+	fid, err := clnt.FWalkContext(ctx, path)
 	if err != nil {
 		return nil, err
 	}
 
-	d, err := clnt.Stat(fid)
+	d, err := clnt.StatContext(ctx, fid)
 	clnt.Clunk(fid)
 	return d, err
 }
@@ -37,11 +70,25 @@ func (clnt *Clnt) FStat(path string) (*ixp.Dir, error) {
 // Modifies the data of the file associated with the Fid, or an Error.
 func (clnt *Clnt) Wstat(fid *Fid, dir *ixp.Dir) error {
 	tc := clnt.NewFcall()
-	err := ixp.PackTwstat(tc, fid.Fid, dir, clnt.Dotu)
+	err := ixp.PackTwstat(tc, fid.Fid, dir, clnt.Dotu())
 	if err != nil {
 		return err
 	}
 
 	_, err = clnt.Rpc(tc)
+	if dir.Name != "" {
+		clnt.Cache.renamed()
+	}
+
+	if err == nil && dir.Name != "" {
+		/* the fid follows the file to its new name */
+		fid.Lock()
+		if n := len(fid.path); n > 0 {
+			fid.path = append(append([]string(nil), fid.path[:n-1]...), dir.Name)
+		}
+		fid.Unlock()
+	}
+
+	clnt.Cache.changed(fid.Qid)
 	return err
 }
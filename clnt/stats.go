@@ -0,0 +1,110 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"github.com/jsouthworth/ixp"
+	"sync"
+)
+
+// The ClntList type keeps track of all live clients.
+type ClntList struct {
+	sync.Mutex
+	clntList, clntLast *Clnt
+	nextId             uint64
+}
+
+var clnts = new(ClntList)
+
+// Stats contains a snapshot of the counters of a client.
+type Stats struct {
+	Serial     uint64           // unique number of the client in the registry
+	Id         string           // the client's Id
+	Msize      uint32           // negotiated message size
+	Dialect    ixp.Dialect      // dialect negotiated with the server
+	Rpcs       map[uint8]uint64 // number of requests sent, by message type
+	Sent       uint64           // total size of the T messages sent
+	Received   uint64           // total size of the R messages received
+	Pending    int              // number of requests waiting for a response
+	MaxPending int              // maximum number of pending requests
+	Tags       int              // number of tags allocated from the tag pool
+	Fids       int              // number of fids allocated from the fid pool
+	Reconnects uint64           // number of successful reconnects
+}
+
+func (clnt *Clnt) statsLink() {
+	clnts.Lock()
+	clnts.nextId++
+	clnt.serial = clnts.nextId
+	if clnts.clntLast != nil {
+		clnts.clntLast.next = clnt
+	} else {
+		clnts.clntList = clnt
+	}
+
+	clnt.prev = clnts.clntLast
+	clnts.clntLast = clnt
+	clnts.Unlock()
+
+	if sop, ok := (interface{}(clnt)).(StatsOps); ok {
+		sop.statsRegister()
+	}
+}
+
+func (clnt *Clnt) statsUnlink() {
+	clnts.Lock()
+	if clnt.prev != nil {
+		clnt.prev.next = clnt.next
+	} else if clnts.clntList == clnt {
+		clnts.clntList = clnt.next
+	}
+
+	if clnt.next != nil {
+		clnt.next.prev = clnt.prev
+	} else if clnts.clntLast == clnt {
+		clnts.clntLast = clnt.prev
+	}
+
+	clnt.next = nil
+	clnt.prev = nil
+	clnts.Unlock()
+}
+
+// Returns all clients whose connection to the server is still open.
+func Clnts() []*Clnt {
+	var ret []*Clnt
+
+	clnts.Lock()
+	for clnt := clnts.clntList; clnt != nil; clnt = clnt.next {
+		ret = append(ret, clnt)
+	}
+	clnts.Unlock()
+
+	return ret
+}
+
+// Returns a snapshot of the client's counters.
+func (clnt *Clnt) Stats() *Stats {
+	st := new(Stats)
+	clnt.Lock()
+	st.Serial = clnt.serial
+	st.Id = clnt.Id
+	st.Msize = clnt.Msize
+	st.Dialect = clnt.Dialect
+	st.Reconnects = clnt.nreconn
+	st.Rpcs = make(map[uint8]uint64, len(clnt.nrpcs))
+	for t, n := range clnt.nrpcs {
+		st.Rpcs[t] = n
+	}
+	st.Sent = clnt.tsz
+	st.Received = clnt.rsz
+	st.Pending = clnt.npend
+	st.MaxPending = clnt.maxpend
+	clnt.Unlock()
+
+	st.Tags = clnt.tagpool.count()
+	st.Fids = clnt.fidpool.count()
+	return st
+}
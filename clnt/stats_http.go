@@ -0,0 +1,111 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build httpstats
+// +build httpstats
+
+package clnt
+
+import (
+	"fmt"
+	"github.com/jsouthworth/ixp"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var httponce sync.Once
+
+func (clnt *Clnt) statsRegister() {
+	httponce.Do(func() {
+		http.HandleFunc("/ixp/clnt/", StatsHandler)
+	})
+}
+
+// Shows the counters and the last logged 9P messages of the client.
+func (clnt *Clnt) ServeHTTP(c http.ResponseWriter, r *http.Request) {
+	st := clnt.Stats()
+	io.WriteString(c, fmt.Sprintf("<html><body><h1>Client %d %s</h1>",
+		st.Serial, html.EscapeString(st.Id)))
+	defer io.WriteString(c, "</body></html>")
+
+	// statistics
+	io.WriteString(c, fmt.Sprintf("<p>Msize: %d<br>Dialect: %v", st.Msize, st.Dialect))
+	io.WriteString(c, fmt.Sprintf("<br>Sent %v bytes", st.Sent))
+	io.WriteString(c, fmt.Sprintf("<br>Received %v bytes", st.Received))
+	io.WriteString(c, fmt.Sprintf("<br>Pending requests: %d max %d", st.Pending, st.MaxPending))
+	io.WriteString(c, fmt.Sprintf("<br>Allocated tags: %d", st.Tags))
+	io.WriteString(c, fmt.Sprintf("<br>Allocated fids: %d", st.Fids))
+	io.WriteString(c, fmt.Sprintf("<br>Reconnects: %d", st.Reconnects))
+
+	types := make([]int, 0, len(st.Rpcs))
+	for t := range st.Rpcs {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+
+	io.WriteString(c, "<h2>Requests</h2><table>")
+	for _, t := range types {
+		io.WriteString(c, fmt.Sprintf("<tr><td>%s</td><td>%d</td></tr>",
+			ixp.TypeName(uint8(t)), st.Rpcs[uint8(t)]))
+	}
+	io.WriteString(c, "</table>")
+
+	// fcalls
+	if clnt.Debuglevel&DbgLogFcalls == 0 || clnt.Log == nil {
+		io.WriteString(c, "<h2>9P messages</h2><p>not logged (DbgLogFcalls is not set)")
+		return
+	}
+
+	fs := clnt.Log.Filter(clnt, DbgLogFcalls)
+	io.WriteString(c, fmt.Sprintf("<h2>Last %d 9P messages</h2><pre>", len(fs)))
+	for _, l := range fs {
+		fc, ok := l.Data.(*ixp.Fcall)
+		if !ok || fc.Type == 0 {
+			continue
+		}
+
+		io.WriteString(c, html.EscapeString(fc.String())+"\n")
+	}
+	io.WriteString(c, "</pre>")
+}
+
+// Serves the list of live clients at /ixp/clnt/ and the stats of
+// a single client at /ixp/clnt/<serial>. The handler is registered
+// in the default HTTP mux when the first client is created.
+func StatsHandler(c http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/ixp/clnt/")
+	if name == "" {
+		io.WriteString(c, "<html><body><h1>Clients</h1><p>")
+		defer io.WriteString(c, "</body></html>")
+
+		cl := Clnts()
+		if len(cl) == 0 {
+			io.WriteString(c, "none")
+			return
+		}
+
+		for _, clnt := range cl {
+			io.WriteString(c, fmt.Sprintf("<a href='/ixp/clnt/%d'>%d</a> %s<br>",
+				clnt.serial, clnt.serial, html.EscapeString(clnt.Id)))
+		}
+		return
+	}
+
+	serial, err := strconv.ParseUint(name, 10, 64)
+	if err == nil {
+		for _, clnt := range Clnts() {
+			if clnt.serial == serial {
+				clnt.ServeHTTP(c, r)
+				return
+			}
+		}
+	}
+
+	http.NotFound(c, r)
+}
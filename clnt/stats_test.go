@@ -0,0 +1,88 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt_test
+
+import (
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"testing"
+	"time"
+)
+
+// Returns true if the client is in the list of the live clients.
+func live(c *clnt.Clnt) bool {
+	for _, lc := range clnt.Clnts() {
+		if lc == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestStats(t *testing.T) {
+	s := srvtest.FileSrv(t, srvtest.Root(t, 0777))
+	c, unmount, err := srvtest.Loopback(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, unmountOther, err := srvtest.Loopback(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmountOther()
+
+	if !live(c) || !live(other) {
+		t.Fatal("the mounted clients aren't in the list")
+	}
+
+	st := c.Stats()
+	if st.Serial == 0 || st.Serial == other.Stats().Serial {
+		t.Errorf("serials %d and %d", st.Serial, other.Stats().Serial)
+	}
+
+	if st.Rpcs[ixp.Tversion] != 1 || st.Rpcs[ixp.Tattach] != 1 || st.Sent == 0 || st.Received == 0 {
+		t.Errorf("stats after mount: %+v", st)
+	}
+
+	if st.Dialect != ixp.Dialect9P2000u || st.Msize != c.Msize || st.Fids != 1 || st.Tags != 1 {
+		t.Errorf("stats after mount: %+v", st)
+	}
+
+	/* FStat walks, stats and clunks a fid, the requests keep their tags */
+	for i := 0; i < 2; i++ {
+		if _, err := c.FStat("/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nst := c.Stats()
+	for _, typ := range []uint8{ixp.Twalk, ixp.Tstat, ixp.Tclunk} {
+		if n := nst.Rpcs[typ] - st.Rpcs[typ]; n != 2 {
+			t.Errorf("%d %s sent, want 2", n, ixp.TypeName(typ))
+		}
+	}
+
+	if nst.Sent <= st.Sent || nst.Received <= st.Received || nst.Fids != 1 || nst.Tags != 1 || nst.Pending != 0 {
+		t.Errorf("stats after FStat: %+v, before %+v", nst, st)
+	}
+
+	if ost := other.Stats(); ost.Rpcs[ixp.Tstat] != 0 {
+		t.Errorf("stats of the other client: %+v", ost)
+	}
+
+	/* the client is removed once its connection is closed */
+	unmount()
+	deadline := time.Now().Add(5 * time.Second)
+	for live(c) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if live(c) || !live(other) {
+		t.Errorf("clients after unmount: %v", clnt.Clnts())
+	}
+}
@@ -101,7 +101,7 @@ func (tag *Tag) reqproc() {
 func (tag *Tag) Auth(afid *Fid, user ixp.User, aname string) error {
 	req := tag.reqAlloc()
 	req.fid = afid
-	err := ixp.PackTauth(req.Tc, afid.Fid, user.Name(), aname, uint32(user.Id()), tag.clnt.Dotu)
+	err := ixp.PackTauth(req.Tc, afid.Fid, user.Name(), aname, uint32(user.Id()), tag.clnt.Dotu())
 	if err != nil {
 		return err
 	}
@@ -121,7 +121,7 @@ func (tag *Tag) Attach(fid, afid *Fid, user ixp.User, aname string) error {
 
 	req := tag.reqAlloc()
 	req.fid = fid
-	err := ixp.PackTattach(req.Tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), tag.clnt.Dotu)
+	err := ixp.PackTattach(req.Tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), tag.clnt.Dotu())
 	if err != nil {
 		return err
 	}
@@ -161,7 +161,7 @@ func (tag *Tag) Open(fid *Fid, mode uint8) error {
 func (tag *Tag) Create(fid *Fid, name string, perm uint32, mode uint8, ext string) error {
 	req := tag.reqAlloc()
 	req.fid = fid
-	err := ixp.PackTcreate(req.Tc, fid.Fid, name, perm, mode, ext, tag.clnt.Dotu)
+	err := ixp.PackTcreate(req.Tc, fid.Fid, name, perm, mode, ext, tag.clnt.Dotu())
 	if err != nil {
 		return err
 	}
@@ -228,7 +228,7 @@ func (tag *Tag) Stat(fid *Fid) error {
 func (tag *Tag) Wstat(fid *Fid, dir *ixp.Dir) error {
 	req := tag.reqAlloc()
 	req.fid = fid
-	err := ixp.PackTwstat(req.Tc, fid.Fid, dir, tag.clnt.Dotu)
+	err := ixp.PackTwstat(req.Tc, fid.Fid, dir, tag.clnt.Dotu())
 	if err != nil {
 		return err
 	}
@@ -5,6 +5,7 @@
 package clnt
 
 import (
+	"context"
 	"github.com/jsouthworth/ixp"
 	"strings"
 )
@@ -14,79 +15,91 @@ import (
 // were walked successfully, an Error is returned. Otherwise a slice with a
 // Qid for each walked name is returned.
 func (clnt *Clnt) Walk(fid *Fid, newfid *Fid, wnames []string) ([]ixp.Qid, error) {
+	return clnt.WalkContext(context.Background(), fid, newfid, wnames)
+}
+
+// Same as Walk, but the request is flushed if the context is cancelled.
+func (clnt *Clnt) WalkContext(ctx context.Context, fid *Fid, newfid *Fid, wnames []string) ([]ixp.Qid, error) {
 	tc := clnt.NewFcall()
 	err := ixp.PackTwalk(tc, fid.Fid, newfid.Fid, wnames)
 	if err != nil {
 		return nil, err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, gen, err := clnt.rpcgen(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
 
-	newfid.walked = true
+	for _, qid := range rc.Wqid {
+		clnt.Cache.seen(qid)
+	}
+
+	/* newfid is created only if all names were walked */
+	if len(rc.Wqid) == len(wnames) {
+		newfid.walked = true
+		if n := len(wnames); n > 0 {
+			newfid.Qid = rc.Wqid[n-1]
+		} else {
+			newfid.Qid = fid.Qid
+		}
+
+		path := append(append([]string(nil), fid.path...), wnames...)
+		newfid.User = fid.User
+		newfid.norestore = fid.norestore
+		newfid.setPath(fid.aname, path, gen)
+	}
 	return rc.Wqid, nil
 }
 
 // Walks to a named file. Returns a Fid associated with the file,
 // or an Error.
 func (clnt *Clnt) FWalk(path string) (*Fid, error) {
-	var err error = nil
+	return clnt.FWalkContext(context.Background(), path)
+}
 
-	var i, m int
-	for i = 0; i < len(path); i++ {
-		if path[i] != '/' {
-			break
-		}
+// Same as FWalk, but the requests are flushed if the context is
+// cancelled.
+func (clnt *Clnt) FWalkContext(ctx context.Context, path string) (*Fid, error) {
+	wnames := splitPath(path)
+	key := clnt.Root.cacheKey(wnames...)
+	if err := clnt.Cache.missing(key); err != nil {
+		return nil, err
 	}
 
-	if i > 0 {
-		path = path[i:]
+	newfid, _, err := clnt.walkAll(ctx, clnt.Root, wnames)
+	if err != nil {
+		clnt.Cache.notFound(key, err)
+		return nil, err
 	}
 
-	wnames := strings.Split(path, "/")
+	clnt.Cache.walked(key, newfid.Qid)
+	return newfid, nil
+}
+
+// Walks all wnames starting from fid, with as many Twalks as needed.
+// Returns a new Fid associated with the file and the number of the
+// names walked, or the number of the names walked before the walk
+// failed and an Error.
+func (clnt *Clnt) walkAll(ctx context.Context, fid *Fid, wnames []string) (*Fid, int, error) {
 	newfid := clnt.FidAlloc()
-	fid := clnt.Root
 	newfid.User = fid.User
-
-	/* get rid of the empty names */
-	for i, m = 0, 0; i < len(wnames); i++ {
-		if wnames[i] != "" {
-			wnames[m] = wnames[i]
-			m++
-		}
-	}
-
-	wnames = wnames[0:m]
+	nwalked := 0
 	for {
 		n := len(wnames)
-		if n > 16 {
-			n = 16
+		if n > ixp.MAXWELEM {
+			n = ixp.MAXWELEM
 		}
 
-		tc := clnt.NewFcall()
-		err = ixp.PackTwalk(tc, fid.Fid, newfid.Fid, wnames[0:n])
-		if err != nil {
-			goto error
-		}
-
-		var rc *ixp.Fcall
-		rc, err = clnt.Rpc(tc)
-		if err != nil {
-			goto error
-		}
-
-		newfid.walked = true
-		if len(rc.Wqid) != n {
+		wqids, err := clnt.WalkContext(ctx, fid, newfid, wnames[0:n])
+		if err == nil && len(wqids) != n {
 			err = &ixp.Error{"file not found", ixp.ENOENT}
-			goto error
 		}
 
-		if len(rc.Wqid) > 0 {
-			newfid.Qid = rc.Wqid[len(rc.Wqid)-1]
-		} else {
-			newfid.Qid = fid.Qid
+		nwalked += len(wqids)
+		if err != nil {
+			clnt.Clunk(newfid)
+			return nil, nwalked, err
 		}
 
 		wnames = wnames[n:]
@@ -96,9 +109,31 @@ func (clnt *Clnt) FWalk(path string) (*Fid, error) {
 		}
 	}
 
-	return newfid, nil
+	return newfid, nwalked, nil
+}
+
+// Splits the path into names, skipping the empty ones.
+func splitPath(path string) []string {
+	var i, m int
+	for i = 0; i < len(path); i++ {
+		if path[i] != '/' {
+			break
+		}
+	}
+
+	if i > 0 {
+		path = path[i:]
+	}
+
+	wnames := strings.Split(path, "/")
+
+	/* get rid of the empty names */
+	for i, m = 0, 0; i < len(wnames); i++ {
+		if wnames[i] != "" {
+			wnames[m] = wnames[i]
+			m++
+		}
+	}
 
-error:
-	clnt.Clunk(newfid)
-	return nil, err
+	return wnames[0:m]
 }
@@ -4,53 +4,91 @@
 
 package clnt
 
-import "github.com/jsouthworth/ixp"
+import (
+	"context"
+	"github.com/jsouthworth/ixp"
+)
 
 // Write up to len(data) bytes starting from offset. Returns the
 // number of bytes written, or an Error.
 func (clnt *Clnt) Write(fid *Fid, data []byte, offset uint64) (int, error) {
+	return clnt.WriteContext(context.Background(), fid, data, offset)
+}
+
+// Same as Write, but the request is flushed if the context is cancelled.
+func (clnt *Clnt) WriteContext(ctx context.Context, fid *Fid, data []byte, offset uint64) (int, error) {
 	if uint32(len(data)) > fid.Iounit {
 		data = data[0:fid.Iounit]
 	}
 
 	tc := clnt.NewFcall()
-	err := ixp.PackTwrite(tc, fid.Fid, offset, uint32(len(data)), data)
+	err := ixp.PackTwritev(tc, fid.Fid, offset, data)
 	if err != nil {
 		return 0, err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return 0, err
 	}
 
-	return int(rc.Count), nil
+	n := int(rc.Count)
+	clnt.FreeFcall(rc)
+	clnt.Cache.changed(fid.Qid)
+	return n, nil
 }
 
 // Writes up to len(buf) bytes to a file. Returns the number of
 // bytes written, or an Error.
 func (file *File) Write(buf []byte) (int, error) {
-	n, err := file.WriteAt(buf, int64(file.offset))
-	if err == nil {
-		file.offset += uint64(n)
-	}
+	return file.WriteContext(context.Background(), buf)
+}
 
+// Same as Write, but the request is flushed if the context is cancelled.
+func (file *File) WriteContext(ctx context.Context, buf []byte) (int, error) {
+	n, err := file.WriteAtContext(ctx, buf, int64(file.offset))
+	file.offset += uint64(n)
 	return n, err
 }
 
 // Writes up to len(buf) bytes starting from offset. Returns the number
 // of bytes written, or an Error.
 func (file *File) WriteAt(buf []byte, offset int64) (int, error) {
-	return file.fid.Clnt.Write(file.fid, buf, uint64(offset))
+	return file.WriteAtContext(context.Background(), buf, offset)
+}
+
+// Same as WriteAt, but the requests are flushed if the context is
+// cancelled. If buf is bigger than Iounit and the window of the file
+// allows it, the data is written by multiple concurrent Twrites (see
+// SetWindow). If one of them fails, the returned count only covers the
+// data before it, but the data after it may have been written too, by
+// the Twrites that were in flight.
+func (file *File) WriteAtContext(ctx context.Context, buf []byte, offset int64) (int, error) {
+	if len(buf) > int(file.fid.Iounit) && file.window() > 1 {
+		return file.pipeline(ctx, buf, offset, file.writeAt)
+	}
+
+	return file.writeAt(ctx, buf, offset)
+}
+
+// Writes up to Iounit bytes with a single Twrite.
+func (file *File) writeAt(ctx context.Context, buf []byte, offset int64) (int, error) {
+	return file.fid.Clnt.WriteContext(ctx, file.fid, buf, uint64(offset))
 }
 
 // Writes exactly len(buf) bytes starting from offset. Returns the number of
 // bytes written. If Error is returned the number of bytes can be less
 // than len(buf).
 func (file *File) Writen(buf []byte, offset uint64) (int, error) {
+	return file.WritenContext(context.Background(), buf, offset)
+}
+
+// Same as Writen, but stops and flushes the outstanding request if the
+// context is cancelled.
+func (file *File) WritenContext(ctx context.Context, buf []byte, offset uint64) (int, error) {
 	ret := 0
 	for len(buf) > 0 {
-		n, err := file.WriteAt(buf, int64(offset))
+		n, err := file.WriteAtContext(ctx, buf, int64(offset))
 		if err != nil {
 			return ret, err
 		}
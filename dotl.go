@@ -0,0 +1,109 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Converts Linux file mode (the S_IF* file type and the protection
+// bits, as in the Mode field of an Attr) to the Mode field of a Dir.
+func AttrMode(mode uint32) uint32 {
+	m := mode & 0777
+	switch mode & S_IFMT {
+	case S_IFDIR:
+		m |= DMDIR
+	case S_IFLNK:
+		m |= DMSYMLINK
+	case S_IFSOCK:
+		m |= DMSOCKET
+	case S_IFIFO:
+		m |= DMNAMEDPIPE
+	case S_IFCHR, S_IFBLK:
+		m |= DMDEVICE
+	}
+
+	if mode&S_ISUID != 0 {
+		m |= DMSETUID
+	}
+	if mode&S_ISGID != 0 {
+		m |= DMSETGID
+	}
+
+	return m
+}
+
+// Converts the Mode field of a Dir to Linux file mode. Device files
+// are reported as character devices.
+func LinuxMode(mode uint32) uint32 {
+	m := mode & 0777
+	switch {
+	case mode&DMDIR != 0:
+		m |= S_IFDIR
+	case mode&DMSYMLINK != 0:
+		m |= S_IFLNK
+	case mode&DMSOCKET != 0:
+		m |= S_IFSOCK
+	case mode&DMNAMEDPIPE != 0:
+		m |= S_IFIFO
+	case mode&DMDEVICE != 0:
+		m |= S_IFCHR
+	default:
+		m |= S_IFREG
+	}
+
+	if mode&DMSETUID != 0 {
+		m |= S_ISUID
+	}
+	if mode&DMSETGID != 0 {
+		m |= S_ISGID
+	}
+
+	return m
+}
+
+// Returns the Dir with the attributes of the file called name. The
+// user and group names are the numeric IDs, Muid is empty.
+func (a *Attr) Dir(name string) *Dir {
+	d := new(Dir)
+	d.Qid = a.Qid
+	d.Mode = AttrMode(a.Mode)
+	d.Atime = uint32(a.AtimeSec)
+	d.Mtime = uint32(a.MtimeSec)
+	d.Length = a.Size
+	d.Name = name
+	d.Uid = strconv.FormatUint(uint64(a.Uid), 10)
+	d.Gid = strconv.FormatUint(uint64(a.Gid), 10)
+	d.Uidnum = a.Uid
+	d.Gidnum = a.Gid
+	d.Muidnum = NOUID
+	if a.Mode&S_IFMT == S_IFCHR || a.Mode&S_IFMT == S_IFBLK {
+		t := "c"
+		if a.Mode&S_IFMT == S_IFBLK {
+			t = "b"
+		}
+
+		/* the encoding of dev_t used by Linux */
+		major := (a.Rdev>>8)&0xfff | (a.Rdev>>32)&^0xfff
+		minor := a.Rdev&0xff | (a.Rdev>>12)&^0xff
+		d.Ext = fmt.Sprintf("%s %d %d", t, major, minor)
+	}
+
+	return d
+}
+
+// Returns the Dir for the directory entry. Only the Qid, the name and
+// the file type in Mode are known from the entry.
+func (d *Dirent) Dir() *Dir {
+	dir := new(Dir)
+	dir.Qid = d.Qid
+	dir.Mode = uint32(d.Qid.Type)<<24 | AttrMode(uint32(d.Type)<<12)
+	dir.Name = d.Name
+	dir.Uidnum = NOUID
+	dir.Gidnum = NOUID
+	dir.Muidnum = NOUID
+	return dir
+}
@@ -0,0 +1,552 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of the files read by FileUsers.
+const (
+	Plan9Users  = iota // Plan 9 users file, id:name:leader:members
+	PasswdUsers        // passwd and group files
+)
+
+// Users implementation that reads the users and groups from files
+// instead of the host's user database. It understands the Plan 9
+// users file (/adm/users), where each line defines a user and a
+// group with the same name and id:
+//
+//	id:name:leader:members
+//
+// and the Unix passwd and group files. A group can have a leader.
+// If it doesn't, all its members are considered leaders. The files
+// are checked for changes at most once every Interval, and reloaded
+// when they change. The users and groups can also be added and removed
+// using the methods of FileUsers. These changes are kept in memory only,
+// and are lost when the files are reloaded. If the changed files can't
+// be loaded, the users and groups loaded before are kept, and the error
+// is returned by Err.
+type FileUsers struct {
+	sync.Mutex
+	Interval time.Duration // how often the files are checked for changes
+
+	format  int
+	files   []string    // users file, or passwd and group files
+	stamps  []time.Time // modification times of the files when loaded
+	checked time.Time   // last time the files were checked
+	err     error       // error of the last load of the files
+
+	users  map[string]*fileUser
+	uids   map[int]*fileUser
+	groups map[string]*fileGroup
+	gids   map[int]*fileGroup
+}
+
+type fileUser struct {
+	name string
+	id   int
+	gid  int // primary group
+	up   *FileUsers
+}
+
+type fileGroup struct {
+	name    string
+	id      int
+	leader  string
+	members []string
+	up      *FileUsers
+}
+
+var Eusers = &Error{"bad users file", EINVAL}
+
+// Creates a user database from a Plan 9 users file. If path is
+// empty, the database is empty and can be changed only by the
+// methods of FileUsers.
+func NewFileUsers(path string) (*FileUsers, error) {
+	up := newFileUsers(Plan9Users)
+	if path != "" {
+		up.files = []string{path}
+	}
+
+	return up, up.Reload()
+}
+
+// Creates a user database from passwd and group files.
+func NewPasswdUsers(passwd, group string) (*FileUsers, error) {
+	up := newFileUsers(PasswdUsers)
+	up.files = []string{passwd, group}
+	return up, up.Reload()
+}
+
+func newFileUsers(format int) *FileUsers {
+	up := new(FileUsers)
+	up.Interval = time.Second
+	up.format = format
+	up.clear()
+	return up
+}
+
+func (up *FileUsers) clear() {
+	up.users = make(map[string]*fileUser)
+	up.uids = make(map[int]*fileUser)
+	up.groups = make(map[string]*fileGroup)
+	up.gids = make(map[int]*fileGroup)
+}
+
+// Reads the lines of a file, skipping the empty ones and the comments.
+// Returns the lines split into fields.
+func readFields(path string) ([][]string, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, &Error{err.Error(), EIO}
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, &Error{err.Error(), EIO}
+	}
+
+	var lines [][]string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || l[0] == '#' {
+			continue
+		}
+
+		lines = append(lines, strings.Split(l, ":"))
+	}
+
+	if s.Err() != nil {
+		return nil, time.Time{}, &Error{s.Err().Error(), EIO}
+	}
+
+	return lines, st.ModTime(), nil
+}
+
+// Splits a comma-separated list of names.
+func splitNames(s string) []string {
+	var names []string
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if n != "" {
+			names = append(names, n)
+		}
+	}
+
+	return names
+}
+
+// Reads the files again. If the files can't be read, the
+// users and groups are not changed.
+func (up *FileUsers) Reload() error {
+	up.Lock()
+	defer up.Unlock()
+	up.err = up.load()
+	return up.err
+}
+
+// Returns the error of the last load of the files, by Reload or when
+// the files changed, or nil if it succeeded.
+func (up *FileUsers) Err() error {
+	up.Lock()
+	defer up.Unlock()
+	return up.err
+}
+
+func (up *FileUsers) load() error {
+	up.checked = time.Now()
+	if len(up.files) == 0 {
+		return nil
+	}
+
+	var lines [][][]string
+	var stamps []time.Time
+	for _, path := range up.files {
+		l, t, err := readFields(path)
+		if err != nil {
+			return err
+		}
+
+		lines = append(lines, l)
+		stamps = append(stamps, t)
+	}
+
+	nup := newFileUsers(up.format)
+	var err error
+	if up.format == Plan9Users {
+		err = nup.loadPlan9(lines[0])
+	} else {
+		err = nup.loadPasswd(lines[0], lines[1])
+	}
+
+	if err != nil {
+		return err
+	}
+
+	up.users, up.uids, up.groups, up.gids = nup.users, nup.uids, nup.groups, nup.gids
+	for _, u := range up.users {
+		u.up = up
+	}
+	for _, g := range up.groups {
+		g.up = up
+	}
+
+	up.stamps = stamps
+	return nil
+}
+
+func (up *FileUsers) loadPlan9(lines [][]string) error {
+	for _, f := range lines {
+		if len(f) != 4 {
+			return Eusers
+		}
+
+		id, err := strconv.Atoi(f[0])
+		if err != nil {
+			return Eusers
+		}
+
+		err = up.addUser(f[1], id, id)
+		if err == nil {
+			err = up.addGroup(f[1], id, f[2], splitNames(f[3]))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (up *FileUsers) loadPasswd(passwd, group [][]string) error {
+	for _, f := range passwd {
+		if len(f) < 4 {
+			return Eusers
+		}
+
+		uid, err := strconv.Atoi(f[2])
+		if err != nil {
+			return Eusers
+		}
+
+		gid, err := strconv.Atoi(f[3])
+		if err != nil {
+			return Eusers
+		}
+
+		err = up.addUser(f[0], uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range group {
+		if len(f) < 4 {
+			return Eusers
+		}
+
+		gid, err := strconv.Atoi(f[2])
+		if err != nil {
+			return Eusers
+		}
+
+		err = up.addGroup(f[0], gid, "", splitNames(f[3]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reloads the files if they changed since they were loaded.
+func (up *FileUsers) check() {
+	if len(up.files) == 0 || time.Since(up.checked) < up.Interval {
+		return
+	}
+
+	up.checked = time.Now()
+	for i, path := range up.files {
+		st, err := os.Stat(path)
+		if err == nil && !st.ModTime().Equal(up.stamps[i]) {
+			up.err = up.load()
+			return
+		}
+	}
+}
+
+func (up *FileUsers) addUser(name string, uid, gid int) error {
+	if name == "" || strings.ContainsAny(name, ":,") {
+		return &Error{"invalid user name", EINVAL}
+	}
+
+	if up.users[name] != nil || up.uids[uid] != nil {
+		return &Error{"user already exists", EEXIST}
+	}
+
+	u := &fileUser{name, uid, gid, up}
+	up.users[name] = u
+	up.uids[uid] = u
+	return nil
+}
+
+func (up *FileUsers) addGroup(name string, gid int, leader string, members []string) error {
+	if name == "" || strings.ContainsAny(name, ":,") {
+		return &Error{"invalid group name", EINVAL}
+	}
+
+	if up.groups[name] != nil || up.gids[gid] != nil {
+		return &Error{"group already exists", EEXIST}
+	}
+
+	g := &fileGroup{name, gid, leader, members, up}
+	up.groups[name] = g
+	up.gids[gid] = g
+	return nil
+}
+
+// Adds a user with the specified id and primary group id. For the
+// Plan 9 users file, a group with the same name and id should be
+// added too.
+func (up *FileUsers) AddUser(name string, uid, gid int) error {
+	up.Lock()
+	defer up.Unlock()
+	return up.addUser(name, uid, gid)
+}
+
+// Removes the user, and removes it from the groups it is member of.
+func (up *FileUsers) RemoveUser(name string) error {
+	up.Lock()
+	defer up.Unlock()
+	u := up.users[name]
+	if u == nil {
+		return &Error{"unknown user", ENOENT}
+	}
+
+	delete(up.users, name)
+	delete(up.uids, u.id)
+	for _, g := range up.groups {
+		g.members = removeName(g.members, name)
+		if g.leader == name {
+			g.leader = ""
+		}
+	}
+
+	return nil
+}
+
+// Adds a group with the specified id, leader and members.
+func (up *FileUsers) AddGroup(name string, gid int, leader string, members ...string) error {
+	up.Lock()
+	defer up.Unlock()
+	return up.addGroup(name, gid, leader, append([]string(nil), members...))
+}
+
+// Removes the group.
+func (up *FileUsers) RemoveGroup(name string) error {
+	up.Lock()
+	defer up.Unlock()
+	g := up.groups[name]
+	if g == nil {
+		return &Error{"unknown group", ENOENT}
+	}
+
+	delete(up.groups, name)
+	delete(up.gids, g.id)
+	return nil
+}
+
+// Adds the user to the members of the group.
+func (up *FileUsers) AddMember(group, user string) error {
+	up.Lock()
+	defer up.Unlock()
+	g := up.groups[group]
+	if g == nil {
+		return &Error{"unknown group", ENOENT}
+	}
+
+	if up.users[user] == nil {
+		return &Error{"unknown user", ENOENT}
+	}
+
+	g.members = append(removeName(g.members, user), user)
+	return nil
+}
+
+// Removes the user from the members of the group.
+func (up *FileUsers) RemoveMember(group, user string) error {
+	up.Lock()
+	defer up.Unlock()
+	g := up.groups[group]
+	if g == nil {
+		return &Error{"unknown group", ENOENT}
+	}
+
+	g.members = removeName(g.members, user)
+	return nil
+}
+
+func removeName(names []string, name string) []string {
+	for i, n := range names {
+		if n == name {
+			return append(names[0:i:i], names[i+1:]...)
+		}
+	}
+
+	return names
+}
+
+func (up *FileUsers) Uid2User(uid int) User {
+	up.Lock()
+	defer up.Unlock()
+	up.check()
+	if u := up.uids[uid]; u != nil {
+		return u
+	}
+
+	return nil
+}
+
+func (up *FileUsers) Uname2User(uname string) User {
+	up.Lock()
+	defer up.Unlock()
+	up.check()
+	if u := up.users[uname]; u != nil {
+		return u
+	}
+
+	return nil
+}
+
+func (up *FileUsers) Gid2Group(gid int) Group {
+	up.Lock()
+	defer up.Unlock()
+	up.check()
+	if g := up.gids[gid]; g != nil {
+		return g
+	}
+
+	return nil
+}
+
+func (up *FileUsers) Gname2Group(gname string) Group {
+	up.Lock()
+	defer up.Unlock()
+	up.check()
+	if g := up.groups[gname]; g != nil {
+		return g
+	}
+
+	return nil
+}
+
+// Returns true if the user is the leader of the group. If the group
+// has no leader, all its members are leaders.
+func (up *FileUsers) IsLeader(u User, g Group) bool {
+	if u == nil || g == nil {
+		return false
+	}
+
+	up.Lock()
+	fg := up.groups[g.Name()]
+	leader := ""
+	if fg != nil {
+		leader = fg.leader
+	}
+	up.Unlock()
+
+	if fg == nil {
+		return false
+	}
+
+	if leader == "" {
+		return u.IsMember(g)
+	}
+
+	return leader == u.Name()
+}
+
+// Returns true if the user is member of the group. Must be called
+// with up locked.
+func (g *fileGroup) member(u *fileUser) bool {
+	if u.gid == g.id {
+		return true
+	}
+
+	for _, m := range g.members {
+		if m == u.name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (u *fileUser) Name() string { return u.name }
+
+func (u *fileUser) Id() int { return u.id }
+
+func (u *fileUser) Groups() []Group {
+	u.up.Lock()
+	defer u.up.Unlock()
+
+	var groups []Group
+	for _, g := range u.up.groups {
+		if g.member(u) {
+			groups = append(groups, g)
+		}
+	}
+
+	return groups
+}
+
+func (u *fileUser) IsMember(g Group) bool {
+	if g == nil {
+		return false
+	}
+
+	u.up.Lock()
+	defer u.up.Unlock()
+	fg := u.up.groups[g.Name()]
+	return fg != nil && fg.id == g.Id() && fg.member(u)
+}
+
+func (g *fileGroup) Name() string { return g.name }
+
+func (g *fileGroup) Id() int { return g.id }
+
+// Returns the leader of the group, or nil if the group has no leader.
+func (g *fileGroup) Leader() User {
+	g.up.Lock()
+	defer g.up.Unlock()
+	if u := g.up.users[g.leader]; u != nil {
+		return u
+	}
+
+	return nil
+}
+
+func (g *fileGroup) Members() []User {
+	g.up.Lock()
+	defer g.up.Unlock()
+
+	var users []User
+	for _, u := range g.up.users {
+		if g.member(u) {
+			users = append(users, u)
+		}
+	}
+
+	return users
+}
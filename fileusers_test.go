@@ -0,0 +1,258 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes the file in a temporary directory, with a modification time
+// that differs from the previous version of the file.
+func writeUsers(t *testing.T, path, data string) {
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := st.ModTime().Add(time.Duration(len(data)) * time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func names(users []User) string {
+	var s []string
+	for _, u := range users {
+		s = append(s, u.Name())
+	}
+
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+const plan9Users = `
+# id:name:leader:members
+1:glenda:glenda:
+2:sys::glenda,bob
+3:bob::
+4:adm:glenda:bob
+`
+
+func TestPlan9Users(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsers(t, path, plan9Users)
+	up, err := NewFileUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	glenda, bob := up.Uname2User("glenda"), up.Uid2User(3)
+	if glenda == nil || glenda.Id() != 1 || bob == nil || bob.Name() != "bob" {
+		t.Fatalf("users: %v %v", glenda, bob)
+	}
+
+	sys, adm := up.Gid2Group(2), up.Gname2Group("adm")
+	if sys == nil || sys.Name() != "sys" || adm == nil || adm.Id() != 4 {
+		t.Fatalf("groups: %v %v", sys, adm)
+	}
+
+	/* each line defines a user and a group, the user is member of its group */
+	if m := names(sys.Members()); m != "bob,glenda,sys" {
+		t.Errorf("members of sys: %s", m)
+	}
+
+	if !bob.IsMember(up.Gname2Group("bob")) || bob.IsMember(up.Gname2Group("glenda")) {
+		t.Errorf("bob is member of %v", bob.Groups())
+	}
+
+	/* the members of a group without a leader are all leaders */
+	if !up.IsLeader(glenda, sys) || !up.IsLeader(bob, sys) {
+		t.Error("the members of sys aren't leaders")
+	}
+
+	if !up.IsLeader(glenda, adm) || up.IsLeader(bob, adm) {
+		t.Error("glenda isn't the only leader of adm")
+	}
+
+	if l := adm.(*fileGroup).Leader(); l == nil || l.Name() != "glenda" {
+		t.Errorf("leader of adm: %v", l)
+	}
+
+	if u := up.Uname2User("sys"); u == nil || u.Id() != 2 || !u.IsMember(sys) {
+		t.Errorf("user sys: %v", u)
+	}
+}
+
+func TestPasswdUsers(t *testing.T) {
+	dir := t.TempDir()
+	passwd, group := filepath.Join(dir, "passwd"), filepath.Join(dir, "group")
+	writeUsers(t, passwd, "root:x:0:0:root:/root:/bin/sh\nbob:x:1000:100::/home/bob:/bin/sh\n")
+	writeUsers(t, group, "root:x:0:\nwheel:x:10:bob\nusers:x:100:\n")
+	up, err := NewPasswdUsers(passwd, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, bob := up.Uid2User(0), up.Uname2User("bob")
+	wheel, users := up.Gname2Group("wheel"), up.Gid2Group(100)
+	if root == nil || bob == nil || wheel == nil || users == nil {
+		t.Fatalf("users %v %v, groups %v %v", root, bob, wheel, users)
+	}
+
+	/* the primary group of the user, and the groups that list it */
+	if !bob.IsMember(users) || !bob.IsMember(wheel) || root.IsMember(wheel) {
+		t.Errorf("bob is member of %v, root of %v", bob.Groups(), root.Groups())
+	}
+
+	if !up.IsLeader(bob, wheel) || up.IsLeader(root, wheel) {
+		t.Error("bob isn't the only leader of wheel")
+	}
+}
+
+func TestBadUsers(t *testing.T) {
+	dir := t.TempDir()
+	for _, data := range []string{
+		"1:glenda:glenda\n",
+		"1:glenda:glenda::\n",
+		"x:glenda:glenda:\n",
+		"1:glenda::\n1:bob::\n",
+		"1:glenda::\n2:glenda::\n",
+	} {
+		path := filepath.Join(dir, "users")
+		writeUsers(t, path, data)
+		if _, err := NewFileUsers(path); err == nil {
+			t.Errorf("users file %q loaded", data)
+		} else if err != Eusers && !strings.Contains(err.Error(), "exists") {
+			t.Errorf("users file %q: %v", data, err)
+		}
+	}
+
+	passwd, group := filepath.Join(dir, "passwd"), filepath.Join(dir, "group")
+	for _, files := range [][2]string{
+		{"bob:x:1000\n", ""},
+		{"bob:x:x:100\n", ""},
+		{"bob:x:1000:x\n", ""},
+		{"bob:x:1000:100\n", "users:x:100\n"},
+		{"bob:x:1000:100\n", "users:x:x:\n"},
+	} {
+		writeUsers(t, passwd, files[0])
+		writeUsers(t, group, files[1])
+		if _, err := NewPasswdUsers(passwd, group); err != Eusers {
+			t.Errorf("passwd %q, group %q: %v, want %v", files[0], files[1], err, Eusers)
+		}
+	}
+
+	if _, err := NewFileUsers(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing users file loaded")
+	}
+}
+
+func TestFileUsersChanges(t *testing.T) {
+	up, err := NewFileUsers("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := up.AddUser("eve", 5, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := up.AddGroup("eve", 5, "eve"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := up.AddGroup("sys", 2, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	eve := up.Uid2User(5)
+	if eve == nil || up.Uname2User("eve") != eve {
+		t.Fatalf("eve: %v %v", eve, up.Uname2User("eve"))
+	}
+
+	/* the name and the id are both unique */
+	if err := up.AddUser("eve", 6, 6); err == nil {
+		t.Error("user with the same name added")
+	}
+
+	if err := up.AddUser("adam", 5, 5); err == nil || up.Uname2User("adam") != nil {
+		t.Errorf("user with the same id added: %v", err)
+	}
+
+	if err := up.AddMember("sys", "adam"); err == nil {
+		t.Error("unknown user added to sys")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := up.AddMember("sys", "eve"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sys := up.Gname2Group("sys")
+	if m := sys.(*fileGroup).members; len(m) != 1 || !eve.IsMember(sys) {
+		t.Errorf("members of sys: %v", m)
+	}
+
+	if err := up.RemoveUser("eve"); err != nil {
+		t.Fatal(err)
+	}
+
+	if up.Uid2User(5) != nil || up.Uname2User("eve") != nil {
+		t.Error("eve not removed")
+	}
+
+	if g := up.Gname2Group("eve").(*fileGroup); g.leader != "" || len(sys.(*fileGroup).members) != 0 {
+		t.Errorf("eve still in the groups: leader %q, members of sys %v", g.leader, sys.(*fileGroup).members)
+	}
+
+	/* the id can be used again */
+	if err := up.AddUser("adam", 5, 5); err != nil || up.Uid2User(5).Name() != "adam" {
+		t.Errorf("AddUser after RemoveUser: %v", err)
+	}
+
+	if err := up.RemoveGroup("sys"); err != nil || up.Gid2Group(2) != nil || up.Gname2Group("sys") != nil {
+		t.Errorf("RemoveGroup: %v", err)
+	}
+}
+
+func TestFileUsersReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsers(t, path, "1:glenda::\n")
+	up, err := NewFileUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.Interval = 0
+
+	writeUsers(t, path, "1:glenda::\n2:bob::\n")
+	if up.Uname2User("bob") == nil || up.Err() != nil {
+		t.Fatalf("changed users file not loaded: %v", up.Err())
+	}
+
+	/* the users loaded before are kept if the file is bad */
+	writeUsers(t, path, "1:glenda::\n2:bob\n")
+	if up.Uname2User("bob") == nil || up.Uid2User(1) == nil {
+		t.Error("users lost when the bad users file was loaded")
+	}
+
+	if up.Err() != Eusers {
+		t.Errorf("Err: %v, want %v", up.Err(), Eusers)
+	}
+
+	writeUsers(t, path, "1:glenda::\n")
+	if err := up.Reload(); err != nil || up.Err() != nil || up.Uname2User("bob") != nil {
+		t.Errorf("Reload: %v %v", err, up.Err())
+	}
+}
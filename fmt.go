@@ -6,6 +6,94 @@ package ixp
 
 import "fmt"
 
+var typeNames = map[uint8]string{
+	Tversion: "Tversion",
+	Rversion: "Rversion",
+	Tauth:    "Tauth",
+	Rauth:    "Rauth",
+	Tattach:  "Tattach",
+	Rattach:  "Rattach",
+	Terror:   "Terror",
+	Rerror:   "Rerror",
+	Tflush:   "Tflush",
+	Rflush:   "Rflush",
+	Twalk:    "Twalk",
+	Rwalk:    "Rwalk",
+	Topen:    "Topen",
+	Ropen:    "Ropen",
+	Tcreate:  "Tcreate",
+	Rcreate:  "Rcreate",
+	Tread:    "Tread",
+	Rread:    "Rread",
+	Twrite:   "Twrite",
+	Rwrite:   "Rwrite",
+	Tclunk:   "Tclunk",
+	Rclunk:   "Rclunk",
+	Tremove:  "Tremove",
+	Rremove:  "Rremove",
+	Tstat:    "Tstat",
+	Rstat:    "Rstat",
+	Twstat:   "Twstat",
+	Rwstat:   "Rwstat",
+	Tbread:   "Tbread",
+	Rbread:   "Rbread",
+	Tbwrite:  "Tbwrite",
+	Rbwrite:  "Rbwrite",
+	Tbtrunc:  "Tbtrunc",
+	Rbtrunc:  "Rbtrunc",
+
+	/* 9P2000.L */
+	Tlerror:      "Tlerror",
+	Rlerror:      "Rlerror",
+	Tstatfs:      "Tstatfs",
+	Rstatfs:      "Rstatfs",
+	Tlopen:       "Tlopen",
+	Rlopen:       "Rlopen",
+	Tlcreate:     "Tlcreate",
+	Rlcreate:     "Rlcreate",
+	Tsymlink:     "Tsymlink",
+	Rsymlink:     "Rsymlink",
+	Tmknod:       "Tmknod",
+	Rmknod:       "Rmknod",
+	Trename:      "Trename",
+	Rrename:      "Rrename",
+	Treadlink:    "Treadlink",
+	Rreadlink:    "Rreadlink",
+	Tgetattr:     "Tgetattr",
+	Rgetattr:     "Rgetattr",
+	Tsetattr:     "Tsetattr",
+	Rsetattr:     "Rsetattr",
+	Txattrwalk:   "Txattrwalk",
+	Rxattrwalk:   "Rxattrwalk",
+	Txattrcreate: "Txattrcreate",
+	Rxattrcreate: "Rxattrcreate",
+	Treaddir:     "Treaddir",
+	Rreaddir:     "Rreaddir",
+	Tfsync:       "Tfsync",
+	Rfsync:       "Rfsync",
+	Tlock:        "Tlock",
+	Rlock:        "Rlock",
+	Tgetlock:     "Tgetlock",
+	Rgetlock:     "Rgetlock",
+	Tlink:        "Tlink",
+	Rlink:        "Rlink",
+	Tmkdir:       "Tmkdir",
+	Rmkdir:       "Rmkdir",
+	Trenameat:    "Trenameat",
+	Rrenameat:    "Rrenameat",
+	Tunlinkat:    "Tunlinkat",
+	Runlinkat:    "Runlinkat",
+}
+
+// Returns the name of a 9P message type, e.g. "Tread".
+func TypeName(t uint8) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("type %d", t)
+}
+
 func permToString(perm uint32) string {
 	ret := ""
 
@@ -155,6 +243,119 @@ func (fc *Fcall) String() string {
 		ret = fmt.Sprintf("Rremove tag %d", fc.Tag)
 	case Rwstat:
 		ret = fmt.Sprintf("Rwstat tag %d", fc.Tag)
+
+	/* IX block messages */
+	case Tbread:
+		ret = fmt.Sprintf("Tbread tag %d fileid %d offset %d count %d", fc.Tag, fc.Fileid, fc.Offset, fc.Count)
+	case Rbread:
+		ret = fmt.Sprintf("Rbread tag %d count %d", fc.Tag, fc.Count)
+	case Tbwrite:
+		ret = fmt.Sprintf("Tbwrite tag %d fileid %d offset %d count %d", fc.Tag, fc.Fileid, fc.Offset, fc.Count)
+	case Rbwrite:
+		ret = fmt.Sprintf("Rbwrite tag %d count %d", fc.Tag, fc.Count)
+	case Tbtrunc:
+		ret = fmt.Sprintf("Tbtrunc tag %d fileid %d offset %d", fc.Tag, fc.Fileid, fc.Offset)
+	case Rbtrunc:
+		ret = fmt.Sprintf("Rbtrunc tag %d", fc.Tag)
+
+	/* 9P2000.L */
+	case Rlerror:
+		ret = fmt.Sprintf("Rlerror tag %d ecode %d", fc.Tag, fc.Errornum)
+	case Tstatfs:
+		ret = fmt.Sprintf("Tstatfs tag %d fid %d", fc.Tag, fc.Fid)
+	case Rstatfs:
+		st := &fc.Statfs
+		ret = fmt.Sprintf("Rstatfs tag %d type %d bsize %d blocks %d bfree %d bavail %d files %d ffree %d fsid %d namelen %d",
+			fc.Tag, st.Type, st.Bsize, st.Blocks, st.Bfree, st.Bavail, st.Files, st.Ffree, st.Fsid, st.Namelen)
+	case Tlopen:
+		ret = fmt.Sprintf("Tlopen tag %d fid %d flags %#o", fc.Tag, fc.Fid, fc.Flags)
+	case Rlopen:
+		ret = fmt.Sprintf("Rlopen tag %d qid %v iounit %d", fc.Tag, &fc.Qid, fc.Iounit)
+	case Tlcreate:
+		ret = fmt.Sprintf("Tlcreate tag %d fid %d name '%s' flags %#o mode %#o gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Flags, fc.Perm, fc.Lgid)
+	case Rlcreate:
+		ret = fmt.Sprintf("Rlcreate tag %d qid %v iounit %d", fc.Tag, &fc.Qid, fc.Iounit)
+	case Tsymlink:
+		ret = fmt.Sprintf("Tsymlink tag %d fid %d name '%s' target '%s' gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Target, fc.Lgid)
+	case Rsymlink:
+		ret = fmt.Sprintf("Rsymlink tag %d qid %v", fc.Tag, &fc.Qid)
+	case Tmknod:
+		ret = fmt.Sprintf("Tmknod tag %d dfid %d name '%s' mode %#o major %d minor %d gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Perm, fc.Major, fc.Minor, fc.Lgid)
+	case Rmknod:
+		ret = fmt.Sprintf("Rmknod tag %d qid %v", fc.Tag, &fc.Qid)
+	case Trename:
+		ret = fmt.Sprintf("Trename tag %d fid %d dfid %d name '%s'", fc.Tag, fc.Fid, fc.Dfid, fc.Name)
+	case Rrename:
+		ret = fmt.Sprintf("Rrename tag %d", fc.Tag)
+	case Treadlink:
+		ret = fmt.Sprintf("Treadlink tag %d fid %d", fc.Tag, fc.Fid)
+	case Rreadlink:
+		ret = fmt.Sprintf("Rreadlink tag %d target '%s'", fc.Tag, fc.Target)
+	case Tgetattr:
+		ret = fmt.Sprintf("Tgetattr tag %d fid %d mask %#x", fc.Tag, fc.Fid, fc.Mask)
+	case Rgetattr:
+		a := &fc.Attr
+		ret = fmt.Sprintf("Rgetattr tag %d valid %#x qid %v mode %#o uid %d gid %d nlink %d rdev %d size %d blksize %d blocks %d atime %d.%09d mtime %d.%09d ctime %d.%09d btime %d.%09d gen %d data_version %d",
+			fc.Tag, a.Valid, &a.Qid, a.Mode, a.Uid, a.Gid, a.Nlink, a.Rdev, a.Size, a.Blksize, a.Blocks,
+			a.AtimeSec, a.AtimeNsec, a.MtimeSec, a.MtimeNsec, a.CtimeSec, a.CtimeNsec,
+			a.BtimeSec, a.BtimeNsec, a.Gen, a.DataVersion)
+	case Tsetattr:
+		a := &fc.SetAttr
+		ret = fmt.Sprintf("Tsetattr tag %d fid %d valid %#x mode %#o uid %d gid %d size %d atime %d.%09d mtime %d.%09d",
+			fc.Tag, fc.Fid, a.Valid, a.Mode, a.Uid, a.Gid, a.Size, a.AtimeSec, a.AtimeNsec, a.MtimeSec, a.MtimeNsec)
+	case Rsetattr:
+		ret = fmt.Sprintf("Rsetattr tag %d", fc.Tag)
+	case Txattrwalk:
+		ret = fmt.Sprintf("Txattrwalk tag %d fid %d newfid %d name '%s'", fc.Tag, fc.Fid, fc.Newfid, fc.Name)
+	case Rxattrwalk:
+		ret = fmt.Sprintf("Rxattrwalk tag %d size %d", fc.Tag, fc.Xattrsize)
+	case Txattrcreate:
+		ret = fmt.Sprintf("Txattrcreate tag %d fid %d name '%s' size %d flags %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Xattrsize, fc.Flags)
+	case Rxattrcreate:
+		ret = fmt.Sprintf("Rxattrcreate tag %d", fc.Tag)
+	case Treaddir:
+		ret = fmt.Sprintf("Treaddir tag %d fid %d offset %d count %d", fc.Tag, fc.Fid, fc.Offset, fc.Count)
+	case Rreaddir:
+		ret = fmt.Sprintf("Rreaddir tag %d count %d", fc.Tag, fc.Count)
+	case Tfsync:
+		ret = fmt.Sprintf("Tfsync tag %d fid %d datasync %d", fc.Tag, fc.Fid, fc.Datasync)
+	case Rfsync:
+		ret = fmt.Sprintf("Rfsync tag %d", fc.Tag)
+	case Tlock:
+		lk := &fc.Flock
+		ret = fmt.Sprintf("Tlock tag %d fid %d type %d flags %d start %d length %d proc_id %d client_id '%s'",
+			fc.Tag, fc.Fid, lk.Type, lk.Flags, lk.Start, lk.Length, lk.ProcId, lk.ClientId)
+	case Rlock:
+		ret = fmt.Sprintf("Rlock tag %d status %d", fc.Tag, fc.Status)
+	case Tgetlock:
+		lk := &fc.Flock
+		ret = fmt.Sprintf("Tgetlock tag %d fid %d type %d start %d length %d proc_id %d client_id '%s'",
+			fc.Tag, fc.Fid, lk.Type, lk.Start, lk.Length, lk.ProcId, lk.ClientId)
+	case Rgetlock:
+		lk := &fc.Flock
+		ret = fmt.Sprintf("Rgetlock tag %d type %d start %d length %d proc_id %d client_id '%s'",
+			fc.Tag, lk.Type, lk.Start, lk.Length, lk.ProcId, lk.ClientId)
+	case Tlink:
+		ret = fmt.Sprintf("Tlink tag %d dfid %d fid %d name '%s'", fc.Tag, fc.Dfid, fc.Fid, fc.Name)
+	case Rlink:
+		ret = fmt.Sprintf("Rlink tag %d", fc.Tag)
+	case Tmkdir:
+		ret = fmt.Sprintf("Tmkdir tag %d dfid %d name '%s' mode %#o gid %d", fc.Tag, fc.Fid, fc.Name, fc.Perm, fc.Lgid)
+	case Rmkdir:
+		ret = fmt.Sprintf("Rmkdir tag %d qid %v", fc.Tag, &fc.Qid)
+	case Trenameat:
+		ret = fmt.Sprintf("Trenameat tag %d olddirfid %d oldname '%s' newdirfid %d newname '%s'",
+			fc.Tag, fc.Fid, fc.Name, fc.Dfid, fc.Newname)
+	case Rrenameat:
+		ret = fmt.Sprintf("Rrenameat tag %d", fc.Tag)
+	case Tunlinkat:
+		ret = fmt.Sprintf("Tunlinkat tag %d dirfid %d name '%s' flags %#x", fc.Tag, fc.Fid, fc.Name, fc.Flags)
+	case Runlinkat:
+		ret = fmt.Sprintf("Runlinkat tag %d", fc.Tag)
 	}
 
 	return ret
@@ -0,0 +1,118 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+import (
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// Converts the Mode and Ext fields of a Dir to io/fs file mode.
+func FileMode(mode uint32, ext string) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	if mode&DMDIR != 0 {
+		m |= fs.ModeDir
+	}
+	if mode&DMAPPEND != 0 {
+		m |= fs.ModeAppend
+	}
+	if mode&DMEXCL != 0 {
+		m |= fs.ModeExclusive
+	}
+	if mode&DMTMP != 0 {
+		m |= fs.ModeTemporary
+	}
+	if mode&DMSYMLINK != 0 {
+		m |= fs.ModeSymlink
+	}
+	if mode&DMDEVICE != 0 {
+		m |= fs.ModeDevice
+		if strings.HasPrefix(ext, "c") {
+			m |= fs.ModeCharDevice
+		}
+	}
+	if mode&DMNAMEDPIPE != 0 {
+		m |= fs.ModeNamedPipe
+	}
+	if mode&DMSOCKET != 0 {
+		m |= fs.ModeSocket
+	}
+	if mode&DMSETUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&DMSETGID != 0 {
+		m |= fs.ModeSetgid
+	}
+
+	return m
+}
+
+// Converts io/fs file mode to the Mode field of a Dir.
+func DirMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&fs.ModeDir != 0 {
+		mode |= DMDIR
+	}
+	if m&fs.ModeAppend != 0 {
+		mode |= DMAPPEND
+	}
+	if m&fs.ModeExclusive != 0 {
+		mode |= DMEXCL
+	}
+	if m&fs.ModeTemporary != 0 {
+		mode |= DMTMP
+	}
+	if m&fs.ModeSymlink != 0 {
+		mode |= DMSYMLINK
+	}
+	if m&fs.ModeDevice != 0 {
+		mode |= DMDEVICE
+	}
+	if m&fs.ModeNamedPipe != 0 {
+		mode |= DMNAMEDPIPE
+	}
+	if m&fs.ModeSocket != 0 {
+		mode |= DMSOCKET
+	}
+	if m&fs.ModeSetuid != 0 {
+		mode |= DMSETUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= DMSETGID
+	}
+
+	return mode
+}
+
+// The dirInfo type implements fs.FileInfo and fs.DirEntry for a Dir.
+type dirInfo struct {
+	d *Dir
+}
+
+// Returns the Dir as fs.FileInfo. The Sys method of the returned
+// value returns the Dir.
+func (d *Dir) FileInfo() fs.FileInfo {
+	return dirInfo{d}
+}
+
+// Returns the Dir as fs.DirEntry.
+func (d *Dir) DirEntry() fs.DirEntry {
+	return dirInfo{d}
+}
+
+func (di dirInfo) Name() string       { return di.d.Name }
+func (di dirInfo) Size() int64        { return int64(di.d.Length) }
+func (di dirInfo) Mode() fs.FileMode  { return FileMode(di.d.Mode, di.d.Ext) }
+func (di dirInfo) ModTime() time.Time { return time.Unix(int64(di.d.Mtime), 0) }
+func (di dirInfo) IsDir() bool        { return di.d.Mode&DMDIR != 0 }
+func (di dirInfo) Sys() interface{}   { return di.d }
+
+func (di dirInfo) Type() fs.FileMode          { return di.Mode().Type() }
+func (di dirInfo) Info() (fs.FileInfo, error) { return di, nil }
+
+func (di dirInfo) String() string {
+	return fs.FormatFileInfo(di)
+}
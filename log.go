@@ -1,9 +1,16 @@
 package ixp
 
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 type Log struct {
 	Data  interface{}
 	Owner interface{}
 	Type  int
+	Time  time.Time // when the entry was recorded
 }
 
 type Logger struct {
@@ -12,14 +19,33 @@ type Logger struct {
 	logchan chan *Log
 	fltchan chan *flt
 	rszchan chan int
+	subchan chan *Subscription
+	unschan chan *Subscription
+	subs    map[*Subscription]bool
 }
 
 type flt struct {
 	owner   interface{}
 	itype   int
+	since   time.Time
 	fltchan chan []*Log
 }
 
+// The Subscription type receives the entries recorded by a Logger
+// after Subscribe is called, like tail -f. The entries are buffered
+// in C, if the subscriber doesn't keep up and the buffer is full, the
+// new entries are dropped and counted.
+type Subscription struct {
+	C <-chan *Log // the recorded entries, closed by Close
+
+	l       *Logger
+	c       chan *Log
+	owner   interface{}
+	itype   int
+	dropped uint64
+	once    sync.Once
+}
+
 func NewLogger(sz int) *Logger {
 	if sz == 0 {
 		return nil
@@ -30,6 +56,9 @@ func NewLogger(sz int) *Logger {
 	l.logchan = make(chan *Log, 16)
 	l.fltchan = make(chan *flt)
 	l.rszchan = make(chan int)
+	l.subchan = make(chan *Subscription)
+	l.unschan = make(chan *Subscription)
+	l.subs = make(map[*Subscription]bool)
 
 	go l.doLog()
 	return l
@@ -44,15 +73,54 @@ func (l *Logger) Resize(sz int) {
 }
 
 func (l *Logger) Log(data, owner interface{}, itype int) {
-	l.logchan <- &Log{data, owner, itype}
+	l.logchan <- &Log{data, owner, itype, time.Now()}
 }
 
 func (l *Logger) Filter(owner interface{}, itype int) []*Log {
+	return l.FilterSince(owner, itype, time.Time{})
+}
+
+// Same as Filter, but returns only the entries recorded at or after
+// since.
+func (l *Logger) FilterSince(owner interface{}, itype int, since time.Time) []*Log {
 	c := make(chan []*Log)
-	l.fltchan <- &flt{owner, itype, c}
+	l.fltchan <- &flt{owner, itype, since, c}
 	return <-c
 }
 
+// Creates a subscription that receives the entries for the owner and
+// the type (nil and 0 match any) recorded from now on. Up to size
+// entries are buffered for the subscriber. The subscription should be
+// closed when no longer used.
+func (l *Logger) Subscribe(owner interface{}, itype int, size int) *Subscription {
+	s := new(Subscription)
+	s.l = l
+	s.c = make(chan *Log, size)
+	s.C = s.c
+	s.owner = owner
+	s.itype = itype
+	l.subchan <- s
+	return s
+}
+
+// Returns the number of entries dropped because the buffer of the
+// subscription was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Stops the subscription and closes C. The entries still buffered in
+// C can be received after Close.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.l.unschan <- s
+	})
+}
+
+func (it *Log) match(owner interface{}, itype int) bool {
+	return (owner == nil || it.Owner == owner) && (itype == 0 || it.Type == itype)
+}
+
 func (l *Logger) doLog() {
 	for {
 		select {
@@ -63,6 +131,24 @@ func (l *Logger) doLog() {
 
 			l.items[l.idx] = it
 			l.idx++
+			for s := range l.subs {
+				if !it.match(s.owner, s.itype) {
+					continue
+				}
+
+				select {
+				case s.c <- it:
+				default:
+					atomic.AddUint64(&s.dropped, 1)
+				}
+			}
+
+		case s := <-l.subchan:
+			l.subs[s] = true
+
+		case s := <-l.unschan:
+			delete(l.subs, s)
+			close(s.c)
 
 		case sz := <-l.rszchan:
 			it := make([]*Log, sz)
@@ -89,8 +175,7 @@ func (l *Logger) doLog() {
 					continue
 				}
 
-				if (flt.owner == nil || it.Owner == flt.owner) &&
-					(flt.itype == 0 || it.Type == flt.itype) {
+				if it.match(flt.owner, flt.itype) && !it.Time.Before(flt.since) {
 					n++
 				}
 			}
@@ -102,8 +187,7 @@ func (l *Logger) doLog() {
 				}
 
 				it := l.items[i]
-				if it != nil && (flt.owner == nil || it.Owner == flt.owner) &&
-					(flt.itype == 0 || it.Type == flt.itype) {
+				if it != nil && it.match(flt.owner, flt.itype) && !it.Time.Before(flt.since) {
 					its[m] = it
 					m++
 				}
@@ -0,0 +1,152 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+import (
+	"testing"
+	"time"
+)
+
+// The types of the entries, the values used by srv and clnt.
+const (
+	logFcalls  = 4
+	logPackets = 8
+)
+
+// An owner of the entries that has a name.
+type logOwner string
+
+func (o logOwner) String() string { return string(o) }
+
+// Receives an entry of the subscription, fails the test if none
+// arrives.
+func recvLog(t *testing.T, s *Subscription) *Log {
+	select {
+	case it, ok := <-s.C:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+
+		return it
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("no entry received")
+	}
+
+	return nil
+}
+
+// Waits until the logger recorded the entry with the data, and
+// returns the entries.
+func waitLog(t *testing.T, l *Logger, data string) []*Log {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		its := l.Filter(nil, 0)
+		if len(its) > 0 && its[len(its)-1].Data == data {
+			return its
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("entry %s not recorded", data)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	l := NewLogger(16)
+	a, b := logOwner("a"), logOwner("b")
+	s := l.Subscribe(a, logFcalls, 8)
+	all := l.Subscribe(nil, 0, 8)
+	l.Log("1", a, logFcalls)
+	l.Log("2", b, logFcalls)
+	l.Log("3", a, logPackets)
+	l.Log("4", a, logFcalls)
+
+	/* the entries of other owners and types are skipped */
+	for _, want := range []string{"1", "4"} {
+		if it := recvLog(t, s); it.Data != want {
+			t.Errorf("received %v, want %s", it.Data, want)
+		}
+	}
+
+	for _, want := range []string{"1", "2", "3", "4"} {
+		if it := recvLog(t, all); it.Data != want {
+			t.Errorf("received %v with nil and 0, want %s", it.Data, want)
+		}
+	}
+
+	/* the entries recorded after Close aren't received */
+	s.Close()
+	s.Close()
+	l.Log("5", a, logFcalls)
+	if it, ok := <-s.C; ok {
+		t.Errorf("received %v after Close", it.Data)
+	}
+
+	if it := recvLog(t, all); it.Data != "5" {
+		t.Errorf("received %v, want 5", it.Data)
+	}
+
+	all.Close()
+	if s.Dropped() != 0 || all.Dropped() != 0 {
+		t.Errorf("%d and %d entries dropped", s.Dropped(), all.Dropped())
+	}
+}
+
+func TestSubscribeDropped(t *testing.T) {
+	l := NewLogger(16)
+	s := l.Subscribe(nil, 0, 1)
+	defer s.Close()
+	for _, data := range []string{"1", "2", "3"} {
+		l.Log(data, nil, logFcalls)
+	}
+
+	/* the buffer is full after the first entry */
+	waitLog(t, l, "3")
+	if n := s.Dropped(); n != 2 {
+		t.Errorf("%d entries dropped, want 2", n)
+	}
+
+	if it := recvLog(t, s); it.Data != "1" {
+		t.Errorf("received %v, want 1", it.Data)
+	}
+
+	l.Log("4", nil, logFcalls)
+	if it := recvLog(t, s); it.Data != "4" || s.Dropped() != 2 {
+		t.Errorf("received %v, %d entries dropped, want 4 and 2", it.Data, s.Dropped())
+	}
+}
+
+func TestFilterSince(t *testing.T) {
+	l := NewLogger(3)
+	for _, data := range []string{"1", "2", "3", "4", "5"} {
+		l.Log(data, nil, logFcalls)
+		time.Sleep(time.Millisecond)
+	}
+
+	/* the oldest entries are replaced, the others are returned in order */
+	its := waitLog(t, l, "5")
+	if len(its) != 3 || its[0].Data != "3" || its[1].Data != "4" || its[2].Data != "5" {
+		t.Fatalf("Filter: %v", its)
+	}
+
+	its = l.FilterSince(nil, 0, its[1].Time)
+	if len(its) != 2 || its[0].Data != "4" || its[1].Data != "5" {
+		t.Errorf("FilterSince: %v", its)
+	}
+
+	if its = l.FilterSince(nil, 0, time.Now()); len(its) != 0 {
+		t.Errorf("FilterSince now: %v", its)
+	}
+
+	l.Log("6", nil, logPackets)
+	waitLog(t, l, "6")
+	its = l.FilterSince(nil, logPackets, time.Time{})
+	if len(its) != 1 || its[0].Data != "6" {
+		t.Errorf("FilterSince of the packets: %v", its)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The JSONEncoder type writes Logger entries as JSON lines, one object
+// per entry, so the 9P traffic of a running client or server can be
+// piped into other tools. An entry with an Fcall is written as:
+//
+//	{"time":"...","owner":"srv/conn","kind":"fcall","fcall":{"type":"Tread","tag":1,"fid":3,...}}
+//
+// The fcall object has the type, tag, size and text of the message,
+// and the fields of the message for the 9P2000 messages. The data of
+// Rread and Twrite is base64 encoded in "data". An entry with a packet
+// is written with "kind":"packet" and the raw bytes of the message,
+// base64 encoded, in "packet". The owner is written if it implements
+// fmt.Stringer.
+type JSONEncoder struct {
+	enc *json.Encoder
+}
+
+type jsonLog struct {
+	Time   time.Time              `json:"time"`
+	Owner  string                 `json:"owner,omitempty"`
+	Type   int                    `json:"type"`
+	Kind   string                 `json:"kind"`
+	Fcall  map[string]interface{} `json:"fcall,omitempty"`
+	Packet []byte                 `json:"packet,omitempty"`
+}
+
+// Creates an encoder that writes the entries to w.
+func NewJSONEncoder(w io.Writer) *JSONEncoder {
+	return &JSONEncoder{json.NewEncoder(w)}
+}
+
+// Writes the entry as a single line.
+func (e *JSONEncoder) Encode(it *Log) error {
+	jl := &jsonLog{Time: it.Time, Type: it.Type}
+	if s, ok := it.Owner.(fmt.Stringer); ok {
+		jl.Owner = s.String()
+	}
+
+	switch d := it.Data.(type) {
+	case *Fcall:
+		jl.Kind = "fcall"
+		jl.Fcall = fcallJSON(d)
+
+	case []byte:
+		jl.Kind = "packet"
+		jl.Packet = d
+
+	default:
+		jl.Kind = fmt.Sprintf("%T", d)
+	}
+
+	return e.enc.Encode(jl)
+}
+
+func qidJSON(q *Qid) map[string]interface{} {
+	return map[string]interface{}{
+		"type":    q.Type,
+		"version": q.Version,
+		"path":    q.Path,
+	}
+}
+
+func dirJSON(d *Dir) map[string]interface{} {
+	return map[string]interface{}{
+		"qid":    qidJSON(&d.Qid),
+		"mode":   d.Mode,
+		"atime":  d.Atime,
+		"mtime":  d.Mtime,
+		"length": d.Length,
+		"name":   d.Name,
+		"uid":    d.Uid,
+		"gid":    d.Gid,
+		"muid":   d.Muid,
+	}
+}
+
+// Returns the fields of the message as a JSON object.
+func fcallJSON(fc *Fcall) map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, a := range FcallAttrs(fc) {
+		m[a.Key] = a.Value.Any()
+	}
+
+	m["size"] = fc.Size
+	m["text"] = fc.String()
+	switch fc.Type {
+	case Tversion, Rversion:
+		m["msize"] = fc.Msize
+		m["version"] = fc.Version
+
+	case Tauth, Tattach:
+		m["afid"] = fc.Afid
+		m["uname"] = fc.Uname
+		m["aname"] = fc.Aname
+
+	case Rauth, Rattach:
+		m["qid"] = qidJSON(&fc.Qid)
+
+	case Rerror:
+		m["ename"] = fc.Error
+		m["errno"] = fc.Errornum
+
+	case Tflush:
+		m["oldtag"] = fc.Oldtag
+
+	case Twalk:
+		m["newfid"] = fc.Newfid
+		m["wname"] = fc.Wname
+
+	case Rwalk:
+		wqid := make([]interface{}, len(fc.Wqid))
+		for i := range fc.Wqid {
+			wqid[i] = qidJSON(&fc.Wqid[i])
+		}
+		m["wqid"] = wqid
+
+	case Topen:
+		m["mode"] = fc.Mode
+
+	case Tcreate:
+		m["name"] = fc.Name
+		m["perm"] = fc.Perm
+		m["mode"] = fc.Mode
+
+	case Ropen, Rcreate:
+		m["qid"] = qidJSON(&fc.Qid)
+		m["iounit"] = fc.Iounit
+
+	case Tread:
+		m["offset"] = fc.Offset
+		m["count"] = fc.Count
+
+	case Rread:
+		m["count"] = fc.Count
+		m["data"] = fc.Data
+
+	case Twrite:
+		m["offset"] = fc.Offset
+		m["count"] = fc.Count
+		m["data"] = fc.Data
+
+	case Rwrite:
+		m["count"] = fc.Count
+
+	case Rstat, Twstat:
+		m["stat"] = dirJSON(&fc.Dir)
+	}
+
+	return m
+}
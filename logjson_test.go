@@ -0,0 +1,39 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+const jsonGolden = `{"time":"2009-11-10T23:00:00Z","owner":"srv/conn","type":4,"kind":"fcall","fcall":{"count":512,"fid":3,"offset":100,"size":23,"tag":1,"text":"Tread tag 1 fid 3 offset 100 count 512","type":"Tread"}}
+{"time":"2009-11-10T23:00:00Z","type":8,"kind":"packet","packet":"AQID"}
+`
+
+func TestJSONEncoder(t *testing.T) {
+	fc := NewFcall(8192)
+	if err := PackTread(fc, 3, 100, 512); err != nil {
+		t.Fatal(err)
+	}
+	SetTag(fc, 1)
+
+	tm := time.Date(2009, 11, 10, 23, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	enc := NewJSONEncoder(&buf)
+	for _, it := range []*Log{
+		{fc, logOwner("srv/conn"), logFcalls, tm},
+		{[]byte{1, 2, 3}, nil, logPackets, tm},
+	} {
+		if err := enc.Encode(it); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if buf.String() != jsonGolden {
+		t.Errorf("JSON lines:\n%s\nwant:\n%s", buf.String(), jsonGolden)
+	}
+}
@@ -4,84 +4,241 @@
 
 package ixp
 
-import "sync"
+import (
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+)
 
-var once sync.Once
+// How long the results of the lookups, including the failed ones, are
+// cached by OsUsers.
+var OsUsersTimeout = 5 * time.Minute
 
 type osUser struct {
-	uid int
+	uid  int
+	gid  int       // primary group
+	name string    // empty if the uid isn't known to the host
+	gids []int     // all groups, including the primary one
+	time time.Time // time of the lookup
+}
+
+type osGroup struct {
+	gid  int
+	name string
+	time time.Time
 }
 
 type osUsers struct {
 	users  map[int]*osUser
+	unames map[string]*osUser // uid is -1 if the lookup failed
 	groups map[int]*osGroup
+	gnames map[string]*osGroup // gid is -1 if the lookup failed
 	sync.Mutex
 }
 
-// Simple Users implementation that fakes looking up users and groups
-// by uid only. The names and groups memberships are empty
-var OsUsers *osUsers
+// Users implementation that looks up users and groups in the host's
+// user database (see os/user). The users are members of their primary
+// group and the supplementary groups. The results, including the failed
+// lookups, are cached for OsUsersTimeout. Uid2User and Gid2Group return
+// a user (group) with an empty name if the id isn't known to the host.
+var OsUsers = &osUsers{
+	users:  make(map[int]*osUser),
+	unames: make(map[string]*osUser),
+	groups: make(map[int]*osGroup),
+	gnames: make(map[string]*osGroup),
+}
 
-func (u *osUser) Name() string { return "" }
+func (u *osUser) Name() string { return u.name }
 
 func (u *osUser) Id() int { return u.uid }
 
-func (u *osUser) Groups() []Group { return nil }
+func (u *osUser) Groups() []Group {
+	groups := make([]Group, 0, len(u.gids))
+	for _, gid := range u.gids {
+		groups = append(groups, OsUsers.Gid2Group(gid))
+	}
+
+	return groups
+}
 
-func (u *osUser) IsMember(g Group) bool { return false }
+func (u *osUser) IsMember(g Group) bool {
+	if g == nil {
+		return false
+	}
 
-type osGroup struct {
-	gid int
+	for _, gid := range u.gids {
+		if gid == g.Id() {
+			return true
+		}
+	}
+
+	return false
 }
 
-func (g *osGroup) Name() string { return "" }
+func (g *osGroup) Name() string { return g.name }
 
 func (g *osGroup) Id() int { return g.gid }
 
+// The host's user database can't be enumerated, so the members of
+// the groups are not known.
 func (g *osGroup) Members() []User { return nil }
 
-func initOsusers() {
-	OsUsers = new(osUsers)
-	OsUsers.users = make(map[int]*osUser)
-	OsUsers.groups = make(map[int]*osGroup)
+func expired(t time.Time) bool {
+	return time.Since(t) > OsUsersTimeout
+}
+
+// Creates a user from the host's user information.
+func newOsUser(u *user.User) *osUser {
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil
+	}
+
+	ou := &osUser{uid: uid, gid: -1, name: u.Username, time: time.Now()}
+	gid, err := strconv.Atoi(u.Gid)
+	if err == nil {
+		ou.gid = gid
+		ou.gids = append(ou.gids, gid)
+	}
+
+	gids, err := u.GroupIds()
+	if err == nil {
+		for _, s := range gids {
+			gid, err := strconv.Atoi(s)
+			if err == nil && gid != ou.gid {
+				ou.gids = append(ou.gids, gid)
+			}
+		}
+	}
+
+	return ou
+}
+
+// Creates a group from the host's group information.
+func newOsGroup(g *user.Group) *osGroup {
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return nil
+	}
+
+	return &osGroup{gid: gid, name: g.Name, time: time.Now()}
 }
 
 func (up *osUsers) Uid2User(uid int) User {
-	once.Do(initOsusers)
-	OsUsers.Lock()
-	defer OsUsers.Unlock()
-	user, present := OsUsers.users[uid]
-	if present {
-		return user
-	}
-
-	user = new(osUser)
-	user.uid = uid
-	OsUsers.users[uid] = user
-	return user
+	up.Lock()
+	u, present := up.users[uid]
+	up.Unlock()
+	if present && !expired(u.time) {
+		return u
+	}
+
+	hu, err := user.LookupId(strconv.Itoa(uid))
+	if err == nil {
+		u = newOsUser(hu)
+	} else {
+		u = nil
+	}
+
+	if u == nil {
+		u = &osUser{uid: uid, gid: -1, time: time.Now()}
+	}
+
+	up.Lock()
+	up.users[uid] = u
+	if u.name != "" {
+		up.unames[u.name] = u
+	}
+	up.Unlock()
+	return u
 }
 
 func (up *osUsers) Uname2User(uname string) User {
-	// unimplemented
-	return nil
+	up.Lock()
+	u, present := up.unames[uname]
+	up.Unlock()
+	if !present || expired(u.time) {
+		hu, err := user.Lookup(uname)
+		if err == nil {
+			u = newOsUser(hu)
+		} else {
+			u = nil
+		}
+
+		if u == nil {
+			u = &osUser{uid: -1, gid: -1, time: time.Now()}
+		}
+
+		up.Lock()
+		up.unames[uname] = u
+		if u.uid >= 0 {
+			up.users[u.uid] = u
+		}
+		up.Unlock()
+	}
+
+	if u.uid < 0 {
+		return nil
+	}
+
+	return u
 }
 
 func (up *osUsers) Gid2Group(gid int) Group {
-	once.Do(initOsusers)
-	OsUsers.Lock()
-	group, present := OsUsers.groups[gid]
-	if present {
-		OsUsers.Unlock()
-		return group
-	}
-
-	group = new(osGroup)
-	group.gid = gid
-	OsUsers.groups[gid] = group
-	OsUsers.Unlock()
-	return group
+	up.Lock()
+	g, present := up.groups[gid]
+	up.Unlock()
+	if present && !expired(g.time) {
+		return g
+	}
+
+	hg, err := user.LookupGroupId(strconv.Itoa(gid))
+	if err == nil {
+		g = newOsGroup(hg)
+	} else {
+		g = nil
+	}
+
+	if g == nil {
+		g = &osGroup{gid: gid, time: time.Now()}
+	}
+
+	up.Lock()
+	up.groups[gid] = g
+	if g.name != "" {
+		up.gnames[g.name] = g
+	}
+	up.Unlock()
+	return g
 }
 
 func (up *osUsers) Gname2Group(gname string) Group {
-	return nil
+	up.Lock()
+	g, present := up.gnames[gname]
+	up.Unlock()
+	if !present || expired(g.time) {
+		hg, err := user.LookupGroup(gname)
+		if err == nil {
+			g = newOsGroup(hg)
+		} else {
+			g = nil
+		}
+
+		if g == nil {
+			g = &osGroup{gid: -1, time: time.Now()}
+		}
+
+		up.Lock()
+		up.gnames[gname] = g
+		if g.gid >= 0 {
+			up.groups[g.gid] = g
+		}
+		up.Unlock()
+	}
+
+	if g.gid < 0 {
+		return nil
+	}
+
+	return g
 }
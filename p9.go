@@ -3,7 +3,7 @@
 // license that can be found in the LICENSE file.
 
 // The p9 package ixprovides the definitions and functions used to implement
-// the 9P2000 protocol.
+// the 9P2000 protocol and its 9P2000.u and 9P2000.L dialects.
 package ixp
 
 import (
@@ -43,10 +43,106 @@ const (
 	Tlast
 )
 
+// IX block message types. The block messages don't use fids, the file
+// is addressed by its fileid (the Path of its Qid).
 const (
-	MSIZE   = 8192 + IOHDRSZ // default message size (8192+IOHdrSz)
-	IOHDRSZ = 24             // the non-data size of the Twrite messages
-	PORT    = 564            // default port for 9P file servers
+	Tbread = Tlast + iota
+	Rbread
+	Tbwrite
+	Rbwrite
+	Tbtrunc
+	Rbtrunc
+	Tblast
+)
+
+// 9P2000.L message types
+const (
+	Tlerror      = 6
+	Rlerror      = 7
+	Tstatfs      = 8
+	Rstatfs      = 9
+	Tlopen       = 12
+	Rlopen       = 13
+	Tlcreate     = 14
+	Rlcreate     = 15
+	Tsymlink     = 16
+	Rsymlink     = 17
+	Tmknod       = 18
+	Rmknod       = 19
+	Trename      = 20
+	Rrename      = 21
+	Treadlink    = 22
+	Rreadlink    = 23
+	Tgetattr     = 24
+	Rgetattr     = 25
+	Tsetattr     = 26
+	Rsetattr     = 27
+	Txattrwalk   = 30
+	Rxattrwalk   = 31
+	Txattrcreate = 32
+	Rxattrcreate = 33
+	Treaddir     = 40
+	Rreaddir     = 41
+	Tfsync       = 50
+	Rfsync       = 51
+	Tlock        = 52
+	Rlock        = 53
+	Tgetlock     = 54
+	Rgetlock     = 55
+	Tlink        = 70
+	Rlink        = 71
+	Tmkdir       = 72
+	Rmkdir       = 73
+	Trenameat    = 74
+	Rrenameat    = 75
+	Tunlinkat    = 76
+	Runlinkat    = 77
+)
+
+// Protocol dialects, in the order of preference
+type Dialect int
+
+const (
+	Dialect9P2000  Dialect = iota // plain 9P2000
+	Dialect9P2000u                // 9P2000 with the Unix extensions
+	Dialect9P2000L                // 9P2000 with the Linux extensions
+)
+
+var dialectVersions = [...]string{"9P2000", "9P2000.u", "9P2000.L"}
+
+// Returns the version string sent in Tversion and Rversion for the dialect.
+func (d Dialect) String() string {
+	if d < 0 || int(d) >= len(dialectVersions) {
+		return "unknown"
+	}
+
+	return dialectVersions[d]
+}
+
+// Returns true if the messages of the dialect use the 9P2000.u
+// encoding, as both 9P2000.u and 9P2000.L do.
+func (d Dialect) Dotu() bool {
+	return d != Dialect9P2000
+}
+
+// Converts a version string from Tversion or Rversion to a dialect.
+// Returns false if the version is not one of the known dialects.
+func ParseDialect(version string) (Dialect, bool) {
+	for i, v := range dialectVersions {
+		if version == v {
+			return Dialect(i), true
+		}
+	}
+
+	return Dialect9P2000, false
+}
+
+const (
+	MSIZE    = 8192 + IOHDRSZ // default message size (8192+IOHdrSz)
+	IOHDRSZ  = 24             // the non-data size of the Twrite messages
+	BIOHDRSZ = 28             // the non-data size of the Tbwrite messages
+	PORT     = 564            // default port for 9P file servers
+	MAXWELEM = 16             // maximum number of names in a Twalk message
 )
 
 // Qid types
@@ -93,6 +189,95 @@ const (
 	DMEXEC      = 0x1        // mode bit for execute permission
 )
 
+// Flags for the flags field in Tlopen and Tlcreate messages (9P2000.L).
+// The values are the ones used by Linux.
+const (
+	LO_RDONLY    = 00000000
+	LO_WRONLY    = 00000001
+	LO_RDWR      = 00000002
+	LO_CREAT     = 00000100
+	LO_EXCL      = 00000200
+	LO_NOCTTY    = 00000400
+	LO_TRUNC     = 00001000
+	LO_APPEND    = 00002000
+	LO_NONBLOCK  = 00004000
+	LO_DSYNC     = 00010000
+	LO_DIRECTORY = 00200000
+	LO_NOFOLLOW  = 00400000
+	LO_SYNC      = 04000000
+)
+
+// File type bits in the mode field of Tlcreate, Tmkdir, Tmknod and
+// Rgetattr messages (9P2000.L)
+const (
+	S_IFMT   = 0170000
+	S_IFSOCK = 0140000
+	S_IFLNK  = 0120000
+	S_IFREG  = 0100000
+	S_IFBLK  = 0060000
+	S_IFDIR  = 0040000
+	S_IFCHR  = 0020000
+	S_IFIFO  = 0010000
+	S_ISUID  = 0004000
+	S_ISGID  = 0002000
+	S_ISVTX  = 0001000
+)
+
+// Bits in the request_mask field of Tgetattr and the valid field of
+// Rgetattr messages (9P2000.L)
+const (
+	GETATTR_MODE         = 0x00000001
+	GETATTR_NLINK        = 0x00000002
+	GETATTR_UID          = 0x00000004
+	GETATTR_GID          = 0x00000008
+	GETATTR_RDEV         = 0x00000010
+	GETATTR_ATIME        = 0x00000020
+	GETATTR_MTIME        = 0x00000040
+	GETATTR_CTIME        = 0x00000080
+	GETATTR_INO          = 0x00000100
+	GETATTR_SIZE         = 0x00000200
+	GETATTR_BLOCKS       = 0x00000400
+	GETATTR_BTIME        = 0x00000800
+	GETATTR_GEN          = 0x00001000
+	GETATTR_DATA_VERSION = 0x00002000
+	GETATTR_BASIC        = 0x000007ff // mask for all fields except btime, gen and data_version
+	GETATTR_ALL          = 0x00003fff
+)
+
+// Bits in the valid field of Tsetattr messages (9P2000.L)
+const (
+	SETATTR_MODE      = 0x00000001
+	SETATTR_UID       = 0x00000002
+	SETATTR_GID       = 0x00000004
+	SETATTR_SIZE      = 0x00000008
+	SETATTR_ATIME     = 0x00000010
+	SETATTR_MTIME     = 0x00000020
+	SETATTR_CTIME     = 0x00000040
+	SETATTR_ATIME_SET = 0x00000080
+	SETATTR_MTIME_SET = 0x00000100
+)
+
+// Lock types, status values and flags used by Tlock, Rlock, Tgetlock
+// and Rgetlock (9P2000.L)
+const (
+	LOCK_TYPE_RDLCK = 0
+	LOCK_TYPE_WRLCK = 1
+	LOCK_TYPE_UNLCK = 2
+
+	LOCK_SUCCESS = 0
+	LOCK_BLOCKED = 1
+	LOCK_ERROR   = 2
+	LOCK_GRACE   = 3
+
+	LOCK_FLAGS_BLOCK   = 1
+	LOCK_FLAGS_RECLAIM = 2
+)
+
+// Flags for the flags field of Tunlinkat (9P2000.L)
+const (
+	AT_REMOVEDIR = 0x200
+)
+
 const (
 	NOTAG uint16 = 0xFFFF     // no tag specified
 	NOFID uint32 = 0xFFFFFFFF // no fid specified
@@ -104,9 +289,11 @@ const (
 	EPERM   = 1
 	ENOENT  = 2
 	EIO     = 5
+	EACCES  = 13
 	EEXIST  = 17
 	ENOTDIR = 20
 	EINVAL  = 22
+	EROFS   = 30
 )
 
 // Error represents a 9P2000 (and 9P2000.u) error
@@ -144,6 +331,77 @@ type Dir struct {
 	Muidnum uint32 // ID of the last user that modified the file
 }
 
+// Attr describes the attributes of a file, as returned by Rgetattr (9P2000.L)
+type Attr struct {
+	Valid       uint64 // bitmask of the valid fields (GETATTR_* values)
+	Qid                // file's Qid
+	Mode        uint32 // protection bits and file type (S_IF* values)
+	Uid         uint32 // owner ID
+	Gid         uint32 // group ID
+	Nlink       uint64 // number of hard links
+	Rdev        uint64 // device ID (if special file)
+	Size        uint64 // file length in bytes
+	Blksize     uint64 // block size for file system I/O
+	Blocks      uint64 // number of 512 byte blocks allocated
+	AtimeSec    uint64 // time of last access
+	AtimeNsec   uint64
+	MtimeSec    uint64 // time of last modification
+	MtimeNsec   uint64
+	CtimeSec    uint64 // time of last status change
+	CtimeNsec   uint64
+	BtimeSec    uint64 // time of creation
+	BtimeNsec   uint64
+	Gen         uint64 // inode generation
+	DataVersion uint64 // data version
+}
+
+// SetAttr describes the attributes of a file that should be changed
+// by Tsetattr (9P2000.L)
+type SetAttr struct {
+	Valid     uint32 // bitmask of the fields to change (SETATTR_* values)
+	Mode      uint32 // protection bits
+	Uid       uint32 // owner ID
+	Gid       uint32 // group ID
+	Size      uint64 // file length in bytes
+	AtimeSec  uint64 // time of last access (if SETATTR_ATIME_SET is set)
+	AtimeNsec uint64
+	MtimeSec  uint64 // time of last modification (if SETATTR_MTIME_SET is set)
+	MtimeNsec uint64
+}
+
+// Statfs describes a file system, as returned by Rstatfs (9P2000.L)
+type Statfs struct {
+	Type    uint32 // type of the file system
+	Bsize   uint32 // optimal transfer block size
+	Blocks  uint64 // total data blocks in the file system
+	Bfree   uint64 // free blocks
+	Bavail  uint64 // free blocks available to unprivileged users
+	Files   uint64 // total file nodes
+	Ffree   uint64 // free file nodes
+	Fsid    uint64 // file system ID
+	Namelen uint32 // maximum length of file names
+}
+
+// Flock describes a POSIX record lock, used by Tlock, Tgetlock and
+// Rgetlock (9P2000.L)
+type Flock struct {
+	Type     uint8  // lock type (LOCK_TYPE_* values)
+	Flags    uint32 // lock flags (LOCK_FLAGS_* values), Tlock only
+	Start    uint64 // starting offset of the lock
+	Length   uint64 // number of bytes, 0 means until the end of the file
+	ProcId   uint32 // process ID of the lock owner
+	ClientId string // client ID of the lock owner
+}
+
+// Dirent describes a directory entry, as returned in the data of
+// Rreaddir (9P2000.L)
+type Dirent struct {
+	Qid           // file's Qid
+	Offset uint64 // offset of the next entry
+	Type   uint8  // file type (the DT_* value used by Linux)
+	Name   string // file name
+}
+
 // Fcall represents a 9P2000 message
 type Fcall struct {
 	Size    uint32   // size of the message
@@ -165,9 +423,10 @@ type Fcall struct {
 	Newfid  uint32   // the fid that represents the file walked to (used by Twalk)
 	Wname   []string // list of names to walk (used by Twalk)
 	Wqid    []Qid    // list of Qids for the walked files (used by Rwalk)
-	Offset  uint64   // offset in the file to read/write from/to (used by Tread, Twrite)
-	Count   uint32   // number of bytes read/written (used by Tread, Rread, Twrite, Rwrite)
-	Data    []uint8  // data read/to-write (used by Rread, Twrite)
+	Offset  uint64   // offset in the file to read/write from/to (used by Tread, Twrite, Tbread, Tbwrite, Tbtrunc)
+	Count   uint32   // number of bytes read/written (used by Tread, Rread, Twrite, Rwrite, Tbread, Rbread, Tbwrite, Rbwrite)
+	Data    []uint8  // data read/to-write (used by Rread, Twrite, Rbread, Tbwrite)
+	Fileid  uint64   // file identifier (used by Tbread, Tbwrite, Tbtrunc)
 	Dir              // file description (used by Rstat, Twstat)
 
 	/* 9P2000.u extensions */
@@ -175,8 +434,26 @@ type Fcall struct {
 	Ext      string // special file description, 9P2000.u only (used by Tcreate)
 	Unamenum uint32 // user ID, 9P2000.u only (used by Tauth, Tattach)
 
-	Pkt []uint8 // raw packet data
-	Buf []uint8 // buffer to put the raw data in
+	/* 9P2000.L extensions */
+	Dfid      uint32  // directory fid (used by Trename, Trenameat, Tlink)
+	Flags     uint32  // flags (used by Tlopen, Tlcreate, Txattrcreate, Tunlinkat)
+	Lgid      uint32  // group ID (used by Tlcreate, Tsymlink, Tmknod, Tmkdir)
+	Major     uint32  // major device number (used by Tmknod)
+	Minor     uint32  // minor device number (used by Tmknod)
+	Target    string  // symbolic link target (used by Tsymlink, Rreadlink)
+	Newname   string  // new file name (used by Trenameat)
+	Mask      uint64  // attributes requested (used by Tgetattr)
+	Attr      Attr    // file attributes (used by Rgetattr)
+	SetAttr   SetAttr // attributes to change (used by Tsetattr)
+	Statfs    Statfs  // file system description (used by Rstatfs)
+	Flock     Flock   // lock description (used by Tlock, Tgetlock, Rgetlock)
+	Status    uint8   // lock status (used by Rlock)
+	Xattrsize uint64  // size of the extended attribute (used by Rxattrwalk, Txattrcreate)
+	Datasync  uint32  // if non-zero, only flush the data (used by Tfsync)
+
+	Pkt     []uint8 // raw packet data
+	Buf     []uint8 // buffer to put the raw data in
+	Payload []uint8 // data sent after Pkt, not copied to Buf (used by Twrite, see PackTwritev)
 }
 
 // Interface for accessing users and groups
@@ -206,7 +483,7 @@ type Group interface {
 var minFcsize = [...]uint32{
 	6,  /* Tversion msize[4] version[s] */
 	6,  /* Rversion msize[4] version[s] */
-	8,  /* Tauth fid[4] uname[s] aname[s] */
+	8,  /* Tauth afid[4] uname[s] aname[s] */
 	13, /* Rauth aqid[13] */
 	12, /* Tattach fid[4] afid[4] uname[s] aname[s] */
 	13, /* Rattach qid[13] */
@@ -244,9 +521,9 @@ var minFcsize = [...]uint32{
 var minFcusize = [...]uint32{
 	6,  /* Tversion msize[4] version[s] */
 	6,  /* Rversion msize[4] version[s] */
-	12, /* Tauth fid[4] uname[s] aname[s] */
+	8,  /* Tauth afid[4] uname[s] aname[s] (n_uname[4]) */
 	13, /* Rauth aqid[13] */
-	16, /* Tattach fid[4] afid[4] uname[s] aname[s] */
+	12, /* Tattach fid[4] afid[4] uname[s] aname[s] (n_uname[4]) */
 	13, /* Rattach qid[13] */
 	0,  /* Terror */
 	6,  /* Rerror ename[s] (ecode[4]) */
@@ -256,7 +533,7 @@ var minFcusize = [...]uint32{
 	2,  /* Rwalk nwqid[2] */
 	5,  /* Topen fid[4] mode[1] */
 	17, /* Ropen qid[13] iounit[4] */
-	13, /* Tcreate fid[4] name[s] perm[4] mode[1] */
+	13, /* Tcreate fid[4] name[s] perm[4] mode[1] extension[s] */
 	17, /* Rcreate qid[13] iounit[4] */
 	16, /* Tread fid[4] offset[8] count[4] */
 	4,  /* Rread count[4] */
@@ -269,6 +546,7 @@ var minFcusize = [...]uint32{
 	4,  /* Tstat fid[4] */
 	4,  /* Rstat stat[n] */
 	8,  /* Twstat fid[4] stat[n] */
+	0,  /* Rwstat */
 	20, /* Tbread fileid[8] offset[8] count[4] */
 	4,  /* Rbread count[4] */
 	20, /* Tbwrite fileid[8] offset[8] count[4] */
@@ -277,6 +555,49 @@ var minFcusize = [...]uint32{
 	0,  /* Rbtrunc */
 }
 
+// minimum size of a 9P2000.L message for a type
+var minFclsize = map[uint8]uint32{
+	Rlerror:      4,   /* ecode[4] */
+	Tstatfs:      4,   /* fid[4] */
+	Rstatfs:      60,  /* type[4] bsize[4] blocks[8] bfree[8] bavail[8] files[8] ffree[8] fsid[8] namelen[4] */
+	Tlopen:       8,   /* fid[4] flags[4] */
+	Rlopen:       17,  /* qid[13] iounit[4] */
+	Tlcreate:     18,  /* fid[4] name[s] flags[4] mode[4] gid[4] */
+	Rlcreate:     17,  /* qid[13] iounit[4] */
+	Tsymlink:     12,  /* fid[4] name[s] symtgt[s] gid[4] */
+	Rsymlink:     13,  /* qid[13] */
+	Tmknod:       22,  /* dfid[4] name[s] mode[4] major[4] minor[4] gid[4] */
+	Rmknod:       13,  /* qid[13] */
+	Trename:      10,  /* fid[4] dfid[4] name[s] */
+	Rrename:      0,   /* (empty) */
+	Treadlink:    4,   /* fid[4] */
+	Rreadlink:    2,   /* target[s] */
+	Tgetattr:     12,  /* fid[4] request_mask[8] */
+	Rgetattr:     153, /* valid[8] qid[13] mode[4] uid[4] gid[4] nlink[8] rdev[8] size[8] blksize[8] blocks[8] atime[16] mtime[16] ctime[16] btime[16] gen[8] data_version[8] */
+	Tsetattr:     60,  /* fid[4] valid[4] mode[4] uid[4] gid[4] size[8] atime[16] mtime[16] */
+	Rsetattr:     0,   /* (empty) */
+	Txattrwalk:   10,  /* fid[4] newfid[4] name[s] */
+	Rxattrwalk:   8,   /* size[8] */
+	Txattrcreate: 18,  /* fid[4] name[s] attr_size[8] flags[4] */
+	Rxattrcreate: 0,   /* (empty) */
+	Treaddir:     16,  /* fid[4] offset[8] count[4] */
+	Rreaddir:     4,   /* count[4] */
+	Tfsync:       8,   /* fid[4] datasync[4] */
+	Rfsync:       0,   /* (empty) */
+	Tlock:        31,  /* fid[4] type[1] flags[4] start[8] length[8] proc_id[4] client_id[s] */
+	Rlock:        1,   /* status[1] */
+	Tgetlock:     27,  /* fid[4] type[1] start[8] length[8] proc_id[4] client_id[s] */
+	Rgetlock:     23,  /* type[1] start[8] length[8] proc_id[4] client_id[s] */
+	Tlink:        10,  /* dfid[4] fid[4] name[s] */
+	Rlink:        0,   /* (empty) */
+	Tmkdir:       14,  /* dfid[4] name[s] mode[4] gid[4] */
+	Rmkdir:       13,  /* qid[13] */
+	Trenameat:    12,  /* olddirfid[4] oldname[s] newdirfid[4] newname[s] */
+	Rrenameat:    0,   /* (empty) */
+	Tunlinkat:    10,  /* dirfd[4] name[s] flags[4] */
+	Runlinkat:    0,   /* (empty) */
+}
+
 func gint8(buf []byte) (uint8, []byte) { return buf[0], buf[1:] }
 
 func gint16(buf []byte) (uint16, []byte) {
@@ -298,75 +619,6 @@ func gint64(buf []byte) (uint64, []byte) {
 		buf[8:]
 }
 
-func gstr(buf []byte) (string, []byte) {
-	var n uint16
-
-	if buf == nil {
-		return "", nil
-	}
-
-	n, buf = gint16(buf)
-	if int(n) > len(buf) {
-		return "", nil
-	}
-
-	return string(buf[0:n]), buf[n:]
-}
-
-func gqid(buf []byte, qid *Qid) []byte {
-	qid.Type, buf = gint8(buf)
-	qid.Version, buf = gint32(buf)
-	qid.Path, buf = gint64(buf)
-
-	return buf
-}
-
-func gstat(buf []byte, d *Dir, dotu bool) []byte {
-	d.Size, buf = gint16(buf)
-	d.Type, buf = gint16(buf)
-	d.Dev, buf = gint32(buf)
-	buf = gqid(buf, &d.Qid)
-	d.Mode, buf = gint32(buf)
-	d.Atime, buf = gint32(buf)
-	d.Mtime, buf = gint32(buf)
-	d.Length, buf = gint64(buf)
-	d.Name, buf = gstr(buf)
-	if buf == nil {
-		return nil
-	}
-
-	d.Uid, buf = gstr(buf)
-	if buf == nil {
-		return nil
-	}
-	d.Gid, buf = gstr(buf)
-	if buf == nil {
-		return nil
-	}
-
-	d.Muid, buf = gstr(buf)
-	if buf == nil {
-		return nil
-	}
-
-	if dotu {
-		d.Ext, buf = gstr(buf)
-		if buf == nil {
-			return nil
-		}
-
-		d.Uidnum, buf = gint32(buf)
-		d.Gidnum, buf = gint32(buf)
-		d.Muidnum, buf = gint32(buf)
-	} else {
-		d.Uidnum = NOUID
-		d.Gidnum = NOUID
-		d.Muidnum = NOUID
-	}
-
-	return buf
-}
-
 func pint8(val uint8, buf []byte) []byte {
 	buf[0] = val
 	return buf[1:]
@@ -460,32 +712,18 @@ func PackDir(d *Dir, buf []byte, dotu bool) int {
 }
 
 // Converts the on-the-wire representation of a stat to Stat value.
-// Returns an error if the conversion is impossible, otherwise
-// a pointer to a Stat value.
+// The entry can be followed by other entries, d.Size+2 bytes of buf
+// are used. Returns an UnpackError if the entry is malformed,
+// otherwise a pointer to a Stat value.
 func UnpackDir(buf []byte, dotu bool) (d *Dir, err error) {
-	sz := 2 + 2 + 4 + 13 + 4 + /* size[2] type[2] dev[4] qid[13] mode[4] */
-		4 + 4 + 8 + /* atime[4] mtime[4] length[8] */
-		2 + 2 + 2 + 2 /* name[s] uid[s] gid[s] muid[s] */
-
-	if dotu {
-		sz += 2 + 4 + 4 + 4 /* extension[s] n_uid[4] n_gid[4] n_muid[4] */
-	}
-
-	if len(buf) < sz {
-		goto szerror
-	}
-
+	dec := &decoder{p: buf}
 	d = new(Dir)
-	buf = gstat(buf, d, dotu)
-	if buf == nil {
-		goto szerror
+	dec.stat(d, dotu)
+	if dec.err != nil {
+		return nil, dec.err
 	}
 
 	return d, nil
-
-szerror:
-	return nil, &Error{"short buffer", EINVAL}
-
 }
 
 // Allocates a new Fcall.
@@ -511,6 +749,8 @@ func packCommon(fc *Fcall, size int, id uint8) ([]byte, error) {
 	fc.Size = uint32(size)
 	fc.Type = id
 	fc.Tag = NOTAG
+	fc.Data = nil
+	fc.Payload = nil
 	p := fc.Buf
 	p = pint32(uint32(size), p)
 	p = pint8(id, p)
@@ -0,0 +1,627 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+// Create a Rlerror message in the specified Fcall.
+func PackRlerror(fc *Fcall, errornum uint32) error {
+	p, err := packCommon(fc, 4, Rlerror) /* ecode[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Errornum = errornum
+	p = pint32(errornum, p)
+	return nil
+}
+
+// Create a Tstatfs message in the specified Fcall.
+func PackTstatfs(fc *Fcall, fid uint32) error {
+	p, err := packCommon(fc, 4, Tstatfs) /* fid[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	p = pint32(fid, p)
+	return nil
+}
+
+// Create a Rstatfs message in the specified Fcall.
+func PackRstatfs(fc *Fcall, st *Statfs) error {
+	size := 4 + 4 + 8 + 8 + 8 + 8 + 8 + 8 + 4 /* type[4] bsize[4] blocks[8] bfree[8] bavail[8] files[8] ffree[8] fsid[8] namelen[4] */
+	p, err := packCommon(fc, size, Rstatfs)
+	if err != nil {
+		return err
+	}
+
+	fc.Statfs = *st
+	p = pint32(st.Type, p)
+	p = pint32(st.Bsize, p)
+	p = pint64(st.Blocks, p)
+	p = pint64(st.Bfree, p)
+	p = pint64(st.Bavail, p)
+	p = pint64(st.Files, p)
+	p = pint64(st.Ffree, p)
+	p = pint64(st.Fsid, p)
+	p = pint32(st.Namelen, p)
+	return nil
+}
+
+// Create a Tlopen message in the specified Fcall.
+func PackTlopen(fc *Fcall, fid uint32, flags uint32) error {
+	p, err := packCommon(fc, 4+4, Tlopen) /* fid[4] flags[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Flags = flags
+	p = pint32(fid, p)
+	p = pint32(flags, p)
+	return nil
+}
+
+// Create a Rlopen message in the specified Fcall.
+func PackRlopen(fc *Fcall, qid *Qid, iounit uint32) error {
+	p, err := packCommon(fc, 13+4, Rlopen) /* qid[13] iounit[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Qid = *qid
+	fc.Iounit = iounit
+	p = pqid(qid, p)
+	p = pint32(iounit, p)
+	return nil
+}
+
+// Create a Tlcreate message in the specified Fcall.
+func PackTlcreate(fc *Fcall, fid uint32, name string, flags uint32, mode uint32, gid uint32) error {
+	size := 4 + 2 + len(name) + 4 + 4 + 4 /* fid[4] name[s] flags[4] mode[4] gid[4] */
+	p, err := packCommon(fc, size, Tlcreate)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Name = name
+	fc.Flags = flags
+	fc.Perm = mode
+	fc.Lgid = gid
+	p = pint32(fid, p)
+	p = pstr(name, p)
+	p = pint32(flags, p)
+	p = pint32(mode, p)
+	p = pint32(gid, p)
+	return nil
+}
+
+// Create a Rlcreate message in the specified Fcall.
+func PackRlcreate(fc *Fcall, qid *Qid, iounit uint32) error {
+	p, err := packCommon(fc, 13+4, Rlcreate) /* qid[13] iounit[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Qid = *qid
+	fc.Iounit = iounit
+	p = pqid(qid, p)
+	p = pint32(iounit, p)
+	return nil
+}
+
+// Create a Tsymlink message in the specified Fcall.
+func PackTsymlink(fc *Fcall, fid uint32, name string, target string, gid uint32) error {
+	size := 4 + 2 + len(name) + 2 + len(target) + 4 /* fid[4] name[s] symtgt[s] gid[4] */
+	p, err := packCommon(fc, size, Tsymlink)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Name = name
+	fc.Target = target
+	fc.Lgid = gid
+	p = pint32(fid, p)
+	p = pstr(name, p)
+	p = pstr(target, p)
+	p = pint32(gid, p)
+	return nil
+}
+
+// Create a Tmknod message in the specified Fcall.
+func PackTmknod(fc *Fcall, dfid uint32, name string, mode uint32, major uint32, minor uint32, gid uint32) error {
+	size := 4 + 2 + len(name) + 4 + 4 + 4 + 4 /* dfid[4] name[s] mode[4] major[4] minor[4] gid[4] */
+	p, err := packCommon(fc, size, Tmknod)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = dfid
+	fc.Name = name
+	fc.Perm = mode
+	fc.Major = major
+	fc.Minor = minor
+	fc.Lgid = gid
+	p = pint32(dfid, p)
+	p = pstr(name, p)
+	p = pint32(mode, p)
+	p = pint32(major, p)
+	p = pint32(minor, p)
+	p = pint32(gid, p)
+	return nil
+}
+
+// Create a Trename message in the specified Fcall.
+func PackTrename(fc *Fcall, fid uint32, dfid uint32, name string) error {
+	size := 4 + 4 + 2 + len(name) /* fid[4] dfid[4] name[s] */
+	p, err := packCommon(fc, size, Trename)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Dfid = dfid
+	fc.Name = name
+	p = pint32(fid, p)
+	p = pint32(dfid, p)
+	p = pstr(name, p)
+	return nil
+}
+
+// Create a Treadlink message in the specified Fcall.
+func PackTreadlink(fc *Fcall, fid uint32) error {
+	p, err := packCommon(fc, 4, Treadlink) /* fid[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	p = pint32(fid, p)
+	return nil
+}
+
+// Create a Rreadlink message in the specified Fcall.
+func PackRreadlink(fc *Fcall, target string) error {
+	p, err := packCommon(fc, 2+len(target), Rreadlink) /* target[s] */
+	if err != nil {
+		return err
+	}
+
+	fc.Target = target
+	p = pstr(target, p)
+	return nil
+}
+
+// Create a Tgetattr message in the specified Fcall.
+func PackTgetattr(fc *Fcall, fid uint32, mask uint64) error {
+	p, err := packCommon(fc, 4+8, Tgetattr) /* fid[4] request_mask[8] */
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Mask = mask
+	p = pint32(fid, p)
+	p = pint64(mask, p)
+	return nil
+}
+
+// Create a Rgetattr message in the specified Fcall.
+func PackRgetattr(fc *Fcall, attr *Attr) error {
+	size := 8 + 13 + 4 + 4 + 4 + 8 + 8 + 8 + 8 + 8 + /* valid[8] qid[13] mode[4] uid[4] gid[4] nlink[8] rdev[8] size[8] blksize[8] blocks[8] */
+		16 + 16 + 16 + 16 + 8 + 8 /* atime[16] mtime[16] ctime[16] btime[16] gen[8] data_version[8] */
+	p, err := packCommon(fc, size, Rgetattr)
+	if err != nil {
+		return err
+	}
+
+	fc.Attr = *attr
+	p = pint64(attr.Valid, p)
+	p = pqid(&attr.Qid, p)
+	p = pint32(attr.Mode, p)
+	p = pint32(attr.Uid, p)
+	p = pint32(attr.Gid, p)
+	p = pint64(attr.Nlink, p)
+	p = pint64(attr.Rdev, p)
+	p = pint64(attr.Size, p)
+	p = pint64(attr.Blksize, p)
+	p = pint64(attr.Blocks, p)
+	p = pint64(attr.AtimeSec, p)
+	p = pint64(attr.AtimeNsec, p)
+	p = pint64(attr.MtimeSec, p)
+	p = pint64(attr.MtimeNsec, p)
+	p = pint64(attr.CtimeSec, p)
+	p = pint64(attr.CtimeNsec, p)
+	p = pint64(attr.BtimeSec, p)
+	p = pint64(attr.BtimeNsec, p)
+	p = pint64(attr.Gen, p)
+	p = pint64(attr.DataVersion, p)
+	return nil
+}
+
+// Create a Tsetattr message in the specified Fcall.
+func PackTsetattr(fc *Fcall, fid uint32, attr *SetAttr) error {
+	size := 4 + 4 + 4 + 4 + 4 + 8 + 16 + 16 /* fid[4] valid[4] mode[4] uid[4] gid[4] size[8] atime[16] mtime[16] */
+	p, err := packCommon(fc, size, Tsetattr)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.SetAttr = *attr
+	p = pint32(fid, p)
+	p = pint32(attr.Valid, p)
+	p = pint32(attr.Mode, p)
+	p = pint32(attr.Uid, p)
+	p = pint32(attr.Gid, p)
+	p = pint64(attr.Size, p)
+	p = pint64(attr.AtimeSec, p)
+	p = pint64(attr.AtimeNsec, p)
+	p = pint64(attr.MtimeSec, p)
+	p = pint64(attr.MtimeNsec, p)
+	return nil
+}
+
+// Create a Txattrwalk message in the specified Fcall.
+func PackTxattrwalk(fc *Fcall, fid uint32, newfid uint32, name string) error {
+	size := 4 + 4 + 2 + len(name) /* fid[4] newfid[4] name[s] */
+	p, err := packCommon(fc, size, Txattrwalk)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Newfid = newfid
+	fc.Name = name
+	p = pint32(fid, p)
+	p = pint32(newfid, p)
+	p = pstr(name, p)
+	return nil
+}
+
+// Create a Rxattrwalk message in the specified Fcall.
+func PackRxattrwalk(fc *Fcall, size uint64) error {
+	p, err := packCommon(fc, 8, Rxattrwalk) /* size[8] */
+	if err != nil {
+		return err
+	}
+
+	fc.Xattrsize = size
+	p = pint64(size, p)
+	return nil
+}
+
+// Create a Txattrcreate message in the specified Fcall.
+func PackTxattrcreate(fc *Fcall, fid uint32, name string, size uint64, flags uint32) error {
+	sz := 4 + 2 + len(name) + 8 + 4 /* fid[4] name[s] attr_size[8] flags[4] */
+	p, err := packCommon(fc, sz, Txattrcreate)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Name = name
+	fc.Xattrsize = size
+	fc.Flags = flags
+	p = pint32(fid, p)
+	p = pstr(name, p)
+	p = pint64(size, p)
+	p = pint32(flags, p)
+	return nil
+}
+
+// Create a Treaddir message in the specified Fcall.
+func PackTreaddir(fc *Fcall, fid uint32, offset uint64, count uint32) error {
+	p, err := packCommon(fc, 4+8+4, Treaddir) /* fid[4] offset[8] count[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Offset = offset
+	fc.Count = count
+	p = pint32(fid, p)
+	p = pint64(offset, p)
+	p = pint32(count, p)
+	return nil
+}
+
+// Initializes the specified Fcall value to contain Rreaddir message.
+// The user should pack the directory entries with PackDirent to the
+// slice pointed by fc.Data and call SetRreadCount to update the data
+// size to the actual value.
+func InitRreaddir(fc *Fcall, count uint32) error {
+	size := int(4 + count) /* count[4] data[count] */
+	p, err := packCommon(fc, size, Rreaddir)
+	if err != nil {
+		return err
+	}
+
+	fc.Count = count
+	fc.Data = p[4 : fc.Count+4]
+	p = pint32(count, p)
+	return nil
+}
+
+// Create a Rreaddir message with the specified directory entries in the
+// Fcall. Returns the number of entries that fit in the message.
+func PackRreaddir(fc *Fcall, count uint32, dirents []Dirent) (int, error) {
+	err := InitRreaddir(fc, count)
+	if err != nil {
+		return 0, err
+	}
+
+	n, b := 0, fc.Data
+	for i := range dirents {
+		sz := PackDirent(&dirents[i], b)
+		if sz == 0 {
+			break
+		}
+
+		b = b[sz:]
+		n++
+	}
+
+	SetRreadCount(fc, count-uint32(len(b)))
+	return n, nil
+}
+
+// Create a Tfsync message in the specified Fcall.
+func PackTfsync(fc *Fcall, fid uint32, datasync uint32) error {
+	p, err := packCommon(fc, 4+4, Tfsync) /* fid[4] datasync[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Datasync = datasync
+	p = pint32(fid, p)
+	p = pint32(datasync, p)
+	return nil
+}
+
+// Create a Tlock message in the specified Fcall.
+func PackTlock(fc *Fcall, fid uint32, lk *Flock) error {
+	size := 4 + 1 + 4 + 8 + 8 + 4 + 2 + len(lk.ClientId) /* fid[4] type[1] flags[4] start[8] length[8] proc_id[4] client_id[s] */
+	p, err := packCommon(fc, size, Tlock)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Flock = *lk
+	p = pint32(fid, p)
+	p = pint8(lk.Type, p)
+	p = pint32(lk.Flags, p)
+	p = pint64(lk.Start, p)
+	p = pint64(lk.Length, p)
+	p = pint32(lk.ProcId, p)
+	p = pstr(lk.ClientId, p)
+	return nil
+}
+
+// Create a Rlock message in the specified Fcall.
+func PackRlock(fc *Fcall, status uint8) error {
+	p, err := packCommon(fc, 1, Rlock) /* status[1] */
+	if err != nil {
+		return err
+	}
+
+	fc.Status = status
+	p = pint8(status, p)
+	return nil
+}
+
+// Create a Tgetlock message in the specified Fcall. The Flags field of
+// the lock is ignored.
+func PackTgetlock(fc *Fcall, fid uint32, lk *Flock) error {
+	size := 4 + 1 + 8 + 8 + 4 + 2 + len(lk.ClientId) /* fid[4] type[1] start[8] length[8] proc_id[4] client_id[s] */
+	p, err := packCommon(fc, size, Tgetlock)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Flock = *lk
+	fc.Flock.Flags = 0
+	p = pint32(fid, p)
+	p = pint8(lk.Type, p)
+	p = pint64(lk.Start, p)
+	p = pint64(lk.Length, p)
+	p = pint32(lk.ProcId, p)
+	p = pstr(lk.ClientId, p)
+	return nil
+}
+
+// Create a Rgetlock message in the specified Fcall. The Flags field of
+// the lock is ignored.
+func PackRgetlock(fc *Fcall, lk *Flock) error {
+	size := 1 + 8 + 8 + 4 + 2 + len(lk.ClientId) /* type[1] start[8] length[8] proc_id[4] client_id[s] */
+	p, err := packCommon(fc, size, Rgetlock)
+	if err != nil {
+		return err
+	}
+
+	fc.Flock = *lk
+	fc.Flock.Flags = 0
+	p = pint8(lk.Type, p)
+	p = pint64(lk.Start, p)
+	p = pint64(lk.Length, p)
+	p = pint32(lk.ProcId, p)
+	p = pstr(lk.ClientId, p)
+	return nil
+}
+
+// Create a Tlink message in the specified Fcall.
+func PackTlink(fc *Fcall, dfid uint32, fid uint32, name string) error {
+	size := 4 + 4 + 2 + len(name) /* dfid[4] fid[4] name[s] */
+	p, err := packCommon(fc, size, Tlink)
+	if err != nil {
+		return err
+	}
+
+	fc.Dfid = dfid
+	fc.Fid = fid
+	fc.Name = name
+	p = pint32(dfid, p)
+	p = pint32(fid, p)
+	p = pstr(name, p)
+	return nil
+}
+
+// Create a Tmkdir message in the specified Fcall.
+func PackTmkdir(fc *Fcall, dfid uint32, name string, mode uint32, gid uint32) error {
+	size := 4 + 2 + len(name) + 4 + 4 /* dfid[4] name[s] mode[4] gid[4] */
+	p, err := packCommon(fc, size, Tmkdir)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = dfid
+	fc.Name = name
+	fc.Perm = mode
+	fc.Lgid = gid
+	p = pint32(dfid, p)
+	p = pstr(name, p)
+	p = pint32(mode, p)
+	p = pint32(gid, p)
+	return nil
+}
+
+// Create a Trenameat message in the specified Fcall.
+func PackTrenameat(fc *Fcall, olddirfid uint32, oldname string, newdirfid uint32, newname string) error {
+	size := 4 + 2 + len(oldname) + 4 + 2 + len(newname) /* olddirfid[4] oldname[s] newdirfid[4] newname[s] */
+	p, err := packCommon(fc, size, Trenameat)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = olddirfid
+	fc.Name = oldname
+	fc.Dfid = newdirfid
+	fc.Newname = newname
+	p = pint32(olddirfid, p)
+	p = pstr(oldname, p)
+	p = pint32(newdirfid, p)
+	p = pstr(newname, p)
+	return nil
+}
+
+// Create a Tunlinkat message in the specified Fcall.
+func PackTunlinkat(fc *Fcall, dirfid uint32, name string, flags uint32) error {
+	size := 4 + 2 + len(name) + 4 /* dirfd[4] name[s] flags[4] */
+	p, err := packCommon(fc, size, Tunlinkat)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = dirfid
+	fc.Name = name
+	fc.Flags = flags
+	p = pint32(dirfid, p)
+	p = pstr(name, p)
+	p = pint32(flags, p)
+	return nil
+}
+
+func packRqid(fc *Fcall, id uint8, qid *Qid) error {
+	p, err := packCommon(fc, 13, id) /* qid[13] */
+	if err != nil {
+		return err
+	}
+
+	fc.Qid = *qid
+	p = pqid(qid, p)
+	return nil
+}
+
+// Create a Rsymlink message in the specified Fcall.
+func PackRsymlink(fc *Fcall, qid *Qid) error { return packRqid(fc, Rsymlink, qid) }
+
+// Create a Rmknod message in the specified Fcall.
+func PackRmknod(fc *Fcall, qid *Qid) error { return packRqid(fc, Rmknod, qid) }
+
+// Create a Rmkdir message in the specified Fcall.
+func PackRmkdir(fc *Fcall, qid *Qid) error { return packRqid(fc, Rmkdir, qid) }
+
+// Create a Rrename message in the specified Fcall.
+func PackRrename(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rrename)
+	return err
+}
+
+// Create a Rsetattr message in the specified Fcall.
+func PackRsetattr(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rsetattr)
+	return err
+}
+
+// Create a Rxattrcreate message in the specified Fcall.
+func PackRxattrcreate(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rxattrcreate)
+	return err
+}
+
+// Create a Rfsync message in the specified Fcall.
+func PackRfsync(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rfsync)
+	return err
+}
+
+// Create a Rlink message in the specified Fcall.
+func PackRlink(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rlink)
+	return err
+}
+
+// Create a Rrenameat message in the specified Fcall.
+func PackRrenameat(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rrenameat)
+	return err
+}
+
+// Create a Runlinkat message in the specified Fcall.
+func PackRunlinkat(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Runlinkat)
+	return err
+}
+
+func direntsz(d *Dirent) int {
+	return 13 + 8 + 1 + 2 + len(d.Name) /* qid[13] offset[8] type[1] name[s] */
+}
+
+// Converts a Dirent value to its on-the-wire representation and writes it
+// to the buf. Returns the number of bytes written, 0 if there is not enough
+// space.
+func PackDirent(d *Dirent, buf []byte) int {
+	sz := direntsz(d)
+	if sz > len(buf) {
+		return 0
+	}
+
+	buf = pqid(&d.Qid, buf)
+	buf = pint64(d.Offset, buf)
+	buf = pint8(d.Type, buf)
+	buf = pstr(d.Name, buf)
+	return sz
+}
+
+// Converts the on-the-wire representation of a directory entry from
+// Rreaddir to a Dirent value. Returns the entry and the number of bytes
+// used, or an UnpackError if the entry is malformed.
+func UnpackDirent(buf []byte) (d *Dirent, sz int, err error) {
+	dec := &decoder{p: buf}
+	d = new(Dirent)
+	dec.qid("dirent.qid", &d.Qid)
+	d.Offset = dec.u64("dirent.offset")
+	d.Type = dec.u8("dirent.type")
+	d.Name = dec.str("dirent.name")
+	if dec.err != nil {
+		return nil, 0, dec.err
+	}
+
+	return d, dec.off, nil
+}
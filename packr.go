@@ -143,8 +143,8 @@ func InitRread(fc *Fcall, count uint32) error {
 	return nil
 }
 
-// Updates the size of the data returned by Rread. Expects that
-// the Fcall value is already initialized by InitRread.
+// Updates the size of the data returned by Rread (or Rbread). Expects
+// that the Fcall value is already initialized by InitRread (or InitRbread).
 func SetRreadCount(fc *Fcall, count uint32) {
 	/* we need to update both the packet size as well as the data count */
 	size := 4 + 1 + 2 + 4 + count /* size[4] id[1] tag[2] count[4] data[count] */
@@ -182,6 +182,53 @@ func PackRwrite(fc *Fcall, count uint32) error {
 	return nil
 }
 
+// Initializes the specified Fcall value to contain Rbread message.
+// The user should copy the returned data to the slice pointed by
+// fc.Data and call SetRreadCount to update the data size to the
+// actual value.
+func InitRbread(fc *Fcall, count uint32) error {
+	size := int(4 + count) /* count[4] data[count] */
+	p, err := packCommon(fc, size, Rbread)
+	if err != nil {
+		return err
+	}
+
+	fc.Count = count
+	fc.Data = p[4 : fc.Count+4]
+	p = pint32(count, p)
+	return nil
+}
+
+// Create a Rbread message in the specified Fcall.
+func PackRbread(fc *Fcall, data []byte) error {
+	count := uint32(len(data))
+	err := InitRbread(fc, count)
+	if err != nil {
+		return err
+	}
+
+	copy(fc.Data, data)
+	return nil
+}
+
+// Create a Rbwrite message in the specified Fcall.
+func PackRbwrite(fc *Fcall, count uint32) error {
+	p, err := packCommon(fc, 4, Rbwrite) /* count[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Count = count
+	p = pint32(count, p)
+	return nil
+}
+
+// Create a Rbtrunc message in the specified Fcall.
+func PackRbtrunc(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rbtrunc)
+	return err
+}
+
 // Create a Rclunk message in the specified Fcall.
 func PackRclunk(fc *Fcall) error {
 	_, err := packCommon(fc, 0, Rclunk)
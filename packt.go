@@ -199,6 +199,83 @@ func PackTwrite(fc *Fcall, fid uint32, offset uint64, count uint32, data []byte)
 	return nil
 }
 
+// Same as PackTwrite, but the data is not copied to the buffer of the
+// Fcall. Pkt contains only the header and the data is sent from Payload
+// (see FcallWriter), so it shouldn't be changed until the message is
+// sent.
+func PackTwritev(fc *Fcall, fid uint32, offset uint64, data []byte) error {
+	size := 4 + 8 + 4 /* fid[4] offset[8] count[4] */
+	p, err := packCommon(fc, size, Twrite)
+	if err != nil {
+		return err
+	}
+
+	/* the size of the message includes the payload */
+	fc.Size += uint32(len(data))
+	pint32(fc.Size, fc.Pkt)
+	fc.Fid = fid
+	fc.Offset = offset
+	fc.Count = uint32(len(data))
+	p = pint32(fid, p)
+	p = pint64(offset, p)
+	p = pint32(fc.Count, p)
+	fc.Data = data
+	fc.Payload = data
+	return nil
+}
+
+// Create a Tbread message in the specified Fcall.
+func PackTbread(fc *Fcall, fileid uint64, offset uint64, count uint32) error {
+	size := 8 + 8 + 4 /* fileid[8] offset[8] count[4] */
+	p, err := packCommon(fc, size, Tbread)
+	if err != nil {
+		return err
+	}
+
+	fc.Fileid = fileid
+	fc.Offset = offset
+	fc.Count = count
+	p = pint64(fileid, p)
+	p = pint64(offset, p)
+	p = pint32(count, p)
+	return nil
+}
+
+// Create a Tbwrite message in the specified Fcall.
+func PackTbwrite(fc *Fcall, fileid uint64, offset uint64, data []byte) error {
+	c := len(data)
+	size := 8 + 8 + 4 + c /* fileid[8] offset[8] count[4] data[count] */
+	p, err := packCommon(fc, size, Tbwrite)
+	if err != nil {
+		return err
+	}
+
+	fc.Fileid = fileid
+	fc.Offset = offset
+	fc.Count = uint32(c)
+	p = pint64(fileid, p)
+	p = pint64(offset, p)
+	p = pint32(uint32(c), p)
+	fc.Data = p
+	copy(fc.Data, data)
+	return nil
+}
+
+// Create a Tbtrunc message in the specified Fcall.
+func PackTbtrunc(fc *Fcall, fileid uint64, offset uint64) error {
+	size := 8 + 8 /* fileid[8] offset[8] */
+	p, err := packCommon(fc, size, Tbtrunc)
+	if err != nil {
+		return err
+	}
+
+	fc.Fileid = fileid
+	fc.Offset = offset
+	p = pint64(fileid, p)
+	p = pint64(offset, p)
+	return nil
+}
+
 // Create a Tclunk message in the specified Fcall.
 func PackTclunk(fc *Fcall, fid uint32) error {
 	p, err := packCommon(fc, 4, Tclunk) /* fid[4] */
@@ -0,0 +1,64 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+import (
+	"sync"
+)
+
+/* the pooled buffers are powers of two between 512 bytes and 16 MB */
+const (
+	minPoolShift = 9
+	maxPoolShift = 24
+)
+
+var fcallPools [maxPoolShift - minPoolShift + 1]sync.Pool
+
+// Returns the index of the smallest pool with buffers of at least
+// sz bytes, or -1 if the buffers are too big to be pooled.
+func poolIndex(sz uint32) int {
+	for i := range fcallPools {
+		if uint32(1)<<uint(i+minPoolShift) >= sz {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Returns a Fcall with a buffer of at least sz bytes. The Fcall is
+// taken from a pool if one is available. It should be returned with
+// FreeFcall once the message and its data are no longer used.
+func AllocFcall(sz uint32) *Fcall {
+	i := poolIndex(sz)
+	if i < 0 {
+		return NewFcall(sz)
+	}
+
+	if fc, ok := fcallPools[i].Get().(*Fcall); ok {
+		return fc
+	}
+
+	return NewFcall(uint32(1) << uint(i+minPoolShift))
+}
+
+// Returns the Fcall to the pool. The Fcall, its buffer and the
+// slices that point to the buffer (Pkt, Data) can't be used after
+// the call.
+func FreeFcall(fc *Fcall) {
+	if fc == nil {
+		return
+	}
+
+	buf := fc.Buf[0:cap(fc.Buf)]
+	i := poolIndex(uint32(len(buf)))
+	if i < 0 || len(buf) != 1<<uint(i+minPoolShift) {
+		/* not allocated by AllocFcall */
+		return
+	}
+
+	*fc = Fcall{Buf: buf}
+	fcallPools[i].Put(fc)
+}
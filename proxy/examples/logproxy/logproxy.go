@@ -0,0 +1,89 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A proxy that forwards the requests to one or more file servers and
+// logs them. With -ro it rejects the requests that change the files.
+package main
+
+import (
+	"flag"
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/proxy"
+	"github.com/jsouthworth/ixp/srv"
+	"log"
+	"net"
+	"strings"
+)
+
+var addr = flag.String("addr", ":5641", "network address")
+var upstream = flag.String("upstream", "127.0.0.1:5640", "comma-separated addresses of the file servers")
+var conns = flag.Int("n", 1, "number of connections to each file server")
+var readonly = flag.Bool("ro", false, "reject the requests that change the files")
+var debug = flag.Int("d", 0, "print debug messages")
+
+type Hooks struct{}
+
+func (*Hooks) Filter(req *srv.Req) error {
+	if !*readonly {
+		return nil
+	}
+
+	switch req.Tc.Type {
+	case ixp.Tcreate, ixp.Twrite, ixp.Tremove, ixp.Twstat:
+		return srv.Eperm
+
+	case ixp.Topen:
+		if req.Tc.Mode&3 != ixp.OREAD || req.Tc.Mode&(ixp.OTRUNC|ixp.ORCLOSE) != 0 {
+			return srv.Eperm
+		}
+	}
+
+	return nil
+}
+
+func (*Hooks) Log(req *srv.Req, rc *ixp.Fcall, err error) {
+	user := "none"
+	if req.Fid != nil && req.Fid.User != nil {
+		user = req.Fid.User.Name()
+	}
+
+	if err != nil {
+		log.Printf("%s %s %s: %v", req.Conn.Id, user, req.Tc, err)
+	} else {
+		log.Printf("%s %s %s", req.Conn.Id, user, req.Tc)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	var up []*clnt.Clnt
+	for _, a := range strings.Split(*upstream, ",") {
+		for i := 0; i < *conns; i++ {
+			c, err := net.Dial("tcp", a)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			cl, err := clnt.Connect(c, ixp.MSIZE, true)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			up = append(up, cl)
+		}
+	}
+
+	p := proxy.NewProxy(up...)
+	p.Hooks = new(Hooks)
+	p.Id = "logproxy"
+	p.Debuglevel = *debug
+	p.Start(p)
+
+	err := p.StartNetListener("tcp", *addr)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,630 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The proxy package implements a 9P2000 file server that forwards the
+// requests of its clients to one or more upstream file servers.
+package proxy
+
+import (
+	"context"
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/srv"
+	"sync"
+)
+
+// Filter operation. If the Hooks of the proxy implement it, Filter is
+// called for each request before it is forwarded. If it returns an
+// error, the request is responded with the error and isn't forwarded.
+// The upstream request is created from the fields of req.Tc (Wname,
+// Mode, Name, Perm, Offset, Count, Data, Dir), so Filter can rewrite
+// the request by changing them.
+type FilterOps interface {
+	Filter(req *srv.Req) error
+}
+
+// Rewrite operation. If the Hooks of the proxy implement it, Rewrite
+// is called with the upstream response of each successful request,
+// before the response is sent to the client. The response is created
+// from the fields of rc (Qid, Wqid, Iounit, Data, Count, Dir), so
+// Rewrite can change them. If Rewrite returns an error, the request
+// is responded with the error.
+type RewriteOps interface {
+	Rewrite(req *srv.Req, rc *ixp.Fcall) error
+}
+
+// Log operation. If the Hooks of the proxy implement it, Log is called
+// for each request before it is responded, with the upstream response
+// or the error sent to the client. The response can't be used after
+// Log returns.
+type LogOps interface {
+	Log(req *srv.Req, rc *ixp.Fcall, err error)
+}
+
+// Attach operation. If the Hooks of the proxy implement it, MapAttach
+// is called for each Tattach with the user and the attach name sent
+// by the client, and returns the user and the attach name used for
+// the upstream server.
+type AttachOps interface {
+	MapAttach(user ixp.User, aname string) (ixp.User, string, error)
+}
+
+// The Proxy type implements a file server that forwards the requests
+// to the upstream clients. The fids and the tags of the client
+// connections are translated to the fids and the tags of the upstream
+// connections. All attaches of a user with the same attach name share
+// one upstream attach, the new attaches are distributed between the
+// upstream connections in turn. A Tflush flushes the upstream request.
+//
+// The upstream connections should speak 9P2000 or 9P2000.u, the proxy
+// speaks 9P2000.u if all of them do. The Upool of the proxy should know
+// the users that attach to it.
+type Proxy struct {
+	srv.Srv
+	Hooks interface{} // implements any of FilterOps, RewriteOps, LogOps and AttachOps
+
+	lock     sync.Mutex
+	upstream []*clnt.Clnt
+	next     int                             // upstream used for the next new attach
+	attaches map[attachKey]*attach           // upstream attaches
+	reqs     map[*srv.Req]context.CancelFunc // requests that can be flushed
+}
+
+type attachKey struct {
+	uname string
+	aname string
+}
+
+// The attach type represents an upstream attach, shared by the fids
+// walked from the client attaches with the same user and attach name.
+type attach struct {
+	key  attachKey
+	clnt *clnt.Clnt
+	root *clnt.Fid
+	ref  int       // number of fids that use the attach
+	done chan bool // closed once the upstream Tattach is answered
+	err  error     // error of the upstream Tattach
+}
+
+// The pfid type contains the per-Fid data of the proxy.
+type pfid struct {
+	sync.Mutex
+	at   *attach
+	fid  *clnt.Fid // upstream fid, nil after Clunk or Remove
+	doff uint64    // upstream offset of the next directory read
+}
+
+// Creates a proxy that forwards the requests to the upstream clients.
+// The clients should be connected, but not attached.
+func NewProxy(upstream ...*clnt.Clnt) *Proxy {
+	p := new(Proxy)
+	p.upstream = upstream
+	p.attaches = make(map[attachKey]*attach)
+	p.reqs = make(map[*srv.Req]context.CancelFunc)
+	p.Dialect = ixp.Dialect9P2000u
+	for _, c := range upstream {
+		if !c.Dotu() {
+			p.Dialect = ixp.Dialect9P2000
+		}
+
+		if p.Msize == 0 || c.Msize < p.Msize {
+			p.Msize = c.Msize
+		}
+	}
+
+	return p
+}
+
+// Returns the upstream attach for the user and the attach name,
+// attaching if needed. The upstream Tattach is sent without holding
+// the lock of the proxy; the concurrent attaches with the same user
+// and attach name wait for its response. The Tattach is flushed if
+// the context is cancelled.
+func (p *Proxy) attach(ctx context.Context, user ixp.User, aname string) (*attach, error) {
+	if len(p.upstream) == 0 {
+		return nil, &ixp.Error{"no upstream servers", ixp.EIO}
+	}
+
+	key := attachKey{user.Name(), aname}
+	for {
+		p.lock.Lock()
+		at := p.attaches[key]
+		if at == nil {
+			at = &attach{key: key, done: make(chan bool)}
+			at.clnt = p.upstream[p.next%len(p.upstream)]
+			p.next++
+			p.attaches[key] = at
+			at.ref++
+			p.lock.Unlock()
+
+			root, err := at.clnt.AttachContext(ctx, nil, user, aname)
+			p.lock.Lock()
+			at.root, at.err = root, err
+			if err != nil {
+				delete(p.attaches, key)
+			}
+			p.lock.Unlock()
+			close(at.done)
+			if err != nil {
+				return nil, err
+			}
+
+			return at, nil
+		}
+
+		at.ref++
+		p.lock.Unlock()
+
+		select {
+		case <-at.done:
+		case <-ctx.Done():
+			/* the sender of a pending Tattach holds a reference too */
+			p.release(at)
+			return nil, ctx.Err()
+		}
+
+		if at.err == nil {
+			return at, nil
+		}
+
+		if at.err == context.Canceled {
+			/* the request that sent the Tattach was flushed, try again */
+			continue
+		}
+
+		return nil, at.err
+	}
+}
+
+// Drops a reference to the attach. The upstream root fid is clunked
+// when the attach is no longer used.
+func (p *Proxy) release(at *attach) {
+	p.lock.Lock()
+	at.ref--
+	clunk := at.ref == 0 && at.root != nil
+	if at.ref == 0 && p.attaches[at.key] == at {
+		delete(p.attaches, at.key)
+	}
+	p.lock.Unlock()
+
+	if clunk {
+		at.clnt.Clunk(at.root)
+	}
+}
+
+// Returns the upstream fid of the client's fid, or an error if the fid
+// was clunked.
+func getFid(fid *srv.Fid) (*pfid, *clnt.Fid, error) {
+	pf, ok := fid.Aux.(*pfid)
+	if !ok {
+		return nil, nil, srv.Eunknownfid
+	}
+
+	pf.Lock()
+	f := pf.fid
+	pf.Unlock()
+	if f == nil {
+		return nil, nil, srv.Eunknownfid
+	}
+
+	return pf, f, nil
+}
+
+// Takes the upstream fid away from the client's fid.
+func (pf *pfid) take() *clnt.Fid {
+	pf.Lock()
+	f := pf.fid
+	pf.fid = nil
+	pf.Unlock()
+	return f
+}
+
+// Prepares the request for forwarding. Returns the context of the
+// upstream requests, which is cancelled if the request is flushed.
+// If the Filter rejects the request, it is responded and begin returns
+// nil.
+func (p *Proxy) begin(req *srv.Req) context.Context {
+	if h, ok := p.Hooks.(FilterOps); ok {
+		if err := h.Filter(req); err != nil {
+			p.respond(req, nil, err)
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.lock.Lock()
+	p.reqs[req] = cancel
+	p.lock.Unlock()
+	return ctx
+}
+
+// Responds to the request with the upstream response rc, or with the
+// error. If the upstream request was flushed, the request is flushed
+// too.
+func (p *Proxy) respond(req *srv.Req, rc *ixp.Fcall, err error) {
+	p.lock.Lock()
+	cancel := p.reqs[req]
+	delete(p.reqs, req)
+	p.lock.Unlock()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	if h, ok := p.Hooks.(RewriteOps); ok && err == nil {
+		err = h.Rewrite(req, rc)
+	}
+
+	if h, ok := p.Hooks.(LogOps); ok {
+		h.Log(req, rc, err)
+	}
+
+	if err == context.Canceled {
+		req.Flush()
+		return
+	}
+
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	switch rc.Type {
+	case ixp.Rattach:
+		req.RespondRattach(&rc.Qid)
+
+	case ixp.Rwalk:
+		req.RespondRwalk(rc.Wqid)
+
+	case ixp.Ropen:
+		req.RespondRopen(&rc.Qid, p.iounit(req, rc.Iounit))
+
+	case ixp.Rcreate:
+		req.RespondRcreate(&rc.Qid, p.iounit(req, rc.Iounit))
+
+	case ixp.Rread:
+		if len(rc.Data) > 0 && len(req.Rc.Data) > 0 && &rc.Data[0] == &req.Rc.Data[0] {
+			/* the data was received directly into the response */
+			ixp.SetRreadCount(req.Rc, uint32(len(rc.Data)))
+			req.Respond()
+		} else {
+			req.RespondRread(rc.Data)
+		}
+
+	case ixp.Rwrite:
+		req.RespondRwrite(rc.Count)
+
+	case ixp.Rclunk:
+		req.RespondRclunk()
+
+	case ixp.Rremove:
+		req.RespondRremove()
+
+	case ixp.Rstat:
+		req.RespondRstat(&rc.Dir)
+
+	case ixp.Rwstat:
+		req.RespondRwstat()
+
+	default:
+		req.RespondError(&ixp.Error{"invalid response", ixp.EIO})
+	}
+}
+
+// Returns the iounit for the client's connection.
+func (p *Proxy) iounit(req *srv.Req, iounit uint32) uint32 {
+	if max := req.Conn.Msize - ixp.IOHDRSZ; iounit > max {
+		iounit = max
+	}
+
+	return iounit
+}
+
+// Sends the request upstream. The response should be freed with
+// FreeFcall.
+func rpc(ctx context.Context, c *clnt.Clnt, tc *ixp.Fcall, err error) (*ixp.Fcall, error) {
+	if err != nil {
+		c.FreeFcall(tc)
+		return nil, err
+	}
+
+	return c.RpcContext(ctx, tc)
+}
+
+// Cancels the upstream request of a request that is flushed.
+func (p *Proxy) Flush(req *srv.Req) {
+	p.lock.Lock()
+	cancel := p.reqs[req]
+	p.lock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (p *Proxy) Attach(req *srv.Req) {
+	ctx := p.begin(req)
+	if ctx == nil {
+		return
+	}
+
+	user, aname := req.Fid.User, req.Tc.Aname
+	if h, ok := p.Hooks.(AttachOps); ok {
+		var err error
+		user, aname, err = h.MapAttach(user, aname)
+		if err != nil {
+			p.respond(req, nil, err)
+			return
+		}
+	}
+
+	at, err := p.attach(ctx, user, aname)
+	if err != nil {
+		p.respond(req, nil, err)
+		return
+	}
+
+	/* each client fid gets its own clone of the upstream root */
+	fid := at.clnt.FidAlloc()
+	_, err = at.clnt.WalkContext(ctx, at.root, fid, nil)
+	if err != nil {
+		at.clnt.Clunk(fid)
+		p.release(at)
+		p.respond(req, nil, err)
+		return
+	}
+
+	req.Fid.Aux = &pfid{at: at, fid: fid}
+	p.respond(req, &ixp.Fcall{Type: ixp.Rattach, Qid: at.root.Qid}, nil)
+}
+
+func (p *Proxy) Walk(req *srv.Req) {
+	pf, fid, err := getFid(req.Fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	ctx := p.begin(req)
+	if ctx == nil {
+		return
+	}
+
+	c := fid.Clnt
+	newfid := fid
+	if req.Newfid != req.Fid {
+		newfid = c.FidAlloc()
+	}
+
+	wqids, err := c.WalkContext(ctx, fid, newfid, req.Tc.Wname)
+	if newfid != fid {
+		if err != nil || len(wqids) != len(req.Tc.Wname) {
+			c.Clunk(newfid)
+		} else {
+			p.lock.Lock()
+			pf.at.ref++
+			p.lock.Unlock()
+			req.Newfid.Aux = &pfid{at: pf.at, fid: newfid}
+		}
+	}
+
+	p.respond(req, &ixp.Fcall{Type: ixp.Rwalk, Wqid: wqids}, err)
+}
+
+func (p *Proxy) Open(req *srv.Req) {
+	_, fid, err := getFid(req.Fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	ctx := p.begin(req)
+	if ctx == nil {
+		return
+	}
+
+	c := fid.Clnt
+	tc := c.NewFcall()
+	rc, err := rpc(ctx, c, tc, ixp.PackTopen(tc, fid.Fid, req.Tc.Mode))
+	p.respond(req, rc, err)
+	c.FreeFcall(rc)
+}
+
+func (p *Proxy) Create(req *srv.Req) {
+	_, fid, err := getFid(req.Fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	ctx := p.begin(req)
+	if ctx == nil {
+		return
+	}
+
+	c := fid.Clnt
+	tc := c.NewFcall()
+	t := req.Tc
+	rc, err := rpc(ctx, c, tc, ixp.PackTcreate(tc, fid.Fid, t.Name, t.Perm, t.Mode, t.Ext, c.Dotu()))
+	p.respond(req, rc, err)
+	c.FreeFcall(rc)
+}
+
+func (p *Proxy) Read(req *srv.Req) {
+	pf, fid, err := getFid(req.Fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	ctx := p.begin(req)
+	if ctx == nil {
+		return
+	}
+
+	c := fid.Clnt
+	count := req.Tc.Count
+	if max := c.Msize - ixp.IOHDRSZ; count > max {
+		count = max
+	}
+
+	/* the directory entries may need to be converted for the client */
+	dir := req.Fid.Type&ixp.QTDIR != 0
+	conv := dir && c.Dotu() != req.Conn.Dotu()
+	offset := req.Tc.Offset
+	if dir {
+		pf.Lock()
+		if offset != 0 {
+			offset = pf.doff
+		}
+		pf.Unlock()
+	}
+
+	tc := c.NewFcall()
+	err = ixp.PackTread(tc, fid.Fid, offset, count)
+	if err == nil && !conv {
+		/* the data is received directly into the response (see clnt.readBuf) */
+		err = ixp.InitRread(req.Rc, count)
+		tc.Data = req.Rc.Data
+	}
+
+	rc, err := rpc(ctx, c, tc, err)
+	if err == nil && dir {
+		pf.Lock()
+		pf.doff = offset + uint64(len(rc.Data))
+		pf.Unlock()
+		if conv {
+			rc.Data, err = convDirs(rc.Data, c.Dotu(), req.Conn.Dotu())
+		}
+	}
+
+	p.respond(req, rc, err)
+	c.FreeFcall(rc)
+}
+
+// Converts directory entries between the 9P2000 and 9P2000.u formats.
+func convDirs(data []byte, from, to bool) ([]byte, error) {
+	var out []byte
+	for len(data) > 0 {
+		d, err := ixp.UnpackDir(data, from)
+		if err != nil {
+			return nil, err
+		}
+
+		data = data[d.Size+2:]
+		/* big enough for the entry in both formats */
+		buf := make([]byte, int(d.Size)+2+2+len(d.Ext)+3*4)
+		n := ixp.PackDir(d, buf, to)
+		out = append(out, buf[0:n]...)
+	}
+
+	return out, nil
+}
+
+func (p *Proxy) Write(req *srv.Req) {
+	_, fid, err := getFid(req.Fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	ctx := p.begin(req)
+	if ctx == nil {
+		return
+	}
+
+	c := fid.Clnt
+	data := req.Tc.Data
+	if max := c.Msize - ixp.IOHDRSZ; uint32(len(data)) > max {
+		data = data[0:max]
+	}
+
+	tc := c.NewFcall()
+	rc, err := rpc(ctx, c, tc, ixp.PackTwritev(tc, fid.Fid, req.Tc.Offset, data))
+	p.respond(req, rc, err)
+	c.FreeFcall(rc)
+}
+
+func (p *Proxy) Clunk(req *srv.Req) {
+	pf, fid, err := getFid(req.Fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if p.begin(req) == nil {
+		return
+	}
+
+	pf.take()
+	err = fid.Clnt.Clunk(fid)
+	p.respond(req, &ixp.Fcall{Type: ixp.Rclunk}, err)
+}
+
+func (p *Proxy) Remove(req *srv.Req) {
+	pf, fid, err := getFid(req.Fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if p.begin(req) == nil {
+		return
+	}
+
+	pf.take()
+	err = fid.Clnt.Remove(fid)
+	p.respond(req, &ixp.Fcall{Type: ixp.Rremove}, err)
+}
+
+func (p *Proxy) Stat(req *srv.Req) {
+	_, fid, err := getFid(req.Fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	ctx := p.begin(req)
+	if ctx == nil {
+		return
+	}
+
+	c := fid.Clnt
+	tc := c.NewFcall()
+	rc, err := rpc(ctx, c, tc, ixp.PackTstat(tc, fid.Fid))
+	p.respond(req, rc, err)
+	c.FreeFcall(rc)
+}
+
+func (p *Proxy) Wstat(req *srv.Req) {
+	_, fid, err := getFid(req.Fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	ctx := p.begin(req)
+	if ctx == nil {
+		return
+	}
+
+	c := fid.Clnt
+	tc := c.NewFcall()
+	rc, err := rpc(ctx, c, tc, ixp.PackTwstat(tc, fid.Fid, &req.Tc.Dir, c.Dotu()))
+	p.respond(req, rc, err)
+	c.FreeFcall(rc)
+}
+
+// Clunks the upstream fid of a fid that was not clunked by the client,
+// and releases its attach.
+func (p *Proxy) FidDestroy(fid *srv.Fid) {
+	pf, ok := fid.Aux.(*pfid)
+	if !ok {
+		return
+	}
+
+	if f := pf.take(); f != nil {
+		f.Clnt.Clunk(f)
+	}
+
+	p.release(pf.at)
+}
@@ -0,0 +1,86 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy_test
+
+import (
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/proxy"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"github.com/jsouthworth/ixp/srv/ufs"
+	"sync"
+	"testing"
+)
+
+// Starts a proxy in front of n ufs servers that share a directory.
+func newProxy(t *testing.T, n int) *proxy.Proxy {
+	dir := t.TempDir()
+	var upstream []*clnt.Clnt
+	for i := 0; i < n; i++ {
+		fs, err := ufs.New(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { fs.Close() })
+
+		fs.Dialect = ixp.Dialect9P2000u
+		fs.Start(fs)
+		sc, cc := srvtest.Pipe(nil)
+		fs.NewConn(sc)
+		c, err := clnt.Connect(cc, ixp.MSIZE, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Unmount)
+
+		upstream = append(upstream, c)
+	}
+
+	p := proxy.NewProxy(upstream...)
+	p.Start(p)
+	return p
+}
+
+func TestProxy(t *testing.T) {
+	srvtest.Run(t, newProxy(t, 1), nil)
+}
+
+func TestProxyUpstreams(t *testing.T) {
+	srvtest.Run(t, newProxy(t, 2), nil)
+}
+
+// Concurrent attaches of the same user share one upstream attach.
+func TestProxyAttach(t *testing.T) {
+	p := newProxy(t, 1)
+	for round := 0; round < 2; round++ {
+		var wg sync.WaitGroup
+		clnts := make([]*clnt.Clnt, 8)
+		errs := make([]error, len(clnts))
+		for i := range clnts {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				clnts[i], _, errs[i] = srvtest.Loopback(p, nil)
+			}(i)
+		}
+		wg.Wait()
+
+		for i, c := range clnts {
+			if errs[i] != nil {
+				t.Fatalf("attach %d: %v", i, errs[i])
+			}
+
+			if _, err := c.Stat(c.Root); err != nil {
+				t.Errorf("stat of the root of attach %d: %v", i, err)
+			}
+		}
+
+		/* the upstream attach is clunked with the last client, and
+		   attached again in the next round */
+		for _, c := range clnts {
+			c.Unmount()
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+import (
+	"log/slog"
+)
+
+// The level of the structured log records for the 9P messages sent
+// and received by the clients and the servers. The messages are logged
+// if the handler of the logger is enabled for LevelTrace. Setting the
+// DbgPrintFcalls or DbgPrintPackets debug flags logs them at
+// slog.LevelInfo instead.
+const LevelTrace = slog.LevelDebug - 4
+
+// Returns the attributes that describe the message in a structured
+// log record: the type and the tag of the message, and the fid for the
+// T-messages that refer to one.
+func FcallAttrs(fc *Fcall) []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("type", TypeName(fc.Type)),
+		slog.Int("tag", int(fc.Tag)),
+	}
+
+	switch fc.Type {
+	case Tversion, Terror, Tlerror, Tflush, Tbread, Tbwrite, Tbtrunc:
+		/* no fid */
+
+	default:
+		if fc.Type%2 == 0 {
+			attrs = append(attrs, slog.Uint64("fid", uint64(fc.Fid)))
+		}
+	}
+
+	return attrs
+}
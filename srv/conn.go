@@ -5,150 +5,162 @@
 package srv
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/jsouthworth/ixp"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"time"
 )
 
-func (srv *Srv) NewConn(c net.Conn) {
+// Creates a new connection for the transport c and starts serving it.
+// The transport can be a net.Conn, or any other io.ReadWriteCloser (see
+// ixp.AddrTransport).
+func (srv *Srv) NewConn(c io.ReadWriteCloser) {
+	srv.newConn(c)
+}
+
+// Serves the requests received over the transport c, for example
+// the standard input and output of the process. Returns once the
+// transport is closed and the connection is cleaned up.
+func (srv *Srv) ServeConn(c io.ReadWriteCloser) error {
+	conn := srv.newConn(c)
+	if conn == nil {
+		return ErrServerClosed
+	}
+
+	<-conn.gone
+	return nil
+}
+
+func (srv *Srv) newConn(c io.ReadWriteCloser) *Conn {
+	srv.Lock()
+	closing := srv.closing
+	srv.Unlock()
+	if closing {
+		c.Close()
+		return nil
+	}
+
 	conn := new(Conn)
 	conn.Srv = srv
 	conn.Msize = srv.Msize
-	conn.Dotu = srv.Dotu
+	conn.Dialect = srv.Dialect
 	conn.Debuglevel = srv.Debuglevel
 	conn.conn = c
 	conn.fidpool = make(map[uint32]*Fid)
 	conn.reqs = make(map[uint16]*Req)
 	conn.reqout = make(chan *Req, srv.Maxpend)
 	conn.done = make(chan bool)
-	conn.rchan = make(chan *ixp.Fcall, 64)
+	conn.closed = make(chan bool)
+	conn.gone = make(chan bool)
 
 	srv.Lock()
 	if srv.conns == nil {
 		srv.conns = make(map[*Conn]*Conn)
 	}
 	srv.conns[conn] = conn
+	srv.nconns++
+	n := srv.nconns
 	srv.Unlock()
 
-	conn.Id = c.RemoteAddr().String()
+	/* the transports without addresses get unique Ids too */
+	conn.Id = ixp.RemoteAddr(c, fmt.Sprintf("conn%d", n))
+	conn.Slog = srv.Slog.With("conn", conn.Id)
+	statsRegister(conn)
 	if op, ok := (conn.Srv.ops).(ConnOps); ok {
 		op.ConnOpened(conn)
 	}
 
 	go conn.recv()
 	go conn.send()
+	return conn
 }
 
 func (conn *Conn) close() {
+	close(conn.closed)
+	conn.conn.Close()
 	conn.done <- true
-	conn.Srv.Lock()
-	delete(conn.Srv.conns, conn)
-	conn.Srv.Unlock()
+	statsUnregister(conn)
 
 	if op, ok := (conn.Srv.ops).(ConnOps); ok {
 		op.ConnClosed(conn)
 	}
 
 	/* call FidDestroy for all remaining fids */
+	conn.Lock()
+	fids := conn.fidpool
+	conn.fidpool = make(map[uint32]*Fid)
+	conn.Unlock()
 	if op, ok := (conn.Srv.ops).(FidOps); ok {
-		for _, fid := range conn.fidpool {
+		for _, fid := range fids {
 			op.FidDestroy(fid)
 		}
 	}
+
+	conn.Srv.Lock()
+	delete(conn.Srv.conns, conn)
+	conn.Srv.Unlock()
+	close(conn.gone)
 }
 
 func (conn *Conn) recv() {
-	var err error
-	var n int
-
-	buf := make([]byte, conn.Msize*8)
-	pos := 0
+	rd := ixp.NewFcallReader(conn.conn)
 	for {
-		if len(buf) < int(conn.Msize) {
-			b := make([]byte, conn.Msize*8)
-			copy(b, buf[0:pos])
-			buf = b
-			b = nil
-		}
+		conn.Lock()
+		msize, dotu := conn.Msize, conn.Dialect.Dotu()
+		conn.Unlock()
 
-		n, err = conn.conn.Read(buf[pos:])
-		if err != nil || n == 0 {
+		fc := ixp.AllocFcall(msize)
+		err := rd.ReadFcall(fc, msize, dotu)
+		if err != nil {
+			var e *ixp.Error
+			if errors.As(err, &e) {
+				conn.Slog.Warn("bad client connection", "err", err)
+			}
+
+			ixp.FreeFcall(fc)
 			conn.close()
 			return
 		}
 
-		pos += n
-		for pos > 4 {
-			sz, _ := ixp.Gint32(buf)
-			if sz > conn.Msize {
-				log.Println("bad client connection: ", conn.conn.RemoteAddr())
-				conn.conn.Close()
-				conn.close()
-				return
-			}
-			if pos < int(sz) {
-				if len(buf) < int(sz) {
-					b := make([]byte, conn.Msize*8)
-					copy(b, buf[0:pos])
-					buf = b
-					b = nil
-				}
-
-				break
-			}
-			fc, err, fcsize := ixp.Unpack(buf, conn.Dotu)
-			if err != nil {
-				log.Println(fmt.Sprintf("invalid packet : %v %v", err, buf))
-				conn.conn.Close()
-				conn.close()
-				return
-			}
-
-			tag := fc.Tag
-			req := new(Req)
-			select {
-			case req.Rc = <-conn.rchan:
-				break
-			default:
-				req.Rc = ixp.NewFcall(conn.Msize)
-			}
-
-			req.Conn = conn
-			req.Tc = fc
-			//			req.Rc = rc
-			if conn.Debuglevel > 0 {
-				conn.logFcall(req.Tc)
-				if conn.Debuglevel&DbgPrintPackets != 0 {
-					log.Println(">->", conn.Id, fmt.Sprint(req.Tc.Pkt))
-				}
-
-				if conn.Debuglevel&DbgPrintFcalls != 0 {
-					log.Println(">>>", conn.Id, req.Tc.String())
-				}
-			}
-
-			conn.Lock()
-			conn.nreqs++
-			conn.tsz += uint64(fc.Size)
-			conn.npend++
-			if conn.npend > conn.maxpend {
-				conn.maxpend = conn.npend
-			}
+		tag := fc.Tag
+		req := new(Req)
+		req.Conn = conn
+		req.Tc = fc
+		req.Rc = ixp.AllocFcall(conn.Msize)
+		req.start = time.Now()
+		if conn.Debuglevel > 0 {
+			conn.logFcall(req.Tc)
+		}
+		conn.trace(req, req.Tc, "received")
+
+		conn.Lock()
+		conn.nreqs++
+		conn.tsz += uint64(fc.Size)
+		conn.npend++
+		if conn.npend > conn.maxpend {
+			conn.maxpend = conn.npend
+		}
 
-			req.next = conn.reqs[tag]
-			conn.reqs[tag] = req
-			process := req.next == nil
-			if req.next != nil {
-				req.next.prev = req
-			}
-			conn.Unlock()
-			if process {
-				go req.process()
-			}
+		switch fc.Type {
+		case ixp.Tread:
+			conn.nreads++
+		case ixp.Twrite:
+			conn.nwrites++
+		}
 
-			buf = buf[fcsize:]
-			pos -= fcsize
+		req.next = conn.reqs[tag]
+		conn.reqs[tag] = req
+		process := req.next == nil
+		if req.next != nil {
+			req.next.prev = req
+		}
+		conn.Unlock()
+		if process {
+			go req.process()
 		}
 	}
 
@@ -156,6 +168,7 @@ func (conn *Conn) recv() {
 }
 
 func (conn *Conn) send() {
+	wr := ixp.NewFcallWriter(conn.conn)
 	for {
 		select {
 		case <-conn.done:
@@ -169,50 +182,59 @@ func (conn *Conn) send() {
 			conn.Unlock()
 			if conn.Debuglevel > 0 {
 				conn.logFcall(req.Rc)
-				if conn.Debuglevel&DbgPrintPackets != 0 {
-					log.Println("<-<", conn.Id, fmt.Sprint(req.Rc.Pkt))
-				}
-
-				if conn.Debuglevel&DbgPrintFcalls != 0 {
-					log.Println("<<<", conn.Id, req.Rc.String())
-				}
 			}
+			conn.trace(req, req.Rc, "sent")
 
-			for buf := req.Rc.Pkt; len(buf) > 0; {
-				n, err := conn.conn.Write(buf)
-				if err != nil {
-					/* just close the socket, will get signal on conn.done */
-					log.Println("error while writing")
-					conn.conn.Close()
-					break
-				}
-
-				buf = buf[n:]
+			err := wr.WriteFcall(req.Rc)
+			if err != nil {
+				/* just close the socket, will get signal on conn.done */
+				conn.Slog.Warn("error while writing", "err", err)
+				conn.conn.Close()
 			}
 
-			select {
-			case conn.rchan <- req.Rc:
-				break
-			default:
-			}
+			conn.Lock()
+			conn.nout--
+			conn.Unlock()
+
+			/* the request is finished, reuse its messages */
+			ixp.FreeFcall(req.Tc)
+			ixp.FreeFcall(req.Rc)
 		}
 	}
 
 	panic("unreached")
 }
 
+// Returns the remote address of the connection, or nil if
+// the transport doesn't have addresses.
 func (conn *Conn) RemoteAddr() net.Addr {
-	return conn.conn.RemoteAddr()
+	if c, ok := conn.conn.(ixp.AddrTransport); ok {
+		return c.RemoteAddr()
+	}
+
+	return nil
 }
 
+// Returns the local address of the connection, or nil if
+// the transport doesn't have addresses.
 func (conn *Conn) LocalAddr() net.Addr {
-	return conn.conn.LocalAddr()
+	if c, ok := conn.conn.(ixp.AddrTransport); ok {
+		return c.LocalAddr()
+	}
+
+	return nil
+}
+
+// Returns true if the 9P2000.u encoding is used for the messages of the
+// connection, i.e. if 9P2000.u or 9P2000.L was negotiated.
+func (conn *Conn) Dotu() bool {
+	return conn.Dialect.Dotu()
 }
 
 func (conn *Conn) logFcall(fc *ixp.Fcall) {
 	if conn.Debuglevel&DbgLogPackets != 0 {
-		pkt := make([]byte, len(fc.Pkt))
-		copy(pkt, fc.Pkt)
+		pkt := make([]byte, 0, len(fc.Pkt)+len(fc.Payload))
+		pkt = append(append(pkt, fc.Pkt...), fc.Payload...)
 		conn.Srv.Log.Log(pkt, conn, DbgLogPackets)
 	}
 
@@ -220,17 +242,57 @@ func (conn *Conn) logFcall(fc *ixp.Fcall) {
 		f := new(ixp.Fcall)
 		*f = *fc
 		f.Pkt = nil
+		f.Buf = nil
+		f.Data = append([]byte(nil), fc.Data...)
 		conn.Srv.Log.Log(f, conn, DbgLogFcalls)
 	}
 }
 
+// Logs the message received or sent for the request. The message is
+// logged at LevelTrace, or at LevelInfo if the debug level of the
+// connection prints the messages.
+func (conn *Conn) trace(req *Req, fc *ixp.Fcall, msg string) {
+	level := ixp.LevelTrace
+	if conn.Debuglevel&(DbgPrintFcalls|DbgPrintPackets) != 0 {
+		level = slog.LevelInfo
+	}
+
+	ctx := context.Background()
+	if !conn.Slog.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := ixp.FcallAttrs(fc)
+	conn.Lock()
+	user := conn.User
+	conn.Unlock()
+	if req.Fid != nil && req.Fid.User != nil {
+		user = req.Fid.User
+	}
+
+	if user != nil {
+		attrs = append(attrs, slog.String("user", user.Name()))
+	}
+
+	if fc == req.Rc {
+		attrs = append(attrs, slog.Duration("latency", time.Since(req.start)))
+	}
+
+	attrs = append(attrs, slog.String("fcall", fc.String()))
+	if conn.Debuglevel&DbgPrintPackets != 0 {
+		attrs = append(attrs, slog.Any("packet", fc.Pkt))
+	}
+
+	conn.Slog.LogAttrs(ctx, level, msg, attrs...)
+}
+
 func (srv *Srv) StartNetListener(ntype, addr string) error {
 	l, err := net.Listen(ntype, addr)
 	if err != nil {
 		return &ixp.Error{err.Error(), ixp.EIO}
 	}
 
-	return srv.StartListener(l)
+	return srv.Serve(l)
 }
 
 // Start listening on the specified network and address for incoming
@@ -238,13 +300,180 @@ func (srv *Srv) StartNetListener(ntype, addr string) error {
 // value, read messages from the socket, send them to the specified
 // server, and send back responses received from the server.
 func (srv *Srv) StartListener(l net.Listener) error {
+	return srv.Serve(l)
+}
+
+// Accepts the connections on the listener and serves them until the
+// listener fails, or the server is shut down. After Shutdown or
+// Close, Serve returns ErrServerClosed.
+func (srv *Srv) Serve(l net.Listener) error {
+	srv.Lock()
+	if srv.closing {
+		srv.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]bool)
+	}
+	srv.listeners[l] = true
+	srv.Unlock()
+
+	defer func() {
+		srv.Lock()
+		delete(srv.listeners, l)
+		srv.Unlock()
+	}()
+
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			srv.Lock()
+			closing := srv.closing
+			srv.Unlock()
+			if closing {
+				return ErrServerClosed
+			}
+
 			return &ixp.Error{err.Error(), ixp.EIO}
 		}
 
 		srv.NewConn(c)
 	}
-	return nil
+}
+
+// Stops accepting new connections and closes the listeners. Returns
+// the current connections.
+func (srv *Srv) stop() []*Conn {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.closing = true
+	for l := range srv.listeners {
+		l.Close()
+	}
+
+	conns := make([]*Conn, 0, len(srv.conns))
+	for conn := range srv.conns {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
+
+// Returns true if the connection has no outstanding requests, and
+// the responses were written to the client.
+func (conn *Conn) idle() bool {
+	conn.Lock()
+	defer conn.Unlock()
+	return len(conn.reqs) == 0 && conn.nout == 0
+}
+
+// Flushes all outstanding requests of the connection. Their responses
+// are not sent to the client.
+func (conn *Conn) flushAll() {
+	conn.Lock()
+	reqs := make([]*Req, 0, len(conn.reqs))
+	for _, r := range conn.reqs {
+		for rr := r; rr != nil; rr = rr.next {
+			reqs = append(reqs, rr)
+		}
+	}
+	conn.Unlock()
+
+	for _, r := range reqs {
+		r.Lock()
+		status := r.status
+		r.status |= reqFlush
+		r.Unlock()
+
+		if (status & (reqWork | reqSaved)) == 0 {
+			/* not worked on yet */
+			continue
+		}
+
+		if op, ok := (conn.Srv.ops).(FlushOp); ok {
+			op.Flush(r)
+		}
+	}
+}
+
+// Waits until all connections are closed, and ConnClosed and FidDestroy
+// are called for them.
+func (srv *Srv) wait(ctx context.Context) error {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for {
+		srv.Lock()
+		n := len(srv.conns)
+		srv.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-t.C:
+		}
+	}
+}
+
+// Shuts down the server gracefully. Shutdown closes the listeners,
+// rejects new attaches, and waits for the outstanding requests of each
+// connection to finish before closing it. If the context expires
+// first, the outstanding requests are flushed, the remaining
+// connections are closed, and the context's error is returned.
+// ConnClosed and FidDestroy are called for all connections before
+// Shutdown returns. The server is removed from the stats.
+func (srv *Srv) Shutdown(ctx context.Context) error {
+	defer statsUnregister(srv)
+	conns := srv.stop()
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for len(conns) > 0 {
+		busy := conns[:0]
+		for _, conn := range conns {
+			if conn.idle() {
+				conn.conn.Close()
+			} else {
+				busy = append(busy, conn)
+			}
+		}
+		conns = busy
+
+		if len(conns) == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, conn := range conns {
+				conn.flushAll()
+				conn.conn.Close()
+			}
+
+			srv.wait(context.Background())
+			return ctx.Err()
+
+		case <-t.C:
+		}
+	}
+
+	return srv.wait(ctx)
+}
+
+// Closes the listeners and all connections immediately, without
+// waiting for the outstanding requests. The responses of the
+// outstanding requests are not sent. ConnClosed and FidDestroy
+// are called for all connections before Close returns. The server is
+// removed from the stats.
+func (srv *Srv) Close() error {
+	defer statsUnregister(srv)
+	for _, conn := range srv.stop() {
+		conn.conn.Close()
+	}
+
+	return srv.wait(context.Background())
 }
@@ -0,0 +1,226 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv_test
+
+import (
+	"context"
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A file whose reads block until the test releases them.
+type waitFile struct {
+	srv.File
+	sync.Mutex
+	started  chan bool
+	release  chan bool
+	destroys int
+}
+
+func (f *waitFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	f.started <- true
+	<-f.release
+	return copy(buf, "done"), nil
+}
+
+func (f *waitFile) FidDestroy(fid *srv.FFid) {
+	f.Lock()
+	f.destroys++
+	f.Unlock()
+}
+
+// A file server that counts the connections it closes.
+type connSrv struct {
+	*srv.Fsrv
+	sync.Mutex
+	closed int
+}
+
+func (s *connSrv) ConnOpened(conn *srv.Conn) {}
+
+func (s *connSrv) ConnClosed(conn *srv.Conn) {
+	s.Lock()
+	s.closed++
+	s.Unlock()
+}
+
+// A client with the file open, and the result of its read.
+type srvFile struct {
+	c    *clnt.Clnt
+	f    *clnt.File
+	done chan error
+}
+
+// Returns true if err is the error want sent by the server.
+func isErr(err, want error) bool {
+	e, ok := err.(*ixp.Error)
+	w := want.(*ixp.Error)
+	return ok && e.Errornum == w.Errornum && strings.HasPrefix(e.Err, w.Err)
+}
+
+// Serves a waitFile named "f", and mounts the server n times. Each
+// client opens the file. The reads of the file are released when the
+// test ends.
+func waitTree(t *testing.T, n int) (*connSrv, *waitFile, []*srvFile) {
+	root := srvtest.Root(t, 0777)
+	f := &waitFile{started: make(chan bool, n), release: make(chan bool)}
+	if err := root.Add(&f.File, "f", srvtest.User(), nil, 0644, f); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &connSrv{Fsrv: srv.NewFileSrv(root)}
+	s.Dialect = ixp.Dialect9P2000u
+	if !s.Start(s) {
+		t.Fatal("can't start the file server")
+	}
+
+	t.Cleanup(func() {
+		close(f.release)
+		s.Close()
+	})
+
+	var files []*srvFile
+	for i := 0; i < n; i++ {
+		c, unmount, err := srvtest.Loopback(s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(unmount)
+
+		cf, err := c.FOpen("/f", ixp.OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files = append(files, &srvFile{c: c, f: cf})
+	}
+
+	return s, f, files
+}
+
+// Reads the file in the background. The result is sent to done.
+func (sf *srvFile) read() {
+	sf.done = make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64)
+		n, err := sf.f.ReadAt(buf, 0)
+		if err == nil && string(buf[0:n]) != "done" {
+			err = &ixp.Error{"read " + string(buf[0:n]), ixp.EIO}
+		}
+
+		sf.done <- err
+	}()
+}
+
+// Checks that ConnClosed and FidDestroy were called for the n
+// connections.
+func checkClosed(t *testing.T, s *connSrv, f *waitFile, n int) {
+	s.Lock()
+	closed := s.closed
+	s.Unlock()
+	f.Lock()
+	destroys := f.destroys
+	f.Unlock()
+	if closed != n || destroys != n {
+		t.Errorf("%d ConnClosed, %d FidDestroy, want %d", closed, destroys, n)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, f, files := waitTree(t, 1)
+	sf := files[0]
+	sf.read()
+	<-f.started
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := make(chan error, 1)
+	go func() { serve <- s.Serve(l) }()
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	/* the server waits for the read, and doesn't accept new attaches */
+	if err := <-serve; err != srv.ErrServerClosed {
+		t.Errorf("Serve: %v, want %v", err, srv.ErrServerClosed)
+	}
+
+	if _, err := sf.c.Attach(nil, srvtest.User(), ""); !isErr(err, srv.Eshutdown) {
+		t.Errorf("attach during shutdown: %v, want %v", err, srv.Eshutdown)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a read in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	f.release <- true
+	if err := <-sf.done; err != nil {
+		t.Errorf("read during shutdown: %v", err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+
+	checkClosed(t, s, f, 1)
+	if err := s.Serve(l); err != srv.ErrServerClosed {
+		t.Errorf("Serve after Shutdown: %v, want %v", err, srv.ErrServerClosed)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s, f, files := waitTree(t, 2)
+	for _, sf := range files {
+		sf.read()
+		<-f.started
+	}
+
+	/* the reads are flushed, their responses aren't sent */
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	checkClosed(t, s, f, 2)
+	for _, sf := range files {
+		if err := <-sf.done; err == nil {
+			t.Error("flushed read succeeded")
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	s, f, files := waitTree(t, 2)
+	files[0].read()
+	<-f.started
+
+	if err := s.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	checkClosed(t, s, f, 2)
+	if err := <-files[0].done; err == nil {
+		t.Error("read succeeded after Close")
+	}
+
+	sc, cc := srvtest.Pipe(nil)
+	defer cc.Close()
+	if err := s.ServeConn(sc); err != srv.ErrServerClosed {
+		t.Errorf("ServeConn after Close: %v, want %v", err, srv.ErrServerClosed)
+	}
+}
@@ -0,0 +1,499 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import "github.com/jsouthworth/ixp"
+
+// Returns the 9P2000.L operations of the file server, or responds with
+// an error and returns nil if the dialect wasn't negotiated for the
+// connection.
+func (srv *Srv) lops(req *Req) ReqLOps {
+	if req.Conn.Dialect == ixp.Dialect9P2000L {
+		if op, ok := (srv.ops).(ReqLOps); ok {
+			return op
+		}
+	}
+
+	req.RespondError(&ixp.Error{"unknown message type", ixp.EINVAL})
+	return nil
+}
+
+// Looks up the second fid of Trename, Trenameat and Tlink. Responds
+// with an error and returns false if the fid isn't a known directory.
+func (srv *Srv) getDfid(req *Req) bool {
+	srv.Lock()
+	req.Dfid = req.Conn.FidGet(req.Tc.Dfid)
+	srv.Unlock()
+	if req.Dfid == nil {
+		req.RespondError(Eunknownfid)
+		return false
+	}
+
+	if (req.Dfid.Type & ixp.QTDIR) == 0 {
+		req.RespondError(Enotdir)
+		return false
+	}
+
+	return true
+}
+
+func (srv *Srv) statfs(req *Req) {
+	if op := srv.lops(req); op != nil {
+		op.Statfs(req)
+	}
+}
+
+func (srv *Srv) lopen(req *Req) {
+	op := srv.lops(req)
+	if op == nil {
+		return
+	}
+
+	fid := req.Fid
+	tc := req.Tc
+	if fid.opened {
+		req.RespondError(Eopen)
+		return
+	}
+
+	if (fid.Type&ixp.QTDIR) != 0 && (tc.Flags&3) != ixp.LO_RDONLY {
+		req.RespondError(Eperm)
+		return
+	}
+
+	fid.Omode = uint8(tc.Flags & 3)
+	op.Lopen(req)
+}
+
+func (srv *Srv) lopenPost(req *Req) {
+	if req.Fid != nil {
+		req.Fid.opened = req.Rc != nil && req.Rc.Type == ixp.Rlopen
+	}
+}
+
+func (srv *Srv) lcreate(req *Req) {
+	op := srv.lops(req)
+	if op == nil {
+		return
+	}
+
+	fid := req.Fid
+	if fid.opened {
+		req.RespondError(Eopen)
+		return
+	}
+
+	if (fid.Type & ixp.QTDIR) == 0 {
+		req.RespondError(Enotdir)
+		return
+	}
+
+	fid.Omode = uint8(req.Tc.Flags & 3)
+	op.Lcreate(req)
+}
+
+func (srv *Srv) lcreatePost(req *Req) {
+	if req.Rc != nil && req.Rc.Type == ixp.Rlcreate && req.Fid != nil {
+		req.Fid.Type = req.Rc.Qid.Type
+		req.Fid.opened = true
+	}
+}
+
+func (srv *Srv) symlink(req *Req) {
+	op := srv.lops(req)
+	if op == nil {
+		return
+	}
+
+	if (req.Fid.Type & ixp.QTDIR) == 0 {
+		req.RespondError(Enotdir)
+		return
+	}
+
+	op.Symlink(req)
+}
+
+func (srv *Srv) mknod(req *Req) {
+	op := srv.lops(req)
+	if op == nil {
+		return
+	}
+
+	if (req.Fid.Type & ixp.QTDIR) == 0 {
+		req.RespondError(Enotdir)
+		return
+	}
+
+	op.Mknod(req)
+}
+
+func (srv *Srv) rename(req *Req) {
+	op := srv.lops(req)
+	if op == nil || !srv.getDfid(req) {
+		return
+	}
+
+	op.Rename(req)
+}
+
+func (srv *Srv) readlink(req *Req) {
+	if op := srv.lops(req); op != nil {
+		op.Readlink(req)
+	}
+}
+
+func (srv *Srv) getattr(req *Req) {
+	if op := srv.lops(req); op != nil {
+		op.Getattr(req)
+	}
+}
+
+func (srv *Srv) setattr(req *Req) {
+	if op := srv.lops(req); op != nil {
+		op.Setattr(req)
+	}
+}
+
+func (srv *Srv) xattrwalk(req *Req) {
+	op := srv.lops(req)
+	if op == nil {
+		return
+	}
+
+	tc := req.Tc
+	if tc.Fid == tc.Newfid {
+		req.RespondError(Ebaduse)
+		return
+	}
+
+	req.Newfid = req.Conn.FidNew(tc.Newfid)
+	if req.Newfid == nil {
+		req.RespondError(Einuse)
+		return
+	}
+
+	req.Newfid.User = req.Fid.User
+	op.Xattrwalk(req)
+}
+
+func (srv *Srv) xattrwalkPost(req *Req) {
+	if req.Rc != nil && req.Rc.Type == ixp.Rxattrwalk && req.Newfid != nil {
+		req.Newfid.Omode = ixp.OREAD
+		req.Newfid.opened = true
+		req.Newfid.IncRef()
+	}
+}
+
+func (srv *Srv) xattrcreate(req *Req) {
+	op := srv.lops(req)
+	if op == nil {
+		return
+	}
+
+	if req.Fid.opened {
+		req.RespondError(Eopen)
+		return
+	}
+
+	op.Xattrcreate(req)
+}
+
+func (srv *Srv) xattrcreatePost(req *Req) {
+	if req.Rc != nil && req.Rc.Type == ixp.Rxattrcreate && req.Fid != nil {
+		req.Fid.Omode = ixp.OWRITE
+		req.Fid.Type = 0
+		req.Fid.opened = true
+	}
+}
+
+func (srv *Srv) readdir(req *Req) {
+	op := srv.lops(req)
+	if op == nil {
+		return
+	}
+
+	fid := req.Fid
+	if (fid.Type & ixp.QTDIR) == 0 {
+		req.RespondError(Enotdir)
+		return
+	}
+
+	if !fid.opened {
+		req.RespondError(Ebaduse)
+		return
+	}
+
+	if req.Tc.Count+ixp.IOHDRSZ > req.Conn.Msize {
+		req.RespondError(Etoolarge)
+		return
+	}
+
+	op.Readdir(req)
+}
+
+func (srv *Srv) fsync(req *Req) {
+	if op := srv.lops(req); op != nil {
+		op.Fsync(req)
+	}
+}
+
+func (srv *Srv) lock(req *Req) {
+	if op := srv.lops(req); op != nil {
+		op.Flock(req)
+	}
+}
+
+func (srv *Srv) getlock(req *Req) {
+	if op := srv.lops(req); op != nil {
+		op.Getlock(req)
+	}
+}
+
+func (srv *Srv) link(req *Req) {
+	op := srv.lops(req)
+	if op == nil || !srv.getDfid(req) {
+		return
+	}
+
+	op.Link(req)
+}
+
+func (srv *Srv) mkdir(req *Req) {
+	op := srv.lops(req)
+	if op == nil {
+		return
+	}
+
+	if (req.Fid.Type & ixp.QTDIR) == 0 {
+		req.RespondError(Enotdir)
+		return
+	}
+
+	op.Mkdir(req)
+}
+
+func (srv *Srv) renameat(req *Req) {
+	op := srv.lops(req)
+	if op == nil {
+		return
+	}
+
+	if (req.Fid.Type & ixp.QTDIR) == 0 {
+		req.RespondError(Enotdir)
+		return
+	}
+
+	if !srv.getDfid(req) {
+		return
+	}
+
+	op.Renameat(req)
+}
+
+func (srv *Srv) unlinkat(req *Req) {
+	op := srv.lops(req)
+	if op == nil {
+		return
+	}
+
+	if (req.Fid.Type & ixp.QTDIR) == 0 {
+		req.RespondError(Enotdir)
+		return
+	}
+
+	op.Unlinkat(req)
+}
+
+// Respond to the request with Rstatfs message
+func (req *Req) RespondRstatfs(st *ixp.Statfs) {
+	err := ixp.PackRstatfs(req.Rc, st)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlopen message
+func (req *Req) RespondRlopen(qid *ixp.Qid, iounit uint32) {
+	err := ixp.PackRlopen(req.Rc, qid, iounit)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlcreate message
+func (req *Req) RespondRlcreate(qid *ixp.Qid, iounit uint32) {
+	err := ixp.PackRlcreate(req.Rc, qid, iounit)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rsymlink message
+func (req *Req) RespondRsymlink(qid *ixp.Qid) {
+	err := ixp.PackRsymlink(req.Rc, qid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rmknod message
+func (req *Req) RespondRmknod(qid *ixp.Qid) {
+	err := ixp.PackRmknod(req.Rc, qid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rrename message
+func (req *Req) RespondRrename() {
+	err := ixp.PackRrename(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rreadlink message
+func (req *Req) RespondRreadlink(target string) {
+	err := ixp.PackRreadlink(req.Rc, target)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rgetattr message
+func (req *Req) RespondRgetattr(attr *ixp.Attr) {
+	err := ixp.PackRgetattr(req.Rc, attr)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rsetattr message
+func (req *Req) RespondRsetattr() {
+	err := ixp.PackRsetattr(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rxattrwalk message
+func (req *Req) RespondRxattrwalk(size uint64) {
+	err := ixp.PackRxattrwalk(req.Rc, size)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rxattrcreate message
+func (req *Req) RespondRxattrcreate() {
+	err := ixp.PackRxattrcreate(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rreaddir message. As many of the
+// directory entries as fit in the count requested by Treaddir are
+// sent, the client continues from the Offset of the last one.
+func (req *Req) RespondRreaddir(dirents []ixp.Dirent) {
+	_, err := ixp.PackRreaddir(req.Rc, req.Tc.Count, dirents)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rfsync message
+func (req *Req) RespondRfsync() {
+	err := ixp.PackRfsync(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlock message
+func (req *Req) RespondRlock(status uint8) {
+	err := ixp.PackRlock(req.Rc, status)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rgetlock message
+func (req *Req) RespondRgetlock(lk *ixp.Flock) {
+	err := ixp.PackRgetlock(req.Rc, lk)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlink message
+func (req *Req) RespondRlink() {
+	err := ixp.PackRlink(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rmkdir message
+func (req *Req) RespondRmkdir(qid *ixp.Qid) {
+	err := ixp.PackRmkdir(req.Rc, qid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rrenameat message
+func (req *Req) RespondRrenameat() {
+	err := ixp.PackRrenameat(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Runlinkat message
+func (req *Req) RespondRunlinkat() {
+	err := ixp.PackRunlinkat(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
@@ -129,7 +129,7 @@ func main() {
 	}
 
 	s = srv.NewFileSrv(root)
-	s.Dotu = true
+	s.Dialect = ixp.Dialect9P2000u
 
 	if *debug {
 		s.Debuglevel = 1
@@ -234,7 +234,7 @@ func main() {
 
 	l = ixp.NewLogger(*logsz)
 	rsrv.srv = srv.NewFileSrv(&root.File)
-	rsrv.srv.Dotu = true
+	rsrv.srv.Dialect = ixp.Dialect9P2000u
 	rsrv.srv.Debuglevel = *debug
 	rsrv.srv.Start(rsrv.srv)
 	rsrv.srv.Id = "ramfs"
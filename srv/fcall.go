@@ -6,6 +6,7 @@ package srv
 
 import (
 	"github.com/jsouthworth/ixp"
+	"strings"
 )
 
 func (srv *Srv) version(req *Req) {
@@ -17,18 +18,20 @@ func (srv *Srv) version(req *Req) {
 		return
 	}
 
-	if tc.Msize < conn.Msize {
-		conn.Msize = tc.Msize
+	dialect, _ := ixp.ParseDialect(tc.Version)
+	if dialect > srv.Dialect {
+		dialect = srv.Dialect
 	}
 
-	conn.Dotu = tc.Version == "9P2000.u" && srv.Dotu
-	ver := "9P2000"
-	if conn.Dotu {
-		ver = "9P2000.u"
-	}
+	ver := dialect.String()
 
 	/* make sure that the responses of all current requests will be ignored */
 	conn.Lock()
+	if tc.Msize < conn.Msize {
+		conn.Msize = tc.Msize
+	}
+	conn.Dialect = dialect
+	conn.User = nil
 	for tag, r := range conn.reqs {
 		if tag == ixp.NOTAG {
 			continue
@@ -46,6 +49,11 @@ func (srv *Srv) version(req *Req) {
 }
 
 func (srv *Srv) auth(req *Req) {
+	if srv.shuttingDown() {
+		req.RespondError(Eshutdown)
+		return
+	}
+
 	tc := req.Tc
 	conn := req.Conn
 	if tc.Afid == ixp.NOFID {
@@ -60,7 +68,7 @@ func (srv *Srv) auth(req *Req) {
 	}
 
 	var user ixp.User = nil
-	if tc.Unamenum != ixp.NOUID || conn.Dotu {
+	if tc.Unamenum != ixp.NOUID || conn.Dotu() {
 		user = srv.Upool.Uid2User(int(tc.Unamenum))
 	} else if tc.Uname != "" {
 		user = srv.Upool.Uname2User(tc.Uname)
@@ -94,6 +102,11 @@ func (srv *Srv) authPost(req *Req) {
 }
 
 func (srv *Srv) attach(req *Req) {
+	if srv.shuttingDown() {
+		req.RespondError(Eshutdown)
+		return
+	}
+
 	tc := req.Tc
 	conn := req.Conn
 	if tc.Fid == ixp.NOFID {
@@ -111,11 +124,12 @@ func (srv *Srv) attach(req *Req) {
 		req.Afid = conn.FidGet(tc.Afid)
 		if req.Afid == nil {
 			req.RespondError(Eunknownfid)
+			return
 		}
 	}
 
 	var user ixp.User = nil
-	if tc.Unamenum != ixp.NOUID || conn.Dotu {
+	if tc.Unamenum != ixp.NOUID || conn.Dotu() {
 		user = srv.Upool.Uid2User(int(tc.Unamenum))
 	} else if tc.Uname != "" {
 		user = srv.Upool.Uname2User(tc.Uname)
@@ -142,6 +156,12 @@ func (srv *Srv) attachPost(req *Req) {
 	if req.Rc != nil && req.Rc.Type == ixp.Rattach {
 		req.Fid.Type = req.Rc.Qid.Type
 		req.Fid.IncRef()
+		conn := req.Conn
+		conn.Lock()
+		if conn.User == nil {
+			conn.User = req.Fid.User
+		}
+		conn.Unlock()
 	}
 }
 
@@ -197,6 +217,11 @@ func (srv *Srv) walk(req *Req) {
 		return
 	}
 
+	if len(tc.Wname) > ixp.MAXWELEM {
+		req.RespondError(Etoomany)
+		return
+	}
+
 	if tc.Fid != tc.Newfid {
 		req.Newfid = conn.FidNew(tc.Newfid)
 		if req.Newfid == nil {
@@ -273,6 +298,11 @@ func (srv *Srv) create(req *Req) {
 		return
 	}
 
+	if tc.Name == "" || tc.Name == "." || tc.Name == ".." || strings.Contains(tc.Name, "/") {
+		req.RespondError(Ebadname)
+		return
+	}
+
 	/* can't open directories for other than reading */
 	if (tc.Perm&ixp.DMDIR) != 0 && tc.Mode != ixp.OREAD {
 		req.RespondError(Eperm)
@@ -280,7 +310,7 @@ func (srv *Srv) create(req *Req) {
 	}
 
 	/* can't create special files if not 9P2000.u */
-	if (tc.Perm&(ixp.DMNAMEDPIPE|ixp.DMSYMLINK|ixp.DMLINK|ixp.DMDEVICE|ixp.DMSOCKET)) != 0 && !req.Conn.Dotu {
+	if (tc.Perm&(ixp.DMNAMEDPIPE|ixp.DMSYMLINK|ixp.DMLINK|ixp.DMDEVICE|ixp.DMSOCKET)) != 0 && !req.Conn.Dotu() {
 		req.RespondError(Eperm)
 		return
 	}
@@ -330,6 +360,11 @@ func (srv *Srv) read(req *Req) {
 		return
 	}
 
+	if !fid.opened || (fid.Omode&3) == ixp.OWRITE {
+		req.RespondError(Ebaduse)
+		return
+	}
+
 	if (fid.Type & ixp.QTDIR) != 0 {
 		if tc.Offset == 0 {
 			fid.Diroffset = 0
@@ -431,3 +466,57 @@ func (srv *Srv) wstat(req *Req) {
 
 	(req.Conn.Srv.ops).(ReqOps).Wstat(req)
 }
+
+// Returns the block operations of the file server, or responds with
+// an error and returns nil if the block messages can't be served.
+func (srv *Srv) blockops(req *Req) ReqBlockOps {
+	op, ok := (srv.ops).(ReqBlockOps)
+	if !ok {
+		req.RespondError(&ixp.Error{"unknown message type", ixp.EINVAL})
+		return nil
+	}
+
+	req.Conn.Lock()
+	user := req.Conn.User
+	req.Conn.Unlock()
+	if user == nil {
+		req.RespondError(Eperm)
+		return nil
+	}
+
+	return op
+}
+
+func (srv *Srv) bread(req *Req) {
+	op := srv.blockops(req)
+	if op == nil {
+		return
+	}
+
+	if req.Tc.Count+ixp.BIOHDRSZ > req.Conn.Msize {
+		req.RespondError(Etoolarge)
+		return
+	}
+
+	op.Bread(req)
+}
+
+func (srv *Srv) bwrite(req *Req) {
+	op := srv.blockops(req)
+	if op == nil {
+		return
+	}
+
+	if req.Tc.Count+ixp.BIOHDRSZ > req.Conn.Msize {
+		req.RespondError(Etoolarge)
+		return
+	}
+
+	op.Bwrite(req)
+}
+
+func (srv *Srv) btrunc(req *Req) {
+	if op := srv.blockops(req); op != nil {
+		op.Btrunc(req)
+	}
+}
@@ -6,7 +6,7 @@ package srv
 
 import (
 	"github.com/jsouthworth/ixp"
-	"log"
+	"sort"
 	"sync"
 	"time"
 )
@@ -30,7 +30,9 @@ type FWstatOp interface {
 // If the FReadOp interface is implemented, the Read operation will be called
 // to read from the file. If not implemented, "permission denied" error will
 // be send back. The operation returns the number of bytes read, or the
-// error occured while reading.
+// error occured while reading. The buf is the data of the Rread message,
+// which is reused for other requests once the response is sent, so the
+// operation must not keep it after it returns.
 type FReadOp interface {
 	Read(fid *FFid, buf []byte, offset uint64) (int, error)
 }
@@ -38,7 +40,10 @@ type FReadOp interface {
 // If the FWriteOp interface is implemented, the Write operation will be called
 // to write to the file. If not implemented, "permission denied" error will
 // be send back. The operation returns the number of bytes written, or the
-// error occured while writing.
+// error occured while writing. The data is a copy that the operation can
+// keep. If the NoCopy field of the Fsrv is set, the data is part of the
+// Twrite message, which is reused for other requests once the response is
+// sent, so the operation must copy the data it keeps after it returns.
 type FWriteOp interface {
 	Write(fid *FFid, data []byte, offset uint64) (int, error)
 }
@@ -101,7 +106,11 @@ type FFid struct {
 // simple trees of synthetic files.
 type Fsrv struct {
 	Srv
-	Root *File
+	Root   *File
+	NoCopy bool // if true, the FWriteOp gets the data of the Twrite message without a copy
+
+	blk    sync.Mutex
+	blocks map[uint64]*File // files found by the block messages, by Qid.Path
 }
 
 var lock sync.Mutex
@@ -376,6 +385,15 @@ func (*Fsrv) Open(req *Req) {
 			return
 		}
 	}
+
+	/* OTRUNC is ignored for the files that can't be truncated (e.g. ctl files) */
+	if wop, ok := (fid.F.ops).(FWstatOp); ok && tc.Mode&ixp.OTRUNC != 0 {
+		err := wop.Wstat(fid, truncDir(0))
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
 	req.RespondRopen(&fid.F.Qid, 0)
 }
 
@@ -437,7 +455,7 @@ func (*Fsrv) Read(req *Req) {
 				continue
 			}
 
-			sz := ixp.PackDir(&g.Dir, b, req.Conn.Dotu)
+			sz := ixp.PackDir(&g.Dir, b, req.Conn.Dotu())
 			g.Unlock()
 			if sz == 0 {
 				break
@@ -466,13 +484,23 @@ func (*Fsrv) Read(req *Req) {
 	req.Respond()
 }
 
-func (*Fsrv) Write(req *Req) {
+// Returns the data of the Twrite message for the FWriteOp, copied
+// unless NoCopy is set.
+func (s *Fsrv) writeData(tc *ixp.Fcall) []byte {
+	if s.NoCopy {
+		return tc.Data
+	}
+
+	return append([]byte(nil), tc.Data...)
+}
+
+func (s *Fsrv) Write(req *Req) {
 	fid := req.Fid.Aux.(*FFid)
 	f := fid.F
 	tc := req.Tc
 
 	if wop, ok := (f.ops).(FWriteOp); ok {
-		n, err := wop.Write(fid, tc.Data, tc.Offset)
+		n, err := wop.Write(fid, s.writeData(tc), tc.Offset)
 		if err != nil {
 			req.RespondError(err)
 		} else {
@@ -516,7 +544,7 @@ func (*Fsrv) Remove(req *Req) {
 			req.RespondRremove()
 		}
 	} else {
-		log.Println("remove not implemented")
+		req.Conn.Slog.Debug("remove not implemented", "fid", req.Tc.Fid)
 		req.RespondError(Eperm)
 	}
 }
@@ -569,3 +597,238 @@ func (*Fsrv) FidDestroy(ffid *Fid) {
 		op.FidDestroy(fid)
 	}
 }
+
+// Returns true if the file wasn't removed and is in the tree under
+// root.
+func (root *File) contains(f *File) bool {
+	for {
+		f.Lock()
+		removed := f.flags&Fremoved != 0
+		f.Unlock()
+		if removed {
+			return false
+		}
+
+		if f == root {
+			return true
+		}
+
+		if f.Parent == nil || f.Parent == f {
+			return false
+		}
+
+		f = f.Parent
+	}
+}
+
+// Looks for the file with the Qid path in the tree under dir.
+func (dir *File) findPath(path uint64) *File {
+	if dir.Qid.Path == path {
+		return dir
+	}
+
+	dir.Lock()
+	var children []*File
+	for c := dir.cfirst; c != nil; c = c.next {
+		children = append(children, c)
+	}
+	dir.Unlock()
+
+	for _, c := range children {
+		if f := c.findPath(path); f != nil {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// Returns the file of the tree served by s with the Qid path, or nil.
+// The files found are remembered, so only the first block message for
+// a file searches the tree.
+func (s *Fsrv) blockFile(path uint64) *File {
+	s.blk.Lock()
+	f := s.blocks[path]
+	s.blk.Unlock()
+	if f != nil && f.Qid.Path == path && s.Root.contains(f) {
+		return f
+	}
+
+	f = s.Root.findPath(path)
+	s.blk.Lock()
+	if s.blocks == nil {
+		s.blocks = make(map[uint64]*File)
+	}
+
+	if f != nil {
+		s.blocks[path] = f
+	} else {
+		delete(s.blocks, path)
+	}
+	s.blk.Unlock()
+	return f
+}
+
+// Looks up the file addressed by the fileid of a block message in the
+// tree of the server. The messages don't have fids, the request is done
+// on behalf of the first user of the connection's fids (in the order of
+// the fid numbers) that has the perm permissions for the file. The Open
+// operation of the file is called for the returned fid, which isn't
+// known to the connection. The fid should be passed to blockDone when
+// the request is finished.
+func (s *Fsrv) blockFid(req *Req, perm uint32) (*FFid, error) {
+	f := s.blockFile(req.Tc.Fileid)
+	if f == nil {
+		return nil, Enoent
+	}
+
+	if f.Mode&ixp.DMDIR != 0 {
+		return nil, Ebaduse
+	}
+
+	var user ixp.User
+	for _, fid := range req.Conn.fids() {
+		if _, ok := fid.Aux.(*FFid); ok && f.CheckPerm(fid.User, perm) {
+			user = fid.User
+			break
+		}
+	}
+
+	if user == nil {
+		return nil, Eperm
+	}
+
+	mode := uint8(ixp.OREAD)
+	if perm&ixp.DMWRITE != 0 {
+		mode = ixp.OWRITE
+	}
+
+	fid := new(Fid)
+	fid.fid = ixp.NOFID
+	fid.Fconn = req.Conn
+	fid.Type = f.Qid.Type
+	fid.User = user
+	fid.Omode = mode
+
+	ffid := new(FFid)
+	ffid.F = f
+	ffid.Fid = fid
+	fid.Aux = ffid
+	if op, ok := (f.ops).(FOpenOp); ok {
+		err := op.Open(ffid, mode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fid.opened = true
+	return ffid, nil
+}
+
+// Calls the FidDestroy operation of the file for a fid returned by
+// blockFid.
+func blockDone(fid *FFid) {
+	if op, ok := (fid.F.ops).(FDestroyOp); ok {
+		op.FidDestroy(fid)
+	}
+}
+
+// Returns the fids of the connection, ordered by their numbers.
+func (conn *Conn) fids() []*Fid {
+	conn.Lock()
+	fids := make([]*Fid, 0, len(conn.fidpool))
+	for _, fid := range conn.fidpool {
+		fids = append(fids, fid)
+	}
+	conn.Unlock()
+
+	sort.Slice(fids, func(i, j int) bool { return fids[i].fid < fids[j].fid })
+	return fids
+}
+
+func (s *Fsrv) Bread(req *Req) {
+	fid, err := s.blockFid(req, ixp.DMREAD)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	rc := req.Rc
+	n := 0
+	rop, ok := (fid.F.ops).(FReadOp)
+	if !ok {
+		err = Eperm
+	} else if err = ixp.InitRbread(rc, req.Tc.Count); err == nil {
+		n, err = rop.Read(fid, rc.Data, req.Tc.Offset)
+	}
+
+	blockDone(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	ixp.SetRreadCount(rc, uint32(n))
+	req.Respond()
+}
+
+func (s *Fsrv) Bwrite(req *Req) {
+	fid, err := s.blockFid(req, ixp.DMWRITE)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	n := 0
+	if wop, ok := (fid.F.ops).(FWriteOp); ok {
+		n, err = wop.Write(fid, s.writeData(req.Tc), req.Tc.Offset)
+	} else {
+		err = Eperm
+	}
+
+	blockDone(fid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.RespondRbwrite(uint32(n))
+	}
+}
+
+// Returns a Dir for Wstat that only changes the length of the file.
+func truncDir(length uint64) *ixp.Dir {
+	return &ixp.Dir{
+		Type:    0xFFFF,
+		Dev:     0xFFFFFFFF,
+		Qid:     ixp.Qid{Type: 0xFF, Version: 0xFFFFFFFF, Path: 0xFFFFFFFFFFFFFFFF},
+		Mode:    0xFFFFFFFF,
+		Atime:   0xFFFFFFFF,
+		Mtime:   0xFFFFFFFF,
+		Length:  length,
+		Uidnum:  ixp.NOUID,
+		Gidnum:  ixp.NOUID,
+		Muidnum: ixp.NOUID,
+	}
+}
+
+// Truncates the file by calling its Wstat operation with a Dir that
+// only changes the length.
+func (s *Fsrv) Btrunc(req *Req) {
+	fid, err := s.blockFid(req, ixp.DMWRITE)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if wop, ok := (fid.F.ops).(FWstatOp); ok {
+		err = wop.Wstat(fid, truncDir(req.Tc.Offset))
+	} else {
+		err = Eperm
+	}
+
+	blockDone(fid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.RespondRbtrunc()
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv_test
+
+import (
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type blockFile struct {
+	srv.File
+	sync.Mutex
+	data     []byte
+	opens    int
+	destroys int
+}
+
+func (f *blockFile) Open(fid *srv.FFid, mode uint8) error {
+	f.Lock()
+	f.opens++
+	f.Unlock()
+	return nil
+}
+
+func (f *blockFile) FidDestroy(fid *srv.FFid) {
+	f.Lock()
+	f.destroys++
+	f.Unlock()
+}
+
+func (f *blockFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if offset >= uint64(len(f.data)) {
+		return 0, nil
+	}
+
+	return copy(buf, f.data[offset:]), nil
+}
+
+func newBlockTree(t *testing.T, name string) (*srv.File, *blockFile) {
+	user := srvtest.User()
+	root := srvtest.Root(t, 0777)
+	f := &blockFile{data: []byte("hello")}
+	if err := root.Add(&f.File, name, user, nil, 0644, f); err != nil {
+		t.Fatal(err)
+	}
+
+	return root, f
+}
+
+func TestBlockTree(t *testing.T) {
+	root, f := newBlockTree(t, "f")
+	_, other := newBlockTree(t, "other")
+	c, unmount, err := srvtest.Loopback(srvtest.FileSrv(t, root), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmount()
+
+	data, err := c.Bread(f.Qid.Path, 0, 100)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Bread: %q %v", data, err)
+	}
+
+	f.Lock()
+	opens, destroys := f.opens, f.destroys
+	f.Unlock()
+	if opens != 1 || destroys != 1 {
+		t.Errorf("Bread: %d opens, %d destroys, want 1 and 1", opens, destroys)
+	}
+
+	if _, err := c.Bread(other.Qid.Path, 0, 100); err == nil {
+		t.Errorf("Bread of a file of another tree succeeded")
+	}
+
+	f.Remove()
+	if _, err := c.Bread(f.Qid.Path, 0, 100); err == nil {
+		t.Errorf("Bread of a removed file succeeded")
+	}
+}
+
+// A file that keeps the slices passed to Write.
+type keepFile struct {
+	srv.File
+	sync.Mutex
+	writes [][]byte
+}
+
+func (f *keepFile) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
+	f.Lock()
+	f.writes = append(f.writes, data)
+	f.Unlock()
+	return len(data), nil
+}
+
+func TestWriteKeep(t *testing.T) {
+	root := srvtest.Root(t, 0777)
+	f := new(keepFile)
+	if err := root.Add(&f.File, "f", srvtest.User(), nil, 0666, f); err != nil {
+		t.Fatal(err)
+	}
+
+	c, unmount, err := srvtest.Loopback(srvtest.FileSrv(t, root), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmount()
+
+	cf, err := c.FOpen("/f", ixp.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cf.Close()
+
+	/* the messages of the writes are reused, the kept data isn't */
+	var want []string
+	for i := 0; i < 10; i++ {
+		data := strings.Repeat(string(rune('a'+i)), 100)
+		if _, err := cf.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		want = append(want, data)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if len(f.writes) != len(want) {
+		t.Fatalf("%d writes, want %d", len(f.writes), len(want))
+	}
+
+	for i, data := range f.writes {
+		if string(data) != want[i] {
+			t.Errorf("write %d kept %q, want %q", i, data[0:10], want[i][0:10])
+		}
+	}
+}
@@ -0,0 +1,394 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"github.com/jsouthworth/ixp"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"path"
+)
+
+// The IOFsrv type implements a read-only file server that serves the
+// files of an io/fs file system, for example embed.FS, a zip archive
+// or os.DirFS. The Qid paths are derived from the file names, so they
+// don't change between the connections or the runs of the server.
+// Directory reads are streamed through fs.ReadDirFile, file reads use
+// io.ReaderAt if the file implements it.
+type IOFsrv struct {
+	Srv
+	FS  fs.FS
+	Uid ixp.User  // Owner of the files, "none" if nil
+	Gid ixp.Group // Group of the files, "none" if nil
+}
+
+// The ioFid type contains the per-Fid data of IOFsrv.
+type ioFid struct {
+	root string        // attach point
+	path string        // name of the file in FS
+	file fs.File       // the file, if opened
+	off  uint64        // offset of the next sequential read from file
+	dirs []fs.DirEntry // directory entries read, but not sent yet
+}
+
+// Creates a file server that serves the files of fsys.
+func NewIOFsrv(fsys fs.FS) *IOFsrv {
+	srv := new(IOFsrv)
+	srv.FS = fsys
+
+	return srv
+}
+
+func ioError(err error) error {
+	if _, ok := err.(*ixp.Error); ok {
+		return err
+	}
+
+	switch {
+	case err == fs.ErrNotExist || isPathError(err, fs.ErrNotExist):
+		return Enoent
+
+	case err == fs.ErrPermission || isPathError(err, fs.ErrPermission):
+		return Eperm
+	}
+
+	return &ixp.Error{err.Error(), ixp.EIO}
+}
+
+func isPathError(err, target error) bool {
+	if e, ok := err.(*fs.PathError); ok {
+		return e.Err == target
+	}
+
+	return false
+}
+
+// Returns the Qid of the named file.
+func fileInfo2Qid(name string, fi fs.FileInfo) ixp.Qid {
+	h := fnv.New64a()
+	io.WriteString(h, name)
+
+	var qid ixp.Qid
+	qid.Type = uint8(ixp.DirMode(fi.Mode()) >> 24)
+	qid.Version = uint32(fi.ModTime().UnixNano() / 1000000)
+	qid.Path = h.Sum64()
+	return qid
+}
+
+// Converts the file info of the named file to Dir.
+func (s *IOFsrv) fileInfo2Dir(name string, fi fs.FileInfo, dotu bool) *ixp.Dir {
+	d := new(ixp.Dir)
+	d.Qid = fileInfo2Qid(name, fi)
+	d.Mode = ixp.DirMode(fi.Mode())
+	if !dotu {
+		d.Mode &^= ixp.DMSYMLINK | ixp.DMDEVICE | ixp.DMNAMEDPIPE |
+			ixp.DMSOCKET | ixp.DMSETUID | ixp.DMSETGID
+	}
+
+	d.Mtime = uint32(fi.ModTime().Unix())
+	d.Atime = d.Mtime
+	if !fi.IsDir() {
+		d.Length = uint64(fi.Size())
+	}
+
+	if name == "." {
+		d.Name = "/"
+	} else {
+		d.Name = path.Base(name)
+	}
+
+	d.Uid, d.Uidnum = "none", ixp.NOUID
+	if s.Uid != nil {
+		d.Uid, d.Uidnum = s.Uid.Name(), uint32(s.Uid.Id())
+	}
+
+	d.Gid, d.Gidnum = "none", ixp.NOUID
+	if s.Gid != nil {
+		d.Gid, d.Gidnum = s.Gid.Name(), uint32(s.Gid.Id())
+	}
+
+	d.Muid, d.Muidnum = "", ixp.NOUID
+	return d
+}
+
+func (s *IOFsrv) Attach(req *Req) {
+	if req.Afid != nil && req.Afid.Type&ixp.QTAUTH == 0 {
+		req.RespondError(Enoauth)
+		return
+	}
+
+	root := path.Clean(req.Tc.Aname)
+	if root == "/" || root == "" {
+		root = "."
+	} else if root[0] == '/' {
+		root = root[1:]
+	}
+
+	if !fs.ValidPath(root) {
+		req.RespondError(Enoent)
+		return
+	}
+
+	fi, err := fs.Stat(s.FS, root)
+	if err != nil {
+		req.RespondError(ioError(err))
+		return
+	}
+
+	if !fi.IsDir() {
+		req.RespondError(Enotdir)
+		return
+	}
+
+	req.Fid.Aux = &ioFid{root: root, path: root}
+	qid := fileInfo2Qid(root, fi)
+	req.RespondRattach(&qid)
+}
+
+func (s *IOFsrv) Walk(req *Req) {
+	fid := req.Fid.Aux.(*ioFid)
+	tc := req.Tc
+
+	wqids := make([]ixp.Qid, len(tc.Wname))
+	p := fid.path
+	i := 0
+	for ; i < len(tc.Wname); i++ {
+		name := tc.Wname[i]
+		np := p
+		switch {
+		case name == "..":
+			if p != fid.root {
+				np = path.Dir(p)
+			}
+
+		case name == "." || !fs.ValidPath(name) || path.Base(name) != name:
+			np = ""
+
+		case p == ".":
+			np = name
+
+		default:
+			np = p + "/" + name
+		}
+
+		if np == "" {
+			break
+		}
+
+		fi, err := fs.Stat(s.FS, np)
+		if err != nil {
+			break
+		}
+
+		wqids[i] = fileInfo2Qid(np, fi)
+		p = np
+	}
+
+	if len(tc.Wname) > 0 && i == 0 {
+		req.RespondError(Enoent)
+		return
+	}
+
+	if i == len(tc.Wname) {
+		req.Newfid.Aux = &ioFid{root: fid.root, path: p}
+	}
+
+	req.RespondRwalk(wqids[0:i])
+}
+
+func (s *IOFsrv) Open(req *Req) {
+	fid := req.Fid.Aux.(*ioFid)
+	mode := req.Tc.Mode
+	if mode&3 != ixp.OREAD && mode&3 != ixp.OEXEC || mode&(ixp.OTRUNC|ixp.ORCLOSE) != 0 {
+		req.RespondError(Eperm)
+		return
+	}
+
+	f, err := s.FS.Open(fid.path)
+	if err != nil {
+		req.RespondError(ioError(err))
+		return
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		req.RespondError(ioError(err))
+		return
+	}
+
+	fid.file = f
+	qid := fileInfo2Qid(fid.path, fi)
+	req.RespondRopen(&qid, 0)
+}
+
+func (*IOFsrv) Create(req *Req) {
+	req.RespondError(Eperm)
+}
+
+// Reads the directory entries that fit in the response.
+func (s *IOFsrv) readDir(req *Req, fid *ioFid) (int, error) {
+	if req.Tc.Offset == 0 {
+		f, err := s.FS.Open(fid.path)
+		if err != nil {
+			return 0, ioError(err)
+		}
+
+		fid.file.Close()
+		fid.file = f
+		fid.dirs = nil
+	}
+
+	df, ok := fid.file.(fs.ReadDirFile)
+	if !ok {
+		return 0, Enotdir
+	}
+
+	n := 0
+	b := req.Rc.Data
+	for {
+		if len(fid.dirs) == 0 {
+			var err error
+			fid.dirs, err = df.ReadDir(16)
+			if err != nil && err != io.EOF {
+				return 0, ioError(err)
+			}
+
+			if len(fid.dirs) == 0 {
+				return n, nil
+			}
+		}
+
+		for len(fid.dirs) > 0 {
+			fi, err := fid.dirs[0].Info()
+			if err != nil {
+				// the entry was removed since the directory was read
+				fid.dirs = fid.dirs[1:]
+				continue
+			}
+
+			name := path.Join(fid.path, fid.dirs[0].Name())
+			d := s.fileInfo2Dir(name, fi, req.Conn.Dotu())
+			sz := ixp.PackDir(d, b, req.Conn.Dotu())
+			if sz == 0 {
+				return n, nil
+			}
+
+			b = b[sz:]
+			n += sz
+			fid.dirs = fid.dirs[1:]
+		}
+	}
+}
+
+// Reads from the file at the offset of the request. If the file
+// doesn't implement io.ReaderAt or io.Seeker, the file is reopened
+// and read from the beginning when the offset goes backwards.
+func (s *IOFsrv) readFile(req *Req, fid *ioFid) (int, error) {
+	buf := req.Rc.Data
+	offset := req.Tc.Offset
+	var n int
+	var err error
+	switch f := fid.file.(type) {
+	case io.ReaderAt:
+		n, err = f.ReadAt(buf, int64(offset))
+
+	case io.ReadSeeker:
+		_, err = f.Seek(int64(offset), io.SeekStart)
+		if err == nil {
+			n, err = io.ReadFull(f, buf)
+		}
+
+	default:
+		if offset < fid.off {
+			var nf fs.File
+			nf, err = s.FS.Open(fid.path)
+			if err != nil {
+				return 0, ioError(err)
+			}
+
+			fid.file.Close()
+			fid.file = nf
+			fid.off = 0
+		}
+
+		if offset > fid.off {
+			var m int64
+			m, err = io.CopyN(io.Discard, fid.file, int64(offset-fid.off))
+			fid.off += uint64(m)
+		}
+
+		if err == nil {
+			n, err = io.ReadFull(fid.file, buf)
+			fid.off += uint64(n)
+		}
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	if err != nil {
+		return 0, ioError(err)
+	}
+
+	return n, nil
+}
+
+func (s *IOFsrv) Read(req *Req) {
+	fid := req.Fid.Aux.(*ioFid)
+	ixp.InitRread(req.Rc, req.Tc.Count)
+
+	var n int
+	var err error
+	if req.Fid.Type&ixp.QTDIR != 0 {
+		n, err = s.readDir(req, fid)
+	} else {
+		n, err = s.readFile(req, fid)
+	}
+
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	ixp.SetRreadCount(req.Rc, uint32(n))
+	req.Respond()
+}
+
+func (*IOFsrv) Write(req *Req) {
+	req.RespondError(Eperm)
+}
+
+func (*IOFsrv) Clunk(req *Req) {
+	req.RespondRclunk()
+}
+
+func (*IOFsrv) Remove(req *Req) {
+	req.RespondError(Eperm)
+}
+
+func (s *IOFsrv) Stat(req *Req) {
+	fid := req.Fid.Aux.(*ioFid)
+	fi, err := fs.Stat(s.FS, fid.path)
+	if err != nil {
+		req.RespondError(ioError(err))
+		return
+	}
+
+	req.RespondRstat(s.fileInfo2Dir(fid.path, fi, req.Conn.Dotu()))
+}
+
+func (*IOFsrv) Wstat(req *Req) {
+	req.RespondError(Eperm)
+}
+
+func (*IOFsrv) FidDestroy(sfid *Fid) {
+	fid, ok := sfid.Aux.(*ioFid)
+	if ok && fid.file != nil {
+		fid.file.Close()
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv_test
+
+import (
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIOFsrv(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a":     {Data: []byte("a file")},
+		"dir/b": {Data: []byte("another file")},
+		"dir/c": {Data: make([]byte, 100000)},
+	}
+
+	s := srv.NewIOFsrv(fsys)
+	s.Dialect = ixp.Dialect9P2000u
+	s.Start(s)
+	srvtest.Run(t, s, &srvtest.Config{ReadOnly: true})
+}
@@ -4,18 +4,44 @@
 
 package srv
 
-import "fmt"
-import "github.com/jsouthworth/ixp"
-
-// Respond to the request with Rerror message
+import (
+	"errors"
+	"fmt"
+	"github.com/jsouthworth/ixp"
+	"syscall"
+)
+
+// Respond to the request with Rerror message, or Rlerror if 9P2000.L
+// was negotiated. The error number is taken from an *ixp.Error or a
+// syscall.Errno in the chain of err, EIO is used for the other errors.
 func (req *Req) RespondError(err interface{}) {
+	var ename string
+	var errornum uint32 = ixp.EIO
 	switch e := err.(type) {
 	case *ixp.Error:
-		ixp.PackRerror(req.Rc, e.Error(), uint32(e.Errornum), req.Conn.Dotu)
+		ename = e.Error()
+		errornum = e.Errornum
 	case error:
-		ixp.PackRerror(req.Rc, e.Error(), uint32(ixp.EIO), req.Conn.Dotu)
+		ename = e.Error()
+		var ie *ixp.Error
+		var errno syscall.Errno
+		if errors.As(e, &ie) {
+			errornum = ie.Errornum
+		} else if errors.As(e, &errno) {
+			errornum = uint32(errno)
+		}
 	default:
-		ixp.PackRerror(req.Rc, fmt.Sprintf("%v", e), uint32(ixp.EIO), req.Conn.Dotu)
+		ename = fmt.Sprintf("%v", e)
+	}
+
+	if req.Conn.Dialect == ixp.Dialect9P2000L {
+		if errornum == 0 {
+			errornum = ixp.EIO
+		}
+
+		ixp.PackRlerror(req.Rc, errornum)
+	} else {
+		ixp.PackRerror(req.Rc, ename, errornum, req.Conn.Dotu())
 	}
 
 	req.Respond()
@@ -133,7 +159,7 @@ func (req *Req) RespondRremove() {
 
 // Respond to the request with Rstat message
 func (req *Req) RespondRstat(st *ixp.Dir) {
-	err := ixp.PackRstat(req.Rc, st, req.Conn.Dotu)
+	err := ixp.PackRstat(req.Rc, st, req.Conn.Dotu())
 	if err != nil {
 		req.RespondError(err)
 	} else {
@@ -150,3 +176,33 @@ func (req *Req) RespondRwstat() {
 		req.Respond()
 	}
 }
+
+// Respond to the request with Rbread message
+func (req *Req) RespondRbread(data []byte) {
+	err := ixp.PackRbread(req.Rc, data)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rbwrite message
+func (req *Req) RespondRbwrite(count uint32) {
+	err := ixp.PackRbwrite(req.Rc, count)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rbtrunc message
+func (req *Req) RespondRbtrunc() {
+	err := ixp.PackRbtrunc(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
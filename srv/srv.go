@@ -7,9 +7,14 @@
 package srv
 
 import (
+	"fmt"
 	"github.com/jsouthworth/ixp"
+	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type reqStatus int
@@ -29,6 +34,8 @@ const (
 	DbgLogPackets                 // keep the last N 9P messages (can be accessed over http)
 )
 
+var nsrvs uint64 // number of started servers, for the default Ids
+
 var Eunknownfid error = &ixp.Error{"unknown fid", ixp.EINVAL}
 var Enoauth error = &ixp.Error{"no authentication required", ixp.EINVAL}
 var Einuse error = &ixp.Error{"fid already in use", ixp.EINVAL}
@@ -37,10 +44,14 @@ var Eopen error = &ixp.Error{"fid already opened", ixp.EINVAL}
 var Enotdir error = &ixp.Error{"not a directory", ixp.ENOTDIR}
 var Eperm error = &ixp.Error{"permission denied", ixp.EPERM}
 var Etoolarge error = &ixp.Error{"i/o count too large", ixp.EINVAL}
+var Etoomany error = &ixp.Error{"too many names in walk", ixp.EINVAL}
+var Ebadname error = &ixp.Error{"invalid file name", ixp.EINVAL}
 var Ebadoffset error = &ixp.Error{"bad offset in directory read", ixp.EINVAL}
 var Edirchange error = &ixp.Error{"cannot convert between files and directories", ixp.EINVAL}
 var Enouser error = &ixp.Error{"unknown user", ixp.EINVAL}
 var Enotimpl error = &ixp.Error{"not implemented", ixp.EINVAL}
+var Eshutdown error = &ixp.Error{"server is shutting down", ixp.EIO}
+var ErrServerClosed error = &ixp.Error{"server closed", ixp.EIO}
 
 // Authentication operations. The file server should implement them if
 // it requires user authentication. The authentication in 9P2000 is
@@ -112,7 +123,9 @@ type ReqProcessOps interface {
 // can flush pending requests. If the interface is not implemented, requests
 // that were passed to the file server implementation won't be flushed.
 // The flush method should call the (req *Req) srv.Flush() method if the flush
-// was successful so the request can be marked appropriately.
+// was successful so the request can be marked appropriately. The messages of
+// the Tflush request are reused once it is responded, so the method must not
+// keep references to its Tc or Rc.
 type FlushOp interface {
 	Flush(*Req)
 }
@@ -132,6 +145,45 @@ type ReqOps interface {
 	Wstat(*Req)
 }
 
+// 9P2000.L request operations. This interface should be implemented by
+// file servers that support the 9P2000.L dialect, in addition to ReqOps.
+// The operations correspond directly to the 9P2000.L message types.
+type ReqLOps interface {
+	Statfs(*Req)
+	Lopen(*Req)
+	Lcreate(*Req)
+	Symlink(*Req)
+	Mknod(*Req)
+	Rename(*Req)
+	Readlink(*Req)
+	Getattr(*Req)
+	Setattr(*Req)
+	Xattrwalk(*Req)
+	Xattrcreate(*Req)
+	Readdir(*Req)
+	Fsync(*Req)
+	Flock(*Req)
+	Getlock(*Req)
+	Link(*Req)
+	Mkdir(*Req)
+	Renameat(*Req)
+	Unlinkat(*Req)
+}
+
+// IX block operations. If implemented by the file server, the Tbread,
+// Tbwrite and Tbtrunc messages are passed to it. The messages don't
+// have fids, the file is specified by req.Tc.Fileid. The messages are
+// rejected before the first successful attach of the connection. The
+// implementation should only serve the files the connection attached
+// to, and check the permissions against the users of the connection's
+// fids (req.Conn.User is only the user of the first attach, see Fsrv).
+// If the interface is not implemented, the messages are rejected.
+type ReqBlockOps interface {
+	Bread(*Req)
+	Bwrite(*Req)
+	Btrunc(*Req)
+}
+
 // The Srv type contains the basic fields used to control the 9P2000
 // file server. Each file server implementation should create a value
 // of Srv type, initialize the values it cares about and pass the
@@ -139,34 +191,42 @@ type ReqOps interface {
 // that implements the file server operations.
 type Srv struct {
 	sync.Mutex
-	Id         string    // Used for debugging and stats
-	Msize      uint32    // Maximum size of the 9P2000 messages supported by the server
-	Dotu       bool      // If true, the server supports the 9P2000.u extension
-	Debuglevel int       // debug level
-	Upool      ixp.Users // Interface for finding users and groups known to the file server
-	Maxpend    int       // Maximum pending outgoing requests
+	Id         string      // Used for debugging and stats, srvN if not set
+	Msize      uint32      // Maximum size of the 9P2000 messages supported by the server
+	Dialect    ixp.Dialect // Highest protocol dialect supported by the server
+	Debuglevel int         // debug level
+	Upool      ixp.Users   // Interface for finding users and groups known to the file server
+	Maxpend    int         // Maximum pending outgoing requests
 	Log        *ixp.Logger
+	Slog       *slog.Logger // Structured logger for the diagnostics, slog.Default() if nil
 
-	ops   interface{}     // operations
-	conns map[*Conn]*Conn // List of connections
+	ops       interface{}           // operations
+	conns     map[*Conn]*Conn       // List of connections
+	listeners map[net.Listener]bool // listeners used by Serve
+	closing   bool                  // true once Shutdown or Close is called
+	nconns    uint64                // number of connections created, numbers the Ids
 }
 
 // The Conn type represents a connection from a client to the file server
 type Conn struct {
 	sync.Mutex
 	Srv        *Srv
-	Msize      uint32 // maximum size of 9P2000 messages for the connection
-	Dotu       bool   // if true, both the client and the server speak 9P2000.u
-	Id         string // used for debugging and stats
+	Msize      uint32      // maximum size of 9P2000 messages for the connection
+	Dialect    ixp.Dialect // protocol dialect negotiated for the connection
+	Id         string      // used for debugging and stats
+	User       ixp.User    // user of the first successful attach, used by the block messages
 	Debuglevel int
+	Slog       *slog.Logger // logger of the connection, Srv.Slog with the conn attribute
 
-	conn    net.Conn
+	conn    io.ReadWriteCloser
 	fidpool map[uint32]*Fid
 	reqs    map[uint16]*Req // all outstanding requests
+	nout    int             // responses not written to the client yet
 
 	reqout chan *Req
-	rchan  chan *ixp.Fcall
 	done   chan bool
+	closed chan bool // closed when the connection is closed
+	gone   chan bool // closed after ConnClosed and FidDestroy are called
 
 	// stats
 	nreqs   int    // number of requests processed by the server
@@ -200,17 +260,21 @@ type Fid struct {
 // T-message (Tc) and a R-message (Rc). If the ReqProcessOps don't
 // override the default behavior, the implementation initializes Fid,
 // Afid and Newfid values and automatically keeps track on when the Fids
-// should be destroyed.
+// should be destroyed. Tc and Rc are reused for other requests once the
+// response is sent. The file server must not use them after calling
+// Respond, and must copy the data of Twrite if it keeps it.
 type Req struct {
 	sync.Mutex
 	Tc     *ixp.Fcall // Incoming 9P2000 message
 	Rc     *ixp.Fcall // Outgoing 9P2000 response
 	Fid    *Fid       // The Fid value for all messages that contain fid[4]
 	Afid   *Fid       // The Fid value for the messages that contain afid[4] (Tauth and Tattach)
-	Newfid *Fid       // The Fid value for the messages that contain newfid[4] (Twalk)
+	Newfid *Fid       // The Fid value for the messages that contain newfid[4] (Twalk, Txattrwalk)
+	Dfid   *Fid       // The Fid value for the messages that contain a second fid (Trename, Trenameat, Tlink)
 	Conn   *Conn      // Connection that the request belongs to
 
 	status     reqStatus
+	start      time.Time // when the request was received
 	flushreq   *Req
 	prev, next *Req
 }
@@ -220,13 +284,30 @@ type Req struct {
 // values to the fields that are not initialized and creates the goroutines
 // required for the server's operation. The method receives an empty
 // interface value, ops, that should implement the interfaces the file server is
-// interested in. Ops must implement the ReqOps interface.
+// interested in. Ops must implement the ReqOps interface. If Dialect is
+// 9P2000.L and ops doesn't implement ReqLOps, a warning is logged and
+// 9P2000.u is used instead.
 func (srv *Srv) Start(ops interface{}) bool {
 	if _, ok := (ops).(ReqOps); !ok {
 		return false
 	}
 
 	srv.ops = ops
+	if srv.Id == "" {
+		/* the servers get unique paths in the stats */
+		srv.Id = fmt.Sprintf("srv%d", atomic.AddUint64(&nsrvs, 1))
+	}
+
+	if srv.Slog == nil {
+		srv.Slog = slog.Default()
+	}
+
+	if _, ok := (ops).(ReqLOps); !ok && srv.Dialect > ixp.Dialect9P2000u {
+		srv.Slog.Warn("the file server doesn't implement ReqLOps, 9P2000.L is disabled",
+			"srv", srv.Id, "dialect", ixp.Dialect9P2000u)
+		srv.Dialect = ixp.Dialect9P2000u
+	}
+
 	if srv.Upool == nil {
 		srv.Upool = ixp.OsUsers
 	}
@@ -239,9 +320,17 @@ func (srv *Srv) Start(ops interface{}) bool {
 		srv.Log = ixp.NewLogger(1024)
 	}
 
+	statsRegister(srv)
 	return true
 }
 
+// Returns true if Shutdown or Close was called.
+func (srv *Srv) shuttingDown() bool {
+	srv.Lock()
+	defer srv.Unlock()
+	return srv.closing
+}
+
 func (srv *Srv) String() string {
 	return srv.Id
 }
@@ -255,7 +344,9 @@ func (req *Req) process() {
 	req.Unlock()
 
 	if flushed {
+		/* the request is dropped, it must not create or change fids */
 		req.Respond()
+		return
 	}
 
 	if rop, ok := (req.Conn.Srv.ops).(ReqProcessOps); ok {
@@ -334,6 +425,74 @@ func (req *Req) Process() {
 
 	case ixp.Twstat:
 		srv.wstat(req)
+
+	/* IX block messages */
+	case ixp.Tbread:
+		srv.bread(req)
+
+	case ixp.Tbwrite:
+		srv.bwrite(req)
+
+	case ixp.Tbtrunc:
+		srv.btrunc(req)
+
+	/* 9P2000.L */
+	case ixp.Tstatfs:
+		srv.statfs(req)
+
+	case ixp.Tlopen:
+		srv.lopen(req)
+
+	case ixp.Tlcreate:
+		srv.lcreate(req)
+
+	case ixp.Tsymlink:
+		srv.symlink(req)
+
+	case ixp.Tmknod:
+		srv.mknod(req)
+
+	case ixp.Trename:
+		srv.rename(req)
+
+	case ixp.Treadlink:
+		srv.readlink(req)
+
+	case ixp.Tgetattr:
+		srv.getattr(req)
+
+	case ixp.Tsetattr:
+		srv.setattr(req)
+
+	case ixp.Txattrwalk:
+		srv.xattrwalk(req)
+
+	case ixp.Txattrcreate:
+		srv.xattrcreate(req)
+
+	case ixp.Treaddir:
+		srv.readdir(req)
+
+	case ixp.Tfsync:
+		srv.fsync(req)
+
+	case ixp.Tlock:
+		srv.lock(req)
+
+	case ixp.Tgetlock:
+		srv.getlock(req)
+
+	case ixp.Tlink:
+		srv.link(req)
+
+	case ixp.Tmkdir:
+		srv.mkdir(req)
+
+	case ixp.Trenameat:
+		srv.renameat(req)
+
+	case ixp.Tunlinkat:
+		srv.unlinkat(req)
 	}
 }
 
@@ -369,6 +528,18 @@ func (req *Req) PostProcess() {
 
 	case ixp.Tremove:
 		srv.removePost(req)
+
+	case ixp.Tlopen:
+		srv.lopenPost(req)
+
+	case ixp.Tlcreate:
+		srv.lcreatePost(req)
+
+	case ixp.Txattrwalk:
+		srv.xattrwalkPost(req)
+
+	case ixp.Txattrcreate:
+		srv.xattrcreatePost(req)
 	}
 
 	if req.Fid != nil {
@@ -385,6 +556,11 @@ func (req *Req) PostProcess() {
 		req.Newfid.DecRef()
 		req.Newfid = nil
 	}
+
+	if req.Dfid != nil {
+		req.Dfid.DecRef()
+		req.Dfid = nil
+	}
 }
 
 // The Respond method sends response back to the client. The req.Rc value
@@ -429,6 +605,10 @@ func (req *Req) Respond() {
 		delete(conn.reqs, req.Tc.Tag)
 		flushreqs = req.flushreq
 	}
+
+	if (status & reqFlush) == 0 {
+		conn.nout++
+	}
 	conn.Unlock()
 
 	if rop, ok := (req.Conn.Srv.ops).(ReqProcessOps); ok {
@@ -438,7 +618,13 @@ func (req *Req) Respond() {
 	}
 
 	if (status & reqFlush) == 0 {
-		conn.reqout <- req
+		select {
+		case conn.reqout <- req:
+		case <-conn.closed:
+			conn.Lock()
+			conn.nout--
+			conn.Unlock()
+		}
 	}
 
 	// process the next request with the same tag (if available)
@@ -524,10 +710,14 @@ func (fid *Fid) DecRef() {
 
 	conn := fid.Fconn
 	conn.Lock()
-	delete(conn.fidpool, fid.fid)
+	present := conn.fidpool[fid.fid] == fid
+	if present {
+		delete(conn.fidpool, fid.fid)
+	}
 	conn.Unlock()
 
-	if fop, ok := (conn.Srv.ops).(FidOps); ok {
+	/* if not present, the fid was already destroyed when the connection was closed */
+	if fop, ok := (conn.Srv.ops).(FidOps); ok && present {
 		fop.FidDestroy(fid)
 	}
 }
@@ -0,0 +1,169 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srvtest
+
+import (
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"github.com/jsouthworth/ixp/srv"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The Faults type describes the faults injected on an in-memory link
+// between a client and a server. The byte limits make the link fail at
+// the same point of the stream on every run, so the error paths of the
+// client and the server can be tested deterministically. A Faults value
+// describes a single link and must not be copied after it is used.
+type Faults struct {
+	sync.Mutex
+	Latency     time.Duration // delay before each write is delivered to the other end
+	ClientBytes int64         // bytes the client can send before the link is cut, 0 for no limit
+	ServerBytes int64         // bytes the server can send before the link is cut, 0 for no limit
+
+	cut   bool
+	conns []net.Conn
+}
+
+type faultConn struct {
+	net.Conn
+	f      *Faults
+	server bool
+	sent   int64
+}
+
+// Creates a connected pair of in-memory transports. The server end is
+// passed to srv.Srv.NewConn, the client end to one of the clnt.Mount
+// functions. If f is not nil, its faults are injected on the link.
+func Pipe(f *Faults) (server, client net.Conn) {
+	sc, cc := net.Pipe()
+	if f == nil {
+		return sc, cc
+	}
+
+	f.Lock()
+	f.conns = append(f.conns, sc, cc)
+	cut := f.cut
+	f.Unlock()
+	if cut {
+		sc.Close()
+		cc.Close()
+	}
+
+	return &faultConn{sc, f, true, 0}, &faultConn{cc, f, false, 0}
+}
+
+// Cuts the link, as if the network between the client and the server
+// failed. The pending and the following reads and writes on both ends
+// return errors.
+func (f *Faults) Cut() {
+	f.Lock()
+	f.cut = true
+	conns := f.conns
+	f.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// Returns true if the link was cut.
+func (f *Faults) IsCut() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.cut
+}
+
+func (c *faultConn) Write(buf []byte) (int, error) {
+	f := c.f
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+
+	limit := f.ClientBytes
+	if c.server {
+		limit = f.ServerBytes
+	}
+
+	f.Lock()
+	if f.cut {
+		f.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+
+	n := int64(len(buf))
+	if limit > 0 && c.sent+n > limit {
+		n = limit - c.sent
+	}
+
+	c.sent += n
+	f.Unlock()
+
+	m, err := c.Conn.Write(buf[0:n])
+	if n < int64(len(buf)) {
+		/* the limit is reached in the middle of the buffer */
+		f.Cut()
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+	}
+
+	return m, err
+}
+
+// Starts serving a connection of s over an in-memory link and mounts
+// it. Returns the client and a function that unmounts it, which closes
+// the link. If cfg is nil, the current user attaches to the default
+// file tree using 9P2000.u. The Dir and ReadOnly fields of cfg are
+// ignored.
+func Loopback(s Server, cfg *Config) (*clnt.Clnt, func(), error) {
+	if cfg == nil {
+		cfg = new(Config)
+	}
+
+	sc, cc := Pipe(cfg.Faults)
+	s.NewConn(sc)
+	c, err := clnt.MountConnAuth(cc, cfg.Aname, cfg.user(), cfg.dialect(), cfg.Auth)
+	if err != nil {
+		cc.Close()
+		return nil, nil, err
+	}
+
+	return c, c.Unmount, nil
+}
+
+// Returns the current user, the user the checks and Loopback attach as
+// by default.
+func User() ixp.User {
+	return ixp.OsUsers.Uid2User(os.Geteuid())
+}
+
+// Creates the root directory of a file tree served by srv.Fsrv, owned
+// by the current user, with the permissions perm. Fails the test if
+// the directory can't be created.
+func Root(tb testing.TB, perm uint32) *srv.File {
+	root := new(srv.File)
+	if err := root.Add(root, "/", User(), nil, ixp.DMDIR|perm, nil); err != nil {
+		tb.Fatal(err)
+	}
+
+	return root
+}
+
+// Starts a srv.Fsrv that serves the file tree using 9P2000.u. The
+// server is closed when the test finishes.
+func FileSrv(tb testing.TB, root *srv.File) *srv.Fsrv {
+	s := srv.NewFileSrv(root)
+	s.Dialect = ixp.Dialect9P2000u
+	if !s.Start(s) {
+		tb.Fatal("can't start the file server")
+	}
+
+	tb.Cleanup(func() { s.Close() })
+	return s
+}
@@ -0,0 +1,929 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The srvtest package checks that a file server follows the 9P2000
+// protocol. Run connects a client to the server over an in-memory pipe
+// and runs the checks as subtests of a Go test, for example:
+//
+//	func TestUfs(t *testing.T) {
+//		fs, err := ufs.New(t.TempDir())
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//
+//		fs.Dialect = ixp.Dialect9P2000u
+//		fs.Start(fs)
+//		srvtest.Run(t, fs, nil)
+//	}
+//
+// The checks cover the walks ("..", partial walks, the limit of
+// MAXWELEM names), the open modes and OTRUNC, the offsets of the
+// directory reads, the rules for creating and removing files, the
+// order of the Rflush responses, the errors for fids that are unknown
+// or already in use, and the "don't touch" values of Twstat. A single
+// check can be run with go test -run 'TestUfs/walk/dotdot'.
+//
+// Loopback mounts a server over the same in-memory link for the tests
+// that need a client, without a network listener. The Faults injected
+// on the link (latency, byte limits, disconnects) exercise the error
+// paths of the client and the server.
+package srvtest
+
+import (
+	"fmt"
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/clnt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The file server to check, a srv.Srv or any value that embeds one.
+// The server must be started before calling Run.
+type Server interface {
+	NewConn(c io.ReadWriteCloser)
+}
+
+// The Config type describes how the checks access the file server.
+type Config struct {
+	Aname    string             // name of the file tree to attach to
+	User     ixp.User           // user to attach as, the current user if nil
+	Auth     clnt.Authenticator // authenticates the user, if not nil
+	Plain    bool               // if true, speaks 9P2000 instead of 9P2000.u
+	Linux    bool               // if true, speaks 9P2000.L instead of 9P2000.u
+	Dir      string             // directory the checks create their files in, the root if empty
+	ReadOnly bool               // if true, the checks that create files are skipped
+	Faults   *Faults            // faults injected on the link to the server, if not nil
+}
+
+// Returns the user to attach as.
+func (cfg *Config) user() ixp.User {
+	if cfg.User == nil {
+		return User()
+	}
+
+	return cfg.User
+}
+
+// Returns the dialect to speak.
+func (cfg *Config) dialect() ixp.Dialect {
+	if cfg.Plain {
+		return ixp.Dialect9P2000
+	}
+
+	if cfg.Linux {
+		return ixp.Dialect9P2000L
+	}
+
+	return ixp.Dialect9P2000u
+}
+
+// The harness type is passed to the checks. Each check gets its own
+// connection to the server and, unless the server is read-only, an
+// empty directory.
+type harness struct {
+	*testing.T
+	c    *clnt.Clnt
+	cfg  *Config
+	user ixp.User
+	dir  []string // names walked from the root to the directory of the check
+}
+
+type check struct {
+	name  string
+	write bool // the check creates files
+	run   func(h *harness)
+}
+
+var checks = []check{
+	{"walk/clone", false, walkClone},
+	{"walk/dotdot", false, walkDotdot},
+	{"walk/maxelem", false, walkMaxelem},
+	{"walk/partial", true, walkPartial},
+	{"walk/file", true, walkFile},
+	{"walk/open", false, walkOpen},
+	{"fid/unknown", false, fidUnknown},
+	{"fid/inuse", false, fidInuse},
+	{"fid/clunked", false, fidClunked},
+	{"open/twice", false, openTwice},
+	{"open/dirwrite", false, openDirwrite},
+	{"open/modes", true, openModes},
+	{"open/trunc", true, openTrunc},
+	{"dirread/offsets", true, dirreadOffsets},
+	{"create/fid", true, createFid},
+	{"create/exists", true, createExists},
+	{"create/names", true, createNames},
+	{"create/infile", true, createInfile},
+	{"create/dir", true, createDir},
+	{"remove/file", true, removeFile},
+	{"remove/nonempty", true, removeNonempty},
+	{"flush/unknown", false, flushUnknown},
+	{"flush/order", false, flushOrder},
+	{"wstat/nop", true, wstatNop},
+	{"wstat/length", true, wstatLength},
+	{"wstat/mode", true, wstatMode},
+	{"wstat/name", true, wstatName},
+}
+
+// Runs the conformance checks against the file server s as subtests
+// of t. If cfg is nil, the current user attaches to the root of the
+// default file tree, and the checks create their files in the root.
+func Run(t *testing.T, s Server, cfg *Config) {
+	if cfg == nil {
+		cfg = new(Config)
+	}
+
+	base := fmt.Sprintf("srvtest.%d.%d", os.Getpid(), time.Now().UnixNano())
+	for _, ck := range checks {
+		ck := ck
+		t.Run(ck.name, func(t *testing.T) {
+			if ck.write && cfg.ReadOnly {
+				t.Skip("the server is read-only")
+			}
+
+			h := connect(t, s, cfg)
+			if !cfg.ReadOnly {
+				h.mkdir(base, strings.Replace(ck.name, "/", "-", -1))
+			}
+
+			ck.run(h)
+		})
+	}
+
+	if !cfg.ReadOnly {
+		h := connect(t, s, cfg)
+		h.removeAll(append(splitPath(cfg.Dir), base))
+	}
+}
+
+// Connects a new client to the server. The client is unmounted when
+// the test ends.
+func connect(t *testing.T, s Server, cfg *Config) *harness {
+	c, unmount, err := Loopback(s, cfg)
+	if err != nil {
+		t.Fatalf("can't mount the server: %v", err)
+	}
+
+	t.Cleanup(unmount)
+	return &harness{t, c, cfg, cfg.user(), splitPath(cfg.Dir)}
+}
+
+func splitPath(path string) []string {
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// Creates the directories in the directory of the check and makes
+// the last one the directory of the check.
+func (h *harness) mkdir(names ...string) {
+	for _, name := range names {
+		fid := h.walk()
+		err := h.c.Create(fid, name, ixp.DMDIR|0777, ixp.OREAD, "")
+		if err != nil && !strings.Contains(err.Error(), "exist") {
+			h.Fatalf("can't create directory %q: %v", name, err)
+		}
+
+		h.c.Clunk(fid)
+		h.dir = append(h.dir, name)
+	}
+}
+
+// Walks to the names from the directory of the check. Fails the
+// check if the walk fails.
+func (h *harness) walk(names ...string) *clnt.Fid {
+	fid, err := h.walkErr(names...)
+	if err != nil {
+		h.Fatalf("walk to %q: %v", strings.Join(names, "/"), err)
+	}
+
+	return fid
+}
+
+func (h *harness) walkErr(names ...string) (*clnt.Fid, error) {
+	wnames := append(append([]string(nil), h.dir...), names...)
+	fid := h.c.FidAlloc()
+	qids, err := h.c.Walk(h.c.Root, fid, wnames)
+	if err == nil && len(qids) != len(wnames) {
+		err = &ixp.Error{"file not found", ixp.ENOENT}
+	}
+
+	if err != nil {
+		h.c.Clunk(fid)
+		return nil, err
+	}
+
+	if len(qids) > 0 {
+		fid.Qid = qids[len(qids)-1]
+	} else {
+		fid.Qid = h.c.Root.Qid
+	}
+
+	return fid, nil
+}
+
+// Creates a file in the directory of the check and writes data to
+// it. Returns the fid of the file, open for the mode.
+func (h *harness) create(name string, perm uint32, mode uint8, data string) *clnt.Fid {
+	fid := h.walk()
+	err := h.c.Create(fid, name, perm, mode, "")
+	if err != nil {
+		h.Fatalf("create %q: %v", name, err)
+	}
+
+	if data != "" {
+		n, err := h.c.Write(fid, []byte(data), 0)
+		if err != nil || n != len(data) {
+			h.Fatalf("write to %q: %d %v", name, n, err)
+		}
+	}
+
+	return fid
+}
+
+// Returns the metadata of the file.
+func (h *harness) stat(fid *clnt.Fid) *ixp.Dir {
+	d, err := h.c.Stat(fid)
+	if err != nil {
+		h.Fatalf("stat: %v", err)
+	}
+
+	return d
+}
+
+// Sends the message packed by pack and returns the error of the
+// response.
+func (h *harness) rpc(pack func(tc *ixp.Fcall) error) error {
+	tc := h.c.NewFcall()
+	if err := pack(tc); err != nil {
+		h.Fatalf("can't pack the message: %v", err)
+	}
+
+	_, err := h.c.Rpc(tc)
+	return err
+}
+
+func (h *harness) tstat(fid uint32) error {
+	return h.rpc(func(tc *ixp.Fcall) error { return ixp.PackTstat(tc, fid) })
+}
+
+func (h *harness) topen(fid uint32, mode uint8) error {
+	return h.rpc(func(tc *ixp.Fcall) error { return ixp.PackTopen(tc, fid, mode) })
+}
+
+func (h *harness) tclunk(fid uint32) error {
+	return h.rpc(func(tc *ixp.Fcall) error { return ixp.PackTclunk(tc, fid) })
+}
+
+func (h *harness) twalk(fid, newfid uint32, wnames []string) error {
+	return h.rpc(func(tc *ixp.Fcall) error { return ixp.PackTwalk(tc, fid, newfid, wnames) })
+}
+
+func (h *harness) tflush(oldtag uint16) error {
+	return h.rpc(func(tc *ixp.Fcall) error { return ixp.PackTflush(tc, oldtag) })
+}
+
+func (h *harness) tattach(fid uint32) error {
+	return h.rpc(func(tc *ixp.Fcall) error {
+		return ixp.PackTattach(tc, fid, ixp.NOFID, h.user.Name(), h.cfg.Aname,
+			uint32(h.user.Id()), h.c.Dotu())
+	})
+}
+
+// Returns a fid number that is not used by the client.
+func (h *harness) unusedFid() uint32 {
+	return ixp.NOFID - 1
+}
+
+// Reads the directory entries of the open fid, count bytes at a time,
+// and checks that each read returns whole entries.
+func (h *harness) readdir(fid *clnt.Fid, count uint32) []*ixp.Dir {
+	var dirs []*ixp.Dir
+	var off uint64
+	for {
+		b, err := h.c.Read(fid, off, count)
+		if err != nil {
+			h.Fatalf("directory read at offset %d: %v", off, err)
+		}
+
+		if len(b) == 0 {
+			return dirs
+		}
+
+		off += uint64(len(b))
+		for len(b) > 0 {
+			d, err := ixp.UnpackDir(b, h.c.Dotu())
+			if err != nil {
+				h.Fatalf("directory read at offset %d returned a partial entry: %v", off, err)
+			}
+
+			b = b[d.Size+2:]
+			dirs = append(dirs, d)
+		}
+	}
+}
+
+// Removes the file and, if it is a directory, its contents.
+func (h *harness) removeAll(names []string) {
+	fid := h.c.FidAlloc()
+	qids, err := h.c.Walk(h.c.Root, fid, names)
+	if err != nil || len(qids) != len(names) {
+		h.c.Clunk(fid)
+		return
+	}
+
+	if len(qids) > 0 && qids[len(qids)-1].Type&ixp.QTDIR != 0 && h.c.Open(fid, ixp.OREAD) == nil {
+		for _, d := range h.readdir(fid, h.c.Msize-ixp.IOHDRSZ) {
+			h.removeAll(append(append([]string(nil), names...), d.Name))
+		}
+
+		h.c.Clunk(fid)
+		fid = h.c.FidAlloc()
+		h.c.Walk(h.c.Root, fid, names)
+	}
+
+	h.c.Remove(fid)
+}
+
+// Returns a Dir with all fields set to the "don't touch" values of
+// Twstat, for the Wstats that change only some of them.
+func NullDir() *ixp.Dir {
+	return &ixp.Dir{
+		Type:    0xFFFF,
+		Dev:     0xFFFFFFFF,
+		Qid:     ixp.Qid{Type: 0xFF, Version: 0xFFFFFFFF, Path: 0xFFFFFFFFFFFFFFFF},
+		Mode:    0xFFFFFFFF,
+		Atime:   0xFFFFFFFF,
+		Mtime:   0xFFFFFFFF,
+		Length:  0xFFFFFFFFFFFFFFFF,
+		Uidnum:  ixp.NOUID,
+		Gidnum:  ixp.NOUID,
+		Muidnum: ixp.NOUID,
+	}
+}
+
+/* walk */
+
+// A walk of no names clones the fid, also onto itself.
+func walkClone(h *harness) {
+	fid := h.c.FidAlloc()
+	qids, err := h.c.Walk(h.c.Root, fid, nil)
+	if err != nil || len(qids) != 0 {
+		h.Fatalf("clone: %v %v", qids, err)
+	}
+
+	defer h.c.Clunk(fid)
+	if d := h.stat(fid); d.Qid != h.stat(h.c.Root).Qid {
+		h.Errorf("the clone has qid %v, the original %v", d.Qid, h.c.Root.Qid)
+	}
+
+	err = h.twalk(fid.Fid, fid.Fid, nil)
+	if err != nil {
+		h.Errorf("walk of no names with newfid == fid: %v", err)
+	}
+}
+
+// ".." in the root is the root, elsewhere it is the parent.
+func walkDotdot(h *harness) {
+	root := h.stat(h.c.Root).Qid
+	fid := h.c.FidAlloc()
+	qids, err := h.c.Walk(h.c.Root, fid, []string{".."})
+	if err != nil || len(qids) != 1 {
+		h.Fatalf("walk to \"..\" from the root: %v %v", qids, err)
+	}
+
+	h.c.Clunk(fid)
+	if qids[0].Path != root.Path {
+		h.Errorf("\"..\" of the root has qid %v, the root %v", qids[0], root)
+	}
+
+	if len(h.dir) == 0 {
+		return
+	}
+
+	dir := h.walk()
+	defer h.c.Clunk(dir)
+	parent := h.c.FidAlloc()
+	qids, err = h.c.Walk(dir, parent, []string{".."})
+	if err != nil || len(qids) != 1 {
+		h.Fatalf("walk to \"..\": %v %v", qids, err)
+	}
+
+	h.c.Clunk(parent)
+	up := h.c.FidAlloc()
+	h.c.Walk(h.c.Root, up, h.dir[0:len(h.dir)-1])
+	defer h.c.Clunk(up)
+	if pq := h.stat(up).Qid; qids[0].Path != pq.Path {
+		h.Errorf("\"..\" has qid %v, the parent %v", qids[0], pq)
+	}
+}
+
+// A walk can have up to MAXWELEM names.
+func walkMaxelem(h *harness) {
+	names := make([]string, ixp.MAXWELEM+1)
+	for i := range names {
+		names[i] = ".."
+	}
+
+	fid := h.c.FidAlloc()
+	qids, err := h.c.Walk(h.c.Root, fid, names[0:ixp.MAXWELEM])
+	if err != nil || len(qids) != ixp.MAXWELEM {
+		h.Errorf("walk of %d names: %d qids, %v", ixp.MAXWELEM, len(qids), err)
+	}
+
+	h.c.Clunk(fid)
+	fid = h.c.FidAlloc()
+	qids, err = h.c.Walk(h.c.Root, fid, names)
+	if err == nil {
+		h.Errorf("walk of %d names returned %d qids, expected an error", len(names), len(qids))
+	}
+
+	h.c.Clunk(fid)
+}
+
+// A walk that fails after the first name returns the qids of the
+// names walked, and doesn't create newfid, or move the fid if newfid
+// is the same. If the first name fails, the walk returns an error.
+func walkPartial(h *harness) {
+	h.mkdir("d")
+	h.dir = h.dir[0 : len(h.dir)-1]
+	dir := h.walk()
+	defer h.c.Clunk(dir)
+	qid := h.stat(dir).Qid
+	qids, err := h.c.Walk(dir, dir, []string{"d", "missing"})
+	if err != nil || len(qids) != 1 {
+		h.Errorf("partial walk with newfid == fid: %d qids, %v, expected 1 qid", len(qids), err)
+	}
+
+	if d := h.stat(dir); d.Qid.Path != qid.Path {
+		h.Errorf("partial walk with newfid == fid moved the fid to %q", d.Name)
+	}
+
+	fid := h.c.FidAlloc()
+	qids, err = h.c.Walk(dir, fid, []string{"d", "missing", "x"})
+	if err != nil || len(qids) != 1 {
+		h.Errorf("partial walk: %d qids, %v, expected 1 qid", len(qids), err)
+	}
+
+	err = h.tstat(fid.Fid)
+	if err == nil {
+		h.Errorf("newfid of a partial walk can be used")
+	}
+
+	qids, err = h.c.Walk(dir, fid, []string{"missing", "d"})
+	if err == nil {
+		h.Errorf("walk with a missing first name: %d qids, expected an error", len(qids))
+	}
+
+	h.c.Clunk(fid)
+}
+
+// Only directories can be walked.
+func walkFile(h *harness) {
+	file := h.create("f", 0666, ixp.OWRITE, "")
+	h.c.Clunk(file)
+	file = h.walk("f")
+	defer h.c.Clunk(file)
+	fid := h.c.FidAlloc()
+	qids, err := h.c.Walk(file, fid, []string{"x"})
+	if err == nil {
+		h.Errorf("walk from a file: %d qids, expected an error", len(qids))
+	}
+
+	h.c.Clunk(fid)
+}
+
+// Open fids can't be walked.
+func walkOpen(h *harness) {
+	dir := h.walk()
+	defer h.c.Clunk(dir)
+	if err := h.c.Open(dir, ixp.OREAD); err != nil {
+		h.Fatalf("open: %v", err)
+	}
+
+	fid := h.c.FidAlloc()
+	_, err := h.c.Walk(dir, fid, nil)
+	if err == nil {
+		h.Errorf("walk of an open fid succeeded")
+	}
+
+	h.c.Clunk(fid)
+}
+
+/* fids */
+
+// The requests for fids that were not created fail.
+func fidUnknown(h *harness) {
+	fid := h.unusedFid()
+	if h.tstat(fid) == nil {
+		h.Errorf("Tstat of an unknown fid succeeded")
+	}
+
+	if h.topen(fid, ixp.OREAD) == nil {
+		h.Errorf("Topen of an unknown fid succeeded")
+	}
+
+	if h.tclunk(fid) == nil {
+		h.Errorf("Tclunk of an unknown fid succeeded")
+	}
+}
+
+// Tattach and Twalk fail if the new fid is already in use.
+func fidInuse(h *harness) {
+	if h.tattach(h.c.Root.Fid) == nil {
+		h.Errorf("Tattach with a fid in use succeeded")
+	}
+
+	fid := h.walk()
+	defer h.c.Clunk(fid)
+	if h.twalk(h.c.Root.Fid, fid.Fid, nil) == nil {
+		h.Errorf("Twalk with a newfid in use succeeded")
+	}
+}
+
+// The fids can't be used after Tclunk, but their numbers can be
+// reused.
+func fidClunked(h *harness) {
+	fid := h.walk()
+	n := fid.Fid
+	h.c.Clunk(fid)
+	if h.tstat(n) == nil {
+		h.Errorf("Tstat of a clunked fid succeeded")
+	}
+
+	if err := h.twalk(h.c.Root.Fid, n, nil); err != nil {
+		h.Fatalf("can't reuse a clunked fid: %v", err)
+	}
+
+	h.tclunk(n)
+}
+
+/* open */
+
+// A fid can be opened only once.
+func openTwice(h *harness) {
+	fid := h.walk()
+	defer h.c.Clunk(fid)
+	if err := h.c.Open(fid, ixp.OREAD); err != nil {
+		h.Fatalf("open: %v", err)
+	}
+
+	if h.topen(fid.Fid, ixp.OREAD) == nil {
+		h.Errorf("second open of a fid succeeded")
+	}
+}
+
+// Directories can be opened only for reading.
+func openDirwrite(h *harness) {
+	for _, mode := range []uint8{ixp.OWRITE, ixp.ORDWR, ixp.OREAD | ixp.OTRUNC} {
+		fid := h.walk()
+		if h.c.Open(fid, mode) == nil {
+			h.Errorf("open of a directory with mode %#x succeeded", mode)
+		}
+
+		h.c.Clunk(fid)
+	}
+}
+
+// The files open for reading can't be written, and the other way
+// around.
+func openModes(h *harness) {
+	h.c.Clunk(h.create("f", 0666, ixp.OWRITE, "data"))
+	fid := h.walk("f")
+	if err := h.c.Open(fid, ixp.OREAD); err != nil {
+		h.Fatalf("open for reading: %v", err)
+	}
+
+	if b, err := h.c.Read(fid, 0, 100); err != nil || string(b) != "data" {
+		h.Errorf("read %q, %v, expected \"data\"", b, err)
+	}
+
+	if _, err := h.c.Write(fid, []byte("x"), 0); err == nil {
+		h.Errorf("write to a file open for reading succeeded")
+	}
+
+	h.c.Clunk(fid)
+	fid = h.walk("f")
+	if err := h.c.Open(fid, ixp.OWRITE); err != nil {
+		h.Fatalf("open for writing: %v", err)
+	}
+
+	if _, err := h.c.Read(fid, 0, 100); err == nil {
+		h.Errorf("read from a file open for writing succeeded")
+	}
+
+	h.c.Clunk(fid)
+}
+
+// OTRUNC truncates the file.
+func openTrunc(h *harness) {
+	h.c.Clunk(h.create("f", 0666, ixp.OWRITE, "data"))
+	fid := h.walk("f")
+	defer h.c.Clunk(fid)
+	if err := h.c.Open(fid, ixp.OWRITE|ixp.OTRUNC); err != nil {
+		h.Fatalf("open with OTRUNC: %v", err)
+	}
+
+	if d := h.stat(fid); d.Length != 0 {
+		h.Errorf("length after OTRUNC is %d", d.Length)
+	}
+}
+
+/* directory reads */
+
+// The directory reads return whole entries, continue from the offset
+// of the previous read, restart from offset 0, and fail for the other
+// offsets.
+func dirreadOffsets(h *harness) {
+	const nfiles = 20
+	for i := 0; i < nfiles; i++ {
+		h.c.Clunk(h.create(fmt.Sprintf("file-with-a-long-name-%02d", i), 0666, ixp.OWRITE, ""))
+	}
+
+	dir := h.walk()
+	defer h.c.Clunk(dir)
+	if err := h.c.Open(dir, ixp.OREAD); err != nil {
+		h.Fatalf("open: %v", err)
+	}
+
+	dirs := h.readdir(dir, 256)
+	seen := make(map[string]bool)
+	for _, d := range dirs {
+		if seen[d.Name] {
+			h.Errorf("entry %q returned twice", d.Name)
+		}
+
+		seen[d.Name] = true
+	}
+
+	if len(seen) != nfiles {
+		h.Errorf("read %d entries, expected %d", len(seen), nfiles)
+	}
+
+	again := h.readdir(dir, 256)
+	if len(again) != len(dirs) {
+		h.Errorf("read %d entries after restarting from offset 0, expected %d", len(again), len(dirs))
+	}
+
+	b, err := h.c.Read(dir, 0, 256)
+	if err != nil || len(b) == 0 {
+		h.Fatalf("read at offset 0: %v", err)
+	}
+
+	if _, err := h.c.Read(dir, uint64(len(b))+1, 256); err == nil {
+		h.Errorf("read at an offset that is not the end of the previous read succeeded")
+	}
+}
+
+/* create and remove */
+
+// After Tcreate the fid is the new file, open for the mode.
+func createFid(h *harness) {
+	fid := h.walk()
+	defer h.c.Clunk(fid)
+	if err := h.c.Create(fid, "f", 0666, ixp.ORDWR, ""); err != nil {
+		h.Fatalf("create: %v", err)
+	}
+
+	if _, err := h.c.Write(fid, []byte("data"), 0); err != nil {
+		h.Errorf("write to the created file: %v", err)
+	}
+
+	if b, err := h.c.Read(fid, 0, 100); err != nil || string(b) != "data" {
+		h.Errorf("read %q, %v from the created file, expected \"data\"", b, err)
+	}
+
+	file := h.walk("f")
+	defer h.c.Clunk(file)
+	if d := h.stat(fid); d.Qid.Path != file.Qid.Path || d.Name != "f" {
+		h.Errorf("the created fid is %q %v, the file %v", d.Name, d.Qid, file.Qid)
+	}
+}
+
+// The files can't be created twice.
+func createExists(h *harness) {
+	h.c.Clunk(h.create("f", 0666, ixp.OWRITE, ""))
+	fid := h.walk()
+	defer h.c.Clunk(fid)
+	if h.c.Create(fid, "f", 0666, ixp.OWRITE, "") == nil {
+		h.Errorf("create of an existing file succeeded")
+	}
+}
+
+// The names "." and ".." and the names with "/" are invalid.
+func createNames(h *harness) {
+	for _, name := range []string{".", "..", "a/b", ""} {
+		fid := h.walk()
+		if h.c.Create(fid, name, 0666, ixp.OWRITE, "") == nil {
+			h.Errorf("create of %q succeeded", name)
+		}
+
+		h.c.Clunk(fid)
+	}
+}
+
+// The files can be created only in directories.
+func createInfile(h *harness) {
+	h.c.Clunk(h.create("f", 0666, ixp.OWRITE, ""))
+	fid := h.walk("f")
+	defer h.c.Clunk(fid)
+	if h.c.Create(fid, "g", 0666, ixp.OWRITE, "") == nil {
+		h.Errorf("create in a file succeeded")
+	}
+}
+
+// The directories are created empty, and can't be opened for writing.
+func createDir(h *harness) {
+	fid := h.walk()
+	if h.c.Create(fid, "w", ixp.DMDIR|0777, ixp.OWRITE, "") == nil {
+		h.Errorf("create of a directory open for writing succeeded")
+	}
+
+	h.c.Clunk(fid)
+	fid = h.walk()
+	defer h.c.Clunk(fid)
+	if err := h.c.Create(fid, "d", ixp.DMDIR|0777, ixp.OREAD, ""); err != nil {
+		h.Fatalf("create of a directory: %v", err)
+	}
+
+	if fid.Type&ixp.QTDIR == 0 {
+		h.Errorf("the created directory has qid type %#x", fid.Type)
+	}
+
+	if dirs := h.readdir(fid, 8192); len(dirs) != 0 {
+		h.Errorf("the created directory has %d entries", len(dirs))
+	}
+}
+
+// The removed files can't be walked to, and Tremove clunks the fid.
+func removeFile(h *harness) {
+	fid := h.create("f", 0666, ixp.OWRITE, "")
+	n := fid.Fid
+	if err := h.c.Remove(fid); err != nil {
+		h.Fatalf("remove: %v", err)
+	}
+
+	if h.tstat(n) == nil {
+		h.Errorf("the fid can be used after Tremove")
+	}
+
+	if fid, err := h.walkErr("f"); err == nil {
+		h.c.Clunk(fid)
+		h.Errorf("walk to the removed file succeeded")
+	}
+}
+
+// The directories that are not empty can't be removed, but Tremove
+// still clunks the fid.
+func removeNonempty(h *harness) {
+	h.mkdir("d")
+	h.c.Clunk(h.create("f", 0666, ixp.OWRITE, ""))
+	h.dir = h.dir[0 : len(h.dir)-1]
+	fid := h.walk("d")
+	n := fid.Fid
+	if h.c.Remove(fid) == nil {
+		h.Errorf("remove of a directory that is not empty succeeded")
+	}
+
+	if h.tstat(n) == nil {
+		h.Errorf("the fid can be used after a failed Tremove")
+	}
+}
+
+/* flush */
+
+// Tflush for a tag that is not in use gets Rflush.
+func flushUnknown(h *harness) {
+	if err := h.tflush(0xFFFE); err != nil {
+		h.Errorf("flush of an unknown tag: %v", err)
+	}
+}
+
+// The response to the flushed request, if any, is sent before
+// Rflush.
+func flushOrder(h *harness) {
+	fid := h.walk()
+	defer h.c.Clunk(fid)
+	for i := 0; i < 20; i++ {
+		done := make(chan *clnt.Req, 4)
+		r := h.c.ReqAlloc()
+		r.Tc = h.c.NewFcall()
+		r.Done = done
+		ixp.PackTstat(r.Tc, fid.Fid)
+		if err := h.c.Rpcnb(r); err != nil {
+			h.Fatalf("Tstat: %v", err)
+		}
+
+		fr := h.c.ReqAlloc()
+		fr.Tc = h.c.NewFcall()
+		fr.Done = done
+		ixp.PackTflush(fr.Tc, r.Tc.Tag)
+		if err := h.c.Rpcnb(fr); err != nil {
+			h.Fatalf("Tflush: %v", err)
+		}
+
+		first := <-done
+		if first.Err != nil {
+			h.Fatalf("%v: %v", first.Tc, first.Err)
+		}
+
+		if first == r {
+			<-done
+			h.c.ReqFree(r)
+			h.c.ReqFree(fr)
+			continue
+		}
+
+		/* the flushed request stays pending in the client */
+		select {
+		case <-done:
+			h.Fatalf("response to the flushed request received after Rflush")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		h.c.ReqFree(fr)
+	}
+}
+
+/* wstat */
+
+// Twstat with all fields set to "don't touch" succeeds and doesn't
+// change the file.
+func wstatNop(h *harness) {
+	fid := h.create("f", 0640, ixp.OWRITE, "data")
+	defer h.c.Clunk(fid)
+	old := h.stat(fid)
+	if err := h.c.Wstat(fid, NullDir()); err != nil {
+		h.Fatalf("wstat with \"don't touch\" values: %v", err)
+	}
+
+	d := h.stat(fid)
+	if d.Name != old.Name || d.Length != old.Length || d.Mode != old.Mode ||
+		d.Mtime != old.Mtime || d.Uid != old.Uid || d.Gid != old.Gid || d.Qid.Path != old.Qid.Path {
+		h.Errorf("wstat with \"don't touch\" values changed %v to %v", old, d)
+	}
+}
+
+// Twstat of the length changes only the length.
+func wstatLength(h *harness) {
+	fid := h.create("f", 0640, ixp.OWRITE, "data")
+	defer h.c.Clunk(fid)
+	old := h.stat(fid)
+	nd := NullDir()
+	nd.Length = 2
+	if err := h.c.Wstat(fid, nd); err != nil {
+		h.Fatalf("wstat: %v", err)
+	}
+
+	d := h.stat(fid)
+	if d.Length != 2 || d.Name != old.Name || d.Mode != old.Mode {
+		h.Errorf("wstat of the length changed %v to %v", old, d)
+	}
+}
+
+// Twstat of the mode changes only the permissions.
+func wstatMode(h *harness) {
+	fid := h.create("f", 0640, ixp.OWRITE, "data")
+	defer h.c.Clunk(fid)
+	old := h.stat(fid)
+	nd := NullDir()
+	nd.Mode = 0600
+	if err := h.c.Wstat(fid, nd); err != nil {
+		h.Fatalf("wstat: %v", err)
+	}
+
+	d := h.stat(fid)
+	if d.Mode&0777 != 0600 || d.Length != old.Length || d.Name != old.Name {
+		h.Errorf("wstat of the mode changed %v to %v", old, d)
+	}
+}
+
+// Twstat of the name renames the file in its directory.
+func wstatName(h *harness) {
+	fid := h.create("f", 0640, ixp.OWRITE, "data")
+	defer h.c.Clunk(fid)
+	nd := NullDir()
+	nd.Name = "g"
+	if err := h.c.Wstat(fid, nd); err != nil {
+		h.Fatalf("wstat: %v", err)
+	}
+
+	if d := h.stat(fid); d.Name != "g" || d.Length != 4 {
+		h.Errorf("the renamed file is %v", d)
+	}
+
+	if f, err := h.walkErr("f"); err == nil {
+		h.c.Clunk(f)
+		h.Errorf("walk to the old name succeeded")
+	}
+
+	h.c.Clunk(h.walk("g"))
+}
@@ -0,0 +1,26 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+// The StatsOps interface is implemented by Srv and Conn when the
+// package is built with the httpstats tag. The values register
+// themselves with the stats server when they are created and remove
+// themselves when they go away.
+type StatsOps interface {
+	statsRegister()
+	statsUnregister()
+}
+
+func statsRegister(v interface{}) {
+	if sop, ok := v.(StatsOps); ok {
+		sop.statsRegister()
+	}
+}
+
+func statsUnregister(v interface{}) {
+	if sop, ok := v.(StatsOps); ok {
+		sop.statsUnregister()
+	}
+}
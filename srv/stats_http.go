@@ -0,0 +1,217 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build httpstats
+// +build httpstats
+
+package srv
+
+import (
+	"fmt"
+	"github.com/jsouthworth/ixp"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// Address the HTTP server started by StartStatsServer listens on. The
+// pages show the users and the traffic of the connections, by default
+// they are served only on the loopback interface.
+var StatsAddr = "localhost:6060"
+
+var mux sync.RWMutex
+var stat map[string]http.Handler
+var httponce sync.Once
+
+func register(s string, h http.Handler) {
+	mux.Lock()
+	if stat == nil {
+		stat = make(map[string]http.Handler)
+	}
+
+	if h == nil {
+		delete(stat, s)
+	} else {
+		stat[s] = h
+	}
+	mux.Unlock()
+}
+
+func srvPath(srv *Srv) string {
+	return "/ixp/srv/" + srv.Id
+}
+
+func connPath(conn *Conn) string {
+	return srvPath(conn.Srv) + "/conn/" + conn.Id
+}
+
+func link(path, name string) string {
+	u := url.URL{Path: path}
+	return fmt.Sprintf("<a href='%s'>%s</a>", html.EscapeString(u.EscapedPath()),
+		html.EscapeString(name))
+}
+
+func (srv *Srv) statsRegister() {
+	register(srvPath(srv), srv)
+}
+
+func (srv *Srv) statsUnregister() {
+	register(srvPath(srv), nil)
+}
+
+func (conn *Conn) statsRegister() {
+	register(connPath(conn), conn)
+}
+
+func (conn *Conn) statsUnregister() {
+	register(connPath(conn), nil)
+}
+
+// Shows the list of connections to the server.
+func (srv *Srv) ServeHTTP(c http.ResponseWriter, r *http.Request) {
+	io.WriteString(c, fmt.Sprintf("<html><body><h1>Server %s</h1>", html.EscapeString(srv.Id)))
+	defer io.WriteString(c, "</body></html>")
+
+	io.WriteString(c, fmt.Sprintf("<p>Msize: %d<br>Dialect: %v<br>Debuglevel: %d",
+		srv.Msize, srv.Dialect, srv.Debuglevel))
+
+	// connections
+	io.WriteString(c, "<h2>Connections</h2><p>")
+	srv.Lock()
+	conns := make([]*Conn, 0, len(srv.conns))
+	for _, conn := range srv.conns {
+		conns = append(conns, conn)
+	}
+	srv.Unlock()
+
+	if len(conns) == 0 {
+		io.WriteString(c, "none")
+		return
+	}
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Id < conns[j].Id })
+	for _, conn := range conns {
+		io.WriteString(c, link(connPath(conn), conn.Id)+"<br>")
+	}
+}
+
+// Shows the counters, the open fids and the last logged 9P messages
+// of the connection.
+func (conn *Conn) ServeHTTP(c http.ResponseWriter, r *http.Request) {
+	io.WriteString(c, fmt.Sprintf("<html><body><h1>Connection %s</h1>",
+		html.EscapeString(conn.String())))
+	defer io.WriteString(c, "</body></html>")
+
+	// statistics
+	conn.Lock()
+	io.WriteString(c, fmt.Sprintf("<p>Msize: %d<br>Dialect: %v", conn.Msize, conn.Dialect))
+	io.WriteString(c, fmt.Sprintf("<br>Number of processed requests: %d", conn.nreqs))
+	io.WriteString(c, fmt.Sprintf("<br>Sent %v bytes", conn.rsz))
+	io.WriteString(c, fmt.Sprintf("<br>Received %v bytes", conn.tsz))
+	io.WriteString(c, fmt.Sprintf("<br>Pending requests: %d max %d", conn.npend, conn.maxpend))
+	io.WriteString(c, fmt.Sprintf("<br>Number of reads: %d", conn.nreads))
+	io.WriteString(c, fmt.Sprintf("<br>Number of writes: %d", conn.nwrites))
+	fids := make([]*Fid, 0, len(conn.fidpool))
+	for _, fid := range conn.fidpool {
+		fids = append(fids, fid)
+	}
+	conn.Unlock()
+
+	// fids
+	io.WriteString(c, fmt.Sprintf("<h2>%d open fids</h2>", len(fids)))
+	if len(fids) > 0 {
+		sort.Slice(fids, func(i, j int) bool { return fids[i].fid < fids[j].fid })
+		io.WriteString(c, "<table><tr><th>fid</th><th>user</th><th>type</th>"+
+			"<th>opened</th><th>mode</th><th>diroffset</th><th>refs</th></tr>")
+		for _, fid := range fids {
+			fid.Lock()
+			uname := ""
+			if fid.User != nil {
+				uname = fid.User.Name()
+				if uname == "" {
+					uname = fmt.Sprintf("%d", fid.User.Id())
+				}
+			}
+
+			io.WriteString(c, fmt.Sprintf("<tr><td>%d</td><td>%s</td><td>%#x</td>"+
+				"<td>%v</td><td>%#x</td><td>%d</td><td>%d</td></tr>",
+				fid.fid, html.EscapeString(uname), fid.Type, fid.opened,
+				fid.Omode, fid.Diroffset, fid.refcount))
+			fid.Unlock()
+		}
+		io.WriteString(c, "</table>")
+	}
+
+	// fcalls
+	if conn.Debuglevel&DbgLogFcalls == 0 || conn.Srv.Log == nil {
+		io.WriteString(c, "<h2>9P messages</h2><p>not logged (DbgLogFcalls is not set)")
+		return
+	}
+
+	fs := conn.Srv.Log.Filter(conn, DbgLogFcalls)
+	io.WriteString(c, fmt.Sprintf("<h2>Last %d 9P messages</h2><pre>", len(fs)))
+	for _, l := range fs {
+		fc, ok := l.Data.(*ixp.Fcall)
+		if !ok || fc.Type == 0 {
+			continue
+		}
+
+		io.WriteString(c, html.EscapeString(fc.String())+"\n")
+	}
+	io.WriteString(c, "</pre>")
+}
+
+// Serves the stats pages for all registered servers and connections.
+// The list of servers is available at /ixp/srv/.
+func StatsHandler(c http.ResponseWriter, r *http.Request) {
+	mux.RLock()
+	h, ok := stat[r.URL.Path]
+	var paths []string
+	if !ok && r.URL.Path == "/ixp/srv/" {
+		for p, v := range stat {
+			if _, ok := v.(*Srv); ok {
+				paths = append(paths, p)
+			}
+		}
+	}
+	mux.RUnlock()
+
+	switch {
+	case ok:
+		h.ServeHTTP(c, r)
+
+	case r.URL.Path == "/ixp/srv/":
+		sort.Strings(paths)
+		io.WriteString(c, "<html><body><h1>Servers</h1><p>")
+		if len(paths) == 0 {
+			io.WriteString(c, "none")
+		}
+		for _, p := range paths {
+			io.WriteString(c, link(p, p[len("/ixp/srv/"):])+"<br>")
+		}
+		io.WriteString(c, "</body></html>")
+
+	default:
+		http.NotFound(c, r)
+	}
+}
+
+// Registers StatsHandler at /ixp/srv/ in the default HTTP mux and
+// starts serving it on StatsAddr. The HTTP server runs in its own
+// goroutine, calling StartStatsServer more than once has no effect.
+func StartStatsServer() {
+	httponce.Do(func() {
+		http.HandleFunc("/ixp/srv/", StatsHandler)
+		go func() {
+			err := http.ListenAndServe(StatsAddr, nil)
+			if err != nil {
+				slog.Error("stats server", "err", err)
+			}
+		}()
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build httpstats
+// +build httpstats
+
+package srv_test
+
+import (
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/srv"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Returns the status and the body of the stats page.
+func statsPage(path string) (int, string) {
+	w := httptest.NewRecorder()
+	srv.StatsHandler(w, httptest.NewRequest("GET", path, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestStatsHandler(t *testing.T) {
+	s := srv.NewFileSrv(srvtest.Root(t, 0777))
+	s.Id = "stats<test>"
+	s.Dialect = ixp.Dialect9P2000u
+	s.Debuglevel = srv.DbgLogFcalls
+	if !s.Start(s) {
+		t.Fatal("can't start the file server")
+	}
+
+	c, unmount, err := srvtest.Loopback(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmount()
+
+	if _, err := c.FStat("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	/* the names are escaped in the links and the text */
+	spath := "/ixp/srv/stats<test>"
+	code, body := statsPage("/ixp/srv/")
+	if code != http.StatusOK || !strings.Contains(body, "href='/ixp/srv/stats%3Ctest%3E'>stats&lt;test&gt;</a>") {
+		t.Errorf("list of the servers: %d %s", code, body)
+	}
+
+	code, body = statsPage(spath)
+	if code != http.StatusOK || !strings.Contains(body, "<h1>Server stats&lt;test&gt;</h1>") {
+		t.Fatalf("page of the server: %d %s", code, body)
+	}
+
+	cpath := spath + "/conn/pipe"
+	if !strings.Contains(body, "href='/ixp/srv/stats%3Ctest%3E/conn/pipe'>pipe</a>") {
+		t.Errorf("page of the server doesn't link to the connection: %s", body)
+	}
+
+	/* the root fid of the client and the logged messages */
+	code, body = statsPage(cpath)
+	if code != http.StatusOK || !strings.Contains(body, "<h2>1 open fids</h2>") ||
+		!strings.Contains(body, "Tattach tag") || !strings.Contains(body, "Rstat tag") {
+		t.Errorf("page of the connection: %d %s", code, body)
+	}
+
+	if code, _ := statsPage("/ixp/srv/none"); code != http.StatusNotFound {
+		t.Errorf("page of an unknown server: %d", code)
+	}
+
+	/* the pages are removed with the server */
+	s.Close()
+	for _, path := range []string{spath, cpath} {
+		if code, _ := statsPage(path); code != http.StatusNotFound {
+			t.Errorf("%s after Close: %d", path, code)
+		}
+	}
+
+	if code, body := statsPage("/ixp/srv/"); code != http.StatusOK || strings.Contains(body, "stats&lt;test&gt;") {
+		t.Errorf("list of the servers after Close: %d %s", code, body)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2012 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"github.com/jsouthworth/ixp"
+	"os"
+	"syscall"
+	"time"
+)
+
+func atime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Atimespec.Unix())
+}
+
+func ctime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Ctimespec.Unix())
+}
+
+// Returns the description of the file system of the open file.
+func statfs(f *os.File) (*ixp.Statfs, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Fstatfs(int(f.Fd()), &st); err != nil {
+		return nil, err
+	}
+
+	return &ixp.Statfs{
+		Type:    st.Type,
+		Bsize:   st.Bsize,
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Fsid:    uint64(uint32(st.Fsid.Val[0])) | uint64(uint32(st.Fsid.Val[1]))<<32,
+		Namelen: 255, /* MAXNAMLEN */
+	}, nil
+}
@@ -0,0 +1,573 @@
+// Copyright 2009 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/srv"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// The 9P2000.L operations of the file server. Like the 9P2000 ones,
+// they resolve all the names through os.Root, so they are confined to
+// the exported tree too. The extended attributes and Tmknod are not
+// supported.
+
+var Enosys = &ixp.Error{"function not implemented", uint32(syscall.ENOSYS)}
+
+// Converts the Linux open flags of Tlopen and Tlcreate to the flags
+// of os.OpenFile.
+func lflags(flags uint32) int {
+	ret := os.O_RDONLY
+	switch flags & 3 {
+	case ixp.LO_WRONLY:
+		ret = os.O_WRONLY
+	case ixp.LO_RDWR:
+		ret = os.O_RDWR
+	}
+
+	if flags&ixp.LO_TRUNC != 0 {
+		ret |= os.O_TRUNC
+	}
+
+	if flags&ixp.LO_APPEND != 0 {
+		ret |= os.O_APPEND
+	}
+
+	return ret
+}
+
+// Returns true if the Linux open flags allow changing the file.
+func lwritable(flags uint32) bool {
+	return flags&3 != ixp.LO_RDONLY || flags&(ixp.LO_TRUNC|ixp.LO_APPEND) != 0
+}
+
+// Converts the Linux protection bits to os.FileMode.
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+
+	return m
+}
+
+// Returns the 9P2000.L attributes of the file.
+func (ufs *Ufs) attr(st os.FileInfo) *ixp.Attr {
+	sys := st.Sys().(*syscall.Stat_t)
+	at, mt, ct := atime(sys), st.ModTime(), ctime(sys)
+	a := new(ixp.Attr)
+	a.Valid = ixp.GETATTR_BASIC
+	a.Qid = *dir2Qid(st)
+	a.Mode = uint32(sys.Mode)
+	a.Uid = uint32(ufs.clientUid(int(sys.Uid)))
+	a.Gid = uint32(ufs.clientGid(int(sys.Gid)))
+	a.Nlink = uint64(sys.Nlink)
+	a.Rdev = uint64(sys.Rdev)
+	a.Size = uint64(st.Size())
+	a.Blksize = uint64(sys.Blksize)
+	a.Blocks = uint64(sys.Blocks)
+	a.AtimeSec, a.AtimeNsec = uint64(at.Unix()), uint64(at.Nanosecond())
+	a.MtimeSec, a.MtimeNsec = uint64(mt.Unix()), uint64(mt.Nanosecond())
+	a.CtimeSec, a.CtimeNsec = uint64(ct.Unix()), uint64(ct.Nanosecond())
+	return a
+}
+
+// Returns the Linux file type of the file, as in the Type of a Dirent.
+func direntType(st os.FileInfo) uint8 {
+	return uint8((uint32(st.Sys().(*syscall.Stat_t).Mode) & ixp.S_IFMT) >> 12)
+}
+
+// Sets the group of a new file to the group the client asked for. The
+// file keeps the group the host gave it if the server can't change it.
+func (ufs *Ufs) chgrp(path string, gid uint32) {
+	if gid != ixp.NOUID {
+		ufs.root.Lchown(path, -1, ufs.hostGid(int(gid)))
+	}
+}
+
+// Returns the name of the new file name in the directory of the fid.
+// Responds with an error and returns "" if the name is invalid, or
+// the file server is read-only.
+func (ufs *Ufs) newName(req *srv.Req, fid *Fid, name string) string {
+	if ufs.ReadOnly {
+		req.RespondError(Erofs)
+		return ""
+	}
+
+	if !validName(name) {
+		req.RespondError(&ixp.Error{"invalid file name", ixp.EINVAL})
+		return ""
+	}
+
+	return join(fid.path, name)
+}
+
+// Responds with the Qid of the file, which was just created.
+func (ufs *Ufs) respondQid(req *srv.Req, path string, respond func(*ixp.Qid)) {
+	st, e := ufs.root.Lstat(path)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	respond(dir2Qid(st))
+}
+
+func (ufs *Ufs) Statfs(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	f, e := ufs.root.Open(fid.path)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+	defer f.Close()
+
+	st, e := statfs(f)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRstatfs(st)
+}
+
+func (ufs *Ufs) Lopen(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	st, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if ufs.ReadOnly && lwritable(tc.Flags) {
+		req.RespondError(Erofs)
+		return
+	}
+
+	var e error
+	fid.file, e = ufs.root.OpenFile(fid.path, lflags(tc.Flags), 0)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRlopen(dir2Qid(st), 0)
+}
+
+func (ufs *Ufs) Lcreate(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	path := ufs.newName(req, fid, tc.Name)
+	if path == "" {
+		return
+	}
+
+	file, e := ufs.root.OpenFile(path, lflags(tc.Flags)|os.O_CREATE|os.O_EXCL, fileMode(tc.Perm))
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	ufs.chgrp(path, tc.Lgid)
+	fid.path = path
+	fid.file = file
+	ufs.respondQid(req, path, func(qid *ixp.Qid) { req.RespondRlcreate(qid, 0) })
+}
+
+func (ufs *Ufs) Symlink(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	path := ufs.newName(req, fid, tc.Name)
+	if path == "" {
+		return
+	}
+
+	/* the target isn't resolved, os.Root doesn't follow it out of the tree */
+	e := ufs.root.Symlink(tc.Target, path)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	ufs.chgrp(path, tc.Lgid)
+	ufs.respondQid(req, path, req.RespondRsymlink)
+}
+
+func (*Ufs) Mknod(req *srv.Req) { req.RespondError(Enosys) }
+
+func (ufs *Ufs) Rename(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	dfid := req.Dfid.Aux.(*Fid)
+	path := ufs.newName(req, dfid, req.Tc.Name)
+	if path == "" {
+		return
+	}
+
+	if fid.path == fid.root {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	e := ufs.root.Rename(fid.path, path)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	fid.path = path
+	req.RespondRrename()
+}
+
+func (ufs *Ufs) Readlink(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	target, e := ufs.root.Readlink(fid.path)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRreadlink(target)
+}
+
+func (ufs *Ufs) Getattr(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	st, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRgetattr(ufs.attr(st))
+}
+
+func (ufs *Ufs) Setattr(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	sa := &req.Tc.SetAttr
+	st, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if ufs.ReadOnly {
+		req.RespondError(Erofs)
+		return
+	}
+
+	var e error
+	if sa.Valid&ixp.SETATTR_MODE != 0 {
+		e = ufs.root.Chmod(fid.path, fileMode(sa.Mode))
+	}
+
+	if e == nil && sa.Valid&(ixp.SETATTR_UID|ixp.SETATTR_GID) != 0 {
+		huid, hgid := -1, -1
+		if sa.Valid&ixp.SETATTR_UID != 0 {
+			huid = ufs.hostUid(int(sa.Uid))
+		}
+		if sa.Valid&ixp.SETATTR_GID != 0 {
+			hgid = ufs.hostGid(int(sa.Gid))
+		}
+
+		e = ufs.root.Lchown(fid.path, huid, hgid)
+	}
+
+	if e == nil && sa.Valid&ixp.SETATTR_SIZE != 0 {
+		var f *os.File
+		f, e = ufs.root.OpenFile(fid.path, os.O_WRONLY, 0)
+		if e == nil {
+			e = f.Truncate(int64(sa.Size))
+			f.Close()
+		}
+	}
+
+	if e == nil && sa.Valid&(ixp.SETATTR_ATIME|ixp.SETATTR_MTIME) != 0 {
+		/* both times are set, the one not changed is set to its current value */
+		now := time.Now()
+		at, mt := atime(st.Sys().(*syscall.Stat_t)), st.ModTime()
+		switch {
+		case sa.Valid&ixp.SETATTR_ATIME_SET != 0:
+			at = time.Unix(int64(sa.AtimeSec), int64(sa.AtimeNsec))
+		case sa.Valid&ixp.SETATTR_ATIME != 0:
+			at = now
+		}
+
+		switch {
+		case sa.Valid&ixp.SETATTR_MTIME_SET != 0:
+			mt = time.Unix(int64(sa.MtimeSec), int64(sa.MtimeNsec))
+		case sa.Valid&ixp.SETATTR_MTIME != 0:
+			mt = now
+		}
+
+		e = ufs.root.Chtimes(fid.path, at, mt)
+	}
+
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRsetattr()
+}
+
+func (*Ufs) Xattrwalk(req *srv.Req)   { req.RespondError(Enosys) }
+func (*Ufs) Xattrcreate(req *srv.Req) { req.RespondError(Enosys) }
+
+// Reads the directory of the fid when the client starts reading it
+// from the beginning. The offset of an entry is its index in the
+// directory plus one, the entries are read from the same snapshot
+// until the client starts again.
+func (ufs *Ufs) Readdir(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	if tc.Offset == 0 || fid.dirents == nil {
+		dirents, err := ufs.dirents(fid)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+
+		fid.dirents = dirents
+	}
+
+	if tc.Offset > uint64(len(fid.dirents)) {
+		req.RespondRreaddir(nil)
+		return
+	}
+
+	req.RespondRreaddir(fid.dirents[tc.Offset:])
+}
+
+// Returns the entries of the directory of the fid, with "." and "..".
+func (ufs *Ufs) dirents(fid *Fid) ([]ixp.Dirent, *ixp.Error) {
+	parent := fid.path
+	if fid.path != fid.root {
+		parent = filepath.Dir(fid.path)
+	}
+
+	var sts []os.FileInfo
+	for _, path := range []string{fid.path, parent} {
+		st, e := ufs.root.Lstat(path)
+		if e != nil {
+			return nil, toError(e)
+		}
+
+		sts = append(sts, st)
+	}
+
+	f, e := ufs.root.Open(fid.path)
+	if e != nil {
+		return nil, toError(e)
+	}
+
+	entries, e := f.Readdir(-1)
+	f.Close()
+	if e != nil {
+		return nil, toError(e)
+	}
+
+	names := append([]string{".", ".."}, make([]string, len(entries))...)
+	for i, st := range entries {
+		names[i+2] = st.Name()
+	}
+
+	sts = append(sts, entries...)
+	dirents := make([]ixp.Dirent, len(sts))
+	for i, st := range sts {
+		dirents[i] = ixp.Dirent{Qid: *dir2Qid(st), Offset: uint64(i + 1), Type: direntType(st), Name: names[i]}
+	}
+
+	return dirents, nil
+}
+
+func (ufs *Ufs) Fsync(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	if fid.file == nil {
+		req.RespondError(srv.Ebaduse)
+		return
+	}
+
+	e := fid.file.Sync()
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRfsync()
+}
+
+// Converts a 9P2000.L lock to a POSIX record lock.
+func hostLock(lk *ixp.Flock) *syscall.Flock_t {
+	hl := new(syscall.Flock_t)
+	switch lk.Type {
+	case ixp.LOCK_TYPE_RDLCK:
+		hl.Type = syscall.F_RDLCK
+	case ixp.LOCK_TYPE_WRLCK:
+		hl.Type = syscall.F_WRLCK
+	default:
+		hl.Type = syscall.F_UNLCK
+	}
+
+	hl.Whence = 0 /* SEEK_SET */
+	hl.Start = int64(lk.Start)
+	hl.Len = int64(lk.Length)
+	return hl
+}
+
+// Takes or releases a POSIX record lock on the open file. The locks
+// are held by the server process, so they exclude the other processes
+// of the host, but not the other clients of the file server. A lock
+// that can't be taken right away is reported as blocked, the client
+// retries it.
+func (ufs *Ufs) Flock(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	if fid.file == nil {
+		req.RespondError(srv.Ebaduse)
+		return
+	}
+
+	e := syscall.FcntlFlock(fid.file.Fd(), syscall.F_SETLK, hostLock(&req.Tc.Flock))
+	switch e {
+	case nil:
+		req.RespondRlock(ixp.LOCK_SUCCESS)
+	case syscall.EAGAIN, syscall.EACCES:
+		req.RespondRlock(ixp.LOCK_BLOCKED)
+	default:
+		req.RespondRlock(ixp.LOCK_ERROR)
+	}
+}
+
+// Tests if the lock could be taken. Responds with the lock that
+// prevents it, or with the lock of the request with the type changed
+// to LOCK_TYPE_UNLCK.
+func (ufs *Ufs) Getlock(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	if fid.file == nil {
+		req.RespondError(srv.Ebaduse)
+		return
+	}
+
+	lk := req.Tc.Flock
+	hl := hostLock(&lk)
+	e := syscall.FcntlFlock(fid.file.Fd(), syscall.F_GETLK, hl)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	switch hl.Type {
+	case syscall.F_RDLCK:
+		lk.Type = ixp.LOCK_TYPE_RDLCK
+	case syscall.F_WRLCK:
+		lk.Type = ixp.LOCK_TYPE_WRLCK
+	default:
+		lk.Type = ixp.LOCK_TYPE_UNLCK
+	}
+
+	if lk.Type != ixp.LOCK_TYPE_UNLCK {
+		lk.Start, lk.Length, lk.ProcId = uint64(hl.Start), uint64(hl.Len), uint32(hl.Pid)
+	}
+
+	req.RespondRgetlock(&lk)
+}
+
+func (ufs *Ufs) Link(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	dfid := req.Dfid.Aux.(*Fid)
+	path := ufs.newName(req, dfid, req.Tc.Name)
+	if path == "" {
+		return
+	}
+
+	e := ufs.root.Link(fid.path, path)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRlink()
+}
+
+func (ufs *Ufs) Mkdir(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	path := ufs.newName(req, fid, tc.Name)
+	if path == "" {
+		return
+	}
+
+	e := ufs.root.Mkdir(path, fileMode(tc.Perm))
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	ufs.chgrp(path, tc.Lgid)
+	ufs.respondQid(req, path, req.RespondRmkdir)
+}
+
+func (ufs *Ufs) Renameat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	dfid := req.Dfid.Aux.(*Fid)
+	tc := req.Tc
+	oldpath := ufs.newName(req, fid, tc.Name)
+	if oldpath == "" {
+		return
+	}
+
+	path := ufs.newName(req, dfid, tc.Newname)
+	if path == "" {
+		return
+	}
+
+	e := ufs.root.Rename(oldpath, path)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRrenameat()
+}
+
+func (ufs *Ufs) Unlinkat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	path := ufs.newName(req, fid, tc.Name)
+	if path == "" {
+		return
+	}
+
+	st, e := ufs.root.Lstat(path)
+	if e == nil {
+		/* AT_REMOVEDIR tells if a directory is expected */
+		switch dir := tc.Flags&ixp.AT_REMOVEDIR != 0; {
+		case dir && !st.IsDir():
+			e = &os.PathError{Op: "unlinkat", Path: tc.Name, Err: syscall.ENOTDIR}
+		case !dir && st.IsDir():
+			e = &os.PathError{Op: "unlinkat", Path: tc.Name, Err: syscall.EISDIR}
+		default:
+			e = ufs.root.Remove(path)
+		}
+	}
+
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRunlinkat()
+}
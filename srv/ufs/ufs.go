@@ -0,0 +1,864 @@
+// Copyright 2009 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The ufs package implements a file server that exports a directory
+// tree of the host.
+//
+// All the names are resolved relative to the root directory through
+// os.Root, which uses openat(2) for every path element. Walking ".."
+// stops at the root, and the symlinks that point outside of the root
+// are not followed, so the clients can't access files outside of the
+// exported tree.
+//
+// The package needs Go 1.25 or later, the first release with the
+// Readlink, Symlink, Link, Chmod, Lchown, Rename and Chtimes methods
+// of os.Root.
+package ufs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/srv"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type Fid struct {
+	root      string // attach point
+	path      string // name relative to the root of the file server
+	file      *os.File
+	dirs      []os.FileInfo
+	diroffset uint64
+	dirents   []ixp.Dirent // entries read by Treaddir
+}
+
+// The IdMap type maps the numeric user and group ids of the host to
+// the ids seen by the clients (and back). The ids that are not in the
+// maps are not changed, unless Squash is set, in which case they are
+// mapped to Anonuid and Anongid.
+type IdMap struct {
+	Uids    map[int]int // host uid to client uid
+	Gids    map[int]int // host gid to client gid
+	Squash  bool
+	Anonuid int
+	Anongid int
+}
+
+// The Ufs type implements a file server that exports the files under
+// the Root directory of the host.
+type Ufs struct {
+	srv.Srv
+	Root     string
+	ReadOnly bool   // if true, the files can't be changed
+	Idmap    *IdMap // if not nil, used to map the uids and gids
+
+	root *os.Root
+}
+
+var Enoent = &ixp.Error{"file not found", ixp.ENOENT}
+var Erofs = &ixp.Error{"read-only file system", ixp.EROFS}
+
+// Creates a file server that exports the directory tree under root.
+func New(root string) (*Ufs, error) {
+	r, err := os.OpenRoot(root)
+	if err != nil {
+		return nil, toError(err)
+	}
+
+	ufs := new(Ufs)
+	ufs.Root = root
+	ufs.root = r
+	return ufs, nil
+}
+
+// Closes the root directory of the file server.
+func (ufs *Ufs) Close() error {
+	return ufs.root.Close()
+}
+
+func toError(err error) *ixp.Error {
+	var ecode uint32
+
+	ename := err.Error()
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		ecode = uint32(errno)
+	} else if errors.Is(err, os.ErrNotExist) {
+		ecode = ixp.ENOENT
+	} else if errors.Is(err, os.ErrPermission) || strings.Contains(ename, "path escapes") {
+		ecode = ixp.EPERM
+	} else {
+		ecode = ixp.EIO
+	}
+
+	return &ixp.Error{ename, ecode}
+}
+
+// Returns the host ids of the client ids.
+func (m *IdMap) host(id int, ids map[int]int) int {
+	for h, c := range ids {
+		if c == id {
+			return h
+		}
+	}
+
+	return id
+}
+
+// Returns the client ids of the host ids.
+func (m *IdMap) client(id int, ids map[int]int, anon int) int {
+	if c, ok := ids[id]; ok {
+		return c
+	}
+
+	if m.Squash {
+		return anon
+	}
+
+	return id
+}
+
+func (ufs *Ufs) clientUid(uid int) int {
+	if ufs.Idmap == nil {
+		return uid
+	}
+
+	return ufs.Idmap.client(uid, ufs.Idmap.Uids, ufs.Idmap.Anonuid)
+}
+
+func (ufs *Ufs) clientGid(gid int) int {
+	if ufs.Idmap == nil {
+		return gid
+	}
+
+	return ufs.Idmap.client(gid, ufs.Idmap.Gids, ufs.Idmap.Anongid)
+}
+
+func (ufs *Ufs) hostUid(uid int) int {
+	if ufs.Idmap == nil {
+		return uid
+	}
+
+	return ufs.Idmap.host(uid, ufs.Idmap.Uids)
+}
+
+func (ufs *Ufs) hostGid(gid int) int {
+	if ufs.Idmap == nil {
+		return gid
+	}
+
+	return ufs.Idmap.host(gid, ufs.Idmap.Gids)
+}
+
+// IsBlock reports if the file is a block device
+func isBlock(d os.FileInfo) bool {
+	stat := d.Sys().(*syscall.Stat_t)
+	return (stat.Mode & syscall.S_IFMT) == syscall.S_IFBLK
+}
+
+// IsChar reports if the file is a character device
+func isChar(d os.FileInfo) bool {
+	stat := d.Sys().(*syscall.Stat_t)
+	return (stat.Mode & syscall.S_IFMT) == syscall.S_IFCHR
+}
+
+// Returns the metadata of the file of the fid. The metadata isn't kept
+// in the fid, as requests for the same fid can run concurrently.
+func (ufs *Ufs) stat(fid *Fid) (os.FileInfo, *ixp.Error) {
+	st, err := ufs.root.Lstat(fid.path)
+	if err != nil {
+		return nil, toError(err)
+	}
+
+	return st, nil
+}
+
+func omode2uflags(mode uint8) int {
+	ret := int(0)
+	switch mode & 3 {
+	case ixp.OREAD:
+		ret = os.O_RDONLY
+		break
+
+	case ixp.ORDWR:
+		ret = os.O_RDWR
+		break
+
+	case ixp.OWRITE:
+		ret = os.O_WRONLY
+		break
+
+	case ixp.OEXEC:
+		ret = os.O_RDONLY
+		break
+	}
+
+	if mode&ixp.OTRUNC != 0 {
+		ret |= os.O_TRUNC
+	}
+
+	return ret
+}
+
+// Returns true if the open mode allows changing the file.
+func writable(mode uint8) bool {
+	return mode&3 == ixp.OWRITE || mode&3 == ixp.ORDWR ||
+		mode&(ixp.OTRUNC|ixp.ORCLOSE) != 0
+}
+
+func dir2Qid(d os.FileInfo) *ixp.Qid {
+	var qid ixp.Qid
+
+	qid.Path = d.Sys().(*syscall.Stat_t).Ino
+	qid.Version = uint32(d.ModTime().UnixNano() / 1000000)
+	qid.Type = dir2QidType(d)
+
+	return &qid
+}
+
+func dir2QidType(d os.FileInfo) uint8 {
+	ret := uint8(0)
+	if d.IsDir() {
+		ret |= ixp.QTDIR
+	}
+
+	if d.Mode()&os.ModeSymlink != 0 {
+		ret |= ixp.QTSYMLINK
+	}
+
+	return ret
+}
+
+func dir2Npmode(d os.FileInfo, dotu bool) uint32 {
+	ret := uint32(d.Mode() & 0777)
+	if d.IsDir() {
+		ret |= ixp.DMDIR
+	}
+
+	if dotu {
+		mode := d.Mode()
+		if mode&os.ModeSymlink != 0 {
+			ret |= ixp.DMSYMLINK
+		}
+
+		if mode&os.ModeSocket != 0 {
+			ret |= ixp.DMSOCKET
+		}
+
+		if mode&os.ModeNamedPipe != 0 {
+			ret |= ixp.DMNAMEDPIPE
+		}
+
+		if mode&os.ModeDevice != 0 {
+			ret |= ixp.DMDEVICE
+		}
+
+		if mode&os.ModeSetuid != 0 {
+			ret |= ixp.DMSETUID
+		}
+
+		if mode&os.ModeSetgid != 0 {
+			ret |= ixp.DMSETGID
+		}
+	}
+
+	return ret
+}
+
+// Dir is an instantiation of the ixp.Dir structure
+// that can act as a receiver for local methods.
+type Dir struct {
+	ixp.Dir
+}
+
+func (ufs *Ufs) dir2Dir(path string, d os.FileInfo, dotu bool, upool ixp.Users) *ixp.Dir {
+	sysMode := d.Sys().(*syscall.Stat_t)
+
+	dir := new(Dir)
+	dir.Qid = *dir2Qid(d)
+	dir.Mode = dir2Npmode(d, dotu)
+	dir.Atime = uint32(atime(sysMode).Unix())
+	dir.Mtime = uint32(d.ModTime().Unix())
+	dir.Length = uint64(d.Size())
+	if path == "." {
+		dir.Name = filepath.Base(ufs.Root)
+	} else {
+		dir.Name = path[strings.LastIndex(path, "/")+1:]
+	}
+
+	unixUid := ufs.clientUid(int(sysMode.Uid))
+	unixGid := ufs.clientGid(int(sysMode.Gid))
+	if dotu {
+		ufs.dotu(dir, path, d, upool, unixUid, unixGid, sysMode)
+		return &dir.Dir
+	}
+
+	dir.Uid = strconv.Itoa(unixUid)
+	dir.Gid = strconv.Itoa(unixGid)
+	dir.Muid = "none"
+
+	// BUG(akumar): LookupId will never find names for
+	// groups, as it only operates on user ids.
+	u, err := user.LookupId(dir.Uid)
+	if err == nil {
+		dir.Uid = u.Username
+	}
+	g, err := user.LookupId(dir.Gid)
+	if err == nil {
+		dir.Gid = g.Username
+	}
+
+	return &dir.Dir
+}
+
+func (ufs *Ufs) dotu(dir *Dir, path string, d os.FileInfo, upool ixp.Users, uid, gid int, sysMode *syscall.Stat_t) {
+	u := upool.Uid2User(uid)
+	g := upool.Gid2Group(gid)
+	dir.Uid = u.Name()
+	if dir.Uid == "" {
+		dir.Uid = "none"
+	}
+
+	dir.Gid = g.Name()
+	if dir.Gid == "" {
+		dir.Gid = "none"
+	}
+	dir.Muid = "none"
+	dir.Ext = ""
+	dir.Uidnum = uint32(u.Id())
+	dir.Gidnum = uint32(g.Id())
+	dir.Muidnum = ixp.NOUID
+	if d.Mode()&os.ModeSymlink != 0 {
+		var err error
+		dir.Ext, err = ufs.root.Readlink(path)
+		if err != nil {
+			dir.Ext = ""
+		}
+	} else if isBlock(d) {
+		dir.Ext = fmt.Sprintf("b %d %d", sysMode.Rdev>>24, sysMode.Rdev&0xFFFFFF)
+	} else if isChar(d) {
+		dir.Ext = fmt.Sprintf("c %d %d", sysMode.Rdev>>24, sysMode.Rdev&0xFFFFFF)
+	}
+}
+
+// Returns the name of the file name in the directory dir.
+func join(dir, name string) string {
+	if dir == "." {
+		return name
+	}
+
+	return dir + "/" + name
+}
+
+// Returns true if name can be used as a single path element.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+func (*Ufs) ConnOpened(conn *srv.Conn) {
+	if conn.Srv.Debuglevel > 0 {
+		conn.Slog.Info("connected")
+	}
+}
+
+func (*Ufs) ConnClosed(conn *srv.Conn) {
+	if conn.Srv.Debuglevel > 0 {
+		conn.Slog.Info("disconnected")
+	}
+}
+
+func (*Ufs) FidDestroy(sfid *srv.Fid) {
+	var fid *Fid
+
+	if sfid.Aux == nil {
+		return
+	}
+
+	fid = sfid.Aux.(*Fid)
+	if fid.file != nil {
+		fid.file.Close()
+	}
+}
+
+// Attaches to the root of the file server, or to the directory
+// named by aname, relative to the root.
+func (ufs *Ufs) Attach(req *srv.Req) {
+	if req.Afid != nil && req.Afid.Type&ixp.QTAUTH == 0 {
+		req.RespondError(srv.Enoauth)
+		return
+	}
+
+	tc := req.Tc
+	fid := new(Fid)
+	fid.path = path.Clean("/" + tc.Aname)[1:]
+	if fid.path == "" {
+		fid.path = "."
+	}
+
+	fid.root = fid.path
+	req.Fid.Aux = fid
+	st, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	qid := dir2Qid(st)
+	req.RespondRattach(qid)
+}
+
+func (*Ufs) Flush(req *srv.Req) {}
+
+func (ufs *Ufs) Walk(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+
+	_, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if req.Newfid.Aux == nil {
+		req.Newfid.Aux = new(Fid)
+	}
+
+	nfid := req.Newfid.Aux.(*Fid)
+	wqids := make([]ixp.Qid, len(tc.Wname))
+	path := fid.path
+	i := 0
+	for ; i < len(tc.Wname); i++ {
+		var p string
+		switch name := tc.Wname[i]; {
+		case name == "..":
+			p = path
+			if path != fid.root {
+				p = filepath.Dir(path)
+			}
+
+		case validName(name):
+			p = join(path, name)
+
+		default:
+			p = ""
+		}
+
+		var st os.FileInfo
+		var e error = os.ErrNotExist
+		if p != "" {
+			st, e = ufs.root.Lstat(p)
+		}
+
+		if e != nil {
+			if i == 0 {
+				req.RespondError(Enoent)
+				return
+			}
+
+			break
+		}
+
+		wqids[i] = *dir2Qid(st)
+		path = p
+	}
+
+	/* newfid may be fid, it's moved only if all names were walked */
+	if i == len(tc.Wname) {
+		nfid.root = fid.root
+		nfid.path = path
+	}
+
+	req.RespondRwalk(wqids[0:i])
+}
+
+func (ufs *Ufs) Open(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	st, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if ufs.ReadOnly && writable(tc.Mode) {
+		req.RespondError(Erofs)
+		return
+	}
+
+	var e error
+	fid.file, e = ufs.root.OpenFile(fid.path, omode2uflags(tc.Mode), 0)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRopen(dir2Qid(st), 0)
+}
+
+func (ufs *Ufs) Create(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	_, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if ufs.ReadOnly {
+		req.RespondError(Erofs)
+		return
+	}
+
+	if !validName(tc.Name) {
+		req.RespondError(&ixp.Error{"invalid file name", ixp.EINVAL})
+		return
+	}
+
+	path := join(fid.path, tc.Name)
+	var e error = nil
+	var file *os.File = nil
+	switch {
+	case tc.Perm&ixp.DMDIR != 0:
+		e = ufs.root.Mkdir(path, os.FileMode(tc.Perm&0777))
+
+	case tc.Perm&ixp.DMSYMLINK != 0:
+		e = ufs.root.Symlink(tc.Ext, path)
+
+	case tc.Perm&ixp.DMLINK != 0:
+		n, perr := strconv.ParseUint(tc.Ext, 10, 0)
+		if perr != nil {
+			e = perr
+			break
+		}
+
+		ofid := req.Conn.FidGet(uint32(n))
+		if ofid == nil {
+			req.RespondError(srv.Eunknownfid)
+			return
+		}
+
+		e = ufs.root.Link(ofid.Aux.(*Fid).path, path)
+		ofid.DecRef()
+
+	case tc.Perm&ixp.DMNAMEDPIPE != 0, tc.Perm&ixp.DMDEVICE != 0:
+		req.RespondError(&ixp.Error{"not implemented", ixp.EIO})
+		return
+
+	default:
+		var mode uint32 = tc.Perm & 0777
+		if req.Conn.Dotu() {
+			if tc.Perm&ixp.DMSETUID > 0 {
+				mode |= syscall.S_ISUID
+			}
+			if tc.Perm&ixp.DMSETGID > 0 {
+				mode |= syscall.S_ISGID
+			}
+		}
+		file, e = ufs.root.OpenFile(path, omode2uflags(tc.Mode)|os.O_CREATE|os.O_EXCL, os.FileMode(mode))
+	}
+
+	if file == nil && e == nil {
+		file, e = ufs.root.OpenFile(path, omode2uflags(tc.Mode), 0)
+	}
+
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	fid.path = path
+	fid.file = file
+	st, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRcreate(dir2Qid(st), 0)
+}
+
+func (ufs *Ufs) Read(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	rc := req.Rc
+	st, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	ixp.InitRread(rc, tc.Count)
+	var count int
+	var e error
+	if st.IsDir() {
+		b := rc.Data
+		if tc.Offset == 0 {
+			fid.file.Close()
+			fid.file, e = ufs.root.OpenFile(fid.path, omode2uflags(req.Fid.Omode), 0)
+			if e != nil {
+				req.RespondError(toError(e))
+				return
+			}
+			fid.dirs = nil
+		}
+
+		for len(b) > 0 {
+			if fid.dirs == nil {
+				fid.dirs, e = fid.file.Readdir(16)
+				if e != nil && e != io.EOF {
+					req.RespondError(toError(e))
+					return
+				}
+
+				if len(fid.dirs) == 0 {
+					break
+				}
+			}
+
+			var i int
+			for i = 0; i < len(fid.dirs); i++ {
+				path := join(fid.path, fid.dirs[i].Name())
+				st := ufs.dir2Dir(path, fid.dirs[i], req.Conn.Dotu(), req.Conn.Srv.Upool)
+				sz := ixp.PackDir(st, b, req.Conn.Dotu())
+				if sz == 0 {
+					break
+				}
+
+				b = b[sz:]
+				count += sz
+			}
+
+			if i < len(fid.dirs) {
+				fid.dirs = fid.dirs[i:]
+				break
+			} else {
+				fid.dirs = nil
+			}
+		}
+	} else {
+		count, e = fid.file.ReadAt(rc.Data, int64(tc.Offset))
+		if e != nil && e != io.EOF {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	ixp.SetRreadCount(rc, uint32(count))
+	req.Respond()
+}
+
+func (ufs *Ufs) Write(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	_, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if ufs.ReadOnly {
+		req.RespondError(Erofs)
+		return
+	}
+
+	n, e := fid.file.WriteAt(tc.Data, int64(tc.Offset))
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRwrite(uint32(n))
+}
+
+func (*Ufs) Clunk(req *srv.Req) { req.RespondRclunk() }
+
+func (ufs *Ufs) Remove(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	_, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if ufs.ReadOnly {
+		req.RespondError(Erofs)
+		return
+	}
+
+	if fid.path == "." {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	e := ufs.root.Remove(fid.path)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRremove()
+}
+
+func (ufs *Ufs) Stat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	st, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRstat(ufs.dir2Dir(fid.path, st, req.Conn.Dotu(), req.Conn.Srv.Upool))
+}
+
+func lookup(uid string, group bool) (uint32, *ixp.Error) {
+	if uid == "" {
+		return ixp.NOUID, nil
+	}
+	usr, e := user.Lookup(uid)
+	if e != nil {
+		return ixp.NOUID, toError(e)
+	}
+	conv := usr.Uid
+	if group {
+		conv = usr.Gid
+	}
+	u, e := strconv.Atoi(conv)
+	if e != nil {
+		return ixp.NOUID, toError(e)
+	}
+	return uint32(u), nil
+}
+
+func (ufs *Ufs) Wstat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	_, err := ufs.stat(fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if ufs.ReadOnly {
+		req.RespondError(Erofs)
+		return
+	}
+
+	dir := &req.Tc.Dir
+	if dir.Mode != 0xFFFFFFFF {
+		mode := dir.Mode & 0777
+		if req.Conn.Dotu() {
+			if dir.Mode&ixp.DMSETUID > 0 {
+				mode |= syscall.S_ISUID
+			}
+			if dir.Mode&ixp.DMSETGID > 0 {
+				mode |= syscall.S_ISGID
+			}
+		}
+		e := ufs.root.Chmod(fid.path, os.FileMode(mode))
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	uid, gid := ixp.NOUID, ixp.NOUID
+	if req.Conn.Dotu() {
+		uid = dir.Uidnum
+		gid = dir.Gidnum
+	}
+
+	// Try to find local uid, gid by name.
+	if (dir.Uid != "" || dir.Gid != "") && !req.Conn.Dotu() {
+		uid, err = lookup(dir.Uid, false)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+
+		// BUG(akumar): Lookup will never find gids
+		// corresponding to group names, because
+		// it only operates on user names.
+		gid, err = lookup(dir.Gid, true)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	if uid != ixp.NOUID || gid != ixp.NOUID {
+		huid, hgid := -1, -1
+		if uid != ixp.NOUID {
+			huid = ufs.hostUid(int(uid))
+		}
+		if gid != ixp.NOUID {
+			hgid = ufs.hostGid(int(gid))
+		}
+
+		e := ufs.root.Lchown(fid.path, huid, hgid)
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	if dir.Name != "" {
+		if !validName(dir.Name) || fid.path == "." {
+			req.RespondError(&ixp.Error{"invalid file name", ixp.EINVAL})
+			return
+		}
+
+		path := join(filepath.Dir(fid.path), dir.Name)
+		err := ufs.root.Rename(fid.path, path)
+		if err != nil {
+			req.RespondError(toError(err))
+			return
+		}
+		fid.path = path
+	}
+
+	if dir.Length != 0xFFFFFFFFFFFFFFFF {
+		f, e := ufs.root.OpenFile(fid.path, os.O_WRONLY, 0)
+		if e == nil {
+			e = f.Truncate(int64(dir.Length))
+			f.Close()
+		}
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	// If either mtime or atime need to be changed, then
+	// we must change both.
+	if dir.Mtime != ^uint32(0) || dir.Atime != ^uint32(0) {
+		mt, at := time.Unix(int64(dir.Mtime), 0), time.Unix(int64(dir.Atime), 0)
+		if cmt, cat := (dir.Mtime == ^uint32(0)), (dir.Atime == ^uint32(0)); cmt || cat {
+			st, e := ufs.root.Stat(fid.path)
+			if e != nil {
+				req.RespondError(toError(e))
+				return
+			}
+			switch cmt {
+			case true:
+				mt = st.ModTime()
+			default:
+				at = atime(st.Sys().(*syscall.Stat_t))
+			}
+		}
+		e := ufs.root.Chtimes(fid.path, at, mt)
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	req.RespondRwstat()
+}
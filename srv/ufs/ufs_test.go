@@ -0,0 +1,367 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs_test
+
+import (
+	"github.com/jsouthworth/ixp"
+	"github.com/jsouthworth/ixp/srv/srvtest"
+	"github.com/jsouthworth/ixp/srv/ufs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func newUfs(t *testing.T) *ufs.Ufs {
+	return serve(t, t.TempDir())
+}
+
+// Starts a file server that exports the root directory.
+func serve(t *testing.T, root string) *ufs.Ufs {
+	fs, err := ufs.New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+
+	fs.Dialect = ixp.Dialect9P2000L
+	if !fs.Start(fs) {
+		t.Fatal("Start failed")
+	}
+	return fs
+}
+
+func TestUfs(t *testing.T) {
+	srvtest.Run(t, newUfs(t), nil)
+}
+
+func TestUfsPlain(t *testing.T) {
+	srvtest.Run(t, newUfs(t), &srvtest.Config{Plain: true})
+}
+
+func TestUfsLinux(t *testing.T) {
+	srvtest.Run(t, newUfs(t), &srvtest.Config{Linux: true})
+}
+
+func TestUfsReadOnly(t *testing.T) {
+	fs := newUfs(t)
+	fs.ReadOnly = true
+	srvtest.Run(t, fs, &srvtest.Config{ReadOnly: true})
+}
+
+// Returns the errno of a 9P2000.L error.
+func errno(err error) syscall.Errno {
+	if e, ok := err.(*ixp.Error); ok {
+		return syscall.Errno(e.Errornum)
+	}
+
+	return 0
+}
+
+// The 9P2000.L operations change the exported tree.
+func TestUfsDotl(t *testing.T) {
+	fs := newUfs(t)
+	c, unmount, err := srvtest.Loopback(fs, &srvtest.Config{Linux: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmount()
+
+	if _, err := c.Mkdir(c.Root, "d", 0750, ixp.NOUID); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	d, err := c.FWalk("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Clunk(d)
+
+	f, err := c.FWalk("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Clunk(f)
+
+	if err := c.Lcreate(f, "f", ixp.LO_RDWR, 0640, ixp.NOUID); err != nil {
+		t.Fatalf("Lcreate: %v", err)
+	}
+
+	if n, err := c.Write(f, []byte("hello"), 0); n != 5 || err != nil {
+		t.Fatalf("Write: %d %v", n, err)
+	}
+
+	if err := c.Fsync(f, false); err != nil {
+		t.Errorf("Fsync: %v", err)
+	}
+
+	lk := &ixp.Flock{Type: ixp.LOCK_TYPE_WRLCK, ProcId: 1, ClientId: "test"}
+	if st, err := c.Flock(f, lk); st != ixp.LOCK_SUCCESS || err != nil {
+		t.Errorf("Flock: %d %v", st, err)
+	}
+
+	if l, err := c.Getlock(f, lk); err != nil || l.Type != ixp.LOCK_TYPE_UNLCK {
+		t.Errorf("Getlock: %v %v", l, err)
+	}
+
+	attr, err := c.Getattr(f, ixp.GETATTR_BASIC)
+	if err != nil || attr.Size != 5 || attr.Mode != ixp.S_IFREG|0640 {
+		t.Errorf("Getattr: %+v %v", attr, err)
+	}
+
+	sa := &ixp.SetAttr{Valid: ixp.SETATTR_MODE | ixp.SETATTR_SIZE, Mode: 0600, Size: 2}
+	if err := c.Setattr(f, sa); err != nil {
+		t.Errorf("Setattr: %v", err)
+	}
+
+	if st, err := os.Stat(filepath.Join(fs.Root, "d/f")); err != nil || st.Size() != 2 || st.Mode() != 0600 {
+		t.Errorf("the file after Setattr: %v %v", st, err)
+	}
+
+	if _, err := c.Symlink(d, "l", "f", ixp.NOUID); err != nil {
+		t.Errorf("Symlink: %v", err)
+	}
+
+	if l, err := c.FWalk("/d/l"); err != nil {
+		t.Errorf("walk to the symlink: %v", err)
+	} else {
+		if target, err := c.Readlink(l); target != "f" || err != nil {
+			t.Errorf("Readlink: %q %v", target, err)
+		}
+		c.Clunk(l)
+	}
+
+	if err := c.Link(d, f, "h"); err != nil {
+		t.Errorf("Link: %v", err)
+	}
+
+	if err := c.Renameat(d, "h", d, "i"); err != nil {
+		t.Errorf("Renameat: %v", err)
+	}
+
+	if err := c.Lopen(d, ixp.LO_RDONLY); err != nil {
+		t.Fatalf("Lopen: %v", err)
+	}
+
+	dirents, err := c.Readdir(d, 0, 8192)
+	if err != nil {
+		t.Fatalf("Readdir: %v", err)
+	}
+
+	var names []string
+	for _, de := range dirents {
+		names = append(names, de.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != ". .. f i l" {
+		t.Errorf("Readdir: %v", names)
+	}
+
+	/* the next read continues after the offset of an entry */
+	rest, err := c.Readdir(d, dirents[1].Offset, 8192)
+	if err != nil || len(rest) != len(dirents)-2 || rest[0].Name != dirents[2].Name {
+		t.Errorf("Readdir from offset %d: %v %v", dirents[1].Offset, rest, err)
+	}
+
+	if err := c.Unlinkat(d, "f", ixp.AT_REMOVEDIR); errno(err) != syscall.ENOTDIR {
+		t.Errorf("Unlinkat of a file with AT_REMOVEDIR: %v", err)
+	}
+
+	if err := c.Unlinkat(d, "i", 0); err != nil {
+		t.Errorf("Unlinkat: %v", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(fs.Root, "d/i")); !os.IsNotExist(err) {
+		t.Errorf("the file after Unlinkat: %v", err)
+	}
+
+	if st, err := c.Statfs(c.Root); err != nil || st.Bsize == 0 {
+		t.Errorf("Statfs: %+v %v", st, err)
+	}
+
+	x := c.FidAlloc()
+	if _, err := c.Xattrwalk(d, x, "user.x"); errno(err) != syscall.ENOSYS {
+		t.Errorf("Xattrwalk: %v", err)
+	}
+}
+
+// Creates the files used by the confinement tests: the exported
+// directory "root" with a file, a subdirectory and symlinks pointing
+// outside of it, and the file "secret" next to it.
+func confined(t *testing.T) (top string, fs *ufs.Ufs) {
+	top = t.TempDir()
+	root := filepath.Join(top, "root")
+	files := map[string]string{"secret": "secret", "root/f": "f", "root/sub/g": "g"}
+	for name, data := range files {
+		p := filepath.Join(top, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Symlink("/etc", filepath.Join(root, "etc")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("../secret", filepath.Join(root, "secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("..", filepath.Join(root, "up")); err != nil {
+		t.Fatal(err)
+	}
+
+	return top, serve(t, root)
+}
+
+// The clients can't reach the files outside of the exported tree.
+func TestUfsConfined(t *testing.T) {
+	top, fs := confined(t)
+	c, unmount, err := srvtest.Loopback(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmount()
+
+	/* ".." stops at the root */
+	fid := c.FidAlloc()
+	qids, err := c.Walk(c.Root, fid, []string{"..", "..", "sub", "..", ".."})
+	if err != nil || len(qids) != 5 {
+		t.Fatalf("walk of ..: %v %v", qids, err)
+	}
+
+	if qids[0] != c.Root.Qid || qids[1] != c.Root.Qid || qids[4] != c.Root.Qid {
+		t.Errorf("walk of .. past the root: %v, root %v", qids, c.Root.Qid)
+	}
+	c.Clunk(fid)
+
+	/* the symlinks pointing outside are neither walked through nor opened */
+	for _, name := range []string{"/etc/passwd", "/up/secret", "/up/root/f"} {
+		if fid, err := c.FWalk(name); err == nil {
+			t.Errorf("walk to %s succeeded", name)
+			c.Clunk(fid)
+		}
+	}
+
+	for _, name := range []string{"/etc", "/secret", "/up"} {
+		if f, err := c.FOpen(name, ixp.OREAD); err == nil {
+			buf := make([]byte, 64)
+			n, _ := f.Read(buf)
+			t.Errorf("open of %s succeeded, read %q", name, buf[0:n])
+			f.Close()
+		}
+	}
+
+	/* a file can't be renamed out of its directory */
+	fid, err = c.FWalk("/sub/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Clunk(fid)
+
+	for _, name := range []string{"../x", "../../x", ".."} {
+		nd := srvtest.NullDir()
+		nd.Name = name
+		if err := c.Wstat(fid, nd); err == nil {
+			t.Errorf("rename to %s succeeded", name)
+		}
+	}
+
+	for _, name := range []string{"root/x", "x", "root/sub/g"} {
+		_, err := os.Lstat(filepath.Join(top, name))
+		if exists := err == nil; exists != (name == "root/sub/g") {
+			t.Errorf("%s after the renames: %v", name, err)
+		}
+	}
+}
+
+// The attach names are resolved relative to the root.
+func TestUfsAname(t *testing.T) {
+	_, fs := confined(t)
+	for aname, want := range map[string]string{"../..": "f", "/..": "f", "sub/../..": "f", "sub": "g"} {
+		c, unmount, err := srvtest.Loopback(fs, &srvtest.Config{Aname: aname})
+		if err != nil {
+			t.Errorf("attach to %s: %v", aname, err)
+			continue
+		}
+
+		if _, err := c.FStat("/" + want); err != nil {
+			t.Errorf("attach to %s: stat of %s: %v", aname, want, err)
+		}
+
+		/* ".." stops at the attach point too */
+		if _, err := c.FStat("/../" + want); err != nil {
+			t.Errorf("attach to %s: stat of ../%s: %v", aname, want, err)
+		}
+
+		unmount()
+	}
+}
+
+// The read-only server rejects the requests that change the tree.
+func TestUfsReadOnlyChanges(t *testing.T) {
+	top, fs := confined(t)
+	c, unmount, err := srvtest.Loopback(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmount()
+
+	/* opened before the server became read-only */
+	f, err := c.FOpen("/f", ixp.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fs.ReadOnly = true
+	if _, err := f.Write([]byte("changed")); err == nil {
+		t.Error("write succeeded")
+	}
+
+	if f, err := c.FOpen("/f", ixp.OWRITE); err == nil {
+		t.Error("open for writing succeeded")
+		f.Close()
+	}
+
+	if f, err := c.FCreate("/new", 0644, ixp.OREAD); err == nil {
+		t.Error("create succeeded")
+		f.Close()
+	}
+
+	fid, err := c.FWalk("/sub/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Clunk(fid)
+
+	nd := srvtest.NullDir()
+	nd.Mode = 0600
+	if err := c.Wstat(fid, nd); err == nil {
+		t.Error("wstat succeeded")
+	}
+
+	if err := c.FRemove("/f"); err == nil {
+		t.Error("remove succeeded")
+	}
+
+	if data, err := os.ReadFile(filepath.Join(top, "root/f")); string(data) != "f" || err != nil {
+		t.Errorf("the file after the changes: %q %v", data, err)
+	}
+
+	if st, err := os.Stat(filepath.Join(top, "root/sub/g")); err != nil || st.Mode() != 0644 {
+		t.Errorf("the file after wstat: %v %v", st, err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(top, "root/new")); !os.IsNotExist(err) {
+		t.Errorf("the created file: %v", err)
+	}
+}
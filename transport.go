@@ -0,0 +1,200 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+import (
+	"bufio"
+	"io"
+	"net"
+)
+
+// The client and the server can run over any io.ReadWriteCloser that
+// delivers the 9P messages in order, such as a net.Conn, a pipe, the
+// standard input and output of a process, or a serial device. If the
+// transport also implements the AddrTransport interface, the addresses
+// are used for identifying the connection in the logs and the stats.
+type AddrTransport interface {
+	io.ReadWriteCloser
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// The Addr type describes the address of a transport that is
+// not a network connection.
+type Addr struct {
+	Net  string // name of the transport, for example "pipe" or "stdio"
+	Name string // address, for example the name of the command or device
+}
+
+func (a *Addr) Network() string { return a.Net }
+
+func (a *Addr) String() string { return a.Name }
+
+// The stream type joins a reader and a writer into a transport.
+type stream struct {
+	io.ReadCloser
+	w             io.WriteCloser
+	local, remote net.Addr
+}
+
+// Creates a transport that reads from r and writes to w, for example
+// os.Stdin and os.Stdout, or the pipes of a subprocess. Close closes
+// both w and r. The local and remote addresses can be nil.
+func NewStream(r io.ReadCloser, w io.WriteCloser, local, remote net.Addr) AddrTransport {
+	return &stream{r, w, local, remote}
+}
+
+func (s *stream) Write(buf []byte) (int, error) {
+	return s.w.Write(buf)
+}
+
+func (s *stream) Close() error {
+	err := s.w.Close()
+	if e := s.ReadCloser.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+func (s *stream) LocalAddr() net.Addr { return s.local }
+
+func (s *stream) RemoteAddr() net.Addr { return s.remote }
+
+// Returns the remote address of the transport as string, or def if
+// the address isn't known.
+func RemoteAddr(c io.ReadWriteCloser, def string) string {
+	if ac, ok := c.(AddrTransport); ok && ac.RemoteAddr() != nil {
+		return ac.RemoteAddr().String()
+	}
+
+	return def
+}
+
+// The FcallReader type reads 9P messages from a transport directly into
+// the buffers of the caller's Fcalls. Small messages are read in bulk,
+// the big ones (Twrite, Rread) without additional copies.
+type FcallReader struct {
+	r *bufio.Reader
+}
+
+// Creates a reader for the messages received over r.
+func NewFcallReader(r io.Reader) *FcallReader {
+	return &FcallReader{bufio.NewReaderSize(r, 8192)}
+}
+
+// Reads the next message into fc, reusing fc.Buf, and unpacks it (see
+// UnpackInto). Returns an UnpackError if the message is malformed or
+// bigger than msize, or the error returned by the transport.
+func (fr *FcallReader) ReadFcall(fc *Fcall, msize uint32, dotu bool) error {
+	return fr.ReadFcallData(fc, msize, dotu, nil)
+}
+
+// Same as ReadFcall, but the data of the Rread messages is read
+// directly into the buffer returned by data for the tag of the message,
+// instead of fc.Buf. If data returns nil, or the buffer is too small,
+// the message is read into fc.Buf.
+func (fr *FcallReader) ReadFcallData(fc *Fcall, msize uint32, dotu bool, data func(tag uint16) []byte) error {
+	var hdr [11]byte /* size[4] id[1] tag[2] count[4] */
+
+	_, err := io.ReadFull(fr.r, hdr[0:7])
+	if err != nil {
+		return err
+	}
+
+	sz, _ := gint32(hdr[:])
+	if sz < 7 || sz > msize {
+		return &UnpackError{hdr[4], "size", 0, Ebadsize}
+	}
+
+	n := 7
+	if hdr[4] == Rread && sz >= 11 && data != nil {
+		tag, _ := gint16(hdr[5:])
+		if b := data(tag); b != nil && uint32(len(b)) >= sz-11 {
+			_, err = io.ReadFull(fr.r, hdr[7:11])
+			if err != nil {
+				return err
+			}
+
+			n = 11
+			count, _ := gint32(hdr[7:])
+			if count == sz-11 {
+				return fr.readData(fc, hdr[:], b[0:count])
+			}
+		}
+	}
+
+	if uint32(cap(fc.Buf)) < sz {
+		fc.Buf = make([]byte, sz)
+	}
+
+	buf := fc.Buf[0:sz]
+	copy(buf, hdr[0:n])
+	_, err = io.ReadFull(fr.r, buf[n:])
+	if err != nil {
+		return err
+	}
+
+	_, err = UnpackInto(fc, buf, dotu)
+	return err
+}
+
+// Reads the data of a Rread message into b. Only the header is
+// kept in fc.Buf, so fc.Pkt is shorter than fc.Size.
+func (fr *FcallReader) readData(fc *Fcall, hdr []byte, b []byte) error {
+	_, err := io.ReadFull(fr.r, b)
+	if err != nil {
+		return err
+	}
+
+	if cap(fc.Buf) < len(hdr) {
+		fc.Buf = make([]byte, len(hdr))
+	}
+
+	*fc = Fcall{Buf: fc.Buf}
+	fc.Fid = NOFID
+	fc.Afid = NOFID
+	fc.Newfid = NOFID
+	fc.Dfid = NOFID
+	fc.Pkt = fc.Buf[0:len(hdr)]
+	copy(fc.Pkt, hdr)
+
+	p := hdr
+	fc.Size, p = gint32(p)
+	fc.Type, p = gint8(p)
+	fc.Tag, p = gint16(p)
+	fc.Count, p = gint32(p)
+	fc.Data = b
+	return nil
+}
+
+// The FcallWriter type writes 9P messages to a transport. If the
+// message has a Payload, the header and the payload are written
+// separately, using writev if the transport supports it (see
+// net.Buffers), so the payload is never copied.
+type FcallWriter struct {
+	w    io.Writer
+	iov  [2][]byte
+	bufs net.Buffers
+}
+
+// Creates a writer for the messages sent over w.
+func NewFcallWriter(w io.Writer) *FcallWriter {
+	return &FcallWriter{w: w}
+}
+
+// Writes the message. Returns the error returned by the transport.
+func (fw *FcallWriter) WriteFcall(fc *Fcall) error {
+	if len(fc.Payload) == 0 {
+		_, err := fw.w.Write(fc.Pkt)
+		return err
+	}
+
+	fw.iov[0], fw.iov[1] = fc.Pkt, fc.Payload
+	fw.bufs = fw.iov[:]
+	_, err := fw.bufs.WriteTo(fw.w)
+	fw.iov[0], fw.iov[1] = nil, nil
+	return err
+}
@@ -8,218 +8,539 @@ import (
 	"fmt"
 )
 
+// Errors returned in the Err field of UnpackError.
+var (
+	Eshort    = &Error{"buffer too short", EINVAL}             // the buffer is shorter than the message
+	Ebadsize  = &Error{"invalid message size", EINVAL}         // size[4] is too small for the message type
+	Ebadid    = &Error{"invalid message id", EINVAL}           // unknown message type
+	Eoverflow = &Error{"field overflows the message", EINVAL}  // a field doesn't fit in the message
+	Ebadcount = &Error{"invalid count", EINVAL}                // a count doesn't match the data that follows it
+	Eextra    = &Error{"extra data after the message", EINVAL} // size[4] is bigger than the fields of the message
+)
+
+// The UnpackError type describes a malformed message or directory
+// entry. Unpack, UnpackInto, UnpackDir and UnpackDirent return it for
+// all malformed input, the caller can check the kind of the error with
+// errors.Is(err, ixp.Eoverflow) etc.
+type UnpackError struct {
+	Type   uint8  // type of the message, 0 for directory entries
+	Field  string // name of the malformed field, e.g. "wname" or "stat.uid"
+	Offset int    // offset of the field from the start of the buffer
+	Err    *Error // one of Eshort, Ebadsize, Ebadid, Eoverflow, Ebadcount or Eextra
+}
+
+func (e *UnpackError) Error() string {
+	name := "dir"
+	if e.Type != 0 {
+		name = TypeName(e.Type)
+	}
+
+	return fmt.Sprintf("%s: %s: %s at offset %d", name, e.Err.Err, e.Field, e.Offset)
+}
+
+func (e *UnpackError) Unwrap() error { return e.Err }
+
+// The decoder type reads the fields of a message or a directory
+// entry, checking that they fit in the buffer. After the first
+// malformed field, err is set and all reads return zero values.
+type decoder struct {
+	p   []byte // fields not read yet
+	off int    // offset of p from the start of the buffer
+	typ uint8
+	err *UnpackError
+}
+
+func (dec *decoder) fail(field string, e *Error) {
+	if dec.err == nil {
+		dec.err = &UnpackError{dec.typ, field, dec.off, e}
+	}
+
+	dec.p = nil
+}
+
+// Returns the next n bytes, or nil if they don't fit.
+func (dec *decoder) next(field string, n int) []byte {
+	if dec.err != nil {
+		return nil
+	}
+
+	if n > len(dec.p) {
+		dec.fail(field, Eoverflow)
+		return nil
+	}
+
+	b := dec.p[0:n]
+	dec.p = dec.p[n:]
+	dec.off += n
+	return b
+}
+
+func (dec *decoder) u8(field string) uint8 {
+	if b := dec.next(field, 1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (dec *decoder) u16(field string) uint16 {
+	if b := dec.next(field, 2); b != nil {
+		v, _ := gint16(b)
+		return v
+	}
+
+	return 0
+}
+
+func (dec *decoder) u32(field string) uint32 {
+	if b := dec.next(field, 4); b != nil {
+		v, _ := gint32(b)
+		return v
+	}
+
+	return 0
+}
+
+func (dec *decoder) u64(field string) uint64 {
+	if b := dec.next(field, 8); b != nil {
+		v, _ := gint64(b)
+		return v
+	}
+
+	return 0
+}
+
+func (dec *decoder) str(field string) string {
+	n := dec.u16(field)
+	return string(dec.next(field, int(n)))
+}
+
+func (dec *decoder) qid(field string, qid *Qid) {
+	qid.Type = dec.u8(field)
+	qid.Version = dec.u32(field)
+	qid.Path = dec.u64(field)
+}
+
+// Returns count bytes of data. The data is not copied.
+func (dec *decoder) data(field string, count uint32) []byte {
+	if dec.err == nil && uint64(count) > uint64(len(dec.p)) {
+		dec.fail(field, Ebadcount)
+	}
+
+	return dec.next(field, int(count))
+}
+
+// Checks that there are at least n fields of sz bytes left, so the
+// slices for the fields can be allocated.
+func (dec *decoder) fits(field string, n, sz int) bool {
+	if dec.err == nil && n*sz > len(dec.p) {
+		dec.fail(field, Ebadcount)
+	}
+
+	return dec.err == nil
+}
+
+// Reads a directory entry. The fields must fit in the size of the
+// entry, the bytes after them up to the size are ignored.
+func (dec *decoder) stat(d *Dir, dotu bool) {
+	d.Size = dec.u16("stat.size")
+	b := dec.next("stat.size", int(d.Size))
+	if dec.err != nil {
+		return
+	}
+
+	rest, end := dec.p, dec.off
+	dec.p, dec.off = b, end-len(b)
+	d.Type = dec.u16("stat.type")
+	d.Dev = dec.u32("stat.dev")
+	dec.qid("stat.qid", &d.Qid)
+	d.Mode = dec.u32("stat.mode")
+	d.Atime = dec.u32("stat.atime")
+	d.Mtime = dec.u32("stat.mtime")
+	d.Length = dec.u64("stat.length")
+	d.Name = dec.str("stat.name")
+	d.Uid = dec.str("stat.uid")
+	d.Gid = dec.str("stat.gid")
+	d.Muid = dec.str("stat.muid")
+	if dotu {
+		d.Ext = dec.str("stat.extension")
+		d.Uidnum = dec.u32("stat.n_uid")
+		d.Gidnum = dec.u32("stat.n_gid")
+		d.Muidnum = dec.u32("stat.n_muid")
+	} else {
+		d.Uidnum = NOUID
+		d.Gidnum = NOUID
+		d.Muidnum = NOUID
+	}
+
+	if dec.err == nil {
+		dec.p, dec.off = rest, end
+	}
+}
+
 // Creates a Fcall value from the on-the-wire representation. If
 // dotu is true, reads 9P2000.u messages. Returns the unpacked message,
 // error and how many bytes from the buffer were used by the message.
+// The error is an UnpackError if the message is malformed.
 func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
-	var m uint16
+	fc = new(Fcall)
+	fcsz, err = UnpackInto(fc, buf, dotu)
+	if err != nil {
+		return nil, err, 0
+	}
+
+	return fc, nil, fcsz
+}
 
+// Same as Unpack, but decodes the message into the caller's Fcall,
+// so the Fcalls can be reused. All fields of fc, except Buf, are
+// overwritten. The strings are copied, but Pkt and Data point to buf.
+// Returns how many bytes from the buffer were used by the message.
+func UnpackInto(fc *Fcall, buf []byte, dotu bool) (fcsz int, err error) {
 	if len(buf) < 7 {
-		return nil, &Error{"buffer too short", EINVAL}, 0
+		return 0, &UnpackError{0, "size", 0, Eshort}
 	}
 
-	fc = new(Fcall)
+	*fc = Fcall{Buf: fc.Buf}
 	fc.Fid = NOFID
 	fc.Afid = NOFID
 	fc.Newfid = NOFID
+	fc.Dfid = NOFID
 
-	p := buf
-	fc.Size, p = gint32(p)
-	fc.Type, p = gint8(p)
-	fc.Tag, p = gint16(p)
-
-	if int(fc.Size) > len(buf) || fc.Size < 7 {
-		return nil, &Error{fmt.Sprintf("buffer too short: %d expected %d",
-				len(buf), fc.Size),
-				EINVAL},
-			0
+	fc.Size, _ = gint32(buf)
+	fc.Type = buf[4]
+	fc.Tag, _ = gint16(buf[5:])
+	if fc.Size < 7 {
+		return 0, &UnpackError{fc.Type, "size", 0, Ebadsize}
 	}
 
-	p = p[0 : fc.Size-7]
-	fc.Pkt = buf[0:fc.Size]
-	fcsz = int(fc.Size)
-	if fc.Type < Tversion || fc.Type >= Tlast {
-		return nil, &Error{"invalid id", EINVAL}, 0
+	if uint64(fc.Size) > uint64(len(buf)) {
+		return 0, &UnpackError{fc.Type, "size", 0, Eshort}
 	}
 
 	var sz uint32
-	if dotu {
-		sz = minFcsize[fc.Type-Tversion]
-	} else {
-		sz = minFcusize[fc.Type-Tversion]
+	var ok bool
+	if fc.Type < Tversion {
+		/* 9P2000.L message */
+		sz, ok = minFclsize[fc.Type]
+	} else if fc.Type < Tblast {
+		ok = true
+		if dotu {
+			sz = minFcusize[fc.Type-Tversion]
+		} else {
+			sz = minFcsize[fc.Type-Tversion]
+		}
 	}
 
-	if fc.Size < sz {
-		goto szerror
+	if !ok {
+		return 0, &UnpackError{fc.Type, "type", 4, Ebadid}
 	}
 
-	err = nil
+	if fc.Size-7 < sz {
+		return 0, &UnpackError{fc.Type, "size", 0, Ebadsize}
+	}
+
+	fc.Pkt = buf[0:fc.Size]
+	dec := &decoder{p: buf[7:fc.Size], off: 7, typ: fc.Type}
 	switch fc.Type {
 	default:
-		return nil, &Error{"invalid message id", EINVAL}, 0
+		return 0, &UnpackError{fc.Type, "type", 4, Ebadid}
 
 	case Tversion, Rversion:
-		fc.Msize, p = gint32(p)
-		fc.Version, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
+		fc.Msize = dec.u32("msize")
+		fc.Version = dec.str("version")
 
 	case Tauth:
-		fc.Afid, p = gint32(p)
-		fc.Uname, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
-
-		fc.Aname, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
-
-		if dotu {
-			if len(p) > 0 {
-				fc.Unamenum, p = gint32(p)
-			} else {
-				fc.Unamenum = NOUID
-			}
-		} else {
-			fc.Unamenum = NOUID
+		fc.Afid = dec.u32("afid")
+		fc.Uname = dec.str("uname")
+		fc.Aname = dec.str("aname")
+		fc.Unamenum = NOUID
+		if dotu && len(dec.p) > 0 {
+			fc.Unamenum = dec.u32("n_uname")
 		}
 
 	case Rauth, Rattach:
-		p = gqid(p, &fc.Qid)
+		dec.qid("qid", &fc.Qid)
 
 	case Tflush:
-		fc.Oldtag, p = gint16(p)
+		fc.Oldtag = dec.u16("oldtag")
 
 	case Tattach:
-		fc.Fid, p = gint32(p)
-		fc.Afid, p = gint32(p)
-		fc.Uname, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
-
-		fc.Aname, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
-
+		fc.Fid = dec.u32("fid")
+		fc.Afid = dec.u32("afid")
+		fc.Uname = dec.str("uname")
+		fc.Aname = dec.str("aname")
 		if dotu {
-			if len(p) > 0 {
-				fc.Unamenum, p = gint32(p)
-			} else {
-				fc.Unamenum = NOUID
+			fc.Unamenum = NOUID
+			if len(dec.p) > 0 {
+				fc.Unamenum = dec.u32("n_uname")
 			}
 		}
 
 	case Rerror:
-		fc.Error, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
+		fc.Error = dec.str("ename")
 		if dotu {
-			fc.Errornum, p = gint32(p)
-		} else {
-			fc.Errornum = 0
+			fc.Errornum = dec.u32("errno")
 		}
 
 	case Twalk:
-		fc.Fid, p = gint32(p)
-		fc.Newfid, p = gint32(p)
-		m, p = gint16(p)
-		fc.Wname = make([]string, m)
-		for i := 0; i < int(m); i++ {
-			fc.Wname[i], p = gstr(p)
-			if p == nil {
-				goto szerror
+		fc.Fid = dec.u32("fid")
+		fc.Newfid = dec.u32("newfid")
+		m := int(dec.u16("nwname"))
+		if dec.fits("nwname", m, 2) {
+			fc.Wname = make([]string, m)
+			for i := 0; i < m; i++ {
+				fc.Wname[i] = dec.str("wname")
 			}
 		}
 
 	case Rwalk:
-		m, p = gint16(p)
-		fc.Wqid = make([]Qid, m)
-		for i := 0; i < int(m); i++ {
-			p = gqid(p, &fc.Wqid[i])
+		m := int(dec.u16("nwqid"))
+		if dec.fits("nwqid", m, 13) {
+			fc.Wqid = make([]Qid, m)
+			for i := 0; i < m; i++ {
+				dec.qid("wqid", &fc.Wqid[i])
+			}
 		}
 
 	case Topen:
-		fc.Fid, p = gint32(p)
-		fc.Mode, p = gint8(p)
+		fc.Fid = dec.u32("fid")
+		fc.Mode = dec.u8("mode")
 
-	case Ropen, Rcreate:
-		p = gqid(p, &fc.Qid)
-		fc.Iounit, p = gint32(p)
+	case Ropen, Rcreate, Rlopen, Rlcreate:
+		dec.qid("qid", &fc.Qid)
+		fc.Iounit = dec.u32("iounit")
 
 	case Tcreate:
-		fc.Fid, p = gint32(p)
-		fc.Name, p = gstr(p)
-		if p == nil {
-			goto szerror
-		}
-		fc.Perm, p = gint32(p)
-		fc.Mode, p = gint8(p)
+		fc.Fid = dec.u32("fid")
+		fc.Name = dec.str("name")
+		fc.Perm = dec.u32("perm")
+		fc.Mode = dec.u8("mode")
 		if dotu {
-			fc.Ext, p = gstr(p)
-			if p == nil {
-				goto szerror
-			}
+			fc.Ext = dec.str("extension")
 		}
 
 	case Tread:
-		fc.Fid, p = gint32(p)
-		fc.Offset, p = gint64(p)
-		fc.Count, p = gint32(p)
-
-	case Rread:
-		fc.Count, p = gint32(p)
-		if len(p) < int(fc.Count) {
-			goto szerror
-		}
-		fc.Data = p
-		p = p[fc.Count:]
+		fc.Fid = dec.u32("fid")
+		fc.Offset = dec.u64("offset")
+		fc.Count = dec.u32("count")
+
+	case Rread, Rbread, Rreaddir:
+		fc.Count = dec.u32("count")
+		fc.Data = dec.data("data", fc.Count)
 
 	case Twrite:
-		fc.Fid, p = gint32(p)
-		fc.Offset, p = gint64(p)
-		fc.Count, p = gint32(p)
-		if len(p) != int(fc.Count) {
-			fc.Data = make([]byte, fc.Count)
-			copy(fc.Data, p)
-			p = p[len(p):]
-		} else {
-			fc.Data = p
-			p = p[fc.Count:]
-		}
+		fc.Fid = dec.u32("fid")
+		fc.Offset = dec.u64("offset")
+		fc.Count = dec.u32("count")
+		fc.Data = dec.data("data", fc.Count)
 
-	case Rwrite:
-		fc.Count, p = gint32(p)
+	case Rwrite, Rbwrite:
+		fc.Count = dec.u32("count")
 
-	case Tclunk, Tremove, Tstat:
-		fc.Fid, p = gint32(p)
+	case Tclunk, Tremove, Tstat, Tstatfs, Treadlink:
+		fc.Fid = dec.u32("fid")
 
 	case Rstat:
-		m, p = gint16(p)
-		p = gstat(p, &fc.Dir, dotu)
-		if p == nil {
-			goto szerror
+		n := dec.u16("n")
+		dec.stat(&fc.Dir, dotu)
+		if dec.err == nil && int(n) != int(fc.Dir.Size)+2 {
+			dec.fail("n", Ebadcount)
 		}
 
 	case Twstat:
-		fc.Fid, p = gint32(p)
-		m, p = gint16(p)
-		p = gstat(p, &fc.Dir, dotu)
+		fc.Fid = dec.u32("fid")
+		n := dec.u16("n")
+		dec.stat(&fc.Dir, dotu)
+		if dec.err == nil && int(n) != int(fc.Dir.Size)+2 {
+			dec.fail("n", Ebadcount)
+		}
 
 	case Rflush, Rclunk, Rremove, Rwstat:
+
+	/* IX block messages */
+	case Tbread, Tbtrunc:
+		fc.Fileid = dec.u64("fileid")
+		fc.Offset = dec.u64("offset")
+		if fc.Type == Tbread {
+			fc.Count = dec.u32("count")
+		}
+
+	case Tbwrite:
+		fc.Fileid = dec.u64("fileid")
+		fc.Offset = dec.u64("offset")
+		fc.Count = dec.u32("count")
+		fc.Data = dec.data("data", fc.Count)
+
+	case Rbtrunc:
+
+	/* 9P2000.L messages */
+	case Rlerror:
+		fc.Errornum = dec.u32("ecode")
+
+	case Rstatfs:
+		fc.Statfs.Type = dec.u32("type")
+		fc.Statfs.Bsize = dec.u32("bsize")
+		fc.Statfs.Blocks = dec.u64("blocks")
+		fc.Statfs.Bfree = dec.u64("bfree")
+		fc.Statfs.Bavail = dec.u64("bavail")
+		fc.Statfs.Files = dec.u64("files")
+		fc.Statfs.Ffree = dec.u64("ffree")
+		fc.Statfs.Fsid = dec.u64("fsid")
+		fc.Statfs.Namelen = dec.u32("namelen")
+
+	case Tlopen:
+		fc.Fid = dec.u32("fid")
+		fc.Flags = dec.u32("flags")
+
+	case Tlcreate:
+		fc.Fid = dec.u32("fid")
+		fc.Name = dec.str("name")
+		fc.Flags = dec.u32("flags")
+		fc.Perm = dec.u32("mode")
+		fc.Lgid = dec.u32("gid")
+
+	case Tsymlink:
+		fc.Fid = dec.u32("fid")
+		fc.Name = dec.str("name")
+		fc.Target = dec.str("symtgt")
+		fc.Lgid = dec.u32("gid")
+
+	case Rsymlink, Rmknod, Rmkdir:
+		dec.qid("qid", &fc.Qid)
+
+	case Tmknod:
+		fc.Fid = dec.u32("dfid")
+		fc.Name = dec.str("name")
+		fc.Perm = dec.u32("mode")
+		fc.Major = dec.u32("major")
+		fc.Minor = dec.u32("minor")
+		fc.Lgid = dec.u32("gid")
+
+	case Trename:
+		fc.Fid = dec.u32("fid")
+		fc.Dfid = dec.u32("dfid")
+		fc.Name = dec.str("name")
+
+	case Rreadlink:
+		fc.Target = dec.str("target")
+
+	case Tgetattr:
+		fc.Fid = dec.u32("fid")
+		fc.Mask = dec.u64("request_mask")
+
+	case Rgetattr:
+		fc.Attr.Valid = dec.u64("valid")
+		dec.qid("qid", &fc.Attr.Qid)
+		fc.Attr.Mode = dec.u32("mode")
+		fc.Attr.Uid = dec.u32("uid")
+		fc.Attr.Gid = dec.u32("gid")
+		fc.Attr.Nlink = dec.u64("nlink")
+		fc.Attr.Rdev = dec.u64("rdev")
+		fc.Attr.Size = dec.u64("size")
+		fc.Attr.Blksize = dec.u64("blksize")
+		fc.Attr.Blocks = dec.u64("blocks")
+		fc.Attr.AtimeSec = dec.u64("atime")
+		fc.Attr.AtimeNsec = dec.u64("atime")
+		fc.Attr.MtimeSec = dec.u64("mtime")
+		fc.Attr.MtimeNsec = dec.u64("mtime")
+		fc.Attr.CtimeSec = dec.u64("ctime")
+		fc.Attr.CtimeNsec = dec.u64("ctime")
+		fc.Attr.BtimeSec = dec.u64("btime")
+		fc.Attr.BtimeNsec = dec.u64("btime")
+		fc.Attr.Gen = dec.u64("gen")
+		fc.Attr.DataVersion = dec.u64("data_version")
+
+	case Tsetattr:
+		fc.Fid = dec.u32("fid")
+		fc.SetAttr.Valid = dec.u32("valid")
+		fc.SetAttr.Mode = dec.u32("mode")
+		fc.SetAttr.Uid = dec.u32("uid")
+		fc.SetAttr.Gid = dec.u32("gid")
+		fc.SetAttr.Size = dec.u64("size")
+		fc.SetAttr.AtimeSec = dec.u64("atime")
+		fc.SetAttr.AtimeNsec = dec.u64("atime")
+		fc.SetAttr.MtimeSec = dec.u64("mtime")
+		fc.SetAttr.MtimeNsec = dec.u64("mtime")
+
+	case Txattrwalk:
+		fc.Fid = dec.u32("fid")
+		fc.Newfid = dec.u32("newfid")
+		fc.Name = dec.str("name")
+
+	case Rxattrwalk:
+		fc.Xattrsize = dec.u64("size")
+
+	case Txattrcreate:
+		fc.Fid = dec.u32("fid")
+		fc.Name = dec.str("name")
+		fc.Xattrsize = dec.u64("attr_size")
+		fc.Flags = dec.u32("flags")
+
+	case Treaddir:
+		fc.Fid = dec.u32("fid")
+		fc.Offset = dec.u64("offset")
+		fc.Count = dec.u32("count")
+
+	case Tfsync:
+		fc.Fid = dec.u32("fid")
+		fc.Datasync = dec.u32("datasync")
+
+	case Tlock:
+		fc.Fid = dec.u32("fid")
+		fc.Flock.Type = dec.u8("type")
+		fc.Flock.Flags = dec.u32("flags")
+		fc.Flock.Start = dec.u64("start")
+		fc.Flock.Length = dec.u64("length")
+		fc.Flock.ProcId = dec.u32("proc_id")
+		fc.Flock.ClientId = dec.str("client_id")
+
+	case Rlock:
+		fc.Status = dec.u8("status")
+
+	case Tgetlock:
+		fc.Fid = dec.u32("fid")
+		fallthrough
+
+	case Rgetlock:
+		fc.Flock.Type = dec.u8("type")
+		fc.Flock.Start = dec.u64("start")
+		fc.Flock.Length = dec.u64("length")
+		fc.Flock.ProcId = dec.u32("proc_id")
+		fc.Flock.ClientId = dec.str("client_id")
+
+	case Tlink:
+		fc.Dfid = dec.u32("dfid")
+		fc.Fid = dec.u32("fid")
+		fc.Name = dec.str("name")
+
+	case Tmkdir:
+		fc.Fid = dec.u32("dfid")
+		fc.Name = dec.str("name")
+		fc.Perm = dec.u32("mode")
+		fc.Lgid = dec.u32("gid")
+
+	case Trenameat:
+		fc.Fid = dec.u32("olddirfid")
+		fc.Name = dec.str("oldname")
+		fc.Dfid = dec.u32("newdirfid")
+		fc.Newname = dec.str("newname")
+
+	case Tunlinkat:
+		fc.Fid = dec.u32("dirfd")
+		fc.Name = dec.str("name")
+		fc.Flags = dec.u32("flags")
+
+	case Rrename, Rsetattr, Rxattrcreate, Rfsync, Rlink, Rrenameat, Runlinkat:
 	}
 
-	if len(p) > 0 {
-		goto szerror
+	if dec.err == nil && len(dec.p) > 0 {
+		dec.fail("size", Eextra)
 	}
 
-	return
+	if dec.err != nil {
+		return 0, dec.err
+	}
 
-szerror:
-	return nil, &Error{"invalid size", EINVAL}, 0
+	return int(fc.Size), nil
 }
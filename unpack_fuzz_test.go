@@ -0,0 +1,372 @@
+// Copyright 2009 The Go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ixp
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The fuzz targets for the decoding of the messages and the directory
+// entries check that malformed input is rejected with an UnpackError
+// instead of a panic, and that the accepted input survives a
+// Pack/Unpack round trip. They run on the seeds with go test, and can
+// be fuzzed with go test -fuzz FuzzUnpack.
+
+var seedDir = Dir{Type: 1, Dev: 2, Qid: Qid{QTFILE, 3, 4}, Mode: 0644, Atime: 5,
+	Mtime: 6, Length: 7, Name: "name", Uid: "uid", Gid: "gid",
+	Muid: "muid", Ext: "ext", Uidnum: 8, Gidnum: 9, Muidnum: 10}
+
+// Adds a packed message of each type, in both dialects, to the seed
+// corpus of f.
+func addMessageSeeds(f *testing.F) {
+	d := seedDir
+	tc := Fcall{Fid: 1, Afid: 2, Newfid: 3, Dfid: 4, Msize: MSIZE,
+		Version: "9P2000", Oldtag: 5, Error: "error", Errornum: EINVAL,
+		Qid: d.Qid, Iounit: 8192, Uname: "user", Aname: "aname",
+		Unamenum: 6, Perm: 0755, Mode: ORDWR, Name: "name",
+		Newname: "newname", Ext: "ext", Target: "target",
+		Wname: []string{"a", "b"}, Wqid: []Qid{d.Qid, d.Qid},
+		Offset: 7, Fileid: 8, Count: 4, Data: []byte("data"), Dir: d,
+		Flags: 9, Lgid: 10, Major: 11, Minor: 12, Mask: 13,
+		Xattrsize: 14, Datasync: 1, Status: 1}
+	tc.Attr.Qid = d.Qid
+	tc.Flock.ClientId = "client"
+
+	for t := range typeNames {
+		for _, dotu := range []bool{false, true} {
+			fc := NewFcall(MSIZE)
+			tc.Type = t
+			if repack(fc, &tc, dotu) == nil {
+				f.Add(append([]byte(nil), fc.Pkt...), dotu)
+			}
+		}
+	}
+
+	f.Add([]byte{}, false)
+	f.Add([]byte{7, 0, 0, 0, Tversion, 0, 0}, false)
+}
+
+// Checks that Unpack doesn't panic, and that the accepted messages
+// are decoded the same way again from the bytes they use.
+func FuzzUnpack(f *testing.F) {
+	addMessageSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte, dotu bool) {
+		fc, err, sz := Unpack(data, dotu)
+		if err != nil {
+			if _, ok := err.(*UnpackError); !ok {
+				t.Fatalf("error %v is not an UnpackError", err)
+			}
+
+			return
+		}
+
+		if sz != int(fc.Size) || sz > len(data) || len(fc.Pkt) != sz {
+			t.Fatalf("%v: used %d bytes of %d, size %d", fc, sz, len(data), fc.Size)
+		}
+
+		fc2, err, _ := Unpack(data[0:sz], dotu)
+		if err != nil {
+			t.Fatalf("%v: can't unpack the used bytes: %v", fc, err)
+		}
+
+		if !sameFcall(fc, fc2) {
+			t.Fatalf("unpacked %v, then %v", fc, fc2)
+		}
+	})
+}
+
+// Checks that the accepted messages are packed again by the Pack
+// function of their type, and that the result is unpacked to the same
+// message.
+func FuzzRoundTrip(f *testing.F) {
+	addMessageSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte, dotu bool) {
+		fc, err, _ := Unpack(data, dotu)
+		if err != nil {
+			return
+		}
+
+		pc := NewFcall(fc.Size + 4096)
+		err = repack(pc, fc, dotu)
+		if err != nil {
+			if fc.Type == Rreaddir {
+				/* the data is not a list of directory entries */
+				return
+			}
+
+			t.Fatalf("%v: can't pack: %v", fc, err)
+		}
+
+		fc2, err, _ := Unpack(pc.Pkt, dotu)
+		if err != nil {
+			t.Fatalf("%v: can't unpack the packed message: %v", fc, err)
+		}
+
+		if !sameFcall(fc, fc2) {
+			t.Fatalf("unpacked %v, packed and unpacked %v", fc, fc2)
+		}
+	})
+}
+
+// Checks that UnpackDir doesn't panic, that the entry fits in the
+// buffer, and that the accepted entries survive a PackDir/UnpackDir
+// round trip.
+func FuzzUnpackDir(f *testing.F) {
+	for _, dotu := range []bool{false, true} {
+		buf := make([]byte, 256)
+		n := PackDir(&seedDir, buf, dotu)
+		f.Add(buf[0:n], dotu)
+		f.Add(buf[0:n/2], dotu)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, dotu bool) {
+		d, err := UnpackDir(data, dotu)
+		if err != nil {
+			if _, ok := err.(*UnpackError); !ok {
+				t.Fatalf("error %v is not an UnpackError", err)
+			}
+
+			return
+		}
+
+		if int(d.Size)+2 > len(data) {
+			t.Fatalf("%v: size %d bigger than the buffer %d", d, d.Size, len(data))
+		}
+
+		buf := make([]byte, len(data)+len(d.Ext)+16)
+		n := PackDir(d, buf, dotu)
+		d2, err := UnpackDir(buf[0:n], dotu)
+		if err != nil {
+			t.Fatalf("%v: can't unpack the packed entry: %v", d, err)
+		}
+
+		/* the bytes after the fields are not packed again */
+		d2.Size = d.Size
+		if *d != *d2 {
+			t.Fatalf("unpacked %v, packed and unpacked %v", d, d2)
+		}
+	})
+}
+
+// Checks that UnpackDirent doesn't panic, and that the accepted
+// entries survive a PackDirent/UnpackDirent round trip.
+func FuzzUnpackDirent(f *testing.F) {
+	buf := make([]byte, 64)
+	n := PackDirent(&Dirent{Qid: seedDir.Qid, Offset: 1, Type: 8, Name: "name"}, buf)
+	f.Add(buf[0:n])
+	f.Add(buf[0 : n-1])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d, sz, err := UnpackDirent(data)
+		if err != nil {
+			if _, ok := err.(*UnpackError); !ok {
+				t.Fatalf("error %v is not an UnpackError", err)
+			}
+
+			return
+		}
+
+		buf := make([]byte, sz)
+		if PackDirent(d, buf) != sz {
+			t.Fatalf("%v: packed size differs from %d", d, sz)
+		}
+
+		d2, _, err := UnpackDirent(buf)
+		if err != nil || *d != *d2 {
+			t.Fatalf("unpacked %v, packed and unpacked %v (%v)", d, d2, err)
+		}
+	})
+}
+
+// Compares the decoded fields of two messages.
+func sameFcall(a, b *Fcall) bool {
+	x, y := *a, *b
+	x.Pkt, y.Pkt = nil, nil
+	x.Buf, y.Buf = nil, nil
+	x.Size, y.Size = 0, 0
+	x.Dir.Size, y.Dir.Size = 0, 0
+	if len(x.Data) == 0 && len(y.Data) == 0 {
+		x.Data, y.Data = nil, nil
+	}
+
+	return reflect.DeepEqual(x, y)
+}
+
+// Packs the message tc into fc with the Pack function for its type.
+func repack(fc, tc *Fcall, dotu bool) error {
+	var err error
+
+	switch tc.Type {
+	default:
+		return &Error{"invalid message id", EINVAL}
+
+	case Tversion:
+		err = PackTversion(fc, tc.Msize, tc.Version)
+	case Rversion:
+		err = PackRversion(fc, tc.Msize, tc.Version)
+	case Tauth:
+		err = PackTauth(fc, tc.Afid, tc.Uname, tc.Aname, tc.Unamenum, dotu)
+	case Rauth:
+		err = PackRauth(fc, &tc.Qid)
+	case Tattach:
+		err = PackTattach(fc, tc.Fid, tc.Afid, tc.Uname, tc.Aname, tc.Unamenum, dotu)
+	case Rattach:
+		err = PackRattach(fc, &tc.Qid)
+	case Rerror:
+		err = PackRerror(fc, tc.Error, tc.Errornum, dotu)
+	case Tflush:
+		err = PackTflush(fc, tc.Oldtag)
+	case Rflush:
+		err = PackRflush(fc)
+	case Twalk:
+		err = PackTwalk(fc, tc.Fid, tc.Newfid, tc.Wname)
+	case Rwalk:
+		err = PackRwalk(fc, tc.Wqid)
+	case Topen:
+		err = PackTopen(fc, tc.Fid, tc.Mode)
+	case Ropen:
+		err = PackRopen(fc, &tc.Qid, tc.Iounit)
+	case Tcreate:
+		err = PackTcreate(fc, tc.Fid, tc.Name, tc.Perm, tc.Mode, tc.Ext, dotu)
+	case Rcreate:
+		err = PackRcreate(fc, &tc.Qid, tc.Iounit)
+	case Tread:
+		err = PackTread(fc, tc.Fid, tc.Offset, tc.Count)
+	case Rread:
+		err = PackRread(fc, tc.Data[0:tc.Count])
+	case Twrite:
+		err = PackTwrite(fc, tc.Fid, tc.Offset, tc.Count, tc.Data)
+	case Rwrite:
+		err = PackRwrite(fc, tc.Count)
+	case Tclunk:
+		err = PackTclunk(fc, tc.Fid)
+	case Rclunk:
+		err = PackRclunk(fc)
+	case Tremove:
+		err = PackTremove(fc, tc.Fid)
+	case Rremove:
+		err = PackRremove(fc)
+	case Tstat:
+		err = PackTstat(fc, tc.Fid)
+	case Rstat:
+		err = PackRstat(fc, &tc.Dir, dotu)
+	case Twstat:
+		err = PackTwstat(fc, tc.Fid, &tc.Dir, dotu)
+	case Rwstat:
+		err = PackRwstat(fc)
+
+	/* IX block messages */
+	case Tbread:
+		err = PackTbread(fc, tc.Fileid, tc.Offset, tc.Count)
+	case Rbread:
+		err = PackRbread(fc, tc.Data[0:tc.Count])
+	case Tbwrite:
+		err = PackTbwrite(fc, tc.Fileid, tc.Offset, tc.Data[0:tc.Count])
+	case Rbwrite:
+		err = PackRbwrite(fc, tc.Count)
+	case Tbtrunc:
+		err = PackTbtrunc(fc, tc.Fileid, tc.Offset)
+	case Rbtrunc:
+		err = PackRbtrunc(fc)
+
+	/* 9P2000.L messages */
+	case Rlerror:
+		err = PackRlerror(fc, tc.Errornum)
+	case Tstatfs:
+		err = PackTstatfs(fc, tc.Fid)
+	case Rstatfs:
+		err = PackRstatfs(fc, &tc.Statfs)
+	case Tlopen:
+		err = PackTlopen(fc, tc.Fid, tc.Flags)
+	case Rlopen:
+		err = PackRlopen(fc, &tc.Qid, tc.Iounit)
+	case Tlcreate:
+		err = PackTlcreate(fc, tc.Fid, tc.Name, tc.Flags, tc.Perm, tc.Lgid)
+	case Rlcreate:
+		err = PackRlcreate(fc, &tc.Qid, tc.Iounit)
+	case Tsymlink:
+		err = PackTsymlink(fc, tc.Fid, tc.Name, tc.Target, tc.Lgid)
+	case Rsymlink:
+		err = PackRsymlink(fc, &tc.Qid)
+	case Tmknod:
+		err = PackTmknod(fc, tc.Fid, tc.Name, tc.Perm, tc.Major, tc.Minor, tc.Lgid)
+	case Rmknod:
+		err = PackRmknod(fc, &tc.Qid)
+	case Trename:
+		err = PackTrename(fc, tc.Fid, tc.Dfid, tc.Name)
+	case Rrename:
+		err = PackRrename(fc)
+	case Treadlink:
+		err = PackTreadlink(fc, tc.Fid)
+	case Rreadlink:
+		err = PackRreadlink(fc, tc.Target)
+	case Tgetattr:
+		err = PackTgetattr(fc, tc.Fid, tc.Mask)
+	case Rgetattr:
+		err = PackRgetattr(fc, &tc.Attr)
+	case Tsetattr:
+		err = PackTsetattr(fc, tc.Fid, &tc.SetAttr)
+	case Rsetattr:
+		err = PackRsetattr(fc)
+	case Txattrwalk:
+		err = PackTxattrwalk(fc, tc.Fid, tc.Newfid, tc.Name)
+	case Rxattrwalk:
+		err = PackRxattrwalk(fc, tc.Xattrsize)
+	case Txattrcreate:
+		err = PackTxattrcreate(fc, tc.Fid, tc.Name, tc.Xattrsize, tc.Flags)
+	case Rxattrcreate:
+		err = PackRxattrcreate(fc)
+	case Treaddir:
+		err = PackTreaddir(fc, tc.Fid, tc.Offset, tc.Count)
+	case Rreaddir:
+		var ents []Dirent
+		for b := tc.Data[0:tc.Count]; len(b) > 0; {
+			d, sz, derr := UnpackDirent(b)
+			if derr != nil {
+				return derr
+			}
+
+			ents = append(ents, *d)
+			b = b[sz:]
+		}
+
+		_, err = PackRreaddir(fc, tc.Count, ents)
+	case Tfsync:
+		err = PackTfsync(fc, tc.Fid, tc.Datasync)
+	case Rfsync:
+		err = PackRfsync(fc)
+	case Tlock:
+		err = PackTlock(fc, tc.Fid, &tc.Flock)
+	case Rlock:
+		err = PackRlock(fc, tc.Status)
+	case Tgetlock:
+		err = PackTgetlock(fc, tc.Fid, &tc.Flock)
+	case Rgetlock:
+		err = PackRgetlock(fc, &tc.Flock)
+	case Tlink:
+		err = PackTlink(fc, tc.Dfid, tc.Fid, tc.Name)
+	case Rlink:
+		err = PackRlink(fc)
+	case Tmkdir:
+		err = PackTmkdir(fc, tc.Fid, tc.Name, tc.Perm, tc.Lgid)
+	case Rmkdir:
+		err = PackRmkdir(fc, &tc.Qid)
+	case Trenameat:
+		err = PackTrenameat(fc, tc.Fid, tc.Name, tc.Dfid, tc.Newname)
+	case Rrenameat:
+		err = PackRrenameat(fc)
+	case Tunlinkat:
+		err = PackTunlinkat(fc, tc.Fid, tc.Name, tc.Flags)
+	case Runlinkat:
+		err = PackRunlinkat(fc)
+	}
+
+	if err == nil {
+		SetTag(fc, tc.Tag)
+	}
+
+	return err
+}